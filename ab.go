@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// abArm is one of the two configurations compared by the ab mode, with the
+// distributions merged over all of its runs.
+type abArm struct {
+	name    string
+	args    string
+	summary runSummary
+}
+
+// runAB runs the demo with the flags in aArgs and bArgs alternately, runs
+// times each for duration, by re-executing this binary, and prints a
+// statistical comparison of the client side measurements of both to stdout.
+func runAB(ctx context.Context, hostPort string, aArgs string, bArgs string, runs int, duration time.Duration) error {
+	if duration <= 0 {
+		return fmt.Errorf("ab mode requires a positive -duration for each run")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate own executable, error was: %w", err)
+	}
+	dir, err := os.MkdirTemp("", "test-http-stream-duplex-ab-")
+	if err != nil {
+		return fmt.Errorf("failed to create directory for run summaries, error was: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if unixSocket != "" {
+		hostPort = unixScheme + unixSocket
+	}
+	arms := []*abArm{{name: "A", args: aArgs}, {name: "B", args: bArgs}}
+	for run := 1; run <= runs; run++ {
+		for _, arm := range arms {
+			path := filepath.Join(dir, fmt.Sprintf("%s-%d.json", arm.name, run))
+			args := []string{"-mode", "demo", "-hostport", hostPort, "-duration", duration.String(), "-log-level", "WARN"}
+			args = append(args, strings.Fields(arm.args)...)
+			args = append(args, "-summary-out", path)
+
+			slog.Info("ab: starting run", "config", arm.name, "run", run, "args", strings.Join(args, " "))
+			cmd := exec.CommandContext(ctx, exe, args...)
+			cmd.Stdout = os.Stderr
+			cmd.Stderr = os.Stderr
+			cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
+			err := cmd.Run()
+			if ctx.Err() != nil {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("run %d of configuration %s failed, error was: %w", run, arm.name, err)
+			}
+
+			summary, err := readSummary(path)
+			if err != nil {
+				return err
+			}
+			arm.summary.Received += summary.Received
+			arm.summary.Latency.merge(&summary.Latency)
+			arm.summary.Jitter.merge(&summary.Jitter)
+		}
+	}
+
+	a, b := arms[0], arms[1]
+	out := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(out, "A:\t%s\t\n", a.args)
+	fmt.Fprintf(out, "B:\t%s\t\n", b.args)
+	fmt.Fprintln(out, "metric\tA\tB\tdelta\tdelta%\t95% CI of delta\t")
+	fmt.Fprintf(out, "received\t%d\t%d\t%+d\t%s\t\t\n", a.summary.Received, b.summary.Received,
+		b.summary.Received-a.summary.Received, relative(float64(a.summary.Received), float64(b.summary.Received)))
+	compareHistograms(out, "latency", &a.summary.Latency, &b.summary.Latency)
+	compareHistograms(out, "jitter", &a.summary.Jitter, &b.summary.Jitter)
+	return out.Flush()
+}
+
+func readSummary(path string) (runSummary, error) {
+	var summary runSummary
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return summary, fmt.Errorf("failed to read run summary, error was: %w", err)
+	}
+	err = json.Unmarshal(data, &summary)
+	if err != nil {
+		return summary, fmt.Errorf("failed to decode run summary %s, error was: %w", path, err)
+	}
+	return summary, nil
+}
+
+// compareHistograms writes rows comparing the mean and percentiles of a and
+// b. The confidence interval of the mean delta is the normal approximation of
+// Welch's, those of the percentile deltas are combined from the distribution
+// free order statistic intervals of each percentile, so are conservative.
+func compareHistograms(out *tabwriter.Writer, name string, a *histogram, b *histogram) {
+	if a.count < 2 || b.count < 2 {
+		fmt.Fprintf(out, "%s\t%d samples\t%d samples\t\t\t\t\n", name, a.count, b.count)
+		return
+	}
+
+	meanA, meanB := a.mean(), b.mean()
+	se := math.Sqrt(a.stddev()*a.stddev()/float64(a.count) + b.stddev()*b.stddev()/float64(b.count))
+	delta := meanB - meanA
+	fmt.Fprintf(out, "%s mean\t%v\t%v\t%v\t%s\t[%v, %v]\t\n", name,
+		roundDuration(meanA), roundDuration(meanB), roundDuration(delta), relative(meanA, meanB),
+		roundDuration(delta-1.96*se), roundDuration(delta+1.96*se))
+
+	for _, q := range []float64{0.5, 0.9, 0.99} {
+		loA, hiA := quantileInterval(a, q)
+		loB, hiB := quantileInterval(b, q)
+		pA, pB := a.quantile(q), b.quantile(q)
+		fmt.Fprintf(out, "%s p%g\t%v\t%v\t%v\t%s\t[%v, %v]\t\n", name, q*100,
+			pA, pB, pB-pA, relative(float64(pA), float64(pB)), loB-hiA, hiB-loA)
+	}
+}
+
+// quantileInterval returns the 95% confidence interval of quantile q of h,
+// from the ranks between which the true quantile lies with that probability.
+func quantileInterval(h *histogram, q float64) (time.Duration, time.Duration) {
+	n := float64(h.count)
+	spread := 1.96 * math.Sqrt(n*q*(1-q))
+	lo := math.Max(1, math.Floor(n*q-spread))
+	hi := math.Min(n, math.Ceil(n*q+spread)+1)
+	return h.atRank(uint64(lo)), h.atRank(uint64(hi))
+}
+
+func roundDuration(ns float64) time.Duration {
+	return time.Duration(math.Round(ns))
+}
+
+func relative(a float64, b float64) string {
+	if a == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%+.1f%%", (b-a)/a*100)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Streams are only accepted from client addresses in allowList, if it is not
+// empty, and never from those in denyList. Behind a load balancer or proxy
+// in trustedProxies the client address is taken from X-Forwarded-For.
+var (
+	allowList      prefixList
+	denyList       prefixList
+	trustedProxies prefixList
+)
+
+// prefixList is a list of networks, settable as a flag of comma separated
+// CIDR prefixes or single addresses, adding to it when given repeatedly.
+type prefixList []netip.Prefix
+
+func (l *prefixList) String() string {
+	if l == nil {
+		return ""
+	}
+	prefixes := make([]string, len(*l))
+	for i, prefix := range *l {
+		prefixes[i] = prefix.String()
+	}
+	return strings.Join(prefixes, ",")
+}
+
+func (l *prefixList) Set(s string) error {
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(field)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(field)
+			if addrErr != nil {
+				return fmt.Errorf("invalid network %q, error was: %w", field, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		*l = append(*l, prefix.Masked())
+	}
+	return nil
+}
+
+func (l prefixList) contains(addr netip.Addr) bool {
+	for _, prefix := range l {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddr returns the address of the client which sent request. That is
+// the peer address, unless the peer is a trusted proxy: then it is the last
+// address in X-Forwarded-For not of a trusted proxy, as proxies append the
+// address they received the request from. The returned address is invalid if
+// the peer address is not an ip address.
+func clientAddr(request *http.Request) netip.Addr {
+	peer, err := netip.ParseAddrPort(request.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}
+	}
+	addr := peer.Addr().Unmap()
+	if !trustedProxies.contains(addr) {
+		return addr
+	}
+	forwarded := strings.Split(strings.Join(request.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			break
+		}
+		addr = hop.Unmap()
+		if !trustedProxies.contains(addr) {
+			break
+		}
+	}
+	return addr
+}
+
+// addrAllowed reports whether streams from addr are accepted.
+func addrAllowed(addr netip.Addr) bool {
+	if len(allowList) == 0 && len(denyList) == 0 {
+		return true
+	}
+	if !addr.IsValid() || denyList.contains(addr) {
+		return false
+	}
+	return len(allowList) == 0 || allowList.contains(addr)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+)
+
+// Both sides report the protocol every connection was served with, as
+// negotiated with ALPN over TLS, such as h3, h2 or http/1.1, h2c for HTTP/2
+// without TLS and http/1.1 otherwise: a connection is counted in protocols by
+// its first stream and logged. Intermediaries in front of the server, such as
+// proxies terminating TLS, may negotiate another protocol with the client
+// than the server sees, so in h2 mode both warn of connections downgraded to
+// HTTP/1.1.
+
+// negotiatedProtocol names the protocol of a request or response with TLS
+// state state, nil without TLS, and major version protoMajor.
+func negotiatedProtocol(state *tls.ConnectionState, protoMajor int) string {
+	switch {
+	case state != nil && state.NegotiatedProtocol != "":
+		return state.NegotiatedProtocol
+	case protoMajor == 2 && state != nil:
+		return "h2"
+	case protoMajor == 2:
+		return "h2c"
+	case protoMajor == 3:
+		return "h3"
+	default:
+		return "http/1.1"
+	}
+}
+
+// traceNewConn returns ctx tracing whether its request gets a new
+// connection, which it sets newConn to.
+func traceNewConn(ctx context.Context, newConn *atomic.Bool) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) { newConn.Store(!info.Reused) },
+	})
+}
+
+// clientConnNegotiated counts and logs the protocol of a new connection,
+// by its first response resp.
+func clientConnNegotiated(resp *http.Response) {
+	protocol := negotiatedProtocol(resp.TLS, resp.ProtoMajor)
+	clientMetrics.connNegotiated(protocol)
+	clientLog.Info("client: connection negotiated protocol", "protocol", protocol, "tls", resp.TLS != nil, "host", resp.Request.URL.Host)
+	if h2 && resp.ProtoMajor != 2 {
+		clientLog.Warn("client: connection downgraded from HTTP/2", "protocol", protocol, "host", resp.Request.URL.Host)
+	}
+}
+
+// negotiatedContextKey keys the sync.Once reporting the protocol of the
+// connection of a request in its context.
+type negotiatedContextKey struct{}
+
+func withNegotiated(ctx context.Context) context.Context {
+	return context.WithValue(ctx, negotiatedContextKey{}, &sync.Once{})
+}
+
+// serverConnNegotiated counts and logs the protocol of the connection of
+// request, once per connection.
+func serverConnNegotiated(request *http.Request) {
+	once, ok := request.Context().Value(negotiatedContextKey{}).(*sync.Once)
+	if !ok {
+		return
+	}
+	once.Do(func() {
+		protocol := negotiatedProtocol(request.TLS, request.ProtoMajor)
+		serverMetrics.connNegotiated(protocol)
+		serverLog.Info("server: connection negotiated protocol", "protocol", protocol, "tls", request.TLS != nil, "remote", request.RemoteAddr)
+		serverConnHandshaked(request)
+		if h2 && request.ProtoMajor != 2 {
+			serverLog.Warn("server: connection downgraded from HTTP/2", "protocol", protocol, "remote", request.RemoteAddr)
+		}
+	})
+}
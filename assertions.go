@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// scenarioAssertion is an assert step of a scenario, checked once all steps
+// ran:
+//
+//	assert latency p50|p90|p99|max <op> D    round trip of the pings
+//	assert gaps <op> N                       pings never answered
+//	assert reconnects <op> N                 reconnect steps
+//	assert sent|received <op> N              pings and pongs
+//
+// where <op> is one of <, <=, ==, >= and >.
+type scenarioAssertion struct {
+	metric string
+	op     string
+	// nanoseconds for latencies
+	want float64
+}
+
+var latencyQuantiles = map[string]float64{"p50": 0.5, "p90": 0.9, "p99": 0.99}
+
+func parseAssertion(args []string) (scenarioAssertion, error) {
+	var a scenarioAssertion
+	if len(args) == 4 && args[0] == "latency" {
+		_, ok := latencyQuantiles[args[1]]
+		if !ok && args[1] != "max" {
+			return a, fmt.Errorf("unknown latency percentile %q", args[1])
+		}
+		a.metric, args = "latency "+args[1], args[2:]
+	} else if len(args) == 3 {
+		switch args[0] {
+		case "gaps", "reconnects", "sent", "received":
+		default:
+			return a, fmt.Errorf("unknown metric %q", args[0])
+		}
+		a.metric, args = args[0], args[1:]
+	} else {
+		return a, fmt.Errorf("expected assert <metric> <op> <value>")
+	}
+	switch args[0] {
+	case "<", "<=", "==", ">=", ">":
+		a.op = args[0]
+	default:
+		return a, fmt.Errorf("unknown comparison %q", args[0])
+	}
+	if a.isLatency() {
+		d, err := time.ParseDuration(args[1])
+		if err != nil {
+			return a, err
+		}
+		a.want = float64(d)
+		return a, nil
+	}
+	n, err := strconv.ParseInt(args[1], 10, 64)
+	a.want = float64(n)
+	return a, err
+}
+
+func (a scenarioAssertion) isLatency() bool {
+	return strings.HasPrefix(a.metric, "latency ")
+}
+
+func (a scenarioAssertion) holds(got float64) bool {
+	switch a.op {
+	case "<":
+		return got < a.want
+	case "<=":
+		return got <= a.want
+	case "==":
+		return got == a.want
+	case ">=":
+		return got >= a.want
+	default:
+		return got > a.want
+	}
+}
+
+func (a scenarioAssertion) format(v float64) string {
+	if a.isLatency() {
+		return time.Duration(v).String()
+	}
+	return strconv.FormatInt(int64(v), 10)
+}
+
+// measure returns the value of the metric of a in the run.
+func (r *scenarioRun) measure(a scenarioAssertion) float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch a.metric {
+	case "gaps":
+		return float64(r.gaps)
+	case "reconnects":
+		return float64(r.reconnects)
+	case "sent":
+		return float64(r.sent)
+	case "received":
+		return float64(r.received.Load())
+	case "latency max":
+		return float64(r.latency.max)
+	default:
+		return float64(r.latency.quantile(latencyQuantiles[strings.TrimPrefix(a.metric, "latency ")]))
+	}
+}
+
+// checkAssertions writes the assertions of the scenario as a diff of what
+// they expected against what the run measured to w, where those that hold are
+// unchanged lines, and returns how many failed.
+func (r *scenarioRun) checkAssertions(w io.Writer) int {
+	failed := 0
+	fmt.Fprintf(w, "--- %s expected\n", r.name)
+	fmt.Fprintf(w, "+++ %s actual\n", r.name)
+	for _, step := range r.steps {
+		if step.op != "assert" {
+			continue
+		}
+		a := step.assertion
+		got := r.measure(a)
+		if a.holds(got) {
+			fmt.Fprintf(w, "  %s %s %s\n", a.metric, a.op, a.format(a.want))
+			continue
+		}
+		failed++
+		fmt.Fprintf(w, "- %s %s %s\n", a.metric, a.op, a.format(a.want))
+		fmt.Fprintf(w, "+ %s = %s\n", a.metric, a.format(got))
+	}
+	return failed
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+)
+
+// auditLog, opened with -audit-log, receives the security relevant events of
+// streams as json lines, kept apart from the regular log so they can be
+// reviewed on their own: authentication successes and failures, quota hits,
+// signature failures and streams rejected or closed by the server.
+var auditLog *slog.Logger
+
+// audit records event about the stream of request in the audit log, with
+// both the peer address and the client address behind trusted proxies.
+func audit(event string, request *http.Request, attrs ...any) {
+	if auditLog == nil {
+		return
+	}
+	auditLog.Info(event, append([]any{"remote", request.RemoteAddr, "client", clientAddr(request), "path", request.URL.Path}, attrs...)...)
+}
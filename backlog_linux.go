@@ -0,0 +1,22 @@
+package main
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const socketBacklogSupported = true
+
+// socketBacklog returns the bytes in the send queue of the socket conn.
+func socketBacklog(conn syscall.RawConn) (int, error) {
+	var n int
+	var sockErr error
+	err := conn.Control(func(fd uintptr) {
+		n, sockErr = unix.IoctlGetInt(int(fd), unix.TIOCOUTQ)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, sockErr
+}
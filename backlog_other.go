@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+const socketBacklogSupported = false
+
+func socketBacklog(conn syscall.RawConn) (int, error) {
+	return 0, fmt.Errorf("socket send queue is not available on this platform")
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Every stream accounts the bytes it buffers as they change, so that memory
+// growing under backpressure can be attributed to the streams holding it. A
+// client stream buffers the bytes written to its send ring buffer and not
+// taken by the transport yet, the messages kept pending for a retry with
+// retryPending, and the messages decoded into its receive buffer with
+// recvBuffer and not consumed by the workload yet. A server stream buffers
+// what its decoder does, whose buffer grows to the largest message received
+// and stays at that size. The streams buffering the most are listed at
+// /debug/streams/top, the topStreams of them or the number of the query,
+// such as ?n=20. The client streams are those of the process, so they only
+// show up next to those of the server in demo mode, and a request naming a
+// tenant only finds the streams of its tenant.
+const (
+	topStreams    = 10
+	topStreamsMax = 1000
+)
+
+// streamBuffers are the bytes a stream buffers, by buffer.
+type streamBuffers struct {
+	send    atomic.Int64
+	pending atomic.Int64
+	recv    atomic.Int64
+	decoder atomic.Int64
+}
+
+// bufferedBytes is a snapshot of streamBuffers.
+type bufferedBytes struct {
+	Total   int64
+	Send    int64 `json:",omitempty"`
+	Pending int64 `json:",omitempty"`
+	Receive int64 `json:",omitempty"`
+	Decoder int64 `json:",omitempty"`
+}
+
+func (b *streamBuffers) snapshot() bufferedBytes {
+	snapshot := bufferedBytes{
+		Send:    b.send.Load(),
+		Pending: b.pending.Load(),
+		Receive: b.recv.Load(),
+		Decoder: b.decoder.Load(),
+	}
+	snapshot.Total = snapshot.Send + snapshot.Pending + snapshot.Receive + snapshot.Decoder
+	return snapshot
+}
+
+// clientStreamRegistry tracks the open streams of the client, for their
+// buffered bytes to be listed with those of the server.
+type clientStreamRegistry struct {
+	mu      sync.Mutex
+	streams map[int64]*clientStream
+}
+
+var openClientStreams = &clientStreamRegistry{streams: map[int64]*clientStream{}}
+
+func (r *clientStreamRegistry) register(s *clientStream) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.streams[s.id] = s
+}
+
+func (r *clientStreamRegistry) unregister(s *clientStream) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.streams, s.id)
+}
+
+func (r *clientStreamRegistry) all() []*clientStream {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	streams := make([]*clientStream, 0, len(r.streams))
+	for _, s := range r.streams {
+		streams = append(streams, s)
+	}
+	return streams
+}
+
+// unregisterOnClose is the response body of a client stream, which leaves
+// the registry once the body is closed, as every stream closes it when it
+// ends.
+type unregisterOnClose struct {
+	io.ReadCloser
+	stream *clientStream
+	once   sync.Once
+}
+
+func (b *unregisterOnClose) Close() error {
+	b.once.Do(func() { openClientStreams.unregister(b.stream) })
+	return b.ReadCloser.Close()
+}
+
+// bufferingStream is a stream as listed at /debug/streams/top.
+type bufferingStream struct {
+	Side     string
+	Stream   uint64
+	Path     string
+	Remote   string
+	Tenant   string `json:",omitempty"`
+	Age      time.Duration
+	Buffered bufferedBytes
+}
+
+// serveTopStreams lists the streams of tenant buffering the most, of all
+// tenants if empty.
+func serveTopStreams(writer http.ResponseWriter, request *http.Request, tenant string) {
+	n := topStreams
+	if text := request.URL.Query().Get("n"); text != "" {
+		var err error
+		n, err = strconv.Atoi(text)
+		if err != nil || n <= 0 || n > topStreamsMax {
+			http.Error(writer, fmt.Sprintf("expected n between 1 and %d, got %q", topStreamsMax, text), http.StatusBadRequest)
+			return
+		}
+	}
+
+	now := clk.Now()
+	streams := []bufferingStream{}
+	for _, s := range activeStreams.all() {
+		if tenant != "" && tenant != s.tenant {
+			continue
+		}
+		streams = append(streams, bufferingStream{Side: "server", Stream: s.id, Path: s.path, Remote: s.remote, Tenant: s.tenant, Age: now.Sub(s.started), Buffered: s.buffers.snapshot()})
+	}
+	if tenant == "" || tenant == clientTenant {
+		for _, s := range openClientStreams.all() {
+			streams = append(streams, bufferingStream{Side: "client", Stream: uint64(s.id), Path: s.resp.Request.URL.Path, Remote: s.resp.Request.URL.Host, Tenant: clientTenant, Age: now.Sub(s.opened), Buffered: s.buffers.snapshot()})
+		}
+	}
+	sort.Slice(streams, func(i, j int) bool {
+		if streams[i].Buffered.Total != streams[j].Buffered.Total {
+			return streams[i].Buffered.Total > streams[j].Buffered.Total
+		}
+		return streams[i].Age > streams[j].Age
+	})
+	if len(streams) > n {
+		streams = streams[:n]
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(streams)
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// capture, opened with -capture, receives every byte sent and received on
+// the connections of the client and server, split and annotated along the
+// HTTP/1.1 framing: header blocks, chunk sizes, chunk data and chunk ends,
+// so framing issues through proxies can be seen without a packet capture.
+// With -capture-hex the bytes are written as a hex dump instead of quoted.
+var (
+	capture    *captureLog
+	captureHex = false
+)
+
+type captureLog struct {
+	mu       sync.Mutex
+	w        io.Writer
+	nextConn int
+}
+
+func newCaptureLog(w io.Writer) *captureLog {
+	return &captureLog{w: w}
+}
+
+// wrap returns conn capturing its bytes, as seen by side.
+func (l *captureLog) wrap(conn net.Conn, side string) net.Conn {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.nextConn++
+	fmt.Fprintf(l.w, "=== %s %s conn %d %s -> %s opened\n", clk.Now().Format(time.RFC3339Nano), side, l.nextConn, conn.LocalAddr(), conn.RemoteAddr())
+	return &captureConn{Conn: conn, log: l, side: side, id: l.nextConn}
+}
+
+func (l *captureLog) record(c *captureConn, direction string, data []byte, framing *framingParser) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintf(l.w, "=== %s %s conn %d %s %d bytes\n", clk.Now().Format(time.RFC3339Nano), c.side, c.id, direction, len(data))
+	for _, segment := range framing.split(data) {
+		if captureHex {
+			fmt.Fprintf(l.w, "  %s\n", segment.label)
+			for _, line := range strings.SplitAfter(strings.TrimSuffix(hex.Dump(segment.data), "\n"), "\n") {
+				fmt.Fprintf(l.w, "    %s", line)
+			}
+			fmt.Fprintln(l.w)
+		} else {
+			fmt.Fprintf(l.w, "  %s: %s\n", segment.label, strconv.Quote(string(segment.data)))
+		}
+	}
+}
+
+type captureConn struct {
+	net.Conn
+	log           *captureLog
+	side          string
+	id            int
+	sent          framingParser
+	received      framingParser
+	closeRecorded sync.Once
+}
+
+func (c *captureConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.log.record(c, "received", p[:n], &c.received)
+	}
+	return n, err
+}
+
+func (c *captureConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.log.record(c, "sent", p[:n], &c.sent)
+	}
+	return n, err
+}
+
+func (c *captureConn) Close() error {
+	c.closeRecorded.Do(func() {
+		c.log.mu.Lock()
+		defer c.log.mu.Unlock()
+		fmt.Fprintf(c.log.w, "=== %s %s conn %d closed\n", clk.Now().Format(time.RFC3339Nano), c.side, c.id)
+	})
+	return c.Conn.Close()
+}
+
+// captureListener captures the connections it accepts, for the server.
+type captureListener struct {
+	net.Listener
+}
+
+func (l *captureListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return capture.wrap(conn, "server"), nil
+}
+
+// newCaptureTransport returns a transport like the default one capturing
+// the connections it dials, for the client.
+func newCaptureTransport() *http.Transport {
+	transport := newBaseTransport()
+	dial := transport.DialContext
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		return capture.wrap(conn, "client"), nil
+	}
+	return transport
+}
+
+// framingParser follows the HTTP/1.1 framing of one direction of a
+// connection across the writes or reads it is split into.
+type framingParser struct {
+	state framingState
+	// the header block or chunk size line read so far
+	pending []byte
+	// bytes left of the chunk, its ending or the body
+	remaining int64
+}
+
+type framingState int
+
+const (
+	framingHeaders framingState = iota
+	framingChunkSize
+	framingChunkData
+	framingChunkEnd
+	framingTrailers
+	framingBody
+	framingBodyUntilClose
+)
+
+var framingLabels = map[framingState]string{
+	framingChunkData: "chunk data",
+	framingChunkEnd:  "chunk end",
+	framingBody:      "body",
+}
+
+type framingSegment struct {
+	label string
+	data  []byte
+}
+
+// split splits data into segments of the framing.
+func (p *framingParser) split(data []byte) []framingSegment {
+	var segments []framingSegment
+	for offset := 0; offset < len(data); {
+		rest := data[offset:]
+		var n int
+		var label string
+		switch p.state {
+		case framingHeaders:
+			n = p.takeUntil(rest, []byte("\r\n\r\n"))
+			label = "headers"
+			if bytes.HasSuffix(p.pending, []byte("\r\n\r\n")) {
+				p.endHeaders()
+			}
+		case framingChunkSize:
+			n = p.takeUntil(rest, []byte("\n"))
+			label = "chunk size"
+			if bytes.HasSuffix(p.pending, []byte("\n")) {
+				label = p.endChunkSize()
+			}
+		case framingChunkData, framingChunkEnd, framingBody:
+			n = int(min(p.remaining, int64(len(rest))))
+			label = framingLabels[p.state]
+			p.remaining -= int64(n)
+			if p.remaining == 0 {
+				switch p.state {
+				case framingChunkData:
+					p.state, p.remaining = framingChunkEnd, 2
+				case framingChunkEnd:
+					p.state = framingChunkSize
+				case framingBody:
+					p.state = framingHeaders
+				}
+			}
+		case framingTrailers:
+			n = p.takeUntil(rest, []byte("\r\n"))
+			label = "trailers"
+			if string(p.pending) == "\r\n" || bytes.HasSuffix(p.pending, []byte("\r\n\r\n")) {
+				label = "end of chunked body"
+				p.state, p.pending = framingHeaders, nil
+			}
+		case framingBodyUntilClose:
+			n = len(rest)
+			label = "body until close"
+		}
+		if last := len(segments) - 1; last >= 0 && segments[last].label == label {
+			segments[last].data = data[offset-len(segments[last].data) : offset+n]
+		} else {
+			segments = append(segments, framingSegment{label: label, data: rest[:n]})
+		}
+		offset += n
+	}
+	return segments
+}
+
+// takeUntil adds the bytes of data up to and including the end of the first
+// occurrence of delim, counting pending bytes, to pending and returns their
+// number.
+func (p *framingParser) takeUntil(data []byte, delim []byte) int {
+	for i, b := range data {
+		p.pending = append(p.pending, b)
+		if bytes.HasSuffix(p.pending, delim) {
+			return i + 1
+		}
+	}
+	return len(data)
+}
+
+// endHeaders moves on to the body after a complete header block.
+func (p *framingParser) endHeaders() {
+	lines := strings.Split(strings.ToLower(string(p.pending)), "\r\n")
+	p.pending = nil
+	chunked, length := false, int64(-1)
+	for _, line := range lines[1:] {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(name) {
+		case "transfer-encoding":
+			chunked = strings.HasSuffix(value, "chunked")
+		case "content-length":
+			length, _ = strconv.ParseInt(value, 10, 64)
+		}
+	}
+	// responses without length run until the connection closes, unless
+	// their status has no body
+	status := strings.Fields(lines[0])
+	untilClose := strings.HasPrefix(lines[0], "http/") && len(status) > 1 &&
+		!strings.HasPrefix(status[1], "1") && status[1] != "204" && status[1] != "304"
+	switch {
+	case chunked:
+		p.state = framingChunkSize
+	case length > 0:
+		p.state, p.remaining = framingBody, length
+	case length < 0 && untilClose:
+		p.state = framingBodyUntilClose
+	default:
+		p.state = framingHeaders
+	}
+}
+
+// endChunkSize moves on to the chunk data after a complete chunk size line
+// and returns the label of the line.
+func (p *framingParser) endChunkSize() string {
+	line := strings.TrimSpace(string(p.pending))
+	p.pending = nil
+	sizeText, _, _ := strings.Cut(line, ";")
+	size, err := strconv.ParseInt(strings.TrimSpace(sizeText), 16, 64)
+	if err != nil {
+		p.state = framingBodyUntilClose
+		return "malformed chunk size"
+	}
+	if size == 0 {
+		p.state = framingTrailers
+		return "last chunk"
+	}
+	p.state, p.remaining = framingChunkData, size
+	return fmt.Sprintf("chunk size %d", size)
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Causes of runs and streams ending, given to the cancel functions of their
+// contexts so that logs and metrics can tell them apart with context.Cause.
+var (
+	errInterrupted     = errors.New("interrupted")
+	errDurationElapsed = errors.New("duration elapsed")
+	errServerShutdown  = errors.New("server shutting down")
+	errPeerClosed      = errors.New("peer closed stream")
+	errStreamFinished  = errors.New("stream finished")
+)
+
+// streamCause returns why a stream run with ctx ended, after its workload
+// returned err.
+func streamCause(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	return errorCause(err)
+}
+
+// errorCause returns the cause of a stream ending after reading or writing it
+// failed with err, or after its workload returned err.
+func errorCause(err error) error {
+	if err == nil {
+		return errStreamFinished
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return errPeerClosed
+	}
+	return err
+}
+
+// socketErrors label the errors of the operating system streams end with,
+// rather than counting them all as error, as what a proxy or firewall on the
+// way did shows in which one it was.
+var socketErrors = []struct {
+	errno syscall.Errno
+	label string
+}{
+	{syscall.ECONNRESET, "connection_reset"},
+	{syscall.EPIPE, "broken_pipe"},
+	{syscall.ETIMEDOUT, "timed_out"},
+	{syscall.ECONNABORTED, "connection_aborted"},
+	{syscall.EHOSTUNREACH, "host_unreachable"},
+	{syscall.ENETUNREACH, "network_unreachable"},
+}
+
+// causeLabel returns the label streams ended by cause are counted under.
+func causeLabel(cause error) string {
+	// checked first, as ETIMEDOUT also is a deadline exceeded
+	for _, socketErr := range socketErrors {
+		if errors.Is(cause, socketErr.errno) {
+			return socketErr.label
+		}
+	}
+	var quotaErr *quotaError
+	switch {
+	case cause == nil, errors.Is(cause, errStreamFinished):
+		return "finished"
+	case errors.Is(cause, errServerShutdown), errors.Is(cause, errInterrupted):
+		return "shutdown"
+	case errors.Is(cause, errDurationElapsed), errors.Is(cause, context.DeadlineExceeded), errors.Is(cause, os.ErrDeadlineExceeded):
+		return "deadline"
+	case errors.Is(cause, errPeerClosed), errors.Is(cause, io.EOF), errors.Is(cause, io.ErrUnexpectedEOF):
+		return "peer_closed"
+	case errors.Is(cause, errCredentialsExpired):
+		return "credentials_expired"
+	case errors.As(cause, &quotaErr):
+		return "quota"
+	case errors.Is(cause, errMemoryLimit):
+		return "memory_limit"
+	case errors.Is(cause, errDeadlock):
+		return "deadlock"
+	case errors.Is(cause, errSlowClient), errors.Is(cause, errRecvOverflow):
+		return "slow_client"
+	default:
+		return "error"
+	}
+}
+
+// formatCounts formats counts per label as "label=count" pairs sorted by
+// label.
+func formatCounts(counts map[string]int64) string {
+	if len(counts) == 0 {
+		return "none"
+	}
+	labels := make([]string, 0, len(counts))
+	for label := range counts {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	pairs := make([]string, len(labels))
+	for i, label := range labels {
+		pairs[i] = fmt.Sprintf("%s=%d", label, counts[label])
+	}
+	return strings.Join(pairs, " ")
+}
+
+// rates returns counts per label as rates per second over interval.
+func rates(counts map[string]int64, interval time.Duration) map[string]float64 {
+	if len(counts) == 0 {
+		return nil
+	}
+	perSecond := make(map[string]float64, len(counts))
+	for label, n := range counts {
+		perSecond[label] = float64(n) / interval.Seconds()
+	}
+	return perSecond
+}
+
+// formatRates formats rates per label as "label=rate/s" pairs sorted by
+// label.
+func formatRates(rates map[string]float64) string {
+	if len(rates) == 0 {
+		return "none"
+	}
+	labels := make([]string, 0, len(rates))
+	for label := range rates {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	pairs := make([]string, len(labels))
+	for i, label := range labels {
+		pairs[i] = fmt.Sprintf("%s=%.2f/s", label, rates[label])
+	}
+	return strings.Join(pairs, " ")
+}
+
+// formatDurations formats durations per label as "label=duration" pairs
+// sorted by label.
+func formatDurations(durations map[string]time.Duration) string {
+	if len(durations) == 0 {
+		return "none"
+	}
+	labels := make([]string, 0, len(durations))
+	for label := range durations {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	pairs := make([]string, len(labels))
+	for i, label := range labels {
+		pairs[i] = fmt.Sprintf("%s=%v", label, durations[label])
+	}
+	return strings.Join(pairs, " ")
+}
+
+// countsAsError tells whether err of sending, receiving or opening a stream
+// is a failure, rather than the stream ending as the peer or this side
+// closed it.
+func countsAsError(err error) bool {
+	return err != nil &&
+		!errors.Is(err, io.EOF) &&
+		!errors.Is(err, io.ErrUnexpectedEOF) &&
+		!errors.Is(err, io.ErrClosedPipe) &&
+		!errors.Is(err, net.ErrClosed) &&
+		!errors.Is(err, errSendClosed) &&
+		!errors.Is(err, context.Canceled)
+}
+
+// errorCategory returns the category an error of op is counted under: the
+// operation, unless it was a timeout, a violation of the protocol or running
+// out of file descriptors, whichever operation it happened in.
+func errorCategory(op string, err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.EMFILE), errors.Is(err, syscall.ENFILE):
+		return "fd_limit"
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.Is(err, syscall.ETIMEDOUT), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case isProtocolError(err):
+		return "protocol"
+	default:
+		return op
+	}
+}
+
+// socketErrListener records the socket errors of the connections it accepts.
+type socketErrListener struct {
+	net.Listener
+}
+
+func (l *socketErrListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &socketErrConn{Conn: conn}, nil
+}
+
+// socketErrConn records the first error of the operating system reading or
+// writing the connection failed with. The server cancels the context of a
+// request when its connection fails, so that streams ended that way can
+// still tell why.
+type socketErrConn struct {
+	net.Conn
+	mu  sync.Mutex
+	err error
+}
+
+func (c *socketErrConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.record(err)
+	return n, err
+}
+
+func (c *socketErrConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.record(err)
+	return n, err
+}
+
+func (c *socketErrConn) record(err error) {
+	var errno syscall.Errno
+	if err == nil || !errors.As(err, &errno) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+// socketErr returns the socket error recorded for conn, if any.
+func socketErr(conn net.Conn) error {
+	if proxyConn, ok := conn.(*proxyConn); ok {
+		conn = proxyConn.Conn
+	}
+	if captureConn, ok := conn.(*captureConn); ok {
+		conn = captureConn.Conn
+	}
+	c, ok := conn.(*socketErrConn)
+	if !ok {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
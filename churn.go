@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// The churn workload measures stream establishment and cleanup rather than
+// steady state streaming: churnConcurrency clients each repeatedly open a
+// stream, exchange churnMessages ping/pongs, close it and start over. The
+// measurements report the rate of streams opened, their setup time, and on
+// the server the number of streams still active.
+var (
+	churnConcurrency = 4
+	churnMessages    = 10
+)
+
+func driveChurn(ctx context.Context, address string) error {
+	eg, ctx := errgroup.WithContext(ctx)
+	for i := 0; i < churnConcurrency; i++ {
+		eg.Go(func() error {
+			for ctx.Err() == nil {
+				err := runStream(ctx, address, runChurnStream)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	return eg.Wait()
+}
+
+func runChurnStream(ctx context.Context, stream *clientStream) error {
+	for i := 0; i < churnMessages; i++ {
+		sent := clk.Now()
+		err := stream.send(requestMsg{Msg: "ping"})
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("client: failed to send ping to server, error was: %w", err)
+		}
+		var in responseMsg
+		err = stream.recv(&in)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("failed to decode response message from server, error was: %w", err)
+		}
+		clientMetrics.observeLatency(clk.Since(sent))
+	}
+
+	// close the request body and wait for the server to end the response,
+	// so the stream is cleaned up on both sides before the next one
+	err := stream.closeSend()
+	if err != nil {
+		return fmt.Errorf("client: failed to close request body, error was: %w", err)
+	}
+	_, err = io.Copy(io.Discard, stream.resp.Body)
+	if err != nil && ctx.Err() == nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("client: failed to drain response after closing, error was: %w", err)
+	}
+	stream.log.Debug("client: churn stream finished")
+	return nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// With schemaClient the schema mode writes a reference client of the
+// protocol in that language instead of the JSON Schema, generated from the
+// same description: it streams pings over HTTP/1.1 against the pong workload
+// of a server and validates every message it receives against the kinds of
+// responses and the fields they carry. With conformanceClients the
+// conformance mode runs the reference clients of those languages against the
+// server as well, which takes their interpreters, so that the protocol is
+// checked as spoken from other languages, not only by the client of Go.
+var (
+	schemaClient       = ""
+	conformanceClients []string
+)
+
+// referenceClient is a reference client generated from a template of
+// clientTemplates and run by interpreter.
+type referenceClient struct {
+	template    string
+	interpreter string
+}
+
+var referenceClients = map[string]referenceClient{
+	"python": {template: "clients/client.py.tmpl", interpreter: "python3"},
+	"node":   {template: "clients/client.js.tmpl", interpreter: "node"},
+}
+
+//go:embed clients/*.tmpl
+var clientTemplates embed.FS
+
+// referenceClientTimeout is how long a reference client may take against a
+// server in conformance mode.
+const referenceClientTimeout = 30 * time.Second
+
+// referenceClientNames lists the languages of the reference clients, comma
+// separated.
+func referenceClientNames() string {
+	names := make([]string, 0, len(referenceClients))
+	for name := range referenceClients {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return strings.Join(names, ", ")
+}
+
+func setSchemaClient(s string) error {
+	if _, ok := referenceClients[s]; !ok {
+		return fmt.Errorf("expected one of %s, got %q", referenceClientNames(), s)
+	}
+	schemaClient = s
+	return nil
+}
+
+func setConformanceClients(s string) error {
+	var languages []string
+	for _, language := range strings.Split(s, ",") {
+		if _, ok := referenceClients[language]; !ok {
+			return fmt.Errorf("expected one of %s, got %q", referenceClientNames(), language)
+		}
+		languages = append(languages, language)
+	}
+	conformanceClients = languages
+	return nil
+}
+
+// wireProtocol describes the protocol for the reference clients, as a
+// literal of their language.
+type wireProtocol struct {
+	ContentType    string   `json:"contentType"`
+	DefaultProfile string   `json:"defaultProfile"`
+	Profiles       []string `json:"profiles"`
+	// RequestFields and ResponseFields are the JSON types of the fields of
+	// the messages, and Requests and Responses the fields every kind of
+	// message carries besides Msg
+	RequestFields  map[string]string   `json:"requestFields"`
+	ResponseFields map[string]string   `json:"responseFields"`
+	Requests       map[string][]string `json:"requests"`
+	Responses      map[string][]string `json:"responses"`
+}
+
+func describeWireProtocol() wireProtocol {
+	protocol := wireProtocol{
+		ContentType:    ContentTypeNdJson,
+		DefaultProfile: defaultProfile,
+		Profiles:       strings.Split(profileNames(), ", "),
+		RequestFields:  fieldTypes(reflect.TypeOf(requestMsg{})),
+		ResponseFields: fieldTypes(reflect.TypeOf(responseMsg{})),
+		Requests:       map[string][]string{},
+		Responses:      map[string][]string{},
+	}
+	for _, kind := range wireKinds {
+		fields := append([]string{}, kind.fields...)
+		if kind.request {
+			protocol.Requests[kind.msg] = fields
+		} else {
+			protocol.Responses[kind.msg] = fields
+		}
+	}
+	return protocol
+}
+
+// fieldTypes returns the JSON types of the fields of the struct t, by their
+// schema.
+func fieldTypes(t reflect.Type) map[string]string {
+	defs := map[string]any{}
+	schemaOf(t, defs)
+	types := map[string]string{}
+	for name, property := range defs[t.Name()].(map[string]any)["properties"].(map[string]any) {
+		jsonType, ok := property.(map[string]any)["type"].(string)
+		if !ok {
+			// referring to a struct
+			jsonType = "object"
+		}
+		types[name] = jsonType
+	}
+	return types
+}
+
+// writeReferenceClient writes the reference client in language to w.
+func writeReferenceClient(w io.Writer, language string) error {
+	client := referenceClients[language]
+	text, err := clientTemplates.ReadFile(client.template)
+	if err != nil {
+		return err
+	}
+	tmpl, err := template.New(language).Parse(string(text))
+	if err != nil {
+		return fmt.Errorf("failed to parse template of %s client, error was: %w", language, err)
+	}
+	protocol, err := json.MarshalIndent(describeWireProtocol(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return tmpl.Execute(w, struct {
+		Generated string
+		Protocol  string
+	}{
+		Generated: fmt.Sprintf("generated with -mode schema -schema-client %s, do not edit", language),
+		Protocol:  string(protocol),
+	})
+}
+
+// checkReferenceClient returns the conformance case running the reference
+// client in language against the server.
+func checkReferenceClient(language string) func(ctx context.Context, url string) error {
+	return func(ctx context.Context, url string) error {
+		client := referenceClients[language]
+		path, err := exec.LookPath(client.interpreter)
+		if err != nil {
+			return fmt.Errorf("%s client takes %s, error was: %w", language, client.interpreter, err)
+		}
+		dir, err := os.MkdirTemp("", "duplex-client-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		file, err := os.Create(filepath.Join(dir, filepath.Base(strings.TrimSuffix(client.template, ".tmpl"))))
+		if err != nil {
+			return err
+		}
+		err = writeReferenceClient(file, language)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write %s client, error was: %w", language, err)
+		}
+
+		ctx, cancelFunc := context.WithTimeout(ctx, referenceClientTimeout)
+		defer cancelFunc()
+		var output bytes.Buffer
+		cmd := exec.CommandContext(ctx, path, file.Name(), url)
+		cmd.Stdout = &output
+		cmd.Stderr = &output
+		err = cmd.Run()
+		if err != nil {
+			lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+			return fmt.Errorf("%s client failed, error was: %w: %s", language, err, lines[len(lines)-1])
+		}
+		return nil
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// clock is the time source of everything that measures or waits on time, so
+// simulation mode can run it on virtual time instead of the wall clock. Only
+// the deadlines of connections stay on the wall clock, as the network runs
+// on it, the timeouts of contexts, and the watchdogs of the property tests
+// and simulation mode, which have to catch real hangs.
+type clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	// Sleep waits for d, or until ctx is done, returning the error of ctx
+	// then.
+	Sleep(ctx context.Context, d time.Duration) error
+	After(d time.Duration) <-chan time.Time
+	NewTimer(d time.Duration) clockTimer
+	NewTicker(d time.Duration) clockTicker
+}
+
+// clockTimer is a time.Timer of a clock.
+type clockTimer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// clockTicker is a time.Ticker of a clock.
+type clockTicker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// clk is the clock in use, the wall clock unless simulating.
+var clk clock = wallClock{}
+
+type wallClock struct{}
+
+func (wallClock) Now() time.Time {
+	return time.Now()
+}
+
+func (wallClock) Since(t time.Time) time.Duration {
+	return time.Since(t)
+}
+
+func (wallClock) Sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (wallClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (wallClock) NewTimer(d time.Duration) clockTimer {
+	return wallTimer{time.NewTimer(d)}
+}
+
+func (wallClock) NewTicker(d time.Duration) clockTicker {
+	return wallTicker{time.NewTicker(d)}
+}
+
+type wallTimer struct {
+	*time.Timer
+}
+
+func (t wallTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+type wallTicker struct {
+	*time.Ticker
+}
+
+func (t wallTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// The conformance mode checks that a server streams full duplex the way this
+// client expects, so other implementations can validate against it. The
+// server at conformanceURL has to answer every ndjson line it receives with
+// one ndjson line of its own, as the pong workload does, while the request is
+// still being sent. The cases are numbered, as they are reported by number:
+//
+//	C1 early response   the status arrives before any of the request body
+//	C2 flush timing     every message is answered while the request goes on,
+//	                    not once it is complete
+//	C3 half-close       messages sent right before the request body ends
+//	                    are still answered, then the response ends
+//	C4 large message    a message of conformanceLargeMessage is answered
+//	C5 idle timeout     a stream idle for conformanceIdle still answers
+//
+// followed by I1 and on, running the reference clients of
+// conformanceClients.
+var (
+	conformanceURL  = ""
+	conformanceIdle = 10 * time.Second
+)
+
+const (
+	// conformanceTimeout is how long a server may take with every step
+	conformanceTimeout      = 5 * time.Second
+	conformanceLargeMessage = 1 << 20
+	conformanceFlushes      = 10
+	conformanceHalfClose    = 3
+)
+
+type conformanceCase struct {
+	id   string
+	name string
+	run  func(ctx context.Context, url string) error
+}
+
+var conformanceCases = []conformanceCase{
+	{"C1", "early response", checkEarlyResponse},
+	{"C2", "flush timing", checkFlushTiming},
+	{"C3", "half-close", checkHalfClose},
+	{"C4", "large message", checkLargeMessage},
+	{"C5", "idle timeout", checkIdleTimeout},
+}
+
+// runConformance runs every case against url and writes the matrix of their
+// results to stdout, failing if any of them failed.
+func runConformance(ctx context.Context, url string) error {
+	out := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(out, "url:\t%s\n", url)
+	fmt.Fprintln(out, "case\tname\tresult\ttime\tdetail")
+	failed := 0
+	cases := conformanceCases
+	for i, language := range conformanceClients {
+		cases = append(cases, conformanceCase{fmt.Sprintf("I%d", i+1), language + " client", checkReferenceClient(language)})
+	}
+	for _, c := range cases {
+		started := clk.Now()
+		err := c.run(ctx, url)
+		if ctx.Err() != nil {
+			return nil
+		}
+		result, detail := "pass", ""
+		if err != nil {
+			failed++
+			result, detail = "FAIL", err.Error()
+		}
+		fmt.Fprintf(out, "%s\t%s\t%s\t%v\t%s\n", c.id, c.name, result, clk.Since(started).Round(time.Millisecond), detail)
+	}
+	err := out.Flush()
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d conformance cases failed", failed, len(cases))
+	}
+	return nil
+}
+
+// conformanceStream is a stream opened by a conformance case, on its own
+// connection, with the received lines read in the background.
+type conformanceStream struct {
+	w        *io.PipeWriter
+	resp     *http.Response
+	enc      *json.Encoder
+	received chan error
+	done     chan struct{}
+}
+
+// openConformanceStream sends the request of a stream to url, with the body
+// left open, and returns once the response status arrived.
+func openConformanceStream(ctx context.Context, url string) (*conformanceStream, error) {
+	r, w := io.Pipe()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request, error was: %w", err)
+	}
+	req.Header.Set("Accept", ContentTypeNdJson)
+	req.Header.Set("Content-Type", ContentTypeNdJson)
+	transport := newBaseTransport()
+	transport.DisableKeepAlives = true
+	client := http.Client{Transport: transport}
+
+	type result struct {
+		resp *http.Response
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		resp, err := client.Do(req)
+		results <- result{resp, err}
+	}()
+	var res result
+	select {
+	case res = <-results:
+	case <-clk.After(conformanceTimeout):
+		w.Close()
+		return nil, fmt.Errorf("no response status within %v of sending the request headers", conformanceTimeout)
+	}
+	if res.err != nil {
+		w.Close()
+		return nil, fmt.Errorf("request failed, error was: %w", res.err)
+	}
+	if res.resp.StatusCode != http.StatusOK {
+		w.Close()
+		res.resp.Body.Close()
+		return nil, fmt.Errorf("expected status 200, got %d", res.resp.StatusCode)
+	}
+
+	s := &conformanceStream{
+		w:        w,
+		resp:     res.resp,
+		enc:      json.NewEncoder(w),
+		received: make(chan error),
+		done:     make(chan struct{}),
+	}
+	go s.read()
+	return s, nil
+}
+
+// read passes on the result of decoding every line of the response until it
+// fails.
+func (s *conformanceStream) read() {
+	dec := json.NewDecoder(s.resp.Body)
+	for {
+		var v json.RawMessage
+		err := dec.Decode(&v)
+		select {
+		case s.received <- err:
+		case <-s.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// send sends msg, failing if the server does not take it within
+// conformanceTimeout.
+func (s *conformanceStream) send(msg any) error {
+	sent := make(chan error, 1)
+	go func() { sent <- s.enc.Encode(msg) }()
+	select {
+	case err := <-sent:
+		if err != nil {
+			return fmt.Errorf("failed to send message, error was: %w", err)
+		}
+		return nil
+	case <-clk.After(conformanceTimeout):
+		return fmt.Errorf("server did not read message within %v", conformanceTimeout)
+	}
+}
+
+// recv waits up to conformanceTimeout for the next line of the response, and
+// returns io.EOF once the response ended.
+func (s *conformanceStream) recv() error {
+	select {
+	case err := <-s.received:
+		return err
+	case <-clk.After(conformanceTimeout):
+		return fmt.Errorf("no message within %v", conformanceTimeout)
+	}
+}
+
+func (s *conformanceStream) close() {
+	close(s.done)
+	s.w.Close()
+	s.resp.Body.Close()
+}
+
+func checkEarlyResponse(ctx context.Context, url string) error {
+	s, err := openConformanceStream(ctx, url)
+	if err != nil {
+		return err
+	}
+	s.close()
+	return nil
+}
+
+func checkFlushTiming(ctx context.Context, url string) error {
+	s, err := openConformanceStream(ctx, url)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	for i := 1; i <= conformanceFlushes; i++ {
+		err := s.send(requestMsg{Msg: "ping"})
+		if err != nil {
+			return err
+		}
+		err = s.recv()
+		if err != nil {
+			return fmt.Errorf("message %d of %d not answered while the request is open, error was: %w", i, conformanceFlushes, err)
+		}
+	}
+	return nil
+}
+
+func checkHalfClose(ctx context.Context, url string) error {
+	s, err := openConformanceStream(ctx, url)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	for i := 0; i < conformanceHalfClose; i++ {
+		err := s.send(requestMsg{Msg: "ping"})
+		if err != nil {
+			return err
+		}
+	}
+	s.w.Close()
+	for i := 1; i <= conformanceHalfClose; i++ {
+		err := s.recv()
+		if err != nil {
+			return fmt.Errorf("message %d of %d not answered after the request body ended, error was: %w", i, conformanceHalfClose, err)
+		}
+	}
+	err = s.recv()
+	if err == nil {
+		return fmt.Errorf("expected the response to end after %d answers, got another message", conformanceHalfClose)
+	}
+	if !errors.Is(err, io.EOF) {
+		return fmt.Errorf("expected the response to end after the request body ended, error was: %w", err)
+	}
+	return nil
+}
+
+func checkLargeMessage(ctx context.Context, url string) error {
+	s, err := openConformanceStream(ctx, url)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	err = s.send(requestMsg{Msg: "ping", Value: strings.Repeat("x", conformanceLargeMessage)})
+	if err != nil {
+		return err
+	}
+	err = s.recv()
+	if err != nil {
+		return fmt.Errorf("message of %v not answered, error was: %w", byteSize(conformanceLargeMessage), err)
+	}
+	return nil
+}
+
+func checkIdleTimeout(ctx context.Context, url string) error {
+	s, err := openConformanceStream(ctx, url)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	err = s.send(requestMsg{Msg: "ping"})
+	if err == nil {
+		err = s.recv()
+	}
+	if err != nil {
+		return fmt.Errorf("first message not answered, error was: %w", err)
+	}
+	select {
+	case <-ctx.Done():
+		return nil
+	case <-clk.After(conformanceIdle):
+	}
+	err = s.send(requestMsg{Msg: "ping"})
+	if err == nil {
+		err = s.recv()
+	}
+	if err != nil {
+		return fmt.Errorf("message after being idle for %v not answered, error was: %w", conformanceIdle, err)
+	}
+	return nil
+}
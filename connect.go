@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/itchyny/gojq"
+)
+
+// connectMaxLine is the longest line of stdin connect posts.
+const connectMaxLine = 16 * 1024 * 1024
+
+// connect opens a single duplex stream against address and pipes it to the
+// terminal: every json line read from stdin is posted to the server as is,
+// and every message received is printed to stdout, optionally transformed by
+// the jq expression filter. When stdin is exhausted the request body is
+// closed, while received messages keep being printed until the server ends
+// the response. Lines of stdin are read up to connectMaxLine long.
+//
+// Output is flushed to stdout once per received message, so that all values a
+// filter produces for one message arrive together and nothing lingers in a
+// buffer while waiting for the next message. With unbuffered set, every value
+// is written to stdout on its own as soon as it is produced.
+func connect(ctx context.Context, address string, filter string, unbuffered bool) error {
+	var query *gojq.Code
+	if filter != "" {
+		parsed, err := gojq.Parse(filter)
+		if err != nil {
+			return fmt.Errorf("failed to parse filter %q, error was: %w", filter, err)
+		}
+		query, err = gojq.Compile(parsed)
+		if err != nil {
+			return fmt.Errorf("failed to compile filter %q, error was: %w", filter, err)
+		}
+	}
+
+	stream, err := openStream(ctx, address)
+	if err != nil {
+		if ctx.Err() != nil {
+			slog.Info("connect: context was done, exiting")
+			return nil
+		}
+		return err
+	}
+	defer stream.resp.Body.Close()
+
+	ctx, cancelFunc := context.WithCancel(ctx)
+	defer cancelFunc()
+	// reading stdin cannot be interrupted, so its reader is not waited for:
+	// connect returns once the response ended or ctx is done, closing the
+	// request body, and leaves the reader blocked on stdin
+	postErr := make(chan error, 1)
+	go func() {
+		err := postStdin(stream)
+		if err != nil {
+			postErr <- err
+			cancelFunc()
+		}
+	}()
+	err = printReceived(ctx, stream, query, unbuffered)
+	stream.closeSend()
+	if err != nil {
+		return err
+	}
+	select {
+	case err := <-postErr:
+		return err
+	default:
+		return nil
+	}
+}
+
+// postStdin posts every json line of stdin to stream, closing the request
+// body once stdin is exhausted.
+func postStdin(stream *clientStream) error {
+	defer stream.closeSend()
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(make([]byte, 0, 64*1024), connectMaxLine)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		if !json.Valid(line) {
+			slog.Warn("connect: skipping line from stdin which is not valid json", "line", string(line))
+			continue
+		}
+		err := stream.send(json.RawMessage(line))
+		if err != nil {
+			if !errors.Is(err, io.ErrClosedPipe) && !errors.Is(err, errSendClosed) {
+				return fmt.Errorf("connect: failed to send message to server, error was: %w", err)
+			}
+			return nil
+		}
+		slog.Debug("connect: posted message to server")
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("connect: failed to read stdin, error was: %w", err)
+	}
+	slog.Info("connect: stdin closed, closing request body")
+	return nil
+}
+
+// printReceived prints the messages received on stream, transformed by
+// query if set, until the server ends the response or ctx is done. Numbers
+// are kept as received, as json.Number, which gojq takes as int or big.Int,
+// so that the timestamps in nanoseconds are not rounded through float64.
+func printReceived(ctx context.Context, stream *clientStream, query *gojq.Code, unbuffered bool) error {
+	stop := context.AfterFunc(ctx, func() { stream.resp.Body.Close() })
+	defer stop()
+
+	stdout := bufio.NewWriter(os.Stdout)
+	out := json.NewEncoder(stdout)
+	emit := func(v any) error {
+		err := out.Encode(v)
+		if err != nil {
+			return fmt.Errorf("connect: failed to print message, error was: %w", err)
+		}
+		if unbuffered {
+			return flushStdout(stdout)
+		}
+		return nil
+	}
+	for {
+		var raw json.RawMessage
+		err := stream.recv(&raw)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, io.EOF) {
+				slog.Info("connect: server closed response - finished")
+				return nil
+			}
+			return fmt.Errorf("connect: failed to decode message from server, error was: %w", err)
+		}
+		var in any
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.UseNumber()
+		err = dec.Decode(&in)
+		if err != nil {
+			return fmt.Errorf("connect: failed to decode message from server, error was: %w", err)
+		}
+		if query == nil {
+			err = emit(in)
+			if err != nil {
+				return err
+			}
+		} else {
+			iter := query.RunWithContext(ctx, in)
+			for {
+				v, ok := iter.Next()
+				if !ok {
+					break
+				}
+				if err, ok := v.(error); ok {
+					slog.Warn("connect: filter failed on received message", "error", err)
+					continue
+				}
+				err = emit(v)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		err = flushStdout(stdout)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func flushStdout(stdout *bufio.Writer) error {
+	err := stdout.Flush()
+	if err != nil {
+		return fmt.Errorf("connect: failed to flush stdout, error was: %w", err)
+	}
+	return nil
+}
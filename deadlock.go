@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"runtime/pprof"
+	"sync"
+	"time"
+)
+
+// deadlockThreshold is how long a send may stay blocked writing before the
+// watchdog reports it, zero disables the watchdog. A write blocks when the
+// peer does not read, and when both sides block writing to each other while
+// neither reads the duplex stream is deadlocked, the failure mode full duplex
+// streaming is prone to. With breakDeadlocks the watchdog also breaks the
+// streams blocked for longer than the threshold.
+var (
+	deadlockThreshold = time.Duration(0)
+	breakDeadlocks    = false
+)
+
+var errDeadlock = errors.New("stream write blocked, deadlock suspected")
+
+// blockedWrite is a send in progress, as seen by the watchdog.
+type blockedWrite struct {
+	side  string
+	path  string
+	since time.Time
+	// breakStream unblocks the write by breaking its stream
+	breakStream func()
+}
+
+var blockedWrites = struct {
+	mu     sync.Mutex
+	writes map[*blockedWrite]struct{}
+}{writes: map[*blockedWrite]struct{}{}}
+
+// watchWrite shows a send starting on a stream of side to the watchdog, the
+// returned done must be called once it returns.
+func watchWrite(side string, path string, breakStream func()) (done func()) {
+	if deadlockThreshold <= 0 {
+		return func() {}
+	}
+	w := &blockedWrite{side: side, path: path, since: clk.Now(), breakStream: breakStream}
+	blockedWrites.mu.Lock()
+	blockedWrites.writes[w] = struct{}{}
+	blockedWrites.mu.Unlock()
+	return func() {
+		blockedWrites.mu.Lock()
+		delete(blockedWrites.writes, w)
+		blockedWrites.mu.Unlock()
+	}
+}
+
+// watchDeadlocks checks for sends blocked longer than deadlockThreshold until
+// ctx is done. On finding some it logs every one of them, and the goroutine
+// stacks once per episode, breaking their streams with breakDeadlocks.
+func watchDeadlocks(ctx context.Context) error {
+	if deadlockThreshold <= 0 {
+		return nil
+	}
+	ticker := clk.NewTicker(deadlockThreshold / 2)
+	defer ticker.Stop()
+	reported := false
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C():
+		}
+
+		now := clk.Now()
+		var stuck []*blockedWrite
+		blockedSides := map[string]int{}
+		blockedWrites.mu.Lock()
+		for w := range blockedWrites.writes {
+			if now.Sub(w.since) > deadlockThreshold {
+				stuck = append(stuck, w)
+				blockedSides[w.side]++
+			}
+		}
+		blockedWrites.mu.Unlock()
+		if len(stuck) == 0 {
+			reported = false
+			continue
+		}
+
+		for _, w := range stuck {
+			slog.Warn("deadlock: write blocked, peer is not reading", "side", w.side, "path", w.path, "blocked", now.Sub(w.since))
+		}
+		if blockedSides["client"] > 0 && blockedSides["server"] > 0 {
+			slog.Error("deadlock: client and server both blocked writing while neither reads", "client_writes", blockedSides["client"], "server_writes", blockedSides["server"])
+		}
+		if !reported {
+			reported = true
+			slog.Warn("deadlock: dumping goroutines of blocked writes")
+			pprof.Lookup("goroutine").WriteTo(os.Stderr, 1)
+		}
+		if breakDeadlocks {
+			for _, w := range stuck {
+				slog.Warn("deadlock: breaking stream of blocked write", "side", w.side, "path", w.path)
+				w.breakStream()
+			}
+		}
+	}
+}
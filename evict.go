@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"time"
+)
+
+// With evictBacklog the server disconnects clients which do not keep up with
+// reading their stream. The receive backlog of a client is what the server
+// sent on its connection that the client has not acknowledged yet, as the
+// socket send queue holds it. When it stays above evictBacklog for longer
+// than evictGrace the stream is closed with an error message, so a single
+// stalled reader cannot pin the memory of the server with blocked sends.
+//
+// The backlog is that of the connection, so under HTTP/2 it is the sum of
+// all streams multiplexed on it: every stream of a connection over the
+// limit is evicted, a stream keeping up included, and the write deadline
+// that unblocks their sends cuts the whole connection. It needs TCP below
+// TLS, so it does not combine with a unix socket or -h3.
+var (
+	evictBacklog byteSize
+	evictGrace   = 10 * time.Second
+)
+
+const (
+	evictCheckInterval = 1 * time.Second
+	// evictWriteTimeout is how long a send to an evicted client, and the
+	// error message telling it why, get to complete
+	evictWriteTimeout = 1 * time.Second
+)
+
+var errSlowClient = errors.New("client receive backlog over limit, evicted")
+
+// connContextKey keys the connection of a request in its context.
+type connContextKey struct{}
+
+func withConn(ctx context.Context, conn net.Conn) context.Context {
+	return withNegotiated(context.WithValue(ctx, connContextKey{}, conn))
+}
+
+func evictSlowClients(ctx context.Context) error {
+	if evictBacklog <= 0 {
+		return nil
+	}
+	if !socketBacklogSupported {
+		serverLog.Warn("server: slow client eviction is not supported on this platform")
+		return nil
+	}
+	ticker := clk.NewTicker(evictCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C():
+		}
+
+		now := clk.Now()
+		for _, s := range activeStreams.all() {
+			backlog, err := connBacklog(s.conn)
+			if err != nil {
+				serverLog.Debug("server: failed to get receive backlog of client", "stream", s.id, "error", err)
+				continue
+			}
+			if backlog <= evictBacklog {
+				s.overBacklogSince = time.Time{}
+				continue
+			}
+			if s.overBacklogSince.IsZero() {
+				s.overBacklogSince = now
+				serverLog.Info("server: client receive backlog over limit", "stream", s.id, "path", s.path, "remote", s.remote, "backlog", backlog, "limit", evictBacklog)
+			}
+			if now.Sub(s.overBacklogSince) > evictGrace {
+				serverLog.Warn("server: evicting slow client", "stream", s.id, "path", s.path, "remote", s.remote, "backlog", backlog, "over_limit", now.Sub(s.overBacklogSince))
+				serverMetrics.streamEvicted()
+				// a send blocked on the client would keep the stream from
+				// ending
+				s.conn.SetWriteDeadline(time.Now().Add(evictWriteTimeout))
+				s.cancel(errSlowClient)
+			}
+		}
+	}
+}
+
+// connBacklog returns the bytes sent on conn not yet acknowledged by the peer.
+func connBacklog(conn net.Conn) (byteSize, error) {
+	tcpConn, ok := tcpConnOf(conn)
+	if !ok {
+		return 0, errors.New("not a tcp connection")
+	}
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	n, err := socketBacklog(rawConn)
+	return byteSize(n), err
+}
+
+// tcpConnOf returns the TCP connection below the wrappers of conn.
+func tcpConnOf(conn net.Conn) (*net.TCPConn, bool) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if flowConn, ok := conn.(*h2FlowConn); ok {
+		conn = flowConn.Conn
+	}
+	if proxyConn, ok := conn.(*proxyConn); ok {
+		conn = proxyConn.Conn
+	}
+	if captureConn, ok := conn.(*captureConn); ok {
+		conn = captureConn.Conn
+	}
+	if socketErrConn, ok := conn.(*socketErrConn); ok {
+		conn = socketErrConn.Conn
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	return tcpConn, ok
+}
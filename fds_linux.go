@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+const fdUsageSupported = true
+
+// procFiles are the files of /proc processFDs reads, kept open from the
+// start, as opening them fails once the process ran out of file descriptors,
+// which is when their counts matter most.
+var procFiles struct {
+	mu  sync.Mutex
+	fd  *os.File
+	tcp []*os.File
+}
+
+func init() {
+	f, err := os.Open("/proc/self/fd")
+	if err != nil {
+		return
+	}
+	procFiles.fd = f
+	for _, path := range []string{"/proc/self/net/tcp", "/proc/self/net/tcp6"} {
+		f, err := os.Open(path)
+		if err == nil {
+			procFiles.tcp = append(procFiles.tcp, f)
+		}
+	}
+}
+
+// processFDs returns the number of open file descriptors of the process and
+// how many of them are TCP connections, not counting listeners, as listed in
+// /proc.
+func processFDs() (fds int, connections int) {
+	procFiles.mu.Lock()
+	defer procFiles.mu.Unlock()
+	if procFiles.fd == nil {
+		return 0, 0
+	}
+	_, err := procFiles.fd.Seek(0, io.SeekStart)
+	if err != nil {
+		return 0, 0
+	}
+	names, err := procFiles.fd.Readdirnames(-1)
+	if err != nil {
+		return 0, 0
+	}
+	sockets := map[string]bool{}
+	for _, name := range names {
+		link, err := os.Readlink("/proc/self/fd/" + name)
+		if err != nil {
+			continue
+		}
+		inode, ok := strings.CutPrefix(link, "socket:[")
+		if ok {
+			sockets[strings.TrimSuffix(inode, "]")] = true
+		}
+	}
+	for _, f := range procFiles.tcp {
+		connections += countTCPConnections(f, sockets)
+	}
+	return len(names), connections
+}
+
+// countTCPConnections counts the sockets in the TCP table f whose inode is
+// among sockets and that are not listening.
+func countTCPConnections(f *os.File, sockets map[string]bool) int {
+	_, err := f.Seek(0, io.SeekStart)
+	if err != nil {
+		return 0
+	}
+	n := 0
+	scanner := bufio.NewScanner(f)
+	// the header
+	scanner.Scan()
+	for scanner.Scan() {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when
+		// retrnsmt uid timeout inode ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		const listening = "0A"
+		if fields[3] != listening && sockets[fields[9]] {
+			n++
+		}
+	}
+	return n
+}
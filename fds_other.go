@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+const fdUsageSupported = false
+
+// processFDs is not measured on this platform.
+func processFDs() (fds int, connections int) {
+	return 0, 0
+}
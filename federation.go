@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// With federate the client sends every report of its measurements to the
+// server as well, as a report control message on a stream of its own, so
+// that the measurements of a test spread over several client machines can be
+// followed in one place. The server keeps the latest report of every client
+// run, by its run id, and publishes them as federation at /debug/vars,
+// together with its own measurements and the totals of all clients
+// combined, where the percentiles are those of the worst client as reports
+// carry no histograms. Reports are sent every -report-interval.
+var federate = false
+
+const federationPath = "/federation"
+
+// federatedReports passes the reports of the client to its federation
+// stream, dropping those it is not ready for.
+var federatedReports = make(chan *metricsSnapshot, 1)
+
+// federateReport hands snapshot to the federation stream without waiting.
+func federateReport(snapshot *metricsSnapshot) {
+	select {
+	case federatedReports <- snapshot:
+	default:
+		clientLog.Warn("client: dropped report not yet federated to the server")
+	}
+}
+
+func runFederation(ctx context.Context, stream *clientStream) error {
+	stop := context.AfterFunc(ctx, func() { stream.resp.Body.Close() })
+	defer stop()
+
+	for {
+		var report *metricsSnapshot
+		select {
+		case <-ctx.Done():
+			return nil
+		case report = <-federatedReports:
+		}
+		err := stream.send(requestMsg{Msg: "report", Report: report})
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("client: failed to send report to server, error was: %w", err)
+		}
+	}
+}
+
+// federatedClient is the latest report of a client run.
+type federatedClient struct {
+	Updated time.Time
+	// Connected is whether its federation stream is open
+	Connected bool
+	// Report is replaced by the next one, never changed
+	Report *metricsSnapshot
+}
+
+// federatedTotals are the measurements of all clients of the federation.
+// Latency and Setup are the worst percentiles of any client.
+type federatedTotals struct {
+	Clients  int
+	Active   int64
+	Opened   int64
+	Closed   int64
+	Received int64
+	Rate     float64
+	Errors   map[string]int64
+	Setup    percentileSummary
+	Latency  percentileSummary
+}
+
+type federationVars struct {
+	Server   any
+	Clients  map[string]federatedClient
+	Combined federatedTotals
+}
+
+var federation = struct {
+	mu      sync.Mutex
+	clients map[string]*federatedClient
+}{clients: map[string]*federatedClient{}}
+
+func init() {
+	expvar.Publish("federation", expvar.Func(func() any {
+		federation.mu.Lock()
+		defer federation.mu.Unlock()
+		vars := federationVars{
+			Server:   serverMetrics.vars(),
+			Clients:  make(map[string]federatedClient, len(federation.clients)),
+			Combined: federatedTotals{Errors: map[string]int64{}},
+		}
+		for runID, c := range federation.clients {
+			vars.Clients[runID] = *c
+			vars.Combined.add(c.Report)
+		}
+		return vars
+	}))
+}
+
+func (t *federatedTotals) add(report *metricsSnapshot) {
+	t.Clients++
+	t.Active += report.Active
+	t.Opened += report.TotalOpened
+	t.Closed += report.TotalClosed
+	t.Received += report.TotalReceived
+	t.Rate += report.Rate
+	for category, n := range report.TotalErrors {
+		t.Errors[category] += n
+	}
+	t.Setup = worst(t.Setup, report.TotalSetup)
+	t.Latency = worst(t.Latency, report.TotalLatency)
+}
+
+func worst(a, b percentileSummary) percentileSummary {
+	return percentileSummary{P50: max(a.P50, b.P50), P90: max(a.P90, b.P90), P99: max(a.P99, b.P99), Max: max(a.Max, b.Max)}
+}
+
+// federated records report as the latest of its client run.
+func federated(report *metricsSnapshot) *federatedClient {
+	federation.mu.Lock()
+	defer federation.mu.Unlock()
+	c, ok := federation.clients[report.Manifest.RunID]
+	if !ok {
+		c = &federatedClient{}
+		federation.clients[report.Manifest.RunID] = c
+		serverLog.Info("server: client joined federation", "client_run_id", report.Manifest.RunID, "hostname", report.Manifest.Hostname)
+	}
+	c.Report = report
+	c.Updated = clk.Now()
+	c.Connected = true
+	return c
+}
+
+func disconnected(c *federatedClient) {
+	federation.mu.Lock()
+	defer federation.mu.Unlock()
+	c.Connected = false
+}
+
+// serveFederation records every report of the client.
+func serveFederation(ctx context.Context, stream *serverStream) {
+	var client *federatedClient
+	defer func() {
+		if client != nil {
+			disconnected(client)
+		}
+	}()
+	for {
+		var inMsg requestMsg
+		err := stream.recv(&inMsg)
+		if err != nil {
+			if ctx.Err() == nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+				stream.log.Error("server: failed to receive request message from client", "error", err)
+			}
+			return
+		}
+		if inMsg.Msg != "report" || inMsg.Report == nil || inMsg.Report.Manifest.RunID == "" {
+			stream.log.Warn("server: received unexpected message on federation stream", "msg", inMsg.Msg)
+			continue
+		}
+		client = federated(inMsg.Report)
+	}
+}
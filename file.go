@@ -0,0 +1,437 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// File mode transfers files in both directions at once over a single duplex
+// stream: the client uploads sendFile, which the server stores in its
+// fileDir under the same name, while the server streams the file of fileDir
+// named as recvFile back, which the client stores as recvFile. Either one may
+// be left out. Every file is sent as base64 chunks followed by an end message
+// carrying its sha256, which the receiving side verifies before moving the
+// file into place, so a broken transfer never leaves a partial file behind.
+// The server confirms a stored upload with its own sha256, which the client
+// checks too, and the client logs the progress of both directions every
+// fileProgressInterval.
+var (
+	sendFile = ""
+	recvFile = ""
+	// fileDir is the directory the server stores and serves files in, file
+	// transfers are refused without it
+	fileDir = ""
+)
+
+const (
+	filePath             = "/file"
+	fileChunk            = 64 << 10
+	fileProgressInterval = 1 * time.Second
+)
+
+// fileName returns the name of a transferred file, without any directory.
+func fileName(name string) (string, error) {
+	base := filepath.Base(name)
+	if name == "" || base == "." || base == ".." || base == string(filepath.Separator) {
+		return "", fmt.Errorf("invalid file name %q", name)
+	}
+	return base, nil
+}
+
+// fileReceiver writes a received file to a temporary file next to its
+// destination and moves it into place once its checksum was verified.
+type fileReceiver struct {
+	path string
+	tmp  *os.File
+	hash hash.Hash
+	n    int64
+}
+
+func newFileReceiver(path string) (*fileReceiver, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file, error was: %w", err)
+	}
+	return &fileReceiver{path: path, tmp: tmp, hash: sha256.New()}, nil
+}
+
+func (r *fileReceiver) write(chunk string) error {
+	data, err := base64.StdEncoding.DecodeString(chunk)
+	if err != nil {
+		return fmt.Errorf("failed to decode chunk, error was: %w", err)
+	}
+	_, err = r.tmp.Write(data)
+	if err != nil {
+		return fmt.Errorf("failed to write file, error was: %w", err)
+	}
+	r.hash.Write(data)
+	r.n += int64(len(data))
+	return nil
+}
+
+// finish verifies the file against the sha256 of the sender and moves it
+// into place, returning the sha256.
+func (r *fileReceiver) finish(sum string) (string, error) {
+	got := hex.EncodeToString(r.hash.Sum(nil))
+	if got != sum {
+		r.abort()
+		return "", fmt.Errorf("checksum mismatch, sent %s, received %s", sum, got)
+	}
+	// temporary files are created only readable by their owner
+	err := r.tmp.Chmod(0o644)
+	if err == nil {
+		err = r.tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(r.tmp.Name(), r.path)
+	}
+	if err != nil {
+		os.Remove(r.tmp.Name())
+		return "", fmt.Errorf("failed to store file, error was: %w", err)
+	}
+	return got, nil
+}
+
+// abort removes the partial file, if not finished yet.
+func (r *fileReceiver) abort() {
+	if r.tmp.Close() == nil {
+		os.Remove(r.tmp.Name())
+	}
+}
+
+// sendFileChunks sends the file at path in chunks with send, followed by the
+// end message with its sha256, which it returns. sent counts the bytes sent.
+func sendFileChunks(path string, send func(msg, data string) error, sent *atomic.Int64) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file, error was: %w", err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	buf := make([]byte, fileChunk)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			h.Write(buf[:n])
+			sendErr := send("chunk", base64.StdEncoding.EncodeToString(buf[:n]))
+			if sendErr != nil {
+				return "", sendErr
+			}
+			sent.Add(int64(n))
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to read file, error was: %w", err)
+		}
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	return sum, send("end", sum)
+}
+
+func serveFile(ctx context.Context, stream *serverStream) {
+	// the first failure ends both directions, the client is told about it
+	var once sync.Once
+	fail := func(err error) {
+		once.Do(func() {
+			if ctx.Err() == nil {
+				stream.log.Error("server: file transfer failed", "error", err)
+				stream.send(responseMsg{Msg: "error", Error: err.Error()})
+			}
+			stream.cancel(err)
+		})
+	}
+	if fileDir == "" {
+		fail(errors.New("file transfers are disabled, the server has no -file-dir"))
+		return
+	}
+	query := stream.request.URL.Query()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		err := serveFileDownload(stream, query.Get("recv"))
+		if err != nil {
+			fail(err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		err := serveFileUpload(stream, query.Get("send"))
+		if err != nil {
+			fail(err)
+		}
+	}()
+	wg.Wait()
+}
+
+// serveFileDownload sends the file of fileDir named name to the client,
+// nothing if name is empty.
+func serveFileDownload(stream *serverStream, name string) error {
+	if name == "" {
+		return nil
+	}
+	name, err := fileName(name)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(fileDir, name)
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to open file, error was: %w", err)
+	}
+	err = stream.send(responseMsg{Msg: "file", Size: info.Size()})
+	if err != nil {
+		return err
+	}
+	var sent atomic.Int64
+	sum, err := sendFileChunks(path, func(msg, data string) error {
+		return stream.send(responseMsg{Msg: msg, Data: data})
+	}, &sent)
+	if err != nil {
+		return err
+	}
+	stream.log.Info("server: sent file", "name", name, "size", byteSize(sent.Load()), "sha256", sum)
+	return nil
+}
+
+// serveFileUpload stores the file the client uploads in fileDir as name,
+// only reading until the client half-closes if name is empty.
+func serveFileUpload(stream *serverStream, name string) error {
+	var receiver *fileReceiver
+	if name != "" {
+		name, err := fileName(name)
+		if err != nil {
+			return err
+		}
+		receiver, err = newFileReceiver(filepath.Join(fileDir, name))
+		if err != nil {
+			return err
+		}
+		defer receiver.abort()
+	}
+	for {
+		var inMsg requestMsg
+		err := stream.recv(&inMsg)
+		if errors.Is(err, io.EOF) {
+			if receiver != nil {
+				return errors.New("upload ended before its end message")
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if receiver == nil {
+			stream.log.Warn("server: received file message without an upload", "msg", inMsg.Msg)
+			continue
+		}
+		switch inMsg.Msg {
+		case "chunk":
+			err = receiver.write(inMsg.Value)
+			if err != nil {
+				return err
+			}
+		case "end":
+			sum, err := receiver.finish(inMsg.Value)
+			if err != nil {
+				return err
+			}
+			stream.log.Info("server: stored file", "name", filepath.Base(receiver.path), "size", byteSize(receiver.n), "sha256", sum)
+			err = stream.send(responseMsg{Msg: "stored", Data: sum})
+			if err != nil {
+				return err
+			}
+			receiver = nil
+		default:
+			stream.log.Warn("server: received unknown file message from client", "msg", inMsg.Msg)
+		}
+	}
+}
+
+// fileProgress is the progress of both directions of a file transfer.
+type fileProgress struct {
+	sent, sendTotal     atomic.Int64
+	received, recvTotal atomic.Int64
+}
+
+func (p *fileProgress) report(ctx context.Context) {
+	ticker := clk.NewTicker(fileProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+		attrs := []any{}
+		if sendFile != "" {
+			attrs = append(attrs, "sent", fmt.Sprintf("%v of %v", byteSize(p.sent.Load()), byteSize(p.sendTotal.Load())))
+		}
+		if recvFile != "" {
+			attrs = append(attrs, "received", fmt.Sprintf("%v of %v", byteSize(p.received.Load()), byteSize(p.recvTotal.Load())))
+		}
+		slog.Info("file: progress", attrs...)
+	}
+}
+
+// transferFiles runs file mode against the server at hostPort.
+func transferFiles(ctx context.Context, hostPort string) error {
+	if sendFile == "" && recvFile == "" {
+		return errors.New("file: nothing to transfer, set -send-file, -recv-file or both")
+	}
+	query := url.Values{}
+	for key, path := range map[string]string{"send": sendFile, "recv": recvFile} {
+		if path == "" {
+			continue
+		}
+		name, err := fileName(path)
+		if err != nil {
+			return err
+		}
+		query.Set(key, name)
+	}
+	stream, err := openStream(ctx, "http://"+hostPort+filePath+"?"+query.Encode())
+	if err != nil {
+		if ctx.Err() != nil {
+			slog.Info("file: context was done, exiting")
+			return nil
+		}
+		return err
+	}
+	defer stream.resp.Body.Close()
+	defer stream.w.Close()
+
+	started := clk.Now()
+	var progress fileProgress
+	eg, egCtx := errgroup.WithContext(ctx)
+	// a failure of either direction, or ctx being done, ends both
+	stop := context.AfterFunc(egCtx, func() {
+		stream.w.Close()
+		stream.resp.Body.Close()
+	})
+	defer stop()
+	go progress.report(egCtx)
+
+	// the sha256 of the upload, for checking the one the server stored
+	uploaded := make(chan string, 1)
+	eg.Go(func() error {
+		defer stream.closeSend()
+		if sendFile == "" {
+			return nil
+		}
+		info, err := os.Stat(sendFile)
+		if err != nil {
+			return fmt.Errorf("file: failed to open file to send, error was: %w", err)
+		}
+		progress.sendTotal.Store(info.Size())
+		sum, err := sendFileChunks(sendFile, func(msg, data string) error {
+			return stream.send(requestMsg{Msg: msg, Value: data})
+		}, &progress.sent)
+		if err != nil {
+			if egCtx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("file: failed to send %s, error was: %w", sendFile, err)
+		}
+		uploaded <- sum
+		return nil
+	})
+	eg.Go(func() error {
+		var receiver *fileReceiver
+		defer func() {
+			if receiver != nil {
+				receiver.abort()
+			}
+		}()
+		stored, downloaded := sendFile == "", recvFile == ""
+		for {
+			var in responseMsg
+			err := stream.recv(&in)
+			if err != nil {
+				if egCtx.Err() != nil {
+					return nil
+				}
+				if !errors.Is(err, io.EOF) {
+					return fmt.Errorf("file: failed to decode message from server, error was: %w", err)
+				}
+				break
+			}
+			switch in.Msg {
+			case "file":
+				if recvFile == "" || receiver != nil {
+					return errors.New("file: server sent a file that was not asked for")
+				}
+				progress.recvTotal.Store(in.Size)
+				receiver, err = newFileReceiver(recvFile)
+				if err != nil {
+					return fmt.Errorf("file: %w", err)
+				}
+			case "chunk":
+				if receiver == nil {
+					return errors.New("file: server sent a chunk before its file")
+				}
+				err = receiver.write(in.Data)
+				if err != nil {
+					return fmt.Errorf("file: %w", err)
+				}
+				progress.received.Store(receiver.n)
+			case "end":
+				if receiver == nil {
+					return errors.New("file: server ended a file before sending it")
+				}
+				sum, err := receiver.finish(in.Data)
+				receiver = nil
+				if err != nil {
+					return fmt.Errorf("file: failed to receive %s, error was: %w", recvFile, err)
+				}
+				downloaded = true
+				slog.Info("file: received file", "path", recvFile, "size", byteSize(progress.received.Load()), "sha256", sum)
+			case "stored":
+				var sum string
+				select {
+				case sum = <-uploaded:
+				case <-egCtx.Done():
+					return nil
+				}
+				if in.Data != sum {
+					return fmt.Errorf("file: server stored %s with checksum %s, sent %s", sendFile, in.Data, sum)
+				}
+				stored = true
+				slog.Info("file: server stored file", "path", sendFile, "size", byteSize(progress.sent.Load()), "sha256", sum)
+			case "error":
+				return fmt.Errorf("file: server failed the transfer: %s", in.Error)
+			default:
+				slog.Warn("file: received unknown message from server", "msg", in.Msg)
+			}
+		}
+		if !stored || !downloaded {
+			return errors.New("file: server ended the stream before completing the transfer")
+		}
+		return nil
+	})
+	err = eg.Wait()
+	if err != nil {
+		return err
+	}
+	if ctx.Err() == nil {
+		slog.Info("file: transfer complete", "took", clk.Since(started).Round(time.Millisecond))
+	}
+	return nil
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Flow control lets either side of a stream pause the data the other sends,
+// in the manner of XON/XOFF: a pause message stops the sends of the peer
+// until a resume message, while control messages, and the messages already
+// in flight, still go through. It is enabled per stream by the workloads
+// using it, on both sides, by setting the flow of the stream before
+// receiving, as the peer would otherwise take the pause and resume messages
+// for data.
+
+// peerFlow is whether the peer of a stream paused it.
+type peerFlow struct {
+	mu sync.Mutex
+	// resumed is closed once the peer resumes the stream, nil while it is
+	// not paused
+	resumed chan struct{}
+}
+
+// control takes the pause and resume messages of the peer, returning
+// whether msg was one, which it never is with a nil f.
+func (f *peerFlow) control(msg string) bool {
+	if f == nil {
+		return false
+	}
+	switch msg {
+	case "pause":
+		f.pause()
+	case "resume":
+		f.resume()
+	default:
+		return false
+	}
+	return true
+}
+
+func (f *peerFlow) pause() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.resumed == nil {
+		f.resumed = make(chan struct{})
+	}
+}
+
+func (f *peerFlow) resume() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.resumed != nil {
+		close(f.resumed)
+		f.resumed = nil
+	}
+}
+
+// wait waits while the peer paused the stream, until ctx is done. It returns
+// right away with a nil f.
+func (f *peerFlow) wait(ctx context.Context) error {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	resumed := f.resumed
+	f.mu.Unlock()
+	if resumed == nil {
+		return nil
+	}
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// pause asks the server to stop sending data until resume.
+func (s *clientStream) pause() error {
+	return s.sendControl(requestMsg{Msg: "pause"})
+}
+
+// resume lets the server send data again after pause.
+func (s *clientStream) resume() error {
+	return s.sendControl(requestMsg{Msg: "resume"})
+}
+
+// pause asks the client to stop sending data until resume.
+func (s *serverStream) pause() error {
+	return s.sendControl(responseMsg{Msg: "pause"})
+}
+
+// resume lets the client send data again after pause.
+func (s *serverStream) resume() error {
+	return s.sendControl(responseMsg{Msg: "resume"})
+}
+
+// The pause workload has the server send numbered data messages at
+// pauseRate messages per second, which the client pauses every pauseEvery
+// for pauseFor. It counts the messages still arriving after it paused, those
+// in flight, and checks that none went missing over the pauses. The time from
+// resuming to the next message is counted as latency.
+var (
+	pauseRate  = 1000
+	pauseEvery = time.Second
+	pauseFor   = 100 * time.Millisecond
+)
+
+// pauseStats are the counts of the pause workload on the client, published
+// with expvar.
+type pauseStats struct {
+	Pauses   int64
+	Received int64
+	// AfterPause is the number of messages received while paused, sent
+	// before the server took the pause
+	AfterPause int64
+	// Missing is the number of messages skipped in the numbering
+	Missing int64
+}
+
+var pauseCounts = struct {
+	mu    sync.Mutex
+	stats pauseStats
+}{}
+
+func init() {
+	expvar.Publish("pause", expvar.Func(func() any {
+		pauseCounts.mu.Lock()
+		defer pauseCounts.mu.Unlock()
+		return pauseCounts.stats
+	}))
+}
+
+func servePause(ctx context.Context, stream *serverStream) {
+	stream.flow = &peerFlow{}
+	ctx, cancelFunc := context.WithCancel(ctx)
+	defer cancelFunc()
+
+	go func() {
+		defer cancelFunc()
+		// the client sends only control messages, which recv takes
+		for {
+			var inMsg requestMsg
+			err := stream.recv(&inMsg)
+			if err != nil {
+				if ctx.Err() == nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+					stream.log.Error("server: failed to receive request message from client", "error", err)
+				}
+				// a client gone can no longer resume the stream
+				stream.flow.resume()
+				return
+			}
+			stream.log.Warn("server: received unexpected message on pause stream", "msg", inMsg.Msg)
+		}
+	}()
+
+	ticker := clk.NewTicker(time.Second / time.Duration(pauseRate))
+	defer ticker.Stop()
+	for seq := int64(1); ; seq++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+		err := stream.send(responseMsg{Msg: "data", Seq: seq})
+		if err != nil {
+			if ctx.Err() == nil {
+				stream.log.Error("server: failed to send data to client", "error", err)
+			}
+			return
+		}
+	}
+}
+
+func runPause(ctx context.Context, stream *clientStream) error {
+	stream.flow = &peerFlow{}
+	stop := context.AfterFunc(ctx, func() { stream.resp.Body.Close() })
+	defer stop()
+
+	arrived := make(chan time.Time)
+	received := make(chan error, 1)
+	go func() {
+		var last int64
+		for {
+			var in responseMsg
+			err := stream.recv(&in)
+			if err == nil && in.Msg == "error" {
+				err = fmt.Errorf("server ended stream with error: %s", in.Error)
+			}
+			if err != nil {
+				received <- err
+				return
+			}
+			now := clk.Now()
+			pauseCounts.mu.Lock()
+			pauseCounts.stats.Received++
+			pauseCounts.stats.Missing += max(in.Seq-last-1, 0)
+			pauseCounts.mu.Unlock()
+			last = in.Seq
+			select {
+			case arrived <- now:
+			case <-ctx.Done():
+				received <- ctx.Err()
+				return
+			}
+		}
+	}()
+
+	// receive takes the messages arriving until until, or only the next
+	// one without, returning how many arrived and when the last did
+	receive := func(until <-chan time.Time) (n int64, last time.Time, err error) {
+		for {
+			select {
+			case last = <-arrived:
+				n++
+				if until == nil {
+					return n, last, nil
+				}
+			case <-until:
+				return n, last, nil
+			case err = <-received:
+				return n, last, err
+			}
+		}
+	}
+	ended := func(err error) error {
+		if ctx.Err() != nil || errors.Is(err, io.EOF) {
+			return nil
+		}
+		return fmt.Errorf("client: failed to receive data from server, error was: %w", err)
+	}
+
+	for {
+		_, _, err := receive(clk.After(pauseEvery))
+		if err != nil {
+			return ended(err)
+		}
+		err = stream.pause()
+		if err != nil {
+			return ended(err)
+		}
+		afterPause, _, err := receive(clk.After(pauseFor))
+		if err != nil {
+			return ended(err)
+		}
+		err = stream.resume()
+		if err != nil {
+			return ended(err)
+		}
+		resumed := clk.Now()
+		_, next, err := receive(nil)
+		if err != nil {
+			return ended(err)
+		}
+		latency := next.Sub(resumed)
+		clientMetrics.observeLatency(latency)
+		stream.log.Debug("client: resumed paused stream", "after_pause", afterPause, "resume_latency", latency)
+		pauseCounts.mu.Lock()
+		pauseCounts.stats.Pauses++
+		pauseCounts.stats.AfterPause += afterPause
+		pauseCounts.mu.Unlock()
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// Every message the server sends is flushed on its own, and the server
+// measures how long writing and flushing it took. The ticks workload also
+// measures when the client observes a flush: every tick carries the time the
+// previous one was flushed, which the client compares with when it received
+// that one. As the clocks of server and client may be apart, the client
+// takes the fastest delivery of a stream as the baseline and records how
+// much later every other one arrived. What accumulates there is buffering
+// between the flush and the application of the client, in the kernel or in
+// proxies, and deliveries flushStallThreshold or more late are counted as
+// stalls: at around 40ms, they are the typical sign of Nagle's algorithm
+// holding back a write until the peer acknowledges the previous one, which
+// the peer delays. Go disables Nagle's algorithm on its connections, nagle
+// enables it again on the connections of the server to reproduce this.
+var nagle = false
+
+const flushStallThreshold = 30 * time.Millisecond
+
+// nagleListener enables Nagle's algorithm on the connections it accepts.
+type nagleListener struct {
+	net.Listener
+}
+
+func (l *nagleListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetNoDelay(false)
+	}
+	return conn, err
+}
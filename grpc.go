@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+)
+
+// In grpc mode the server serves a gRPC service with a bidirectional
+// streaming Ping RPC instead of the duplex ndjson workloads, and the client
+// runs the pong workload over it, pinging every -ping-interval on a single
+// stream, so that duplex ndjson over HTTP/2 and gRPC streaming compare on
+// the same measurements, reported the same way. The messages are the
+// requestMsg and responseMsg of the ndjson streams, encoded as JSON by a
+// gRPC codec instead of protobuf, so the comparison is of the transports
+// rather than of the encodings. gRPC speaks HTTP/2 without TLS, as in h2c
+// mode, through the transport of grpc-go, which the tool is only built with
+// given the grpc build tag, to keep it from the dependencies of every other
+// build, as with h3.
+var grpcMode = false
+
+const (
+	grpcService = "duplex.Duplex"
+	grpcMethod  = "/" + grpcService + "/Ping"
+)
+
+// checkGRPC validates grpc mode against the other flags, with the workload
+// named workloadName.
+func checkGRPC(workloadName string) error {
+	if !grpcMode {
+		return nil
+	}
+	if !grpcSupported {
+		return fmt.Errorf("-grpc requires a build with -tags grpc")
+	}
+	if h2 || h3 {
+		return fmt.Errorf("-grpc does not combine with -h2, -h2c or -h3, gRPC brings its own HTTP/2")
+	}
+	if tcpInfoInterval > 0 {
+		return fmt.Errorf("-tcp-info-interval does not combine with -grpc, whose connections are not those of the tool")
+	}
+	if workloadName != "pong" || workloadMix != nil {
+		return fmt.Errorf("-grpc runs the pong workload only")
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+//go:build grpc
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+)
+
+const grpcSupported = true
+
+// grpcJSONCodec encodes the messages of the gRPC service as JSON, as on the
+// ndjson streams.
+type grpcJSONCodec struct{}
+
+func (grpcJSONCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (grpcJSONCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+func (grpcJSONCodec) Name() string                       { return "json" }
+
+func init() {
+	encoding.RegisterCodec(grpcJSONCodec{})
+}
+
+// grpcPingStream describes the Ping RPC, written by hand as there is no
+// protobuf to generate it from.
+var grpcPingStream = grpc.StreamDesc{
+	StreamName:    "Ping",
+	Handler:       servePingRPC,
+	ServerStreams: true,
+	ClientStreams: true,
+}
+
+var grpcServiceDesc = grpc.ServiceDesc{
+	ServiceName: grpcService,
+	HandlerType: (*any)(nil),
+	Streams:     []grpc.StreamDesc{grpcPingStream},
+}
+
+// grpcConnStats counts the connections of the gRPC server as negotiated.
+type grpcConnStats struct{}
+
+func (grpcConnStats) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context { return ctx }
+func (grpcConnStats) HandleRPC(context.Context, stats.RPCStats)                       {}
+func (grpcConnStats) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (grpcConnStats) HandleConn(_ context.Context, s stats.ConnStats) {
+	if _, ok := s.(*stats.ConnBegin); ok {
+		serverMetrics.connNegotiated("grpc")
+	}
+}
+
+// serveGRPC serves the gRPC service on ln until ctx is done, when it sends
+// GOAWAY and lets the streams in progress go on for h2Grace, as in h2 mode,
+// before closing them.
+func serveGRPC(ctx context.Context, ln net.Listener) error {
+	server := grpc.NewServer(grpc.StatsHandler(grpcConnStats{}))
+	server.RegisterService(&grpcServiceDesc, struct{}{})
+	stop := context.AfterFunc(ctx, func() {
+		serverLog.Info("server: context was done, shutting down grpc server")
+		timer := time.AfterFunc(h2Grace, func() {
+			serverLog.Info("server: closing streams still open after grace", "grace", h2Grace)
+			server.Stop()
+		})
+		server.GracefulStop()
+		timer.Stop()
+		serverLog.Info("server: finished shutting down")
+	})
+	defer stop()
+	err := server.Serve(ln)
+	if ctx.Err() != nil || errors.Is(err, grpc.ErrServerStopped) {
+		return nil
+	}
+	return err
+}
+
+// servePingRPC answers every ping of a Ping RPC with a pong, as servePong
+// does.
+func servePingRPC(_ any, stream grpc.ServerStream) (err error) {
+	serverMetrics.streamOpened(0)
+	defer func() {
+		cause := errorCause(err)
+		if status.Code(err) == codes.Canceled {
+			cause = errPeerClosed
+		}
+		serverMetrics.streamClosed(cause)
+	}()
+	// to get the communication going
+	err = stream.SendHeader(nil)
+	if err != nil {
+		return err
+	}
+	arrivals := serverMetrics.newArrivalRecorder()
+	for {
+		var in requestMsg
+		err := stream.RecvMsg(&in)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		received := clk.Now()
+		arrivals.observe(received)
+		if in.Seq != 0 {
+			serverMetrics.observeSeq(in.Seq, received)
+		}
+		out := answerPing(in, received)
+		started := clk.Now()
+		err = stream.SendMsg(&out)
+		if err != nil {
+			return err
+		}
+		serverMetrics.observeFlush(clk.Since(started))
+	}
+}
+
+// driveGRPC runs the pong workload over the Ping RPC of the server at
+// address, on a single stream at a time.
+func driveGRPC(ctx context.Context, address string) error {
+	target, err := url.Parse(address)
+	if err != nil {
+		return fmt.Errorf("failed to parse address, error was: %w", err)
+	}
+	conn, err := grpc.DialContext(ctx, target.Host,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.CallContentSubtype(grpcJSONCodec{}.Name())),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to set up grpc client, error was: %w", err)
+	}
+	defer conn.Close()
+
+	negotiated := false
+	for {
+		stream, err := openPingRPC(ctx, conn)
+		if err != nil {
+			if ctx.Err() != nil {
+				clientLog.Info("client: context was done, exiting")
+				return nil
+			}
+			return err
+		}
+		if !negotiated {
+			clientMetrics.connNegotiated("grpc")
+			negotiated = true
+		}
+		err = runPingRPC(ctx, stream)
+		cause := streamCause(ctx, err)
+		clientLog.Debug("client: grpc stream ended", "cause", cause, "reason", causeLabel(cause))
+		clientMetrics.streamClosed(cause)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if status.Code(err) != codes.Unavailable {
+			return err
+		}
+		clientLog.Info("client: grpc server went away, opening a new stream", "error", err)
+	}
+}
+
+// openPingRPC opens a Ping RPC on conn, retrying until the server answers
+// it with its headers.
+func openPingRPC(ctx context.Context, conn *grpc.ClientConn) (grpc.ClientStream, error) {
+	for {
+		started := clk.Now()
+		stream, err := conn.NewStream(ctx, &grpcPingStream, grpcMethod)
+		if err == nil {
+			_, err = stream.Header()
+		}
+		if err == nil {
+			clientMetrics.streamOpened(clk.Since(started))
+			return stream, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		clientMetrics.observeError("connect", err)
+		clientLog.Info("client: failed to start grpc stream against server", "error", err)
+		err = clk.Sleep(ctx, openRetryInterval)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// runPingRPC pings every pingInterval on stream, as runPong does.
+func runPingRPC(ctx context.Context, stream grpc.ClientStream) error {
+	defer stream.CloseSend()
+	return runPings(ctx, func(ping *requestMsg) error {
+		err := stream.SendMsg(ping)
+		if errors.Is(err, io.EOF) {
+			// the stream broke, receiving tells how
+			var in responseMsg
+			err = stream.RecvMsg(&in)
+		}
+		return err
+	}, func(pong *responseMsg) error {
+		return stream.RecvMsg(pong)
+	})
+}
@@ -0,0 +1,19 @@
+//go:build !grpc
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+const grpcSupported = false
+
+func serveGRPC(ctx context.Context, ln net.Listener) error {
+	return errors.New("server: built without grpc, build with -tags grpc")
+}
+
+func driveGRPC(ctx context.Context, address string) error {
+	return errors.New("client: built without grpc, build with -tags grpc")
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// In h2 mode the server serves HTTP/2 over TLS, with a self-signed
+// certificate generated when it starts, and the client speaks HTTP/2 to it
+// without verifying the certificate. A server shutting down sends GOAWAY and
+// lets the streams in progress go on for h2Grace, as an HTTP/2 server
+// restarting gracefully does, then closes their connections. The client
+// resumes a stream of a server that went away on a new stream, retrying the
+// messages pending on the old one with -retry-pending, which is counted as a
+// GOAWAY migration.
+//
+// With h2c they speak HTTP/2 without TLS instead, with prior knowledge, so
+// that HTTP/2 can be compared with HTTP/1.1 without the cost of TLS. It is h2
+// mode otherwise, and takes a build with Go 1.24 or later.
+var (
+	h2      = false
+	h2c     = false
+	h2Grace = 2 * time.Second
+)
+
+const goAwayWait = 100 * time.Millisecond
+
+// The HTTP/2 settings that dominate how duplex streams perform can be set in
+// h2 mode, each left to net/http when zero. h2MaxConcurrentStreams is the
+// number of streams a peer may have open on a connection, past which the
+// client of net/http opens another connection. h2StreamWindow and
+// h2ConnWindow are the initial flow control windows, the bytes a peer may
+// send on a stream and on the connection before the receiver consumed them,
+// and h2MaxFrameSize is the largest frame a peer may send. The server and the
+// client both take them, as each limits what its peer sends it. They are
+// recorded in the manifest of the run, and take a build with Go 1.24 or
+// later.
+var (
+	h2MaxConcurrentStreams = 0
+	h2StreamWindow         = byteSize(0)
+	h2ConnWindow           = byteSize(0)
+	h2MaxFrameSize         = byteSize(0)
+)
+
+// http2Settings are the HTTP/2 settings of a run in h2 mode, zero where
+// left to net/http.
+type http2Settings struct {
+	MaxConcurrentStreams int
+	StreamWindow         byteSize
+	ConnWindow           byteSize
+	MaxFrameSize         byteSize
+}
+
+func h2Settings() http2Settings {
+	return http2Settings{
+		MaxConcurrentStreams: h2MaxConcurrentStreams,
+		StreamWindow:         h2StreamWindow,
+		ConnWindow:           h2ConnWindow,
+		MaxFrameSize:         h2MaxFrameSize,
+	}
+}
+
+// checkH2Settings validates the HTTP/2 settings against the limits of the
+// protocol, as net/http ignores those out of range.
+func checkH2Settings() error {
+	if h2Windows && !h2c {
+		return fmt.Errorf("-h2-windows requires -h2c")
+	}
+	if h2c && !h2ConfigSupported {
+		return fmt.Errorf("-h2c requires a build with Go 1.24 or later, this is %s", runtime.Version())
+	}
+	if h2DisableClientPriority && !h2 {
+		return fmt.Errorf("-h2-disable-client-priority requires -h2")
+	}
+	if h2DisableClientPriority && !h2PrioritySupported {
+		return fmt.Errorf("-h2-disable-client-priority requires a build with Go 1.27 or later, this is %s", runtime.Version())
+	}
+	settings := h2Settings()
+	if settings == (http2Settings{}) {
+		return nil
+	}
+	if !h2 {
+		return fmt.Errorf("HTTP/2 settings require -h2")
+	}
+	if !h2ConfigSupported {
+		return fmt.Errorf("HTTP/2 settings require a build with Go 1.24 or later, this is %s", runtime.Version())
+	}
+	if settings.MaxConcurrentStreams < 0 {
+		return fmt.Errorf("expected non-negative maximum of concurrent streams, got %d", settings.MaxConcurrentStreams)
+	}
+	for _, window := range []byteSize{settings.StreamWindow, settings.ConnWindow} {
+		if window < 0 || window > 1<<31-1 {
+			return fmt.Errorf("expected flow control window up to 2GiB-1, got %v", window)
+		}
+	}
+	if settings.MaxFrameSize != 0 && (settings.MaxFrameSize < 16<<10 || settings.MaxFrameSize > 1<<24-1) {
+		return fmt.Errorf("expected maximum frame size from 16KiB to 16MiB-1, got %v", settings.MaxFrameSize)
+	}
+	return nil
+}
+
+// h2TLSConfig returns the TLS config of the server in h2 mode, with a fresh
+// self-signed certificate.
+func h2TLSConfig() (*tls.Config, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key, error was: %w", err)
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(now.UnixNano()),
+		Subject:      pkix.Name{CommonName: "test-stream-http-duplex"},
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create certificate, error was: %w", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   []string{"h2", "http/1.1"},
+		KeyLogWriter: keyLogWriter(),
+	}
+	config.SetSessionTicketKeys([][32]byte{sessionTicketKey()})
+	return config, nil
+}
+
+// newH2Transport returns the transport of the client in h2 mode.
+func newH2Transport() *http.Transport {
+	transport := newBaseTransport()
+	if h2c {
+		if h2Windows {
+			transport.DialContext = dialH2Flow(transport.DialContext)
+		}
+		configureH2Transport(transport)
+		configureH2Strict(transport)
+		return transport
+	}
+	transport.TLSClientConfig = clientTLSConfig()
+	transport.ForceAttemptHTTP2 = true
+	configureH2Transport(transport)
+	configureH2Strict(transport)
+	return transport
+}
+
+// h2Address returns address with the scheme of h2 or h3 mode when in either.
+func h2Address(address string) string {
+	if (!h2 || h2c) && !h3 {
+		return address
+	}
+	return "https://" + strings.TrimPrefix(address, "http://")
+}
+
+// isGoAway returns whether err is that of a stream whose connection the
+// server closed after sending GOAWAY. The transport of net/http does not
+// export its type, so it is told by its message. When sending on the stream
+// the transport may also take the connection as closed before it took the
+// GOAWAY, and abort the stream with an error of its own, which is counted as
+// well, together with the rare connections closed otherwise.
+func isGoAway(err error) bool {
+	return err != nil && (strings.Contains(err.Error(), "server sent GOAWAY") || strings.Contains(err.Error(), "client conn is closed"))
+}
+
+// wentAway returns whether the workload of s ended with err as the server
+// went away with GOAWAY. The workload may have failed to send first, on the
+// request body the transport closed with the connection, so the response is
+// read for up to goAwayWait for the GOAWAY it failed with.
+func (s *clientStream) wentAway(err error) bool {
+	if !h2 || err == nil {
+		return false
+	}
+	if isGoAway(err) {
+		return true
+	}
+	read := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(io.Discard, s.resp.Body)
+		read <- err
+	}()
+	timer := time.NewTimer(goAwayWait)
+	defer timer.Stop()
+	select {
+	case err := <-read:
+		return isGoAway(err)
+	case <-timer.C:
+		return false
+	}
+}
+
+// shutdownH2 shuts server down gracefully: it sends GOAWAY, waits up to
+// h2Grace for the streams to end, and then closes the connections of those
+// still open, which ends them with the GOAWAY for their clients.
+func shutdownH2(server *http.Server, stopStreams context.CancelCauseFunc) error {
+	defer serverLog.Info("server: finished shutting down")
+	timeoutCtx, cancelFunc := context.WithTimeout(context.Background(), h2Grace)
+	defer cancelFunc()
+	err := server.Shutdown(timeoutCtx)
+	if err == nil {
+		return nil
+	}
+	serverLog.Info("server: closing streams still open after grace", "grace", h2Grace)
+	err = server.Close()
+	stopStreams(errServerShutdown)
+	return err
+}
@@ -0,0 +1,35 @@
+//go:build go1.24
+
+package main
+
+import "net/http"
+
+const h2ConfigSupported = true
+
+// h2Config returns the HTTP/2 config of the settings of the run.
+func h2Config() *http.HTTP2Config {
+	return &http.HTTP2Config{
+		MaxConcurrentStreams:          h2MaxConcurrentStreams,
+		MaxReadFrameSize:              int(h2MaxFrameSize),
+		MaxReceiveBufferPerConnection: int(h2ConnWindow),
+		MaxReceiveBufferPerStream:     int(h2StreamWindow),
+	}
+}
+
+func configureH2Server(server *http.Server) {
+	server.HTTP2 = h2Config()
+	if h2c {
+		server.Protocols = new(http.Protocols)
+		server.Protocols.SetHTTP1(true)
+		server.Protocols.SetUnencryptedHTTP2(true)
+	}
+}
+
+func configureH2Transport(transport *http.Transport) {
+	transport.HTTP2 = h2Config()
+	if h2c {
+		// with prior knowledge, as there is no TLS to negotiate HTTP/2 with
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !go1.24
+
+package main
+
+import "net/http"
+
+const h2ConfigSupported = false
+
+func configureH2Server(server *http.Server) {}
+
+func configureH2Transport(transport *http.Transport) {}
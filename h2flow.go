@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"expvar"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// With h2Windows h2c mode follows the frames of its connections on the wire,
+// which TLS would hide, as the framer of net/http is not exposed. Following
+// them tells the flow control
+// windows of every connection and of its streams, in both directions: a
+// window is exhausted once the data sent used it up, and the sender then
+// waits for the receiver to consume data and open the window again with a
+// WINDOW_UPDATE, so streams stalled that way stall on flow control rather
+// than on the application. Every exhaustion is counted as a window stall, and
+// the time until the window opens again as blocked, per direction, send for
+// the data of the side and recv for that of its peer, and per level, stream
+// or connection. The windows of the open connections are published as
+// h2windows at /debug/vars, with the occupancy of each, the share of its
+// largest size in use.
+var h2Windows = false
+
+const (
+	h2ClientPreface  = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+	h2FrameHeaderLen = 9
+	// h2DefaultWindow is the initial size of every window before the
+	// settings of the receiver change that of its streams
+	h2DefaultWindow = 65535
+
+	h2FrameData         = 0x0
+	h2FrameHeaders      = 0x1
+	h2FrameRSTStream    = 0x3
+	h2FrameSettings     = 0x4
+	h2FrameWindowUpdate = 0x8
+
+	h2FlagEndStream = 0x1
+	h2FlagAck       = 0x1
+
+	h2SettingInitialWindowSize = 0x4
+)
+
+// h2Frame is a frame as followed on the wire, with the payload of only the
+// frames whose content matters for flow control.
+type h2Frame struct {
+	length  int
+	typ     byte
+	flags   byte
+	stream  uint32
+	payload []byte
+}
+
+// h2FrameParser splits one direction of a connection into frames across the
+// writes or reads it is split into.
+type h2FrameParser struct {
+	// preface is the number of bytes of the client preface still to skip
+	preface int
+	// header is the frame header read so far
+	header []byte
+	// frame is the frame whose payload is being read, remaining the bytes
+	// of it left
+	frame     h2Frame
+	inPayload bool
+	remaining int
+}
+
+// feed parses b, passing every complete frame to frame.
+func (p *h2FrameParser) feed(b []byte, frame func(f h2Frame)) {
+	for len(b) > 0 {
+		if p.preface > 0 {
+			n := min(p.preface, len(b))
+			p.preface -= n
+			b = b[n:]
+			continue
+		}
+		if !p.inPayload {
+			n := min(h2FrameHeaderLen-len(p.header), len(b))
+			p.header = append(p.header, b[:n]...)
+			b = b[n:]
+			if len(p.header) < h2FrameHeaderLen {
+				return
+			}
+			p.frame = h2Frame{
+				length: int(p.header[0])<<16 | int(p.header[1])<<8 | int(p.header[2]),
+				typ:    p.header[3],
+				flags:  p.header[4],
+				stream: binary.BigEndian.Uint32(p.header[5:9]) & (1<<31 - 1),
+			}
+			p.header = p.header[:0]
+			p.inPayload = true
+			p.remaining = p.frame.length
+		}
+		n := min(p.remaining, len(b))
+		if p.frame.typ == h2FrameSettings || p.frame.typ == h2FrameWindowUpdate {
+			p.frame.payload = append(p.frame.payload, b[:n]...)
+		}
+		p.remaining -= n
+		b = b[n:]
+		if p.remaining == 0 {
+			frame(p.frame)
+			p.inPayload = false
+		}
+	}
+}
+
+// flowWindow is a flow control window as followed on the wire.
+type flowWindow struct {
+	available int64
+	// largest is the most ever available, taken as the size of the window
+	largest int64
+	// exhausted is when the window was used up, zero while it is open
+	exhausted time.Time
+}
+
+// h2Flow is the flow control of the data one peer of a connection sends,
+// named send or recv from the side of the connection.
+type h2Flow struct {
+	name    string
+	conn    flowWindow
+	streams map[uint32]*flowWindow
+	// initial is the initial window of streams set by the receiver
+	initial int64
+}
+
+func newH2Flow(name string) h2Flow {
+	return h2Flow{
+		name:    name,
+		conn:    flowWindow{available: h2DefaultWindow, largest: h2DefaultWindow},
+		streams: map[uint32]*flowWindow{},
+		initial: h2DefaultWindow,
+	}
+}
+
+// h2FlowConn follows the frames of an HTTP/2 connection in both directions
+// on the way through.
+type h2FlowConn struct {
+	net.Conn
+	side    string
+	metrics *metrics
+
+	mu      sync.Mutex
+	send    h2Flow
+	recv    h2Flow
+	written h2FrameParser
+	read    h2FrameParser
+}
+
+var h2FlowConns = struct {
+	mu    sync.Mutex
+	conns map[*h2FlowConn]struct{}
+}{conns: map[*h2FlowConn]struct{}{}}
+
+// newH2FlowConn follows the frames of conn of side, counting its window
+// stalls in m.
+func newH2FlowConn(conn net.Conn, side string, m *metrics) *h2FlowConn {
+	c := &h2FlowConn{
+		Conn:    conn,
+		side:    side,
+		metrics: m,
+		send:    newH2Flow("send"),
+		recv:    newH2Flow("recv"),
+	}
+	// the client starts the connection with the preface, which is not
+	// framed
+	if side == "client" {
+		c.written.preface = len(h2ClientPreface)
+	} else {
+		c.read.preface = len(h2ClientPreface)
+	}
+	h2FlowConns.mu.Lock()
+	h2FlowConns.conns[c] = struct{}{}
+	h2FlowConns.mu.Unlock()
+	return c
+}
+
+func (c *h2FlowConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.mu.Lock()
+	c.written.feed(b[:n], func(f h2Frame) { c.frame(f, &c.send, &c.recv) })
+	c.mu.Unlock()
+	return n, err
+}
+
+func (c *h2FlowConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.mu.Lock()
+	c.read.feed(b[:n], func(f h2Frame) { c.frame(f, &c.recv, &c.send) })
+	c.mu.Unlock()
+	return n, err
+}
+
+func (c *h2FlowConn) Close() error {
+	h2FlowConns.mu.Lock()
+	delete(h2FlowConns.conns, c)
+	h2FlowConns.mu.Unlock()
+	c.mu.Lock()
+	now := clk.Now()
+	for _, flow := range []*h2Flow{&c.send, &c.recv} {
+		c.unblocked(flow, "conn", &flow.conn, now)
+		for id := range flow.streams {
+			c.endStream(flow, id, now)
+		}
+	}
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// frame applies f to the flow control of the connection, where sent is the
+// flow of the data of the peer sending f and credited that of the data of
+// the other one, whose windows f may open.
+func (c *h2FlowConn) frame(f h2Frame, sent, credited *h2Flow) {
+	now := clk.Now()
+	switch f.typ {
+	case h2FrameHeaders:
+		for _, flow := range []*h2Flow{sent, credited} {
+			if _, ok := flow.streams[f.stream]; !ok {
+				flow.streams[f.stream] = &flowWindow{available: flow.initial, largest: flow.initial}
+			}
+		}
+	case h2FrameData:
+		// the whole payload counts, padding included
+		c.consume(sent, "conn", &sent.conn, int64(f.length), now)
+		if window, ok := sent.streams[f.stream]; ok {
+			c.consume(sent, "stream", window, int64(f.length), now)
+		}
+	case h2FrameWindowUpdate:
+		if len(f.payload) != 4 {
+			return
+		}
+		increment := int64(binary.BigEndian.Uint32(f.payload) & (1<<31 - 1))
+		window := &credited.conn
+		level := "conn"
+		if f.stream != 0 {
+			window = credited.streams[f.stream]
+			level = "stream"
+		}
+		if window != nil {
+			window.available += increment
+			c.opened(credited, level, window, now)
+		}
+	case h2FrameSettings:
+		if f.flags&h2FlagAck != 0 {
+			return
+		}
+		for setting := f.payload; len(setting) >= 6; setting = setting[6:] {
+			if binary.BigEndian.Uint16(setting) != h2SettingInitialWindowSize {
+				continue
+			}
+			// the change applies to the open streams as well
+			initial := int64(binary.BigEndian.Uint32(setting[2:]))
+			delta := initial - credited.initial
+			credited.initial = initial
+			for _, window := range credited.streams {
+				window.available += delta
+				if delta < 0 {
+					c.consume(credited, "stream", window, 0, now)
+				} else {
+					c.opened(credited, "stream", window, now)
+				}
+			}
+		}
+	case h2FrameRSTStream:
+		c.endStream(sent, f.stream, now)
+		c.endStream(credited, f.stream, now)
+		return
+	}
+	if (f.typ == h2FrameHeaders || f.typ == h2FrameData) && f.flags&h2FlagEndStream != 0 {
+		c.endStream(sent, f.stream, now)
+	}
+}
+
+// consume takes n bytes sent from window of flow at level, counting a stall
+// if that exhausts it.
+func (c *h2FlowConn) consume(flow *h2Flow, level string, window *flowWindow, n int64, now time.Time) {
+	window.available -= n
+	if window.available <= 0 && window.exhausted.IsZero() {
+		window.exhausted = now
+		c.metrics.windowStalled(flow.name+"_"+level, now)
+	}
+}
+
+// opened counts the time window of flow at level was blocked once it is
+// open again.
+func (c *h2FlowConn) opened(flow *h2Flow, level string, window *flowWindow, now time.Time) {
+	window.largest = max(window.largest, window.available)
+	if window.available > 0 {
+		c.unblocked(flow, level, window, now)
+	}
+}
+
+// unblocked counts the time window of flow at level was blocked until now,
+// if it was.
+func (c *h2FlowConn) unblocked(flow *h2Flow, level string, window *flowWindow, now time.Time) {
+	if !window.exhausted.IsZero() {
+		c.metrics.windowBlocked(flow.name+"_"+level, now.Sub(window.exhausted), now)
+		window.exhausted = time.Time{}
+	}
+}
+
+// endStream stops following the stream id of flow, counting the time it was
+// blocked until then.
+func (c *h2FlowConn) endStream(flow *h2Flow, id uint32, now time.Time) {
+	window, ok := flow.streams[id]
+	if !ok {
+		return
+	}
+	c.unblocked(flow, "stream", window, now)
+	delete(flow.streams, id)
+}
+
+// h2FlowListener follows the frames of the connections it accepts.
+type h2FlowListener struct {
+	net.Listener
+}
+
+func (l h2FlowListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newH2FlowConn(conn, "server", serverMetrics), nil
+}
+
+// dialH2Flow wraps dial to follow the frames of the connections it dials.
+func dialH2Flow(dial func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		return newH2FlowConn(conn, "client", clientMetrics), nil
+	}
+}
+
+// windowVars is a flow control window as published with expvar.
+type windowVars struct {
+	Available int64
+	Occupancy float64
+}
+
+func (w *flowWindow) vars() windowVars {
+	v := windowVars{Available: w.available}
+	if w.largest > 0 {
+		v.Occupancy = 1 - float64(max(w.available, 0))/float64(w.largest)
+	}
+	return v
+}
+
+type flowVars struct {
+	Conn    windowVars
+	Streams map[uint32]windowVars
+}
+
+func (f *h2Flow) vars() flowVars {
+	v := flowVars{Conn: f.conn.vars(), Streams: map[uint32]windowVars{}}
+	for id, window := range f.streams {
+		v.Streams[id] = window.vars()
+	}
+	return v
+}
+
+type h2ConnVars struct {
+	Side   string
+	Local  string
+	Remote string
+	Send   flowVars
+	Recv   flowVars
+}
+
+func init() {
+	expvar.Publish("h2windows", expvar.Func(func() any {
+		h2FlowConns.mu.Lock()
+		conns := make([]*h2FlowConn, 0, len(h2FlowConns.conns))
+		for c := range h2FlowConns.conns {
+			conns = append(conns, c)
+		}
+		h2FlowConns.mu.Unlock()
+		vars := make([]h2ConnVars, 0, len(conns))
+		for _, c := range conns {
+			c.mu.Lock()
+			vars = append(vars, h2ConnVars{
+				Side:   c.side,
+				Local:  c.LocalAddr().String(),
+				Remote: c.RemoteAddr().String(),
+				Send:   c.send.vars(),
+				Recv:   c.recv.vars(),
+			})
+			c.mu.Unlock()
+		}
+		sort.Slice(vars, func(i, j int) bool {
+			if vars[i].Side != vars[j].Side {
+				return vars[i].Side < vars[j].Side
+			}
+			return vars[i].Local < vars[j].Local
+		})
+		return vars
+	}))
+}
@@ -0,0 +1,11 @@
+//go:build go1.27
+
+package main
+
+import "net/http"
+
+const h2PrioritySupported = true
+
+func configureH2Priority(server *http.Server) {
+	server.DisableClientPriority = h2DisableClientPriority
+}
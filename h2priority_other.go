@@ -0,0 +1,9 @@
+//go:build !go1.27
+
+package main
+
+import "net/http"
+
+const h2PrioritySupported = false
+
+func configureH2Priority(server *http.Server) {}
@@ -0,0 +1,17 @@
+//go:build go1.26
+
+package main
+
+import "net/http"
+
+// configureH2Strict keeps the multiplexed streams on a single connection,
+// waiting for the server to allow more rather than opening another.
+func configureH2Strict(transport *http.Transport) {
+	if muxStreams == 0 {
+		return
+	}
+	if transport.HTTP2 == nil {
+		transport.HTTP2 = &http.HTTP2Config{}
+	}
+	transport.HTTP2.StrictMaxConcurrentRequests = true
+}
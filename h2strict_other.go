@@ -0,0 +1,7 @@
+//go:build !go1.26
+
+package main
+
+import "net/http"
+
+func configureH2Strict(transport *http.Transport) {}
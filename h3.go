@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// In h3 mode the server serves HTTP/3 over QUIC as well, on the UDP port of
+// the number of its TCP port, with a self-signed certificate as in h2 mode,
+// and the client speaks HTTP/3 to it without verifying the certificate, so
+// that the same workloads, and the same metrics, compare HTTP/1.1, HTTP/2
+// and HTTP/3. HTTP/3 is served and spoken by quic-go, which the tool is only
+// built with given the h3 build tag, to keep it from the dependencies of
+// every other build.
+var h3 = false
+
+// checkH3 validates h3 mode against the other flags.
+func checkH3() error {
+	if !h3 {
+		return nil
+	}
+	if !h3Supported {
+		return fmt.Errorf("-h3 requires a build with -tags h3")
+	}
+	if h2 {
+		return fmt.Errorf("-h3 does not combine with -h2 or -h2c")
+	}
+	if tcpInfoInterval > 0 || evictBacklog > 0 {
+		return fmt.Errorf("-tcp-info-interval and -evict-backlog do not combine with -h3, whose connections are not TCP")
+	}
+	return nil
+}
+
+// setProto sets the protocol the server serves and the client streams with
+// -proto, h1 for HTTP/1.1, h2 as -h2 and h3 as -h3, failing for h3 in a
+// build without it.
+func setProto(s string) error {
+	switch s {
+	case "h1":
+		h2, h2c, h3 = false, false, false
+	case "h2":
+		h2, h3 = true, false
+	case "h3":
+		if !h3Supported {
+			return fmt.Errorf("h3 requires a build with -tags h3, this one speaks h1 and h2 only")
+		}
+		h2, h2c, h3 = false, false, true
+	default:
+		return fmt.Errorf("expected one of h1, h2, h3, got %q", s)
+	}
+	return nil
+}
+
+// h3ResponseWriter is a response writer of quic-go, whose streams are full
+// duplex from the start, so enabling it for net/http always succeeds.
+type h3ResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w h3ResponseWriter) EnableFullDuplex() error {
+	return nil
+}
+
+func (w h3ResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// h3Handler returns handler serving the streams of quic-go.
+func h3Handler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		handler.ServeHTTP(h3ResponseWriter{writer}, request)
+	})
+}
@@ -0,0 +1,69 @@
+//go:build h3
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+const h3Supported = true
+
+// serveH3 serves handler with HTTP/3 on the UDP address until ctx is done.
+func serveH3(ctx context.Context, address string, handler http.Handler) error {
+	config, err := h2TLSConfig()
+	if err != nil {
+		return fmt.Errorf("server: failed to set up tls, error was: %w", err)
+	}
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return fmt.Errorf("server: failed to listen for quic, error was: %w", err)
+	}
+	defer conn.Close()
+	server := http3.Server{
+		Handler:   h3Handler(handler),
+		TLSConfig: http3.ConfigureTLSConfig(config),
+		ConnContext: func(ctx context.Context, _ quic.Connection) context.Context {
+			return withNegotiated(ctx)
+		},
+	}
+	stop := context.AfterFunc(ctx, func() {
+		serverLog.Info("server: context was done, closing http3 server")
+		server.Close()
+	})
+	defer stop()
+	err = server.Serve(conn)
+	if ctx.Err() != nil || errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// newH3Transport returns the transport of the client in h3 mode.
+func newH3Transport() http.RoundTripper {
+	return &http3.RoundTripper{
+		TLSClientConfig: clientTLSConfig(),
+		Dial:            dialH3,
+	}
+}
+
+// dialH3 dials a QUIC connection for the request of ctx, telling its client
+// trace it got a new one, which the transport of quic-go does not.
+func dialH3(ctx context.Context, address string, tlsConfig *tls.Config, config *quic.Config) (quic.EarlyConnection, error) {
+	conn, err := quic.DialAddrEarly(ctx, address, tlsConfig, config)
+	if err != nil {
+		return nil, err
+	}
+	if trace := httptrace.ContextClientTrace(ctx); trace != nil && trace.GotConn != nil {
+		trace.GotConn(httptrace.GotConnInfo{})
+	}
+	return conn, nil
+}
@@ -0,0 +1,19 @@
+//go:build !h3
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+const h3Supported = false
+
+func serveH3(ctx context.Context, address string, handler http.Handler) error {
+	return errors.New("server: built without http3, build with -tags h3")
+}
+
+func newH3Transport() http.RoundTripper {
+	return nil
+}
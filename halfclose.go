@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The halfclose workload has the client send halfCloseMessages numbered
+// messages at once and then close the request body, half-closing the stream,
+// while the server takes halfCloseWork to answer each. So most answers are
+// streamed after the client stopped sending, and the server ends the
+// response only once it answered all of them. The client checks that every
+// message was answered, in order, before the response ended, counting the
+// answers received after the half-close, and starts over with a new stream.
+var (
+	halfCloseMessages = 10
+	halfCloseWork     = 50 * time.Millisecond
+)
+
+// halfCloseStats are the counts of the halfclose workload on the client,
+// published with expvar.
+type halfCloseStats struct {
+	Streams  int64
+	Answered int64
+	// AfterHalfClose is the number of answers received after the client
+	// closed the request body
+	AfterHalfClose int64
+	// OutOfOrder and Missing are the answers received after one for a later
+	// message, and the messages never answered before the response ended
+	OutOfOrder int64
+	Missing    int64
+}
+
+var halfCloseCounts = struct {
+	mu    sync.Mutex
+	stats halfCloseStats
+}{}
+
+func init() {
+	expvar.Publish("halfclose", expvar.Func(func() any {
+		halfCloseCounts.mu.Lock()
+		defer halfCloseCounts.mu.Unlock()
+		return halfCloseCounts.stats
+	}))
+}
+
+func serveHalfClose(ctx context.Context, stream *serverStream) {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	defer cancelFunc()
+
+	queue := make(chan requestMsg, halfCloseMessages)
+	var halfClosed atomic.Bool
+	go func() {
+		defer close(queue)
+		for {
+			var inMsg requestMsg
+			err := stream.recv(&inMsg)
+			if err != nil {
+				if ctx.Err() == nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+					stream.log.Error("server: failed to receive request message from client", "error", err)
+					cancelFunc()
+				}
+				halfClosed.Store(true)
+				return
+			}
+			select {
+			case queue <- inMsg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	answeredAfter := 0
+	for inMsg := range queue {
+		select {
+		case <-ctx.Done():
+			return
+		case <-clk.After(halfCloseWork):
+		}
+		err := stream.send(responseMsg{Msg: "answer", Seq: inMsg.Seq})
+		if err != nil {
+			stream.log.Error("server: failed to send answer to client", "error", err)
+			return
+		}
+		if halfClosed.Load() {
+			answeredAfter++
+		}
+	}
+	if ctx.Err() == nil {
+		stream.log.Info("server: answered all messages of half-closed stream", "answered_after_half_close", answeredAfter)
+	}
+}
+
+func driveHalfClose(ctx context.Context, address string) error {
+	for ctx.Err() == nil {
+		err := runStream(ctx, address, runHalfCloseStream)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runHalfCloseStream(ctx context.Context, stream *clientStream) error {
+	stop := context.AfterFunc(ctx, func() { stream.resp.Body.Close() })
+	defer stop()
+
+	sentAt := make([]time.Time, halfCloseMessages)
+	// unix nanoseconds of the half-close, zero before it
+	var halfClosed atomic.Int64
+	sent := make(chan error, 1)
+	go func() {
+		for i := range sentAt {
+			sentAt[i] = clk.Now()
+			err := stream.send(requestMsg{Msg: "job", Seq: stream.seq(int64(i + 1))})
+			if err != nil {
+				sent <- fmt.Errorf("client: failed to send message to server, error was: %w", err)
+				return
+			}
+		}
+		halfClosed.Store(clk.Now().UnixNano())
+		sent <- stream.closeSend()
+	}()
+
+	stats := halfCloseStats{Streams: 1}
+	var last int64
+	for {
+		var in responseMsg
+		err := stream.recv(&in)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if !errors.Is(err, io.EOF) {
+				return fmt.Errorf("failed to decode response message from server, error was: %w", err)
+			}
+			break
+		}
+		received := clk.Now()
+		stats.Answered++
+		if closed := halfClosed.Load(); closed != 0 && received.UnixNano() > closed {
+			stats.AfterHalfClose++
+		}
+		seq := stream.seqNumber(in.Seq)
+		if seq <= last || seq > int64(halfCloseMessages) {
+			stats.OutOfOrder++
+			continue
+		}
+		last = seq
+		clientMetrics.observeLatency(received.Sub(sentAt[seq-1]))
+	}
+	// the response only ends after the request body did
+	err := <-sent
+	if err != nil {
+		return err
+	}
+	stats.Missing = int64(halfCloseMessages) - (stats.Answered - stats.OutOfOrder)
+
+	halfCloseCounts.mu.Lock()
+	halfCloseCounts.stats.Streams++
+	halfCloseCounts.stats.Answered += stats.Answered
+	halfCloseCounts.stats.AfterHalfClose += stats.AfterHalfClose
+	halfCloseCounts.stats.OutOfOrder += stats.OutOfOrder
+	halfCloseCounts.stats.Missing += stats.Missing
+	halfCloseCounts.mu.Unlock()
+	if stats.OutOfOrder > 0 || stats.Missing > 0 {
+		stream.log.Error("client: half-closed stream ended without all answers in order", "answered", stats.Answered, "out_of_order", stats.OutOfOrder, "missing", stats.Missing)
+		return nil
+	}
+	stream.log.Debug("client: half-closed stream answered in order", "answered", stats.Answered, "after_half_close", stats.AfterHalfClose)
+	return nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/bits"
+	"time"
+)
+
+// histogram records durations in log-linear buckets, in the spirit of HDR
+// histograms: values below 2^histogramSubBits nanoseconds are counted exactly,
+// larger ones in buckets of relative width below 1/2^(histogramSubBits-1).
+// Memory use is fixed no matter how many values are recorded, so percentiles
+// stay accurate over arbitrarily long runs.
+type histogram struct {
+	counts   [histogramBuckets]uint64
+	count    uint64
+	min, max time.Duration
+}
+
+const (
+	histogramSubBits  = 7
+	histogramSubCount = 1 << histogramSubBits
+	histogramHalf     = histogramSubCount / 2
+	histogramBuckets  = histogramSubCount + (64-histogramSubBits)*histogramHalf
+)
+
+func histogramIndex(v uint64) int {
+	if v < histogramSubCount {
+		return int(v)
+	}
+	shift := bits.Len64(v) - histogramSubBits
+	return histogramSubCount + (shift-1)*histogramHalf + int(v>>shift) - histogramHalf
+}
+
+// histogramValue returns the midpoint of the values counted in bucket i.
+func histogramValue(i int) uint64 {
+	if i < histogramSubCount {
+		return uint64(i)
+	}
+	shift := (i-histogramSubCount)/histogramHalf + 1
+	sub := uint64((i-histogramSubCount)%histogramHalf + histogramHalf)
+	return sub<<shift + (1<<shift)/2
+}
+
+func (h *histogram) record(d time.Duration) {
+	h.recordN(d, 1)
+}
+
+func (h *histogram) recordN(d time.Duration, n uint64) {
+	if n == 0 {
+		return
+	}
+	if d < 0 {
+		d = 0
+	}
+	if h.count == 0 || d < h.min {
+		h.min = d
+	}
+	if h.count == 0 || d > h.max {
+		h.max = d
+	}
+	h.counts[histogramIndex(uint64(d))] += n
+	h.count += n
+}
+
+func (h *histogram) merge(other *histogram) {
+	if other.count == 0 {
+		return
+	}
+	if h.count == 0 || other.min < h.min {
+		h.min = other.min
+	}
+	if h.count == 0 || other.max > h.max {
+		h.max = other.max
+	}
+	for i, c := range other.counts {
+		h.counts[i] += c
+	}
+	h.count += other.count
+}
+
+func (h *histogram) reset() {
+	*h = histogram{}
+}
+
+// quantile returns the value below which the fraction q of the recorded
+// values lie, within the precision of the buckets.
+func (h *histogram) quantile(q float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	return h.atRank(uint64(q*float64(h.count-1)) + 1)
+}
+
+// atRank returns the value of the rank-th smallest recorded value, counting
+// from 1, within the precision of the buckets.
+func (h *histogram) atRank(rank uint64) time.Duration {
+	var seen uint64
+	for i, c := range h.counts {
+		seen += c
+		if seen >= rank {
+			v := time.Duration(histogramValue(i))
+			return min(max(v, h.min), h.max)
+		}
+	}
+	return h.max
+}
+
+// mean and stddev are estimated from the bucket midpoints.
+func (h *histogram) mean() float64 {
+	if h.count == 0 {
+		return 0
+	}
+	var sum float64
+	for i, c := range h.counts {
+		if c != 0 {
+			sum += float64(c) * float64(histogramValue(i))
+		}
+	}
+	return sum / float64(h.count)
+}
+
+func (h *histogram) stddev() float64 {
+	if h.count < 2 {
+		return 0
+	}
+	mean := h.mean()
+	var sumSq float64
+	for i, c := range h.counts {
+		if c != 0 {
+			d := float64(histogramValue(i)) - mean
+			sumSq += float64(c) * d * d
+		}
+	}
+	return math.Sqrt(sumSq / float64(h.count-1))
+}
+
+// histogramJSON is the sparse json representation of a histogram, listing
+// only the non-empty buckets by their midpoint.
+type histogramJSON struct {
+	Count    uint64
+	Min, Max time.Duration
+	Buckets  []histogramBucket
+}
+
+type histogramBucket struct {
+	Value time.Duration
+	Count uint64
+}
+
+func (h histogram) MarshalJSON() ([]byte, error) {
+	out := histogramJSON{Count: h.count, Min: h.min, Max: h.max, Buckets: []histogramBucket{}}
+	for i, c := range h.counts {
+		if c != 0 {
+			out.Buckets = append(out.Buckets, histogramBucket{Value: time.Duration(histogramValue(i)), Count: c})
+		}
+	}
+	return json.Marshal(out)
+}
+
+func (h *histogram) UnmarshalJSON(data []byte) error {
+	var in histogramJSON
+	err := json.Unmarshal(data, &in)
+	if err != nil {
+		return err
+	}
+	h.reset()
+	for _, bucket := range in.Buckets {
+		h.recordN(bucket.Value, bucket.Count)
+	}
+	if h.count != in.Count {
+		return fmt.Errorf("histogram buckets add up to %d values, expected %d", h.count, in.Count)
+	}
+	h.min = in.Min
+	h.max = in.Max
+	return nil
+}
+
+// String formats the median, the 90th and 99th percentile and the maximum.
+func (h *histogram) String() string {
+	if h.count == 0 {
+		return "none"
+	}
+	return fmt.Sprintf("p50=%v p90=%v p99=%v max=%v", h.quantile(0.5), h.quantile(0.9), h.quantile(0.99), h.max)
+}
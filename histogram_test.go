@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"testing"
+	"time"
+
+	"pgregory.net/rapid"
+)
+
+// histogramDurations generates the values of a histogram, spread over the
+// whole range of the buckets, negative ones included.
+func histogramDurations() *rapid.Generator[[]time.Duration] {
+	d := rapid.Custom(func(t *rapid.T) time.Duration {
+		shift := rapid.IntRange(0, 62).Draw(t, "shift")
+		return time.Duration(rapid.Int64Range(-1, 1<<shift).Draw(t, "value"))
+	})
+	return rapid.SliceOf(d)
+}
+
+// TestHistogramProperty checks that the count, minimum and maximum are those
+// of the values recorded, and that every quantile lies between them, grows
+// with q and is within the precision of the buckets of the exact one.
+func TestHistogramProperty(t *testing.T) {
+	rapid.Check(t, func(t *rapid.T) {
+		values := histogramDurations().Draw(t, "values")
+		var h histogram
+		for _, v := range values {
+			h.record(v)
+		}
+		if h.count != uint64(len(values)) {
+			t.Fatalf("counted %d values, recorded %d", h.count, len(values))
+		}
+		if len(values) == 0 {
+			if h.quantile(0.5) != 0 {
+				t.Fatalf("median of no values is %v", h.quantile(0.5))
+			}
+			return
+		}
+
+		sorted := make([]time.Duration, len(values))
+		for i, v := range values {
+			// negative values are recorded as 0
+			sorted[i] = max(v, 0)
+		}
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		if h.min != sorted[0] || h.max != sorted[len(sorted)-1] {
+			t.Fatalf("min %v and max %v, expected %v and %v", h.min, h.max, sorted[0], sorted[len(sorted)-1])
+		}
+
+		previous := time.Duration(0)
+		for _, q := range []float64{0, 0.1, 0.25, 0.5, 0.75, 0.9, 0.99, 0.999, 1} {
+			got := h.quantile(q)
+			if got < h.min || got > h.max {
+				t.Fatalf("quantile %v is %v, outside of %v to %v", q, got, h.min, h.max)
+			}
+			if got < previous {
+				t.Fatalf("quantile %v is %v, below the %v of a lower one", q, got, previous)
+			}
+			previous = got
+			exact := sorted[uint64(q*float64(len(sorted)-1))]
+			// the buckets are narrower than 1/2^(histogramSubBits-1) of
+			// their values, the midpoint is off by half of that at most
+			if diff := got - exact; diff > exact>>histogramSubBits || -diff > exact>>histogramSubBits {
+				t.Fatalf("quantile %v is %v, expected %v", q, got, exact)
+			}
+		}
+	})
+}
+
+// TestHistogramMergeProperty checks that merging histograms equals recording
+// the values of both into one.
+func TestHistogramMergeProperty(t *testing.T) {
+	rapid.Check(t, func(t *rapid.T) {
+		a := histogramDurations().Draw(t, "a")
+		b := histogramDurations().Draw(t, "b")
+		var merged, other, all histogram
+		for _, v := range a {
+			merged.record(v)
+			all.record(v)
+		}
+		for _, v := range b {
+			other.record(v)
+			all.record(v)
+		}
+		merged.merge(&other)
+		if merged != all {
+			t.Fatalf("merged %v, expected %v", &merged, &all)
+		}
+	})
+}
+
+// TestHistogramJSONProperty checks that a histogram survives its json form.
+func TestHistogramJSONProperty(t *testing.T) {
+	rapid.Check(t, func(t *rapid.T) {
+		var h histogram
+		for _, v := range histogramDurations().Draw(t, "values") {
+			h.record(v)
+		}
+		data, err := json.Marshal(h)
+		if err != nil {
+			t.Fatalf("failed to encode histogram, error was: %v", err)
+		}
+		var decoded histogram
+		err = json.Unmarshal(data, &decoded)
+		if err != nil {
+			t.Fatalf("failed to decode histogram, error was: %v", err)
+		}
+		if decoded != h {
+			t.Fatalf("decoded %v from %s, expected %v", &decoded, data, &h)
+		}
+	})
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// The idle workload opens idleStreams streams which stay open but only
+// exchange a heartbeat every heartbeatInterval, to measure what an idle
+// stream costs the server in memory and CPU, as opposed to throughput. The
+// heartbeats of the streams are spread out over the interval, the server's
+// measurements report heap and goroutines per active stream and CPU use.
+var (
+	idleStreams       = 1000
+	heartbeatInterval = 10 * time.Second
+)
+
+func driveIdle(ctx context.Context, address string) error {
+	eg, ctx := errgroup.WithContext(ctx)
+	for i := 0; i < idleStreams; i++ {
+		eg.Go(func() error { return runStream(ctx, address, runIdleStream) })
+	}
+	return eg.Wait()
+}
+
+func runIdleStream(ctx context.Context, stream *clientStream) error {
+	stop := context.AfterFunc(ctx, func() { stream.resp.Body.Close() })
+	defer stop()
+
+	next := clk.Now().Add(time.Duration(rand.Int63n(int64(heartbeatInterval))))
+	for {
+		err := clk.Sleep(ctx, next.Sub(clk.Now()))
+		if err != nil {
+			return nil
+		}
+		next = next.Add(heartbeatInterval)
+
+		sent := clk.Now()
+		err = stream.send(requestMsg{Msg: "heartbeat"})
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("client: failed to send heartbeat to server, error was: %w", err)
+		}
+		var in responseMsg
+		err = stream.recv(&in)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("failed to decode response message from server, error was: %w", err)
+		}
+		clientMetrics.observeLatency(clk.Now().Sub(sent))
+	}
+}
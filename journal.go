@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// With journalDir the server appends every message it receives to a journal
+// of its stream in that directory, and with sendLogDir the client every
+// message it sends to its send log, so that after a crash of either side
+// verify mode tells the messages lost from those sent. Journals and send logs
+// are ndjson files named by the run, and journals by the stream as well,
+// rotated to a new segment once one reaches journalMaxSize. Every record is
+// written to its file as it is taken, unbuffered, so it survives a crash of
+// the process, though not necessarily one of the machine.
+var (
+	journalDir     = ""
+	sendLogDir     = ""
+	journalMaxSize = byteSize(64 << 20)
+)
+
+// sendLog is the send log of the client process, shared by its streams, nil
+// without sendLogDir.
+var sendLog *journal
+
+const (
+	journalPrefix = "received-"
+	sendLogPrefix = "sent-"
+	journalSuffix = ".ndjson"
+	// verifyListed is how many of the lost messages of a sequence space
+	// verify mode lists
+	verifyListed = 5
+)
+
+// journalRecord is a line of a journal or a send log.
+type journalRecord struct {
+	Time time.Time
+	Seq  int64 `json:",omitempty"`
+	Msg  json.RawMessage
+}
+
+// journal is the journal of a stream or the send log of the client, nil
+// unless enabled.
+type journal struct {
+	mu      sync.Mutex
+	dir     string
+	name    string
+	segment int
+	file    *os.File
+	size    int64
+	log     *slog.Logger
+	// failed is set once writing failed, which stops the journal rather
+	// than the stream
+	failed bool
+}
+
+// newJournal returns the journal named name in dir, logging to log, nil if
+// dir is empty. The file of its first segment is created with the first
+// record.
+func newJournal(dir string, name string, log *slog.Logger) *journal {
+	if dir == "" {
+		return nil
+	}
+	return &journal{dir: dir, name: name, log: log}
+}
+
+// record appends msg to the journal.
+func (j *journal) record(msg any) {
+	if j == nil {
+		return
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprintf("unencodable message: %v", err))
+	}
+	record := journalRecord{Time: clk.Now(), Msg: data}
+	switch msg := msg.(type) {
+	case requestMsg:
+		record.Seq = msg.Seq
+	case *requestMsg:
+		record.Seq = msg.Seq
+	}
+	line, _ := json.Marshal(record)
+	line = append(line, '\n')
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.failed {
+		return
+	}
+	err = j.write(line)
+	if err != nil {
+		j.failed = true
+		if j.file != nil {
+			j.file.Close()
+			j.file = nil
+		}
+		j.log.Error("failed to write journal, no longer journaling the stream", "journal", j.name, "error", err)
+	}
+}
+
+// write appends line to the current segment, starting the next one first
+// if line does not fit in it.
+func (j *journal) write(line []byte) error {
+	if j.file != nil && j.size+int64(len(line)) > int64(journalMaxSize) {
+		err := j.file.Close()
+		j.file = nil
+		if err != nil {
+			return err
+		}
+		j.segment++
+	}
+	if j.file == nil {
+		err := os.MkdirAll(j.dir, 0o755)
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(j.dir, fmt.Sprintf("%s.%06d%s", j.name, j.segment, journalSuffix))
+		j.file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if err != nil {
+			return err
+		}
+		j.size = 0
+	}
+	n, err := j.file.Write(line)
+	j.size += int64(n)
+	return err
+}
+
+// close closes the file of the journal.
+func (j *journal) close() {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file != nil {
+		j.file.Close()
+		j.file = nil
+	}
+}
+
+// verifySpace is what verify mode found of a sequence space.
+type verifySpace struct {
+	space int64
+	// sent and journaled are the numbers of the messages of the space in
+	// the send logs and the journals
+	sent      map[int64]time.Time
+	journaled map[int64]int
+	// lastJournaled is when the last message of the space journaled was
+	// sent
+	lastJournaled time.Time
+}
+
+// runVerify checks the journals in journalDir against the send logs in
+// sendLogDir, matching the messages by sequence number, and reports per
+// sequence space the messages sent but never journaled. Lost messages sent
+// after the last message of their space that was journaled were likely in
+// flight when a side crashed, those sent before it are gaps; it fails on
+// gaps only.
+func runVerify(w io.Writer) error {
+	if journalDir == "" || sendLogDir == "" {
+		return fmt.Errorf("verify mode requires -journal-dir and -send-log-dir")
+	}
+	spaces := map[int64]*verifySpace{}
+	spaceOf := func(seq int64) (*verifySpace, int64) {
+		space, n := splitSeq(seq)
+		s := spaces[space]
+		if s == nil {
+			s = &verifySpace{space: space, sent: map[int64]time.Time{}, journaled: map[int64]int{}}
+			spaces[space] = s
+		}
+		return s, n
+	}
+	err := readJournals(sendLogDir, sendLogPrefix, func(record journalRecord) {
+		s, n := spaceOf(record.Seq)
+		// a message retried on a new stream keeps the time it was first
+		// sent
+		if _, ok := s.sent[n]; !ok {
+			s.sent[n] = record.Time
+		}
+	})
+	if err != nil {
+		return err
+	}
+	err = readJournals(journalDir, journalPrefix, func(record journalRecord) {
+		s, n := spaceOf(record.Seq)
+		s.journaled[n]++
+	})
+	if err != nil {
+		return err
+	}
+	if len(spaces) == 0 {
+		return fmt.Errorf("found no numbered messages in %s and %s", sendLogDir, journalDir)
+	}
+
+	ordered := make([]*verifySpace, 0, len(spaces))
+	for _, s := range spaces {
+		for n := range s.journaled {
+			if sent, ok := s.sent[n]; ok && sent.After(s.lastJournaled) {
+				s.lastJournaled = sent
+			}
+		}
+		ordered = append(ordered, s)
+	}
+	sort.Slice(ordered, func(i, j int) bool { return ordered[i].space < ordered[j].space })
+
+	out := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(out, "instance\tstream\tsent\tjournaled\tduplicates\tunsent\tlost in flight\tgaps\tfirst lost")
+	var gaps int
+	for _, s := range ordered {
+		var duplicates, unsent, inFlight int
+		var lost []int64
+		for n, count := range s.journaled {
+			if count > 1 {
+				duplicates += count - 1
+			}
+			if _, ok := s.sent[n]; !ok {
+				unsent++
+			}
+		}
+		for n := range s.sent {
+			if s.journaled[n] == 0 {
+				lost = append(lost, n)
+			}
+		}
+		sort.Slice(lost, func(i, j int) bool { return lost[i] < lost[j] })
+		spaceGaps := 0
+		for _, n := range lost {
+			if s.sent[n].After(s.lastJournaled) {
+				inFlight++
+			} else {
+				spaceGaps++
+			}
+		}
+		gaps += spaceGaps
+		listed := make([]string, 0, verifyListed)
+		for _, n := range lost[:min(len(lost), verifyListed)] {
+			listed = append(listed, fmt.Sprint(n))
+		}
+		if len(lost) > verifyListed {
+			listed = append(listed, "...")
+		}
+		fmt.Fprintf(out, "%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%s\n",
+			s.space>>seqStreamBits, s.space&(1<<seqStreamBits-1),
+			len(s.sent), len(s.journaled), duplicates, unsent, inFlight, spaceGaps, strings.Join(listed, " "))
+	}
+	out.Flush()
+	if gaps > 0 {
+		return fmt.Errorf("%d messages sent were lost before the last message journaled", gaps)
+	}
+	return nil
+}
+
+// readJournals calls f with the records of numbered messages of the files
+// in dir named with prefix, in no particular order. A file may end in a
+// record torn by a crash, which is skipped.
+func readJournals(dir string, prefix string, f func(journalRecord)) error {
+	paths, err := filepath.Glob(filepath.Join(dir, prefix+"*"+journalSuffix))
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("found no files named %s*%s in %s", prefix, journalSuffix, dir)
+	}
+	for _, path := range paths {
+		err := readJournal(path, f)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readJournal(path string, f func(journalRecord)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open journal, error was: %w", err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	var torn error
+	for scanner.Scan() {
+		if torn != nil {
+			return fmt.Errorf("failed to decode record of %s, error was: %w", path, torn)
+		}
+		var record journalRecord
+		err := json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			// only the last record may be torn
+			torn = err
+			continue
+		}
+		if record.Seq != 0 {
+			f(record)
+		}
+	}
+	if torn != nil {
+		slog.Warn("journal ends in a torn record, skipping it", "file", path, "error", torn)
+	}
+	err = scanner.Err()
+	if err != nil {
+		return fmt.Errorf("failed to read %s, error was: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// With -jwt-secret the server only accepts streams opened with a bearer
+// token signed with the secret using HS256, and the client mints such tokens
+// valid for jwtTTL. Shortly before the token of a stream expires the server
+// asks for a new one with a reauth message, the client answers with an auth
+// message carrying a fresh token, and streams whose token expires without
+// being renewed are closed with an error message.
+var (
+	jwtSecret    []byte
+	jwtSubject   = "client"
+	jwtTTL       = 1 * time.Minute
+	reauthBefore = 10 * time.Second
+)
+
+var errCredentialsExpired = errors.New("stream credentials expired")
+
+type jwtClaims struct {
+	Subject   string `json:"sub"`
+	Tenant    string `json:"tenant,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+func setJWTSecret(s string) error {
+	if s == "" {
+		return fmt.Errorf("jwt secret must not be empty")
+	}
+	jwtSecret = []byte(s)
+	return nil
+}
+
+func jwtSignature(signingInput string) string {
+	mac := hmac.New(sha256.New, jwtSecret)
+	mac.Write([]byte(signingInput))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// mintToken returns a token for subject valid for jwtTTL from now.
+func mintToken(subject string, now time.Time) (string, error) {
+	claims, err := json.Marshal(jwtClaims{
+		Subject:   subject,
+		Tenant:    clientTenant,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(jwtTTL).Unix(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode token claims, error was: %w", err)
+	}
+	signingInput := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(claims)
+	return signingInput + "." + jwtSignature(signingInput), nil
+}
+
+// parseToken returns the claims of token if it is signed with jwtSecret and
+// not expired at now.
+func parseToken(token string, now time.Time) (jwtClaims, error) {
+	var claims jwtClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, fmt.Errorf("malformed token")
+	}
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return claims, fmt.Errorf("malformed token header, error was: %w", err)
+	}
+	var alg struct {
+		Alg string `json:"alg"`
+	}
+	err = json.Unmarshal(header, &alg)
+	if err != nil || alg.Alg != "HS256" {
+		return claims, fmt.Errorf("unsupported token algorithm %q", alg.Alg)
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(jwtSignature(parts[0]+"."+parts[1]))) {
+		return claims, fmt.Errorf("invalid token signature")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, fmt.Errorf("malformed token claims, error was: %w", err)
+	}
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return claims, fmt.Errorf("malformed token claims, error was: %w", err)
+	}
+	if !now.Before(time.Unix(claims.ExpiresAt, 0)) {
+		return claims, fmt.Errorf("token expired")
+	}
+	return claims, nil
+}
+
+// bearerToken returns the token of the Authorization header value header.
+func bearerToken(header string) (string, bool) {
+	token, ok := strings.CutPrefix(header, "Bearer ")
+	return token, ok && token != ""
+}
+
+// streamAuth tracks the credentials of one stream on the server.
+type streamAuth struct {
+	request *http.Request
+	subject string
+	tenant  string
+	// expiry of every renewed token
+	renewed chan time.Time
+}
+
+func newStreamAuth(claims jwtClaims, request *http.Request) *streamAuth {
+	return &streamAuth{request: request, subject: claims.Subject, tenant: claims.Tenant, renewed: make(chan time.Time, 1)}
+}
+
+// renew takes the token of an auth message from the client.
+func (a *streamAuth) renew(token string) {
+	claims, err := parseToken(token, clk.Now())
+	if err == nil && claims.Subject != a.subject {
+		err = fmt.Errorf("token is for subject %q instead of %q", claims.Subject, a.subject)
+	}
+	if err == nil && claims.Tenant != a.tenant {
+		err = fmt.Errorf("token is for tenant %q instead of %q", claims.Tenant, a.tenant)
+	}
+	if err != nil {
+		serverLog.Warn("server: rejected token renewing stream credentials", "subject", a.subject, "error", err)
+		audit("reauth_failure", a.request, "subject", a.subject, "error", err.Error())
+		return
+	}
+	audit("reauth_success", a.request, "subject", a.subject, "expires", time.Unix(claims.ExpiresAt, 0))
+	select {
+	case a.renewed <- time.Unix(claims.ExpiresAt, 0):
+	default:
+		// a renewal is already pending, which will do as well
+	}
+}
+
+// enforce asks the client for a new token reauthBefore the current one
+// expires at expiry, and cancels the stream with errCredentialsExpired if it
+// expires before being renewed.
+func (a *streamAuth) enforce(ctx context.Context, stream *serverStream, expiry time.Time, cancel context.CancelCauseFunc) {
+	for {
+		reauth := clk.NewTimer(expiry.Add(-reauthBefore).Sub(clk.Now()))
+		expired := clk.NewTimer(expiry.Sub(clk.Now()))
+		select {
+		case <-ctx.Done():
+		case <-reauth.C():
+			err := stream.sendControl(responseMsg{Msg: "reauth"})
+			if err != nil {
+				stream.log.Warn("server: failed to ask client for new token", "error", err)
+			}
+			select {
+			case <-ctx.Done():
+			case <-expired.C():
+				stream.log.Info("server: closing stream as its credentials expired", "subject", a.subject)
+				cancel(errCredentialsExpired)
+			case expiry = <-a.renewed:
+			}
+		case expiry = <-a.renewed:
+		}
+		reauth.Stop()
+		expired.Stop()
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// decodeIntercepting decodes the next message of dec into v, except that
+// messages intercept takes as control messages are left to it instead, and
+// the next message is decoded.
+func decodeIntercepting(dec *json.Decoder, v any, intercept func(msg requestMsg) bool) error {
+	for {
+		var raw json.RawMessage
+		err := decodeMessage(dec, &raw)
+		if err != nil {
+			return err
+		}
+		var peek requestMsg
+		if json.Unmarshal(raw, &peek) == nil && intercept(peek) {
+			continue
+		}
+		return json.Unmarshal(raw, v)
+	}
+}
+
+// reauth answers a reauth message of the server with a fresh token.
+func (s *clientStream) reauth() {
+	token, err := mintToken(jwtSubject, clk.Now())
+	if err == nil {
+		err = s.sendControl(requestMsg{Msg: "auth", Value: token})
+	}
+	if err != nil {
+		s.log.Warn("client: failed to renew stream credentials", "error", err)
+		return
+	}
+	s.log.Debug("client: renewed stream credentials")
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// With SSLKEYLOGFILE set, the client and the server append the secrets of
+// their TLS sessions, in h2 and h3 mode, to that file in the NSS key log
+// format, as browsers do, so that Wireshark can decrypt a capture of the
+// duplex traffic. It is for debugging only: anyone with the file can read
+// the traffic.
+const keyLogEnv = "SSLKEYLOGFILE"
+
+// keyLogWriter returns the key log of the TLS configs of the run, nil
+// without SSLKEYLOGFILE.
+var keyLogWriter = sync.OnceValue(func() io.Writer {
+	path := os.Getenv(keyLogEnv)
+	if path == "" {
+		return nil
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		slog.Warn("run: failed to open tls key log, not logging tls secrets", "path", path, "error", err)
+		return nil
+	}
+	slog.Warn("run: logging tls secrets, anyone with the key log can decrypt the traffic", "path", path)
+	return file
+})
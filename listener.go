@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+)
+
+var (
+	// reusePort sets SO_REUSEPORT on the listening socket, so a new server
+	// can listen on the same address before the old one stops
+	reusePort = false
+	// handoffOnHangup makes the server pass its listening socket to a new
+	// instance of itself on SIGHUP and then shut down
+	handoffOnHangup = false
+)
+
+// a listening socket is inherited as file descriptor 3, announced by
+// LISTEN_FDS as with systemd socket activation
+const (
+	listenFdsEnv = "LISTEN_FDS"
+	listenFd     = 3
+)
+
+// errHandedOff ends a server which passed its listener on to a new instance.
+var errHandedOff = errors.New("listener handed off to new server instance")
+
+// listen returns the listener inherited from a previous instance if there is
+// one, otherwise listens on hostPort, or on unixSocket if set.
+func listen(ctx context.Context, hostPort string) (net.Listener, error) {
+	ln, err := listenTCP(ctx, hostPort)
+	if err != nil {
+		return nil, err
+	}
+	if nagle {
+		ln = &nagleListener{Listener: ln}
+	}
+	ln = &socketErrListener{Listener: ln}
+	if capture != nil {
+		ln = &captureListener{Listener: ln}
+	}
+	if proxyProtocol {
+		ln = &proxyListener{Listener: ln}
+	}
+	return ln, nil
+}
+
+func listenTCP(ctx context.Context, hostPort string) (net.Listener, error) {
+	if os.Getenv(listenFdsEnv) == "1" {
+		// only the first server of this process takes over the listener
+		os.Unsetenv(listenFdsEnv)
+		file := os.NewFile(listenFd, "listener")
+		defer file.Close()
+		ln, err := net.FileListener(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to use inherited listener, error was: %w", err)
+		}
+		serverLog.Info("server: listening on inherited listener", "address", ln.Addr())
+		return ln, nil
+	}
+
+	if unixSocket != "" {
+		return listenUnix(ctx)
+	}
+	var lc net.ListenConfig
+	if reusePort {
+		lc.Control = setReusePort
+	}
+	return lc.Listen(ctx, "tcp", hostPort)
+}
+
+// handoff starts a new instance of this binary with the same arguments,
+// passing it ln, so it accepts the connections to ln from now on.
+func handoff(ln net.Listener) error {
+	if proxyListener, ok := ln.(*proxyListener); ok {
+		ln = proxyListener.Listener
+	}
+	if captureListener, ok := ln.(*captureListener); ok {
+		ln = captureListener.Listener
+	}
+	if socketErrListener, ok := ln.(*socketErrListener); ok {
+		ln = socketErrListener.Listener
+	}
+	if nagleListener, ok := ln.(*nagleListener); ok {
+		ln = nagleListener.Listener
+	}
+	var file *os.File
+	var err error
+	switch ln := ln.(type) {
+	case *net.TCPListener:
+		file, err = ln.File()
+	case *net.UnixListener:
+		// the socket file stays for the new instance once this one closes
+		// the listener
+		ln.SetUnlinkOnClose(false)
+		file, err = ln.File()
+	default:
+		return fmt.Errorf("cannot hand off listener of type %T", ln)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get file of listener, error was: %w", err)
+	}
+	defer file.Close()
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate own executable, error was: %w", err)
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{file}
+	cmd.Env = append(os.Environ(), listenFdsEnv+"=1")
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("failed to start new server instance, error was: %w", err)
+	}
+	serverLog.Info("server: handed listener off to new instance", "pid", cmd.Process.Pid)
+	return nil
+}
+
+// handoffOnSignal hands ln off on SIGHUP and returns errHandedOff, to shut
+// this server down, once it has.
+func handoffOnSignal(ctx context.Context, ln net.Listener) error {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-hangup:
+			err := handoff(ln)
+			if err != nil {
+				serverLog.Error("server: failed to hand off listener", "error", err)
+				continue
+			}
+			return errHandedOff
+		}
+	}
+}
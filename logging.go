@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"sync/atomic"
+)
+
+// The client and the server log through loggers of their own, so either can
+// be turned up, down or off on its own, such as the server of a demo run to
+// follow only the client. They log at -log-level unless set apart with
+// clientLogLevel and serverLogLevel. Every stream logs through a logger of
+// its side carrying the id of the stream, so the lines of one stream can be
+// picked out of those of many.
+var (
+	clientLog = slog.Default()
+	serverLog = slog.Default()
+	// the levels of the sides, nil for -log-level
+	clientLogLevel *slog.Level
+	serverLogLevel *slog.Level
+)
+
+// logOff is a level above any message, to turn a logger off.
+const logOff = slog.Level(1 << 10)
+
+// clientStreamIDs numbers the streams of the client, as the registry does
+// those of the server.
+var clientStreamIDs atomic.Int64
+
+func setClientLogLevel(s string) error {
+	return setSideLogLevel(&clientLogLevel, s)
+}
+
+func setServerLogLevel(s string) error {
+	return setSideLogLevel(&serverLogLevel, s)
+}
+
+func setSideLogLevel(level **slog.Level, s string) error {
+	l := logOff
+	if s != "off" {
+		err := l.UnmarshalText([]byte(s))
+		if err != nil {
+			return err
+		}
+	}
+	*level = &l
+	return nil
+}
+
+func newLogHandler(level slog.Level) slog.Handler {
+	return slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		AddSource:   false,
+		Level:       level,
+		ReplaceAttr: nil,
+	})
+}
+
+// newSideLogger returns the logger of a side, at sideLevel if set.
+func newSideLogger(sideLevel *slog.Level) *slog.Logger {
+	if sideLevel == nil {
+		return slog.Default()
+	}
+	return slog.New(newLogHandler(*sideLevel))
+}
+
+// sideLog returns the logger of side, client or server.
+func sideLog(side string) *slog.Logger {
+	if side == "server" {
+		return serverLog
+	}
+	return clientLog
+}
+
+// streamLogLevel is the level of a stream of the server set apart at run
+// time from that of the server, through the streams endpoint, so the debug
+// lines of a single stream can be followed without those of every stream at
+// full rate. Unset, the stream logs at the level of the server.
+type streamLogLevel struct {
+	level atomic.Pointer[slog.Level]
+}
+
+// streamLogHandler is a handler of the logger of a stream, enabled at the
+// level of the stream if set and as the handler of its side otherwise.
+type streamLogHandler struct {
+	slog.Handler
+	level *streamLogLevel
+}
+
+func (h streamLogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	if l := h.level.level.Load(); l != nil {
+		return level >= *l
+	}
+	return h.Handler.Enabled(ctx, level)
+}
+
+func (h streamLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return streamLogHandler{Handler: h.Handler.WithAttrs(attrs), level: h.level}
+}
+
+func (h streamLogHandler) WithGroup(name string) slog.Handler {
+	return streamLogHandler{Handler: h.Handler.WithGroup(name), level: h.level}
+}
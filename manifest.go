@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"log/slog"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"time"
+)
+
+// runManifest describes the run that produced a set of measurements, so that
+// results remain interpretable long after the run.
+type runManifest struct {
+	RunID string
+	// Instance is the instance of the client in the sequence numbers of its
+	// messages
+	Instance  int64
+	Started   time.Time
+	Config    map[string]string
+	Revision  string
+	Modified  bool
+	GoVersion string
+	GOOS      string
+	GOARCH    string
+	Hostname  string
+	// HTTP2 is the HTTP/2 settings in h2 mode, nil otherwise
+	HTTP2 *http2Settings `json:",omitempty"`
+}
+
+var manifest runManifest
+
+// newRunManifest captures the effective value of every flag, the vcs revision
+// the binary was built from and the platform it runs on.
+func newRunManifest() runManifest {
+	m := runManifest{
+		Started:   clk.Now(),
+		Config:    map[string]string{},
+		GoVersion: runtime.Version(),
+		GOOS:      runtime.GOOS,
+		GOARCH:    runtime.GOARCH,
+	}
+
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	m.RunID = hex.EncodeToString(id)
+	m.Instance = runInstance(m.RunID)
+
+	flag.VisitAll(func(f *flag.Flag) {
+		m.Config[f.Name] = f.Value.String()
+	})
+
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				m.Revision = setting.Value
+			case "vcs.modified":
+				m.Modified = setting.Value == "true"
+			}
+		}
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		slog.Warn("failed to determine hostname", "error", err)
+	}
+	m.Hostname = hostname
+	if h2 {
+		settings := h2Settings()
+		m.HTTP2 = &settings
+	}
+	return m
+}
+
+func (m runManifest) LogValue() slog.Value {
+	names := make([]string, 0, len(m.Config))
+	for name := range m.Config {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	config := make([]slog.Attr, 0, len(names))
+	for _, name := range names {
+		config = append(config, slog.String(name, m.Config[name]))
+	}
+	attrs := []slog.Attr{
+		slog.String("run_id", m.RunID),
+		slog.Int64("instance", m.Instance),
+		slog.Time("started", m.Started),
+		slog.String("revision", m.Revision),
+		slog.Bool("modified", m.Modified),
+		slog.String("go_version", m.GoVersion),
+		slog.String("goos", m.GOOS),
+		slog.String("goarch", m.GOARCH),
+		slog.String("hostname", m.Hostname),
+		slog.Attr{Key: "config", Value: slog.GroupValue(config...)},
+	}
+	if m.HTTP2 != nil {
+		attrs = append(attrs, slog.Group("http2",
+			"max_concurrent_streams", m.HTTP2.MaxConcurrentStreams,
+			"stream_window", m.HTTP2.StreamWindow,
+			"conn_window", m.HTTP2.ConnWindow,
+			"max_frame_size", m.HTTP2.MaxFrameSize,
+		))
+	}
+	return slog.GroupValue(attrs...)
+}
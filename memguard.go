@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// memLimit is the heap size above which the server sheds load instead of
+// risking getting killed for running out of memory: it stops accepting new
+// streams and closes one stream per memGuardInterval, until the heap is back
+// below memResumeRatio of the limit. The heap is that in use after a
+// collection, the memory of live objects, as garbage not collected yet is
+// freed without closing anything. memShedVictim picks the stream closed:
+// largest, that buffering the most bytes as accounted for
+// /debug/streams/top, or oldest, the longest running one.
+var (
+	memLimit      byteSize
+	memShedVictim = "largest"
+)
+
+const (
+	memGuardInterval = 1 * time.Second
+	memResumeRatio   = 0.9
+)
+
+var (
+	errMemoryLimit = errors.New("server over memory limit, shedding load")
+	// shedding is set while the server rejects new streams
+	shedding atomic.Bool
+)
+
+func setMemShedVictim(s string) error {
+	if s != "largest" && s != "oldest" {
+		return fmt.Errorf("expected largest or oldest, got %q", s)
+	}
+	memShedVictim = s
+	return nil
+}
+
+func guardMemory(ctx context.Context) error {
+	if memLimit <= 0 {
+		return nil
+	}
+	ticker := clk.NewTicker(memGuardInterval)
+	defer ticker.Stop()
+	var stats runtime.MemStats
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C():
+		}
+
+		runtime.ReadMemStats(&stats)
+		if shedding.Load() || byteSize(stats.HeapInuse) > memLimit {
+			// only a collection tells what of the heap is garbage, forced
+			// while it may be over the limit
+			runtime.GC()
+			runtime.ReadMemStats(&stats)
+		}
+		heap := byteSize(stats.HeapInuse)
+		switch {
+		case heap > memLimit:
+			if !shedding.Swap(true) {
+				serverLog.Warn("server: heap over memory limit, rejecting new streams", "heap", heap, "limit", memLimit)
+			}
+			s := activeStreams.oldest()
+			if memShedVictim == "largest" {
+				s = activeStreams.largest()
+			}
+			if s != nil {
+				serverLog.Warn("server: closing "+memShedVictim+" stream to shed load", "stream", s.id, "path", s.path, "remote", s.remote, "age", clk.Since(s.started), "buffered", byteSize(s.buffers.snapshot().Total))
+				serverMetrics.streamShed()
+				s.cancel(errMemoryLimit)
+			}
+		case heap < byteSize(float64(memLimit)*memResumeRatio):
+			if shedding.Swap(false) {
+				serverLog.Info("server: heap back below memory limit, accepting new streams", "heap", heap, "limit", memLimit)
+			}
+		}
+	}
+}
+
+// byteSize is a number of bytes, settable as a flag with an optional unit
+// suffix such as 512MiB or 2GB.
+type byteSize int64
+
+var byteSizeUnits = []struct {
+	suffix string
+	factor int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9},
+	{"B", 1},
+}
+
+func (b byteSize) String() string {
+	for _, unit := range byteSizeUnits[:3] {
+		if b != 0 && int64(b)%unit.factor == 0 && int64(b)/unit.factor < 1024 {
+			return strconv.FormatInt(int64(b)/unit.factor, 10) + unit.suffix
+		}
+	}
+	return strconv.FormatInt(int64(b), 10)
+}
+
+func (b *byteSize) Set(s string) error {
+	factor := int64(1)
+	for _, unit := range byteSizeUnits {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSuffix(s, unit.suffix)
+			factor = unit.factor
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid byte size %q", s)
+	}
+	if n < 0 {
+		return fmt.Errorf("invalid byte size %q, expected no less than 0", s)
+	}
+	if n > math.MaxInt64/factor {
+		return fmt.Errorf("invalid byte size %q, expected at most %d bytes", s, int64(math.MaxInt64))
+	}
+	*b = byteSize(n * factor)
+	return nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"testing"
+
+	"pgregory.net/rapid"
+)
+
+// TestByteSizeProperty checks that a byte size is set back from its string,
+// and that negative sizes and sizes overflowing with their unit are
+// rejected.
+func TestByteSizeProperty(t *testing.T) {
+	rapid.Check(t, func(t *rapid.T) {
+		size := byteSize(rapid.Int64Range(0, math.MaxInt64).Draw(t, "size"))
+		var got byteSize
+		err := got.Set(size.String())
+		if err != nil || got != size {
+			t.Fatalf("set %v from %q, error was: %v", got, size.String(), err)
+		}
+
+		unit := rapid.SampledFrom(byteSizeUnits).Draw(t, "unit")
+		n := rapid.Int64().Draw(t, "n")
+		err = got.Set(strconv.FormatInt(n, 10) + unit.suffix)
+		valid := n >= 0 && n <= math.MaxInt64/unit.factor
+		if valid && (err != nil || int64(got) != n*unit.factor) {
+			t.Fatalf("set %v from %d%s, error was: %v", got, n, unit.suffix, err)
+		}
+		if !valid && err == nil {
+			t.Fatalf("set %v from %d%s, which is out of range", got, n, unit.suffix)
+		}
+	})
+}
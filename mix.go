@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// With workloadMix the client runs a weighted mix of workloads against the
+// server instead of a single one, to generate mixed traffic as real clients
+// would. It keeps mixStreams slots busy, each running a workload picked at
+// random by weight, and picking again whenever that one ends. Workloads
+// driving streams themselves, such as churn, take a slot with all of their
+// streams.
+var (
+	workloadMix []mixEntry
+	mixStreams  = 10
+)
+
+type mixEntry struct {
+	name   string
+	weight int
+	// runs counts the times the workload was picked
+	runs atomic.Int64
+}
+
+// setWorkloadMix parses comma separated workload=weight pairs, such as
+// pong=80,push=20.
+func setWorkloadMix(s string) error {
+	var mix []mixEntry
+	for _, field := range strings.Split(s, ",") {
+		name, weight, ok := strings.Cut(field, "=")
+		if !ok {
+			return fmt.Errorf("expected workload=weight, got %q", field)
+		}
+		if _, ok := workloads[name]; !ok {
+			return fmt.Errorf("unknown workload %q", name)
+		}
+		w, err := strconv.Atoi(weight)
+		if err != nil || w <= 0 {
+			return fmt.Errorf("weight of workload %s must be a positive integer, got %q", name, weight)
+		}
+		mix = append(mix, mixEntry{name: name, weight: w})
+	}
+	workloadMix = mix
+	return nil
+}
+
+// driveMix runs the workloads of workloadMix against the server at address.
+func driveMix(ctx context.Context, address string) error {
+	total := 0
+	for i := range workloadMix {
+		total += workloadMix[i].weight
+	}
+	defer func() {
+		runs := make(map[string]int64, len(workloadMix))
+		for i := range workloadMix {
+			runs[workloadMix[i].name] = workloadMix[i].runs.Load()
+		}
+		clientLog.Info("client: workload mix ended", "runs", formatCounts(runs))
+	}()
+
+	eg, ctx := errgroup.WithContext(ctx)
+	for i := 0; i < mixStreams; i++ {
+		eg.Go(func() error {
+			for ctx.Err() == nil {
+				entry := pickMix(total)
+				entry.runs.Add(1)
+				wl := workloads[entry.name]
+				var err error
+				if wl.drive != nil {
+					err = wl.drive(ctx, address+wl.path)
+				} else {
+					err = runStream(ctx, address+wl.path, wl.run)
+				}
+				if err != nil {
+					return fmt.Errorf("client: workload %s of mix failed, error was: %w", entry.name, err)
+				}
+			}
+			return nil
+		})
+	}
+	return eg.Wait()
+}
+
+// pickMix picks an entry of workloadMix at random by weight, of the total
+// weight total.
+func pickMix(total int) *mixEntry {
+	n := rand.Intn(total)
+	for i := range workloadMix {
+		n -= workloadMix[i].weight
+		if n < 0 {
+			return &workloadMix[i]
+		}
+	}
+	return &workloadMix[len(workloadMix)-1]
+}
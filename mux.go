@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net/http/httptrace"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// With muxStreams the client runs the workload on that many streams at once,
+// multiplexed over a single HTTP/2 connection, to measure how fairly the
+// connection serves its streams and how much they hold each other up, as
+// the data of one waits behind that of the others in the TCP stream and the
+// flow control windows of the connection. Once the server limits the
+// concurrent streams, further streams wait for one to end rather than open
+// another connection, in a build with Go 1.26 or later. Every stream counts
+// the messages and bytes it received and the time between them, and with
+// the pong workload the round trips of its pings. With every report the
+// client logs Jain's fairness index of the messages the streams received
+// since the previous one, the least and most any received, the spread of
+// their worst gaps and round trips, and the connections they are on, and it
+// publishes the counters per stream as multiplex at /debug/vars.
+var muxStreams = 0
+
+// checkMuxStreams validates muxStreams against the other flags, with the
+// workload named workloadName.
+func checkMuxStreams(workloadName string) error {
+	if muxStreams == 0 {
+		return nil
+	}
+	if muxStreams < 0 {
+		return fmt.Errorf("-streams must be positive, got %d", muxStreams)
+	}
+	if !h2 || h3 || grpcMode {
+		return fmt.Errorf("-streams requires -h2 or -h2c, which multiplex streams over a connection")
+	}
+	if wl, ok := workloads[workloadName]; ok && wl.run == nil || workloadMix != nil {
+		return fmt.Errorf("-streams runs a workload of a single stream, not %s or a mix", workloadName)
+	}
+	return nil
+}
+
+// muxStream is a stream of those multiplexed, as counted by the client.
+type muxStream struct {
+	index int
+	mu    sync.Mutex
+	// conn is the local address of the connection of the stream
+	conn string
+	// offset is the input offset of the decoder of the stream at the
+	// last message
+	offset       int64
+	received     int64
+	bytes        int64
+	lastReceived time.Time
+	interArrival histogram
+	latency      histogram
+	// received at the previous report
+	reported int64
+}
+
+var muxCounts = struct {
+	mu      sync.Mutex
+	streams []*muxStream
+}{}
+
+// muxStreamVars is a multiplexed stream as published with expvar.
+type muxStreamVars struct {
+	Index        int
+	Conn         string
+	Received     int64
+	Bytes        int64
+	InterArrival percentileSummary
+	Latency      percentileSummary
+}
+
+func init() {
+	expvar.Publish("multiplex", expvar.Func(func() any {
+		muxCounts.mu.Lock()
+		defer muxCounts.mu.Unlock()
+		vars := make([]muxStreamVars, 0, len(muxCounts.streams))
+		for _, m := range muxCounts.streams {
+			m.mu.Lock()
+			vars = append(vars, muxStreamVars{
+				Index:        m.index,
+				Conn:         m.conn,
+				Received:     m.received,
+				Bytes:        m.bytes,
+				InterArrival: summarize(&m.interArrival),
+				Latency:      summarize(&m.latency),
+			})
+			m.mu.Unlock()
+		}
+		return vars
+	}))
+}
+
+// driveMux runs run on muxStreams streams against address at once.
+func driveMux(ctx context.Context, address string, run func(ctx context.Context, stream *clientStream) error) error {
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.Go(func() error { return reportMux(ctx) })
+	muxCounts.mu.Lock()
+	for i := 0; i < muxStreams; i++ {
+		m := &muxStream{index: i}
+		muxCounts.streams = append(muxCounts.streams, m)
+		streamCtx := httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) {
+				m.mu.Lock()
+				defer m.mu.Unlock()
+				m.conn = info.Conn.LocalAddr().String()
+			},
+		})
+		eg.Go(func() error {
+			return runStream(streamCtx, address, func(ctx context.Context, stream *clientStream) error {
+				m.attach(stream)
+				return run(ctx, stream)
+			})
+		})
+	}
+	muxCounts.mu.Unlock()
+	err := eg.Wait()
+	if err == nil {
+		err = errStreamEnded
+	}
+	return err
+}
+
+// attach counts the messages of stream, opened anew, to m.
+func (m *muxStream) attach(stream *clientStream) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.offset = 0
+	stream.mux = m
+}
+
+// observeReceived records a message received at now on the stream m, nil
+// unless multiplexing, whose decoder is at offset after it.
+func (m *muxStream) observeReceived(now time.Time, offset int64) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.lastReceived.IsZero() {
+		m.interArrival.record(now.Sub(m.lastReceived))
+	}
+	m.received++
+	m.bytes += offset - m.offset
+	m.offset = offset
+	m.lastReceived = now
+}
+
+// observeLatency records the round trip d of a ping on the stream m, nil
+// unless multiplexing.
+func (m *muxStream) observeLatency(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.latency.record(d)
+}
+
+// reportMux logs the fairness and spread of the multiplexed streams every
+// reportInterval until ctx is done.
+func reportMux(ctx context.Context) error {
+	if reportInterval <= 0 {
+		return nil
+	}
+	ticker := clk.NewTicker(reportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C():
+			logMux()
+		}
+	}
+}
+
+// logMux logs the messages the multiplexed streams received since the
+// previous report, and the spread of their worst gaps and round trips.
+func logMux() {
+	muxCounts.mu.Lock()
+	defer muxCounts.mu.Unlock()
+	var sum, sumSq float64
+	var least, most int64
+	var gaps, latencies []time.Duration
+	conns := map[string]bool{}
+	for i, m := range muxCounts.streams {
+		m.mu.Lock()
+		n := m.received - m.reported
+		m.reported = m.received
+		sum += float64(n)
+		sumSq += float64(n) * float64(n)
+		if i == 0 || n < least {
+			least = n
+		}
+		if i == 0 || n > most {
+			most = n
+		}
+		if m.interArrival.count > 0 {
+			gaps = append(gaps, m.interArrival.max)
+		}
+		if m.latency.count > 0 {
+			latencies = append(latencies, m.latency.quantile(0.99))
+		}
+		if m.conn != "" {
+			conns[m.conn] = true
+		}
+		m.mu.Unlock()
+	}
+	fairness := 1.0
+	if sumSq > 0 {
+		fairness = sum * sum / (float64(len(muxCounts.streams)) * sumSq)
+	}
+	attrs := []any{
+		"streams", len(muxCounts.streams),
+		"connections", len(conns),
+		"received", int64(sum),
+		"least", least,
+		"most", most,
+		"fairness", fmt.Sprintf("%.3f", fairness),
+	}
+	if len(gaps) > 0 {
+		attrs = append(attrs, "max_gap", spread(gaps))
+	}
+	if len(latencies) > 0 {
+		attrs = append(attrs, "latency_p99", spread(latencies))
+	}
+	clientLog.Info("client: multiplexed streams", attrs...)
+}
+
+// spread formats the least and the most of durations, one per stream.
+func spread(durations []time.Duration) string {
+	return fmt.Sprintf("%v..%v", slices.Min(durations), slices.Max(durations))
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Netem mode emulates network conditions on the loopback for the tests, so
+// experiments need no tc incantations: it has the netem queueing discipline
+// delay the packets from and to the ports in netemPorts by netemDelay, varied
+// by netemJitter, and drop netemLoss percent of them, until interrupted, then
+// removes it again. Other traffic on the device passes untouched. Both
+// directions of a connection on the loopback leave through the same device,
+// so the round trip takes twice the delay. It takes Linux and root.
+var (
+	netemDelay  = 50 * time.Millisecond
+	netemJitter = time.Duration(0)
+	netemLoss   = 0.0
+	// netemPorts is the first and last port, the port of -hostport if unset
+	netemPorts  [2]uint16
+	netemDevice = "lo"
+)
+
+// netemConfig is the network conditions netem emulates on device for the
+// ports from first to last.
+type netemConfig struct {
+	device      string
+	first, last uint16
+	delay       time.Duration
+	jitter      time.Duration
+	// loss is in percent
+	loss float64
+}
+
+func (c netemConfig) String() string {
+	return fmt.Sprintf("delay=%v jitter=%v loss=%g%%", c.delay, c.jitter, c.loss)
+}
+
+// setNetemPorts parses a port or a range of ports, such as 8080-8089.
+func setNetemPorts(s string) error {
+	first, last, isRange := strings.Cut(s, "-")
+	if !isRange {
+		last = first
+	}
+	var ports [2]uint16
+	for i, port := range []string{first, last} {
+		p, err := strconv.ParseUint(port, 10, 16)
+		if err != nil || p == 0 {
+			return fmt.Errorf("expected port or range of ports, got %q", s)
+		}
+		ports[i] = uint16(p)
+	}
+	if ports[0] > ports[1] {
+		return fmt.Errorf("first port of range %q is above the last", s)
+	}
+	netemPorts = ports
+	return nil
+}
+
+// newNetemConfig returns the conditions set with the flags, for the port of
+// hostPort unless netemPorts is set.
+func newNetemConfig(hostPort string) (netemConfig, error) {
+	config := netemConfig{
+		device: netemDevice,
+		first:  netemPorts[0],
+		last:   netemPorts[1],
+		delay:  netemDelay,
+		jitter: netemJitter,
+		loss:   netemLoss,
+	}
+	if config.first == 0 {
+		_, port, err := net.SplitHostPort(hostPort)
+		if err != nil {
+			return config, fmt.Errorf("netem: failed to get port of %q, error was: %w", hostPort, err)
+		}
+		p, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return config, fmt.Errorf("netem: failed to parse port of %q, error was: %w", hostPort, err)
+		}
+		config.first, config.last = uint16(p), uint16(p)
+	}
+	return config, nil
+}
+
+// runNetem emulates the conditions set with the flags until ctx is done.
+func runNetem(ctx context.Context, hostPort string) error {
+	config, err := newNetemConfig(hostPort)
+	if err != nil {
+		return err
+	}
+	remove, err := applyNetem(config)
+	if err != nil {
+		return err
+	}
+	slog.Info("netem: emulating network conditions, interrupt to remove them", "device", config.device, "ports", fmt.Sprintf("%d-%d", config.first, config.last), "conditions", config)
+	<-ctx.Done()
+	err = remove()
+	if err != nil {
+		return err
+	}
+	slog.Info("netem: removed network conditions", "device", config.device)
+	return nil
+}
+
+// portMasks covers the ports from first to last with port and mask pairs,
+// as packet filters match ports under a mask rather than ranges.
+func portMasks(first, last uint16) [][2]uint16 {
+	var masks [][2]uint16
+	port := uint32(first)
+	for port <= uint32(last) {
+		// the largest block aligned at port not reaching past last
+		size := uint32(1)
+		for port&(size*2-1) == 0 && port+size*2-1 <= uint32(last) && size < 1<<16 {
+			size *= 2
+		}
+		masks = append(masks, [2]uint16{uint16(port), uint16(^(size - 1))})
+		port += size
+	}
+	return masks
+}
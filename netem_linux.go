@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// applyNetem adds a prio queueing discipline at the root of the device of
+// config whose fourth band, unused by its default priority map, delays and
+// drops packets with netem, and filters the packets from and to the ports of
+// config into that band. It returns the function removing it again.
+func applyNetem(config netemConfig) (remove func() error, err error) {
+	if os.Geteuid() != 0 {
+		return nil, errors.New("netem: changing queueing disciplines takes root")
+	}
+	err = tc("qdisc", "add", "dev", config.device, "root", "handle", "1:", "prio", "bands", "4")
+	if err != nil {
+		return nil, err
+	}
+	remove = func() error {
+		return tc("qdisc", "del", "dev", config.device, "root")
+	}
+	defer func() {
+		if err != nil {
+			remove()
+		}
+	}()
+
+	netem := []string{"qdisc", "add", "dev", config.device, "parent", "1:4", "handle", "40:", "netem"}
+	netem = append(netem, "delay", tcTime(config.delay))
+	if config.jitter > 0 {
+		netem = append(netem, tcTime(config.jitter))
+	}
+	if config.loss > 0 {
+		netem = append(netem, "loss", fmt.Sprintf("%g%%", config.loss))
+	}
+	err = tc(netem...)
+	if err != nil {
+		return nil, err
+	}
+	for _, mask := range portMasks(config.first, config.last) {
+		for _, direction := range []string{"sport", "dport"} {
+			port, portMask := fmt.Sprint(mask[0]), fmt.Sprintf("0x%04x", mask[1])
+			// filters of one priority take one protocol
+			err = tc("filter", "add", "dev", config.device, "parent", "1:", "protocol", "ip", "prio", "1", "u32", "match", "ip", direction, port, portMask, "flowid", "1:4")
+			if err != nil {
+				return nil, err
+			}
+			err = tc("filter", "add", "dev", config.device, "parent", "1:", "protocol", "ipv6", "prio", "2", "u32", "match", "ip6", direction, port, portMask, "flowid", "1:4")
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return remove, nil
+}
+
+func tc(args ...string) error {
+	cmd := exec.Command("tc", args...)
+	// out of the process group, so that the interrupt ending netem mode
+	// does not end the removal of the conditions as well
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("netem: tc %s failed: %s, error was: %w", strings.Join(args, " "), strings.TrimSpace(string(out)), err)
+	}
+	return nil
+}
+
+// tcTime formats d in microseconds, the resolution of tc.
+func tcTime(d time.Duration) string {
+	return fmt.Sprintf("%dus", d.Microseconds())
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func applyNetem(config netemConfig) (remove func() error, err error) {
+	return nil, errors.New("netem: emulating network conditions is only supported on linux")
+}
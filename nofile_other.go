@@ -0,0 +1,14 @@
+//go:build !linux && !darwin
+
+package main
+
+import "fmt"
+
+// nofileLimit is not read on this platform, returning no limit.
+func nofileLimit() (soft, hard uint64, err error) {
+	return 0, 0, nil
+}
+
+func raiseNofileLimit(n uint64) error {
+	return fmt.Errorf("raising the limit of open files is not supported on this platform")
+}
@@ -0,0 +1,40 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// nofileLimit returns the soft and hard limit of open file descriptors.
+func nofileLimit() (soft, hard uint64, err error) {
+	var limit syscall.Rlimit
+	err = syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint64(limit.Cur), uint64(limit.Max), nil
+}
+
+// raiseNofileLimit raises the soft limit of open file descriptors to n, and
+// the hard limit along if below, which takes privileges.
+func raiseNofileLimit(n uint64) error {
+	var limit syscall.Rlimit
+	err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit)
+	if err != nil {
+		return fmt.Errorf("failed to get limit of open files, error was: %w", err)
+	}
+	if uint64(limit.Cur) >= n {
+		return nil
+	}
+	limit.Cur = n
+	if uint64(limit.Max) < n {
+		limit.Max = n
+	}
+	err = syscall.Setrlimit(syscall.RLIMIT_NOFILE, &limit)
+	if err != nil {
+		return fmt.Errorf("failed to raise limit of open files to %d, error was: %w", n, err)
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// With otlpURL every report also exports the histograms of the interval as
+// OTLP exponential histograms, in the json encoding of OTLP over http, to a
+// collector such as http://localhost:4318/v1/metrics. Backends aggregate
+// those across runs and instances correctly, which the percentiles of the
+// reports cannot be. They are delta histograms of seconds, at the finest
+// scale fitting otlpMaxBuckets buckets, as the OpenTelemetry SDKs choose it.
+var otlpURL = ""
+
+const (
+	otlpMaxScale   = 20
+	otlpMaxBuckets = 160
+)
+
+// otlpHistograms are the histograms exported, by metric name.
+var otlpHistograms = []struct {
+	name, description string
+	histogram         func(m *measurements) *histogram
+}{
+	{"duplex.latency", "Round trip time of messages", func(m *measurements) *histogram { return &m.latency }},
+	{"duplex.setup", "Time taken to establish a stream", func(m *measurements) *histogram { return &m.setup }},
+	{"duplex.inter_arrival", "Time between consecutive messages received on a stream", func(m *measurements) *histogram { return &m.interArrival }},
+	{"duplex.jitter", "Variation between consecutive inter-arrival times", func(m *measurements) *histogram { return &m.jitter }},
+	{"duplex.upstream", "Time from client to server of pings", func(m *measurements) *histogram { return &m.upstream }},
+	{"duplex.server_time", "Time the server took to answer pings", func(m *measurements) *histogram { return &m.serverTime }},
+	{"duplex.downstream", "Time from server to client of pongs", func(m *measurements) *histogram { return &m.downstream }},
+	{"duplex.probe_delivery", "Delivery of probes later than the fastest probe of their stream", func(m *measurements) *histogram { return &m.probeDelivery }},
+}
+
+type otlpExportRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpMetric struct {
+	Name                 string                   `json:"name"`
+	Description          string                   `json:"description"`
+	Unit                 string                   `json:"unit"`
+	ExponentialHistogram otlpExponentialHistogram `json:"exponentialHistogram"`
+}
+
+type otlpExponentialHistogram struct {
+	DataPoints []otlpDataPoint `json:"dataPoints"`
+	// AggregationTemporality is 1 for delta
+	AggregationTemporality int `json:"aggregationTemporality"`
+}
+
+// otlpDataPoint is an exponential histogram data point. Its 64 bit integers
+// are strings, as in the json encoding of protocol buffers.
+type otlpDataPoint struct {
+	Attributes        []otlpAttribute `json:"attributes"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	TimeUnixNano      string          `json:"timeUnixNano"`
+	Count             string          `json:"count"`
+	Sum               float64         `json:"sum"`
+	Scale             int             `json:"scale"`
+	ZeroCount         string          `json:"zeroCount"`
+	Positive          otlpBuckets     `json:"positive"`
+	Min               float64         `json:"min"`
+	Max               float64         `json:"max"`
+}
+
+type otlpBuckets struct {
+	Offset       int      `json:"offset"`
+	BucketCounts []string `json:"bucketCounts"`
+}
+
+func otlpString(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: value}}
+}
+
+// exportOTLP posts the histograms of snapshot of side as exponential
+// histograms to url.
+func exportOTLP(ctx context.Context, url string, side string, snapshot metricsSnapshot) error {
+	start := strconv.FormatInt(snapshot.Time.Add(-snapshot.Interval).UnixNano(), 10)
+	end := strconv.FormatInt(snapshot.Time.UnixNano(), 10)
+	var metrics []otlpMetric
+	for _, h := range otlpHistograms {
+		histogram := h.histogram(&snapshot.histograms)
+		if histogram.count == 0 {
+			continue
+		}
+		point := exponentialHistogram(histogram)
+		point.Attributes = []otlpAttribute{otlpString("side", side)}
+		point.StartTimeUnixNano = start
+		point.TimeUnixNano = end
+		metrics = append(metrics, otlpMetric{
+			Name:        h.name,
+			Description: h.description,
+			Unit:        "s",
+			ExponentialHistogram: otlpExponentialHistogram{
+				DataPoints:             []otlpDataPoint{point},
+				AggregationTemporality: 1,
+			},
+		})
+	}
+	if len(metrics) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(otlpExportRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource: otlpResource{Attributes: []otlpAttribute{
+			otlpString("service.name", "test-stream-http-duplex"),
+			otlpString("service.instance.id", snapshot.Manifest.RunID),
+		}},
+		ScopeMetrics: []otlpScopeMetrics{{
+			Scope:   otlpScope{Name: "test-stream-http-duplex"},
+			Metrics: metrics,
+		}},
+	}}})
+	if err != nil {
+		return fmt.Errorf("failed to encode otlp metrics, error was: %w", err)
+	}
+	ctx, cancelFunc := context.WithTimeout(ctx, reportInterval)
+	defer cancelFunc()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request, error was: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// exponentialHistogram converts h to an exponential histogram of seconds,
+// counting the values of every bucket of h at its midpoint.
+func exponentialHistogram(h *histogram) otlpDataPoint {
+	point := otlpDataPoint{
+		Count: strconv.FormatUint(h.count, 10),
+		Sum:   h.mean() * float64(h.count) / float64(time.Second),
+		Min:   h.min.Seconds(),
+		Max:   h.max.Seconds(),
+	}
+	var zeros uint64
+	lowest, highest := math.MaxInt, math.MinInt
+	for i, c := range h.counts {
+		if c == 0 {
+			continue
+		}
+		if histogramValue(i) == 0 {
+			zeros += c
+			continue
+		}
+		index := exponentialIndex(histogramValue(i), otlpMaxScale)
+		lowest, highest = min(lowest, index), max(highest, index)
+	}
+	point.ZeroCount = strconv.FormatUint(zeros, 10)
+	if lowest > highest {
+		point.Positive.BucketCounts = []string{}
+		return point
+	}
+
+	// every step down the scale halves the span of the indexes
+	scale := otlpMaxScale
+	for highest-lowest >= otlpMaxBuckets {
+		scale--
+		lowest, highest = lowest>>1, highest>>1
+	}
+	counts := make([]uint64, highest-lowest+1)
+	for i, c := range h.counts {
+		if c == 0 || histogramValue(i) == 0 {
+			continue
+		}
+		index := exponentialIndex(histogramValue(i), otlpMaxScale) >> (otlpMaxScale - scale)
+		counts[index-lowest] += c
+	}
+	point.Scale = scale
+	point.Positive.Offset = lowest
+	point.Positive.BucketCounts = make([]string, len(counts))
+	for i, c := range counts {
+		point.Positive.BucketCounts[i] = strconv.FormatUint(c, 10)
+	}
+	return point
+}
+
+// exponentialIndex returns the index of the bucket of the exponential
+// histogram of scale counting the value of ns nanoseconds in seconds: the
+// bucket of index i counts the values above 2^(i/2^scale) up to
+// 2^((i+1)/2^scale).
+func exponentialIndex(ns uint64, scale int) int {
+	seconds := float64(ns) / float64(time.Second)
+	return int(math.Ceil(math.Log2(seconds)*math.Exp2(float64(scale)))) - 1
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// With offlineQueue the outbox of the telemetry workload is kept on disk in
+// that directory rather than in memory, so that readings queued while the
+// client cannot reach the server survive a restart of the client, and are
+// uploaded once it reconnects. The outbox drops its oldest readings to stay
+// within offlineQueueMaxBytes and offlineQueueMaxAge, on disk or not.
+var (
+	offlineQueue         = ""
+	offlineQueueMaxBytes = byteSize(64 << 20)
+	offlineQueueMaxAge   = 1 * time.Hour
+)
+
+const (
+	outboxFile = "outbox.ndjson"
+	// outboxSlack is how much the file of an outbox may grow beyond twice
+	// the entries left before it is compacted
+	outboxSlack = 1 << 20
+)
+
+// outboxEntry is a reading queued in the outbox.
+type outboxEntry struct {
+	Seq    int64
+	Queued time.Time
+	Value  string
+	// size is that of the entry as stored, counted against the bound
+	size int64
+}
+
+// outboxRecord is a line of the file of an outbox: an entry queued, or the
+// new head of the outbox once entries were acknowledged or dropped.
+type outboxRecord struct {
+	Entry *outboxEntry `json:",omitempty"`
+	Head  int64        `json:",omitempty"`
+}
+
+// outbox is the queue of readings not yet acknowledged by the server, in the
+// order they were queued. The file, if any, is appended every record and
+// compacted to the entries left once it grew well beyond them.
+type outbox struct {
+	mu      sync.Mutex
+	entries []*outboxEntry
+	bytes   int64
+	// head is the seq of the last entry acknowledged or dropped, next that
+	// of the next entry queued
+	head int64
+	next int64
+	dir  string
+	file *os.File
+	// written is the size of the file
+	written int64
+	// queued wakes the uploader once an entry is queued
+	queued chan struct{}
+}
+
+// openOutboxes are the directories of the open outboxes, each taken by a
+// single one.
+var openOutboxes = struct {
+	mu   sync.Mutex
+	dirs map[string]bool
+}{dirs: map[string]bool{}}
+
+// openOutbox opens the outbox in dir, in memory if dir is empty, numbering
+// its entries from seqBase unless it restores entries numbered before.
+func openOutbox(dir string, seqBase int64) (*outbox, error) {
+	b := &outbox{dir: dir, head: seqBase, next: seqBase + 1, queued: make(chan struct{}, 1)}
+	if dir == "" {
+		return b, nil
+	}
+	openOutboxes.mu.Lock()
+	defer openOutboxes.mu.Unlock()
+	if openOutboxes.dirs[dir] {
+		return nil, fmt.Errorf("offline queue %s is taken by another telemetry workload", dir)
+	}
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create offline queue directory, error was: %w", err)
+	}
+	err = b.restore()
+	if err != nil {
+		return nil, err
+	}
+	// the file may end in a record torn by a crash, which compacting drops
+	err = b.compact()
+	if err != nil {
+		return nil, err
+	}
+	openOutboxes.dirs[dir] = true
+	return b, nil
+}
+
+// restore reads the entries left in the file of b, up to the first record
+// that does not decode.
+func (b *outbox) restore() error {
+	file, err := os.Open(filepath.Join(b.dir, outboxFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open offline queue, error was: %w", err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	restored := false
+	for scanner.Scan() {
+		var record outboxRecord
+		err := json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			clientLog.Warn("client: offline queue ends in a torn record, dropping it", "error", err)
+			break
+		}
+		if !restored {
+			// entries keep the numbers they were queued with
+			b.head, b.next = 0, 1
+			restored = true
+		}
+		if record.Entry != nil {
+			record.Entry.size = int64(len(scanner.Bytes()) + 1)
+			b.entries = append(b.entries, record.Entry)
+			b.bytes += record.Entry.size
+			b.next = record.Entry.Seq + 1
+		}
+		if record.Head != 0 {
+			b.head = record.Head
+			b.next = max(b.next, record.Head+1)
+		}
+	}
+	telemetryCounts.mu.Lock()
+	telemetryCounts.stats.Queued += int64(len(b.entries))
+	telemetryCounts.stats.Bytes += b.bytes
+	telemetryCounts.mu.Unlock()
+	b.drop(b.head)
+	b.expire(clk.Now())
+	telemetryCounts.mu.Lock()
+	telemetryCounts.stats.Restored += int64(len(b.entries))
+	telemetryCounts.mu.Unlock()
+	if len(b.entries) > 0 {
+		clientLog.Info("client: restored readings from offline queue", "dir", b.dir, "count", len(b.entries), "size", byteSize(b.bytes), "oldest", b.entries[0].Queued)
+	}
+	return scanner.Err()
+}
+
+// close closes the file of b, keeping the entries left in it.
+func (b *outbox) close() error {
+	if b.dir == "" {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	openOutboxes.mu.Lock()
+	delete(openOutboxes.dirs, b.dir)
+	openOutboxes.mu.Unlock()
+	if b.file == nil {
+		return nil
+	}
+	return b.file.Close()
+}
+
+// push queues a reading of value, dropping the oldest entries beyond the
+// bounds of the outbox.
+func (b *outbox) push(value string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entry := &outboxEntry{Seq: b.next, Queued: clk.Now(), Value: value}
+	size, err := b.append(outboxRecord{Entry: entry})
+	if err != nil {
+		return err
+	}
+	b.next++
+	entry.size = size
+	b.entries = append(b.entries, entry)
+	b.bytes += size
+	telemetryCounts.mu.Lock()
+	telemetryCounts.stats.Produced++
+	telemetryCounts.stats.Queued++
+	telemetryCounts.stats.Bytes += size
+	telemetryCounts.mu.Unlock()
+
+	dropped := b.expire(entry.Queued)
+	for b.bytes > int64(offlineQueueMaxBytes) && len(b.entries) > 1 {
+		dropped = b.entries[0].Seq
+		b.drop(dropped)
+		telemetryCounts.mu.Lock()
+		telemetryCounts.stats.DroppedSize++
+		telemetryCounts.mu.Unlock()
+	}
+	if dropped != 0 {
+		err = b.advanced()
+		if err != nil {
+			return err
+		}
+	}
+	wake(b.queued)
+	return nil
+}
+
+// expire drops the entries older than offlineQueueMaxAge at now, returning
+// the seq of the last one dropped, 0 if none was.
+func (b *outbox) expire(now time.Time) int64 {
+	var dropped int64
+	for len(b.entries) > 0 && now.Sub(b.entries[0].Queued) > offlineQueueMaxAge {
+		dropped = b.entries[0].Seq
+		b.drop(dropped)
+		telemetryCounts.mu.Lock()
+		telemetryCounts.stats.DroppedAge++
+		telemetryCounts.mu.Unlock()
+	}
+	return dropped
+}
+
+// drop removes the entries up to seq and returns them.
+func (b *outbox) drop(seq int64) []*outboxEntry {
+	n := 0
+	var bytes int64
+	for n < len(b.entries) && b.entries[n].Seq <= seq {
+		bytes += b.entries[n].size
+		n++
+	}
+	dropped := b.entries[:n:n]
+	b.entries = b.entries[n:]
+	b.bytes -= bytes
+	b.head = max(b.head, seq)
+	telemetryCounts.mu.Lock()
+	telemetryCounts.stats.Queued -= int64(n)
+	telemetryCounts.stats.Bytes -= bytes
+	telemetryCounts.mu.Unlock()
+	return dropped
+}
+
+// ack removes the entries up to seq, acknowledged by the server, and returns
+// them.
+func (b *outbox) ack(seq int64) ([]*outboxEntry, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if seq <= b.head || seq >= b.next {
+		return nil, nil
+	}
+	acked := b.drop(seq)
+	telemetryCounts.mu.Lock()
+	telemetryCounts.stats.Acked += int64(len(acked))
+	telemetryCounts.mu.Unlock()
+	return acked, b.advanced()
+}
+
+// advanced records the head of b after it advanced, compacting the file
+// once it grew well beyond the entries left.
+func (b *outbox) advanced() error {
+	_, err := b.append(outboxRecord{Head: b.head})
+	if err != nil {
+		return err
+	}
+	if b.file != nil && b.written > 2*b.bytes+outboxSlack {
+		return b.compact()
+	}
+	return nil
+}
+
+// pending returns the entries queued after seq, in order.
+func (b *outbox) pending(seq int64) []*outboxEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.expire(clk.Now())
+	for i, entry := range b.entries {
+		if entry.Seq > seq {
+			return append([]*outboxEntry{}, b.entries[i:]...)
+		}
+	}
+	return nil
+}
+
+// append writes record to the file of b, if any, and syncs it, so the
+// record is on disk once queued. It returns the size of the record.
+func (b *outbox) append(record outboxRecord) (int64, error) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return 0, err
+	}
+	line = append(line, '\n')
+	if b.file == nil {
+		return int64(len(line)), nil
+	}
+	_, err = b.file.Write(line)
+	if err == nil {
+		err = b.file.Sync()
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to write offline queue, error was: %w", err)
+	}
+	b.written += int64(len(line))
+	return int64(len(line)), nil
+}
+
+// compact rewrites the file of b with the head and the entries left, and
+// replaces the file with it.
+func (b *outbox) compact() error {
+	if b.file != nil {
+		b.file.Close()
+		b.file = nil
+	}
+	path := filepath.Join(b.dir, outboxFile)
+	tmp, err := os.CreateTemp(b.dir, outboxFile+".*")
+	if err != nil {
+		return fmt.Errorf("failed to compact offline queue, error was: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	err = enc.Encode(outboxRecord{Head: b.head})
+	for _, entry := range b.entries {
+		if err == nil {
+			err = enc.Encode(outboxRecord{Entry: entry})
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to compact offline queue, error was: %w", err)
+	}
+	b.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open offline queue, error was: %w", err)
+	}
+	info, err := b.file.Stat()
+	if err != nil {
+		return err
+	}
+	b.written = info.Size()
+	return nil
+}
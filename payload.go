@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// payloadAEAD, when set with -payload-key, seals every message end to end
+// with AES-GCM under a key shared by client and server beforehand, so the
+// contents stay confidential through proxies terminating TLS. A sealed
+// message is still a json line, {"Sealed":"<base64 nonce and ciphertext>"}.
+var payloadAEAD cipher.AEAD
+
+type sealedMsg struct {
+	Sealed []byte
+}
+
+// setPayloadKey sets the AES-128, AES-192 or AES-256 key, given as hex, with
+// which messages are sealed.
+func setPayloadKey(s string) error {
+	key, err := hex.DecodeString(s)
+	if err != nil {
+		return fmt.Errorf("payload key is not hex, error was: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	payloadAEAD, err = cipher.NewGCM(block)
+	return err
+}
+
+// seal returns msg sealed as a sealedMsg if payload encryption is enabled,
+// otherwise msg itself.
+func seal(msg any) (any, error) {
+	if payloadAEAD == nil {
+		return msg, nil
+	}
+	plaintext, err := json.Marshal(msg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode message to seal, error was: %w", err)
+	}
+	nonce := make([]byte, payloadAEAD.NonceSize(), payloadAEAD.NonceSize()+len(plaintext)+payloadAEAD.Overhead())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate nonce, error was: %w", err)
+	}
+	return sealedMsg{Sealed: payloadAEAD.Seal(nonce, nonce, plaintext, nil)}, nil
+}
+
+// open returns the message sealed in raw.
+func open(raw []byte) ([]byte, error) {
+	var sealed sealedMsg
+	err := json.Unmarshal(raw, &sealed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode sealed message, error was: %w", err)
+	}
+	if len(sealed.Sealed) < payloadAEAD.NonceSize() {
+		return nil, fmt.Errorf("sealed message is too short")
+	}
+	nonce, ciphertext := sealed.Sealed[:payloadAEAD.NonceSize()], sealed.Sealed[payloadAEAD.NonceSize():]
+	plaintext, err := payloadAEAD.Open(ciphertext[:0], nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sealed message, error was: %w", err)
+	}
+	return plaintext, nil
+}
+
+// decodeMessage decodes the next message of dec into v, opening it if
+// payload encryption is enabled and verifying its signature if signature
+// verification is.
+func decodeMessage(dec *json.Decoder, v any) error {
+	if payloadAEAD == nil && verifyKey == nil {
+		return dec.Decode(v)
+	}
+	var raw json.RawMessage
+	err := dec.Decode(&raw)
+	if err != nil {
+		return err
+	}
+	if payloadAEAD != nil {
+		raw, err = open(raw)
+		if err != nil {
+			return fmt.Errorf("%w: %w", errMalformedMessage, err)
+		}
+	}
+	if verifyKey != nil {
+		raw, err = verify(raw)
+		if errors.Is(err, errBadSignature) {
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %w", errMalformedMessage, err)
+		}
+	}
+	return json.Unmarshal(raw, v)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	"pgregory.net/rapid"
+)
+
+// codecKeys sets the keys of payload encryption and signing, each either
+// enabled or not, until the returned func restores the previous ones.
+func codecKeys(t *rapid.T) func() {
+	aead, signing, verifying := payloadAEAD, signingKey, verifyKey
+	restore := func() {
+		payloadAEAD, signingKey, verifyKey = aead, signing, verifying
+	}
+	payloadAEAD, signingKey, verifyKey = nil, nil, nil
+	if rapid.Bool().Draw(t, "sealed") {
+		size := rapid.SampledFrom([]int{16, 24, 32}).Draw(t, "key size")
+		key := rapid.SliceOfN(rapid.Byte(), size, size).Draw(t, "payload key")
+		err := setPayloadKey(hex.EncodeToString(key))
+		if err != nil {
+			restore()
+			t.Fatalf("failed to set payload key, error was: %v", err)
+		}
+	}
+	if rapid.Bool().Draw(t, "signed") {
+		seed := rapid.SliceOfN(rapid.Byte(), ed25519.SeedSize, ed25519.SeedSize).Draw(t, "signing key")
+		signingKey = ed25519.NewKeyFromSeed(seed)
+		verifyKey = signingKey.Public().(ed25519.PublicKey)
+	}
+	return restore
+}
+
+// encodeMessages encodes msgs as the streams send them.
+func encodeMessages(msgs []any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, msg := range msgs {
+		msg, err := sign(msg)
+		if err != nil {
+			return nil, err
+		}
+		msg, err = seal(msg)
+		if err != nil {
+			return nil, err
+		}
+		err = enc.Encode(msg)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+var requestMsgs = rapid.Custom(func(t *rapid.T) requestMsg {
+	return requestMsg{
+		Msg:   rapid.SampledFrom([]string{"ping", "set", "delete", "echo"}).Draw(t, "msg"),
+		Key:   rapid.String().Draw(t, "key"),
+		Value: rapid.String().Draw(t, "value"),
+		Seq:   rapid.Int64().Draw(t, "seq"),
+		Sent:  rapid.Int64().Draw(t, "sent"),
+	}
+})
+
+var responseMsgs = rapid.Custom(func(t *rapid.T) responseMsg {
+	msg := responseMsg{
+		Msg:   rapid.SampledFrom([]string{"pong", "state", "tick", "echo", "error"}).Draw(t, "msg"),
+		Error: rapid.String().Draw(t, "error"),
+		Sent:  rapid.Int64().Draw(t, "sent"),
+		Data:  rapid.String().Draw(t, "data"),
+		Seq:   rapid.Int64().Draw(t, "seq"),
+	}
+	// empty ones are left out of the json and decode as nil
+	if rapid.Bool().Draw(t, "with state") {
+		msg.State = rapid.MapOfN(rapid.String(), rapid.String(), 1, 5).Draw(t, "state")
+	}
+	if rapid.Bool().Draw(t, "with deleted") {
+		msg.Deleted = rapid.SliceOfN(rapid.String(), 1, 5).Draw(t, "deleted")
+	}
+	return msg
+})
+
+// TestCodecProperty checks that messages decode as they were encoded, signed
+// and sealed or not.
+func TestCodecProperty(t *testing.T) {
+	rapid.Check(t, func(t *rapid.T) {
+		defer codecKeys(t)()
+		requests := rapid.SliceOf(requestMsgs).Draw(t, "requests")
+		responses := rapid.SliceOf(responseMsgs).Draw(t, "responses")
+
+		msgs := make([]any, len(requests))
+		for i, msg := range requests {
+			msgs[i] = msg
+		}
+		data, err := encodeMessages(msgs)
+		if err != nil {
+			t.Fatalf("failed to encode requests, error was: %v", err)
+		}
+		dec := json.NewDecoder(bytes.NewReader(data))
+		for _, want := range requests {
+			var got requestMsg
+			err := decodeMessage(dec, &got)
+			if err != nil {
+				t.Fatalf("failed to decode request, error was: %v", err)
+			}
+			if got != want {
+				t.Fatalf("decoded request %+v, expected %+v", got, want)
+			}
+		}
+
+		msgs = make([]any, len(responses))
+		for i, msg := range responses {
+			msgs[i] = msg
+		}
+		data, err = encodeMessages(msgs)
+		if err != nil {
+			t.Fatalf("failed to encode responses, error was: %v", err)
+		}
+		dec = json.NewDecoder(bytes.NewReader(data))
+		for _, want := range responses {
+			var got responseMsg
+			err := decodeMessage(dec, &got)
+			if err != nil {
+				t.Fatalf("failed to decode response, error was: %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("decoded response %+v, expected %+v", got, want)
+			}
+		}
+	})
+}
+
+// TestCodecTamperProperty checks that a message changed after it was signed
+// does not verify, and one changed after it was sealed does not open.
+func TestCodecTamperProperty(t *testing.T) {
+	rapid.Check(t, func(t *rapid.T) {
+		defer codecKeys(t)()
+		if payloadAEAD == nil && signingKey == nil {
+			t.Skip("neither sealed nor signed")
+		}
+		data, err := encodeMessages([]any{requestMsgs.Draw(t, "request")})
+		if err != nil {
+			t.Fatalf("failed to encode request, error was: %v", err)
+		}
+
+		// flip a bit of the ciphertext, or of the signature if not sealed
+		if payloadAEAD != nil {
+			var sealed sealedMsg
+			err = json.Unmarshal(data, &sealed)
+			if err != nil {
+				t.Fatalf("failed to decode sealed message, error was: %v", err)
+			}
+			i := rapid.IntRange(0, len(sealed.Sealed)-1).Draw(t, "byte")
+			sealed.Sealed[i] ^= 1 << rapid.IntRange(0, 7).Draw(t, "bit")
+			data, err = json.Marshal(sealed)
+		} else {
+			var signed signedMsg
+			err = json.Unmarshal(data, &signed)
+			if err != nil {
+				t.Fatalf("failed to decode signed message, error was: %v", err)
+			}
+			i := rapid.IntRange(0, len(signed.Signature)-1).Draw(t, "byte")
+			signed.Signature[i] ^= 1 << rapid.IntRange(0, 7).Draw(t, "bit")
+			data, err = json.Marshal(signed)
+		}
+		if err != nil {
+			t.Fatalf("failed to encode changed message, error was: %v", err)
+		}
+
+		var got requestMsg
+		err = decodeMessage(json.NewDecoder(bytes.NewReader(data)), &got)
+		if payloadAEAD == nil && !errors.Is(err, errBadSignature) {
+			t.Fatalf("decoded %+v with a changed signature, error was: %v", got, err)
+		}
+		if payloadAEAD != nil && !errors.Is(err, errMalformedMessage) {
+			t.Fatalf("decoded %+v with a changed ciphertext, error was: %v", got, err)
+		}
+	})
+}
+
+// TestContentTypeProperty checks that the profile of every content type the
+// client sends is the one the server parses.
+func TestContentTypeProperty(t *testing.T) {
+	names := []string{""}
+	for name := range protocolProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	rapid.Check(t, func(t *rapid.T) {
+		name := rapid.SampledFrom(names).Draw(t, "profile")
+		profile, err := parseContentType(contentType(name))
+		if err != nil {
+			t.Fatalf("failed to parse content type of profile %q, error was: %v", name, err)
+		}
+		if want := protocolProfiles[defaultProfile]; name == "" && profile != want {
+			t.Fatalf("parsed profile %q without profile, expected %q", profile.name, want.name)
+		}
+		if name != "" && profile.name != name {
+			t.Fatalf("parsed profile %q, expected %q", profile.name, name)
+		}
+	})
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// With streamPriorities the client assigns the streams it opens the
+// priorities of RFC 9218 in turn, which it sends in the Priority header of
+// their requests, "u=3, i" for an urgency of 3, from 0 the most urgent to 7
+// the least, and incremental delivery. An HTTP/2 server of net/http built
+// with Go 1.27 or later schedules the data of the streams of a connection by
+// them, the most urgent first, and the incremental ones of the same urgency
+// round robin, unless h2DisableClientPriority, while HTTP/1.1 and older
+// builds ignore them. The weights and dependencies of RFC 7540 cannot be
+// assigned, as the transport of net/http never sends them.
+var (
+	streamPriorities        []string
+	h2DisableClientPriority = false
+)
+
+// The priority workload has the client open priorityStreamCount streams at
+// once, to which the server sends data messages of prioritySize bytes as fast
+// as it can, so that the streams of a connection contend for it, and the
+// client measures the bandwidth every stream gets.
+// The bytes received are published per stream and per priority, with their
+// share of all received, as priority at /debug/vars, and logged when a
+// stream ends.
+var (
+	priorityStreamCount = 4
+	prioritySize        = byteSize(16 << 10)
+)
+
+// prioritiesAssigned numbers the streams assigned priorities.
+var prioritiesAssigned atomic.Int64
+
+// setStreamPriorities parses a comma separated list of urgencies, each
+// incremental with an i suffix, such as 0,3i,7.
+func setStreamPriorities(s string) error {
+	var priorities []string
+	for _, field := range strings.Split(s, ",") {
+		urgency, incremental := strings.CutSuffix(field, "i")
+		u, err := strconv.Atoi(urgency)
+		if err != nil || u < 0 || u > 7 {
+			return fmt.Errorf("expected urgency from 0 to 7, optionally followed by i, got %q", field)
+		}
+		priority := fmt.Sprintf("u=%d", u)
+		if incremental {
+			priority += ", i"
+		}
+		priorities = append(priorities, priority)
+	}
+	streamPriorities = priorities
+	return nil
+}
+
+// nextStreamPriority returns the priority of the next stream opened, none
+// without streamPriorities.
+func nextStreamPriority() string {
+	if len(streamPriorities) == 0 {
+		return ""
+	}
+	n := prioritiesAssigned.Add(1) - 1
+	return streamPriorities[n%int64(len(streamPriorities))]
+}
+
+// priorityStream is a stream of the priority workload, as counted by the
+// client.
+type priorityStream struct {
+	id       int64
+	priority string
+	started  time.Time
+	// received is the bytes received by all streams when it started
+	received int64
+	bytes    atomic.Int64
+}
+
+// share returns the share of p of the bytes received by all streams since
+// it started.
+func (p *priorityStream) share() float64 {
+	received := priorityCounts.received.Load() - p.received
+	if received == 0 {
+		return 0
+	}
+	return float64(p.bytes.Load()) / float64(received)
+}
+
+var priorityCounts = struct {
+	mu      sync.Mutex
+	streams []*priorityStream
+	// bytes received on the streams ended, per priority
+	ended map[string]int64
+	// received is the bytes received on all streams
+	received atomic.Int64
+}{ended: map[string]int64{}}
+
+// priorityStreamVars is a stream of the priority workload as published with
+// expvar.
+type priorityStreamVars struct {
+	ID       int64
+	Priority string
+	Bytes    int64
+	// Rate is the bytes per second received since the stream started, and
+	// Share the share of all bytes received since
+	Rate  float64
+	Share float64
+}
+
+// priorityClassVars are the bytes received on the streams of a priority, as
+// published with expvar.
+type priorityClassVars struct {
+	Bytes int64
+	Share float64
+}
+
+type priorityVars struct {
+	Streams []priorityStreamVars
+	// Priorities counts the streams ended as well
+	Priorities map[string]priorityClassVars
+}
+
+func init() {
+	expvar.Publish("priority", expvar.Func(func() any {
+		priorityCounts.mu.Lock()
+		defer priorityCounts.mu.Unlock()
+		return priorityShares()
+	}))
+}
+
+// priorityShares returns the bytes received so far and their shares, per
+// open stream and per priority, under the mu of priorityCounts.
+func priorityShares() priorityVars {
+	now := clk.Now()
+	classes := map[string]int64{}
+	var total int64
+	for priority, n := range priorityCounts.ended {
+		classes[priority] += n
+		total += n
+	}
+	vars := priorityVars{
+		Streams:    make([]priorityStreamVars, 0, len(priorityCounts.streams)),
+		Priorities: make(map[string]priorityClassVars, len(classes)),
+	}
+	for _, p := range priorityCounts.streams {
+		n := p.bytes.Load()
+		classes[p.priority] += n
+		total += n
+		vars.Streams = append(vars.Streams, priorityStreamVars{
+			ID:       p.id,
+			Priority: p.priority,
+			Bytes:    n,
+			Rate:     float64(n) / now.Sub(p.started).Seconds(),
+			Share:    p.share(),
+		})
+	}
+	for priority, n := range classes {
+		vars.Priorities[priority] = priorityClassVars{Bytes: n, Share: float64(n) / float64(max(total, 1))}
+	}
+	return vars
+}
+
+func addPriorityStream(stream *clientStream) *priorityStream {
+	priorityCounts.mu.Lock()
+	defer priorityCounts.mu.Unlock()
+	priority := stream.priority
+	if priority == "" {
+		priority = "none"
+	}
+	p := &priorityStream{id: stream.id, priority: priority, started: clk.Now(), received: priorityCounts.received.Load()}
+	priorityCounts.streams = append(priorityCounts.streams, p)
+	return p
+}
+
+func removePriorityStream(p *priorityStream) {
+	priorityCounts.mu.Lock()
+	defer priorityCounts.mu.Unlock()
+	priorityCounts.streams = slices.DeleteFunc(priorityCounts.streams, func(q *priorityStream) bool { return q == p })
+	priorityCounts.ended[p.priority] += p.bytes.Load()
+}
+
+func servePriority(ctx context.Context, stream *serverStream) {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	defer cancelFunc()
+
+	go func() {
+		defer cancelFunc()
+		// the client is not expected to send anything but control messages,
+		// read to take those and to notice it going away
+		err := stream.discard()
+		if err != nil && ctx.Err() == nil {
+			stream.log.Error("server: failed to receive from client", "error", err)
+		}
+	}()
+
+	data := strings.Repeat("x", int(prioritySize))
+	for seq := int64(1); ctx.Err() == nil; seq++ {
+		err := stream.send(responseMsg{Msg: "data", Seq: seq, Data: data})
+		if err != nil {
+			if ctx.Err() == nil {
+				stream.log.Error("server: failed to send data to client", "error", err)
+			}
+			return
+		}
+	}
+}
+
+func drivePriority(ctx context.Context, address string) error {
+	eg, ctx := errgroup.WithContext(ctx)
+	for i := 0; i < priorityStreamCount; i++ {
+		eg.Go(func() error { return runStream(ctx, address, runPriorityStream) })
+	}
+	return eg.Wait()
+}
+
+func runPriorityStream(ctx context.Context, stream *clientStream) error {
+	stop := context.AfterFunc(ctx, func() { stream.resp.Body.Close() })
+	defer stop()
+
+	p := addPriorityStream(stream)
+	defer func() {
+		removePriorityStream(p)
+		stream.log.Info("client: priority stream ended", "priority", p.priority, "bytes", p.bytes.Load(), "share", fmt.Sprintf("%.3f", p.share()))
+	}()
+	for {
+		var in responseMsg
+		err := stream.recv(&in)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("failed to decode response message from server, error was: %w", err)
+		}
+		if in.Msg == "error" {
+			return fmt.Errorf("server ended stream with error: %s", in.Error)
+		}
+		p.bytes.Add(int64(len(in.Data)))
+		priorityCounts.received.Add(int64(len(in.Data)))
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// With probeInterval the client probes the path of the responses of the
+// server for buffering, alongside its workload: it opens a stream carrying
+// nothing but probes, on which it asks for a probe every probeInterval, and
+// the server answers with a probe carrying when it was sent, flushed on its
+// own. The client records how much later than the fastest probe each was
+// delivered, which cancels out the offset between the clocks of server and
+// client, as probe_delivery. Buffering added anywhere on the path during a
+// long run, by the kernel, a proxy or the stack, shows as a drift of the
+// probe deliveries, and the client warns of deliveries drifting by
+// probeDriftThreshold or more.
+var probeInterval = time.Duration(0)
+
+const (
+	probePath           = "/probe"
+	probeDriftThreshold = flushStallThreshold
+)
+
+// serveProbe answers every probe of the client with one carrying when it was
+// sent.
+func serveProbe(ctx context.Context, stream *serverStream) {
+	for {
+		var inMsg requestMsg
+		err := stream.recv(&inMsg)
+		if err != nil {
+			if ctx.Err() == nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+				stream.log.Error("server: failed to receive request message from client", "error", err)
+			}
+			return
+		}
+		if inMsg.Msg != "probe" {
+			stream.log.Warn("server: received unexpected message on probe stream", "msg", inMsg.Msg)
+			continue
+		}
+		err = stream.send(responseMsg{Msg: "probe", Sent: clk.Now().UnixNano()})
+		if err != nil {
+			stream.log.Error("server: failed to send probe to client", "error", err)
+			return
+		}
+	}
+}
+
+func runProbe(ctx context.Context, stream *clientStream) error {
+	stop := context.AfterFunc(ctx, func() { stream.resp.Body.Close() })
+	defer stop()
+
+	ticker := clk.NewTicker(probeInterval)
+	defer ticker.Stop()
+	// the fastest delivery, including the offset between the clocks
+	var fastest time.Duration
+	for probed := false; ; probed = true {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C():
+		}
+		err := stream.send(requestMsg{Msg: "probe"})
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("client: failed to send probe to server, error was: %w", err)
+		}
+		var in responseMsg
+		if !probed && !stream.split && halfDuplexAfter > 0 {
+			err = recvFirstProbe(stream, &in)
+		} else {
+			err = stream.recv(&in)
+		}
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("failed to decode response message from server, error was: %w", err)
+		}
+		delivery := clk.Since(time.Unix(0, in.Sent))
+		if !probed || delivery < fastest {
+			fastest = delivery
+		}
+		drift := delivery - fastest
+		clientMetrics.observeProbeDelivery(drift)
+		if drift >= probeDriftThreshold {
+			stream.log.Warn("client: probe delivery drifted", "drift", drift)
+		}
+	}
+}
+
+// recvFirstProbe receives the first probe of stream into in, switching to the
+// split transport when it is not delivered within halfDuplexAfter, as the
+// path then holds the response back until the request ends.
+func recvFirstProbe(stream *clientStream, in *responseMsg) error {
+	timer := clk.NewTimer(halfDuplexAfter)
+	defer timer.Stop()
+	received := make(chan struct{})
+	defer close(received)
+	go func() {
+		select {
+		case <-timer.C():
+			takeHalfDuplex(stream.log)
+		case <-received:
+		}
+	}()
+	return stream.recv(in)
+}
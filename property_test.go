@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"pgregory.net/rapid"
+)
+
+// The property tests run every sequence against a server of their own, on
+// an ephemeral port of the loopback interface, which serves propertyPath
+// only: it echoes every message, stalls for the duration of a stall message
+// and ends the response on an end message.
+const (
+	propertyPath    = "/property"
+	propertyMaxOps  = 20
+	propertyMaxSize = 128 << 10
+	propertyMaxWait = 50 * time.Millisecond
+	propertyTimeout = 5 * time.Second
+)
+
+// propertyOp is an operation of a property run.
+type propertyOp struct {
+	// send, pause, stall (of the server), end (by the server), halfclose or
+	// cancel
+	kind string
+	size int
+	wait time.Duration
+}
+
+func (op propertyOp) String() string {
+	switch op.kind {
+	case "send":
+		return "send " + strconv.Itoa(op.size)
+	case "pause", "stall":
+		return op.kind + " " + op.wait.String()
+	}
+	return op.kind
+}
+
+// propertyOps generates the operations of a run, shrinking towards fewer
+// and smaller sends.
+func propertyOps() *rapid.Generator[[]propertyOp] {
+	op := rapid.Custom(func(t *rapid.T) propertyOp {
+		kind := rapid.SampledFrom([]string{"send", "pause", "stall"}).Draw(t, "kind")
+		if kind == "send" {
+			return propertyOp{kind: kind, size: rapid.IntRange(0, propertyMaxSize-1).Draw(t, "size")}
+		}
+		return propertyOp{kind: kind, wait: time.Duration(rapid.Int64Range(0, int64(propertyMaxWait)-1).Draw(t, "wait"))}
+	})
+	return rapid.Custom(func(t *rapid.T) []propertyOp {
+		ops := rapid.SliceOfN(op, 0, propertyMaxOps-1).Draw(t, "ops")
+		// the stream ends with at most one of these
+		ending := rapid.SampledFrom([]string{"", "end", "halfclose", "cancel"}).Draw(t, "ending")
+		if ending != "" {
+			ops = append(ops, propertyOp{kind: ending})
+		}
+		return ops
+	})
+}
+
+func formatProperty(ops []propertyOp) string {
+	formatted := make([]string, len(ops))
+	for i, op := range ops {
+		formatted[i] = op.String()
+	}
+	return strings.Join(formatted, ", ")
+}
+
+// TestStreamProperty checks that every message is echoed once, unchanged and
+// in order, all of them after a half-close and those before an early end of
+// the server, that no operation takes longer than propertyTimeout, and that
+// no stream is left open on the server once all runs ended.
+func TestStreamProperty(t *testing.T) {
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	ln, err := listen(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen, error was: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(propertyPath, streamHandler(ctx, serveProperty))
+	server := http.Server{Handler: mux, ConnContext: withConn}
+	go server.Serve(ln)
+	defer server.Close()
+	address := "http://" + ln.Addr().(*net.TCPAddr).AddrPort().String() + propertyPath
+
+	rapid.Check(t, func(t *rapid.T) {
+		ops := propertyOps().Draw(t, "operations")
+		err := checkProperty(ctx, address, ops)
+		if err != nil {
+			t.Fatalf("operations %s: %v", formatProperty(ops), err)
+		}
+	})
+
+	// streams end on the server shortly after the client saw them end
+	deadline := time.Now().Add(propertyTimeout)
+	for len(activeStreams.all()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d streams left open on the server", len(activeStreams.all()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// serveProperty echoes every message of a property run, stalling or ending
+// the response when asked to.
+func serveProperty(ctx context.Context, stream *serverStream) {
+	for {
+		var inMsg requestMsg
+		err := stream.recv(&inMsg)
+		if err != nil {
+			return
+		}
+		switch inMsg.Msg {
+		case "stall":
+			wait, _ := time.ParseDuration(inMsg.Value)
+			select {
+			case <-ctx.Done():
+				return
+			case <-clk.After(wait):
+			}
+		case "end":
+			return
+		default:
+			err = stream.send(responseMsg{Msg: "echo", Seq: inMsg.Seq, Data: inMsg.Value})
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// checkProperty runs ops on a new stream and returns the invariant they
+// broke, if any.
+func checkProperty(ctx context.Context, address string, ops []propertyOp) error {
+	ctx, cancelFunc := context.WithCancelCause(ctx)
+	defer cancelFunc(nil)
+	stream, err := openStream(ctx, address)
+	if err != nil {
+		return fmt.Errorf("failed to open stream, error was: %w", err)
+	}
+	defer stream.resp.Body.Close()
+	defer stream.w.Close()
+	stop := context.AfterFunc(ctx, func() {
+		stream.w.Close()
+		stream.resp.Body.Close()
+	})
+	defer stop()
+
+	// the messages sent and not echoed yet, in order
+	expected := make(chan requestMsg, propertyMaxOps)
+	received := make(chan error, 1)
+	go func() {
+		received <- receiveProperty(stream, expected)
+	}()
+
+	var seq int64
+	ending := ""
+	for _, op := range ops {
+		done := time.AfterFunc(propertyTimeout, func() {
+			cancelFunc(fmt.Errorf("operation %v did not complete within %v", op, propertyTimeout))
+		})
+		switch op.kind {
+		case "send":
+			seq++
+			msg := requestMsg{Msg: "echo", Seq: stream.seq(seq), Value: strings.Repeat("x", op.size)}
+			expected <- msg
+			err = stream.send(msg)
+		case "pause":
+			clk.Sleep(ctx, op.wait)
+		case "stall":
+			err = stream.send(requestMsg{Msg: "stall", Value: op.wait.String()})
+		case "end":
+			err = stream.send(requestMsg{Msg: "end"})
+		case "halfclose":
+			err = stream.closeSend()
+		case "cancel":
+			cancelFunc(errPropertyCancelled)
+		}
+		done.Stop()
+		if err != nil {
+			if cause := context.Cause(ctx); cause != nil && !errors.Is(cause, errPropertyCancelled) {
+				return cause
+			}
+			return fmt.Errorf("operation %v failed, error was: %w", op, err)
+		}
+		ending = op.kind
+	}
+	close(expected)
+	if ending != "end" && ending != "halfclose" && ending != "cancel" {
+		// the response only ends once the request did
+		err = stream.closeSend()
+		if err != nil {
+			return fmt.Errorf("failed to half-close, error was: %w", err)
+		}
+	}
+
+	select {
+	case err = <-received:
+	case <-time.After(propertyTimeout):
+		return fmt.Errorf("response did not end within %v of the last operation", propertyTimeout)
+	}
+	if ending == "cancel" {
+		// anything may be lost, only the echoes received were checked
+		return nil
+	}
+	if cause := context.Cause(ctx); cause != nil {
+		return cause
+	}
+	return err
+}
+
+var errPropertyCancelled = errors.New("cancelled by property run")
+
+// receiveProperty checks the echoes of a property run against the messages
+// expected, until the response ends.
+func receiveProperty(stream *clientStream, expected chan requestMsg) error {
+	for {
+		var in responseMsg
+		err := stream.recv(&in)
+		if errors.Is(err, io.EOF) {
+			want, ok := <-expected
+			if ok {
+				return fmt.Errorf("response ended without echo of message %d", stream.seqNumber(want.Seq))
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to receive echo, error was: %w", err)
+		}
+		want, ok := <-expected
+		if !ok {
+			return fmt.Errorf("received echo of message %d, which was not sent", stream.seqNumber(in.Seq))
+		}
+		if in.Seq != want.Seq || in.Data != want.Value {
+			return fmt.Errorf("expected echo of message %d with %d bytes, received message %d with %d bytes", stream.seqNumber(want.Seq), len(want.Value), stream.seqNumber(in.Seq), len(in.Data))
+		}
+		slog.Debug("property: received echo", "seq", stream.seqNumber(in.Seq))
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"sort"
+	"strings"
+)
+
+// Generations of the protocol are told apart by the profile parameter of
+// the content type, such as application/x-ndjson; profile=duplex-v2, so that
+// clients of several generations can be served on one endpoint while
+// migrating from one to the next. A request without profile speaks the first
+// generation. protocolProfiles maps every profile to how its messages differ,
+// the server answers in the profile of the request and names it in the
+// content type of its response. clientProfile is the profile the client
+// requests, none for the first generation.
+var clientProfile = ""
+
+// protocolProfile is the schema and behaviour of a generation of the
+// protocol.
+type protocolProfile struct {
+	name string
+	// answerSeq makes the answers of the server carry the sequence number
+	// of the message answered, which the first generation only does in
+	// the workloads numbering their messages, and not for pongs
+	answerSeq bool
+}
+
+const defaultProfile = "duplex-v1"
+
+var protocolProfiles = map[string]protocolProfile{
+	"duplex-v1": {name: "duplex-v1"},
+	"duplex-v2": {name: "duplex-v2", answerSeq: true},
+}
+
+func setClientProfile(s string) error {
+	if _, ok := protocolProfiles[s]; !ok {
+		return fmt.Errorf("unknown protocol profile %q, expected one of %s", s, profileNames())
+	}
+	clientProfile = s
+	return nil
+}
+
+// profileNames lists the names of the profiles, comma separated.
+func profileNames() string {
+	names := make([]string, 0, len(protocolProfiles))
+	for name := range protocolProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// parseContentType returns the profile of the ndjson content type s, the
+// first generation if it has none.
+func parseContentType(s string) (protocolProfile, error) {
+	mediaType, params, err := mime.ParseMediaType(s)
+	if err != nil {
+		return protocolProfile{}, err
+	}
+	if mediaType != ContentTypeNdJson {
+		return protocolProfile{}, fmt.Errorf("expected %s, got %s", ContentTypeNdJson, mediaType)
+	}
+	name, ok := params["profile"]
+	if !ok {
+		name = defaultProfile
+	}
+	profile, ok := protocolProfiles[name]
+	if !ok {
+		return protocolProfile{}, fmt.Errorf("unknown protocol profile %q", name)
+	}
+	return profile, nil
+}
+
+// contentType returns the content type of the profile name, the bare ndjson
+// one without name.
+func contentType(name string) string {
+	if name == "" {
+		return ContentTypeNdJson
+	}
+	return mime.FormatMediaType(ContentTypeNdJson, map[string]string{"profile": name})
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// With connectProxy the client tunnels its connections to the server through
+// the HTTP proxy at that URL with CONNECT, whatever the scheme of the
+// server, as corporate proxies expect, rather than having a proxy forward
+// its requests one by one. Without it the client tunnels through the proxy
+// of HTTPS_PROXY, unless NO_PROXY excludes the server, as for https. The
+// user info of the proxy URL is sent as basic Proxy-Authorization. A proxy
+// passes on the bytes of a tunnel as they come, so streaming works through
+// it unless the proxy inspects the traffic; the client reports whether it
+// received messages through the tunnel, and with -probe-interval it tells
+// a proxy holding responses back, as it does any other path.
+var connectProxy *url.URL
+
+// checkConnectProxy validates connectProxy and socksProxy against the other
+// flags.
+func checkConnectProxy() error {
+	if connectProxy == nil && socksProxy == "" {
+		return nil
+	}
+	if connectProxy != nil && socksProxy != "" {
+		return fmt.Errorf("-proxy and -socks5 do not combine")
+	}
+	if unixSocket != "" || h3 || grpcMode || tcpBaseline || reverseProxy {
+		return fmt.Errorf("-proxy and -socks5 do not combine with a unix socket, -h3, -grpc, tcp mode or -reverse-proxy, which do not dial the server with the transport of the client")
+	}
+	return nil
+}
+
+func setConnectProxy(s string) error {
+	proxy, err := url.Parse(s)
+	if err != nil || proxy.Scheme != "http" || proxy.Host == "" {
+		return fmt.Errorf("expected proxy url as http://host:port, got %q", s)
+	}
+	connectProxy = proxy
+	return nil
+}
+
+// proxyStats are the counts of the tunnels of the client, published with
+// expvar.
+type proxyStats struct {
+	Proxy    string
+	Tunnels  int64
+	Failures int64
+	// EndToEnd is whether a stream received a message through a tunnel
+	EndToEnd bool
+}
+
+var tunnels = struct {
+	mu    sync.Mutex
+	stats proxyStats
+	// opened and endToEnd are whether stats count a tunnel and
+	// stats.EndToEnd, read without the lock on every message received
+	opened   atomic.Bool
+	endToEnd atomic.Bool
+}{}
+
+func init() {
+	expvar.Publish("proxy", expvar.Func(func() any {
+		tunnels.mu.Lock()
+		defer tunnels.mu.Unlock()
+		return tunnels.stats
+	}))
+}
+
+// proxyConfigured returns whether the client may tunnel through a proxy.
+func proxyConfigured() bool {
+	return connectProxy != nil || socksProxy != "" || os.Getenv("HTTPS_PROXY") != "" || os.Getenv("https_proxy") != ""
+}
+
+// proxyFor returns the proxy to tunnel to address through, nil to connect
+// directly.
+func proxyFor(address string) *url.URL {
+	if socksProxy != "" {
+		return &url.URL{Scheme: "socks5", Host: socksProxy}
+	}
+	if connectProxy != nil {
+		return connectProxy
+	}
+	return proxyFromEnvironment(address)
+}
+
+// proxyFromEnvironment returns the proxy of the environment for https to
+// address, nil if none.
+func proxyFromEnvironment(address string) *url.URL {
+	proxy, err := http.ProxyFromEnvironment(&http.Request{URL: &url.URL{Scheme: "https", Host: address}})
+	if err != nil || proxy == nil || proxy.Scheme != "http" {
+		return nil
+	}
+	return proxy
+}
+
+// dialTunnel returns a dial function like dial tunneling through the proxy
+// for the address dialed, if any.
+func dialTunnel(dial func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		proxy := proxyFor(address)
+		if proxy == nil {
+			return dial(ctx, network, address)
+		}
+		conn, err := openTunnel(ctx, dial, network, proxy, address)
+		tunnels.mu.Lock()
+		defer tunnels.mu.Unlock()
+		tunnels.stats.Proxy = proxy.Redacted()
+		if err != nil {
+			tunnels.stats.Failures++
+			return nil, err
+		}
+		tunnels.stats.Tunnels++
+		tunnels.opened.Store(true)
+		clientLog.Info("client: tunneled through proxy", "proxy", proxy.Redacted(), "target", address)
+		return conn, nil
+	}
+}
+
+// openTunnel connects to address through proxy, with CONNECT unless it is a
+// SOCKS5 proxy.
+func openTunnel(ctx context.Context, dial func(ctx context.Context, network, address string) (net.Conn, error), network string, proxy *url.URL, address string) (net.Conn, error) {
+	if proxy.Scheme == "socks5" {
+		return openSOCKSTunnel(ctx, dial, network, proxy, address)
+	}
+	proxyAddress := proxy.Host
+	if proxy.Port() == "" {
+		proxyAddress = net.JoinHostPort(proxy.Hostname(), "80")
+	}
+	conn, err := dial(ctx, network, proxyAddress)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to proxy, error was: %w", err)
+	}
+	// a proxy not answering holds the handshake only until ctx is done
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	err = req.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send CONNECT to proxy, error was: %w", err)
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read answer of proxy to CONNECT, error was: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused tunnel to %s with status %s", address, resp.Status)
+	}
+	if !stop() {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	if r.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: r}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a connection of which r buffered the first bytes read.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// observeTunnelReceived records that a stream, logging to log, received a
+// message, which shows streaming works end to end if through a tunnel.
+func observeTunnelReceived(log *slog.Logger) {
+	if !tunnels.opened.Load() || tunnels.endToEnd.Load() {
+		return
+	}
+	tunnels.mu.Lock()
+	defer tunnels.mu.Unlock()
+	if tunnels.stats.EndToEnd {
+		return
+	}
+	tunnels.stats.EndToEnd = true
+	tunnels.endToEnd.Store(true)
+	log.Info("client: streaming works end to end through proxy, received a message through the tunnel", "proxy", tunnels.stats.Proxy)
+}
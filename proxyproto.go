@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyProtocol makes the server expect the PROXY protocol header, version 1
+// or 2, of a TCP load balancer at the start of every connection and take the
+// client address from it. Connections without the header are closed, so it
+// may only be set when all connections come through such load balancers.
+var proxyProtocol = false
+
+// proxyHeaderTimeout bounds the wait for the PROXY protocol header.
+const proxyHeaderTimeout = 5 * time.Second
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyListener wraps the connections accepted by Listener to read the PROXY
+// protocol header. The header is read on first use of a connection, in its
+// own goroutine, so a slow client does not hold up accepting others.
+type proxyListener struct {
+	net.Listener
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn}, nil
+}
+
+type proxyConn struct {
+	net.Conn
+	once       sync.Once
+	reader     *bufio.Reader
+	remoteAddr net.Addr
+	err        error
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.reader = bufio.NewReader(c.Conn)
+		c.remoteAddr = c.Conn.RemoteAddr()
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		addr, err := readProxyHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			c.err = fmt.Errorf("failed to read proxy protocol header from %s, error was: %w", c.remoteAddr, err)
+			serverLog.Warn("server: closing connection without valid proxy protocol header", "remote", c.remoteAddr, "error", err)
+			return
+		}
+		if addr.IsValid() {
+			c.remoteAddr = net.TCPAddrFromAddrPort(addr)
+		}
+	})
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	return c.remoteAddr
+}
+
+// readProxyHeader reads a PROXY protocol header from r and returns the source
+// address it carries. The address is invalid for headers of health checks by
+// the proxy itself or of unknown protocols, for which the peer address is
+// kept.
+func readProxyHeader(r *bufio.Reader) (netip.AddrPort, error) {
+	signature, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	if bytes.Equal(signature, proxyV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+	return readProxyHeaderV1(r)
+}
+
+// readProxyHeaderV1 reads the text header, such as
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n".
+func readProxyHeaderV1(r *bufio.Reader) (netip.AddrPort, error) {
+	// the longest valid header is 107 bytes
+	line, err := r.ReadSlice('\n')
+	if err != nil || len(line) > 107 {
+		return netip.AddrPort{}, fmt.Errorf("no proxy protocol header")
+	}
+	fields := strings.Fields(strings.TrimSuffix(string(line), "\r\n"))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return netip.AddrPort{}, fmt.Errorf("no proxy protocol header")
+	}
+	if fields[1] == "UNKNOWN" {
+		return netip.AddrPort{}, nil
+	}
+	if (fields[1] != "TCP4" && fields[1] != "TCP6") || len(fields) != 6 {
+		return netip.AddrPort{}, fmt.Errorf("malformed proxy protocol header %q", line)
+	}
+	addr, err := netip.ParseAddr(fields[2])
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("malformed proxy protocol source address, error was: %w", err)
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("malformed proxy protocol source port, error was: %w", err)
+	}
+	return netip.AddrPortFrom(addr, uint16(port)), nil
+}
+
+// readProxyHeaderV2 reads the binary header: the signature, the version and
+// command, the address family and protocol, the length of the rest and then
+// the addresses, possibly followed by extensions which are skipped.
+func readProxyHeaderV2(r *bufio.Reader) (netip.AddrPort, error) {
+	var header [16]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	if header[12]>>4 != 2 {
+		return netip.AddrPort{}, fmt.Errorf("unsupported proxy protocol version %d", header[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	const local, proxy = 0, 1
+	switch header[12] & 0xf {
+	case local:
+		return netip.AddrPort{}, nil
+	case proxy:
+	default:
+		return netip.AddrPort{}, fmt.Errorf("unsupported proxy protocol command %d", header[12]&0xf)
+	}
+	const tcp4, tcp6 = 0x11, 0x21
+	switch header[13] {
+	case tcp4:
+		if len(payload) < 12 {
+			return netip.AddrPort{}, fmt.Errorf("short proxy protocol addresses")
+		}
+		addr := netip.AddrFrom4([4]byte(payload[0:4]))
+		return netip.AddrPortFrom(addr, binary.BigEndian.Uint16(payload[8:10])), nil
+	case tcp6:
+		if len(payload) < 36 {
+			return netip.AddrPort{}, fmt.Errorf("short proxy protocol addresses")
+		}
+		addr := netip.AddrFrom16([16]byte(payload[0:16]))
+		return netip.AddrPortFrom(addr, binary.BigEndian.Uint16(payload[32:34])), nil
+	default:
+		return netip.AddrPort{}, nil
+	}
+}
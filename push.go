@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The push workload has the server push generated data messages of pushSize
+// bytes to its streams, as fast as an outbound capacity of pushRate messages
+// per second allows. A single scheduler shares the capacity among the
+// streams round robin: every pushRoundInterval it grants the streams in turn
+// a budget of up to pushBudget messages each, until the capacity of the round
+// is used, continuing with the next stream in the next round. Streams still
+// busy writing their previous grant are skipped, so a client reading fast
+// cannot starve the slow ones, and a slow one does not hold on to capacity
+// the others could use. The client reads slowly with pushReadDelay, and
+// through a receive buffer with recvBuffer.
+//
+// With pushBurst the capacity is a token bucket instead, refilled at
+// pushRate: capacity the streams left unused, as they were busy or there was
+// no stream, is kept for later rounds, up to pushBurst messages, so the
+// server pushes above pushRate for as long as that lasts, as a bursty sender
+// does, and at pushRate on average. The bucket starts full, as after a
+// sender was idle.
+var (
+	pushRate      = 10000
+	pushBurst     = 0
+	pushBudget    = 16
+	pushSize      = 256
+	pushReadDelay = time.Duration(0)
+)
+
+const (
+	pushRoundInterval    = 10 * time.Millisecond
+	pushFairnessInterval = 5 * time.Second
+)
+
+// pushStream is a stream of the push workload, as seen by the scheduler.
+type pushStream struct {
+	id      uint64
+	remote  string
+	started time.Time
+	// grants carries the budget of a round to the writer of the stream
+	grants chan int
+	// busy is set from granting a budget until it is written
+	busy atomic.Bool
+	// counted by the scheduler, under its mu
+	granted int64
+	skipped int64
+	// counted by the writer
+	sent atomic.Int64
+	// sent at the previous fairness report
+	reported int64
+}
+
+// pushScheduler grants the push streams their budgets, running only while
+// there are streams.
+type pushScheduler struct {
+	mu      sync.Mutex
+	streams []*pushStream
+	nextID  uint64
+	// index of the stream granted first in the next round
+	next    int
+	running bool
+	// capacity kept in the bucket with pushBurst
+	tokens int
+}
+
+var pusher = &pushScheduler{}
+
+func init() {
+	expvar.Publish("push", expvar.Func(pusher.vars))
+}
+
+func (s *pushScheduler) add(remote string) *pushStream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	p := &pushStream{id: s.nextID, remote: remote, started: clk.Now(), grants: make(chan int, 1)}
+	s.streams = append(s.streams, p)
+	if !s.running {
+		s.running = true
+		s.tokens = pushBurst
+		go s.run()
+	}
+	return p
+}
+
+func (s *pushScheduler) remove(p *pushStream) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := slices.Index(s.streams, p)
+	if i < 0 {
+		return
+	}
+	s.streams = slices.Delete(s.streams, i, i+1)
+	if s.next > i {
+		s.next--
+	}
+}
+
+func (s *pushScheduler) run() {
+	rounds := clk.NewTicker(pushRoundInterval)
+	defer rounds.Stop()
+	reports := clk.NewTicker(pushFairnessInterval)
+	defer reports.Stop()
+	for {
+		select {
+		case <-rounds.C():
+			if !s.round() {
+				return
+			}
+		case <-reports.C():
+			s.reportFairness()
+		}
+	}
+}
+
+// round grants the budgets of one round, and returns false, stopping the
+// scheduler, once there are no streams left.
+func (s *pushScheduler) round() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.streams) == 0 {
+		s.running = false
+		return false
+	}
+	capacity := int(int64(pushRate) * int64(pushRoundInterval) / int64(time.Second))
+	if pushBurst > 0 {
+		// a round always has the capacity it refills
+		capacity = min(s.tokens+capacity, max(pushBurst, capacity))
+	}
+	for i := 0; i < len(s.streams) && capacity > 0; i++ {
+		p := s.streams[s.next%len(s.streams)]
+		s.next = (s.next + 1) % len(s.streams)
+		if p.busy.Load() {
+			p.skipped++
+			continue
+		}
+		budget := min(pushBudget, capacity)
+		capacity -= budget
+		p.granted += int64(budget)
+		p.busy.Store(true)
+		p.grants <- budget
+	}
+	if pushBurst > 0 {
+		s.tokens = capacity
+	}
+	return true
+}
+
+// reportFairness logs how evenly the streams were served since the previous
+// report, by Jain's fairness index of the messages sent to each: 1 when all
+// got the same, down to 1/n when a single one of n got everything.
+func (s *pushScheduler) reportFairness() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var sum, sumSq float64
+	var least, most int64
+	for i, p := range s.streams {
+		sent := p.sent.Load()
+		n := sent - p.reported
+		p.reported = sent
+		sum += float64(n)
+		sumSq += float64(n) * float64(n)
+		if i == 0 || n < least {
+			least = n
+		}
+		if i == 0 || n > most {
+			most = n
+		}
+		serverLog.Debug("server: push stream", "stream", p.id, "remote", p.remote, "sent", n, "granted", p.granted, "skipped", p.skipped)
+	}
+	fairness := 1.0
+	if sumSq > 0 {
+		fairness = sum * sum / (float64(len(s.streams)) * sumSq)
+	}
+	serverLog.Info("server: push fairness", "streams", len(s.streams), "sent", int64(sum), "least", least, "most", most, "fairness", fmt.Sprintf("%.3f", fairness))
+}
+
+// pushStreamVars is a push stream as published with expvar.
+type pushStreamVars struct {
+	ID      uint64
+	Remote  string
+	Started time.Time
+	Granted int64
+	Sent    int64
+	// rounds skipped as the stream was still busy writing
+	Skipped int64
+}
+
+func (s *pushScheduler) vars() any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	streams := make([]pushStreamVars, 0, len(s.streams))
+	for _, p := range s.streams {
+		streams = append(streams, pushStreamVars{
+			ID:      p.id,
+			Remote:  p.remote,
+			Started: p.started,
+			Granted: p.granted,
+			Sent:    p.sent.Load(),
+			Skipped: p.skipped,
+		})
+	}
+	return streams
+}
+
+func servePush(ctx context.Context, stream *serverStream) {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	defer cancelFunc()
+
+	go func() {
+		defer cancelFunc()
+		// the client is not expected to send anything but control messages,
+		// read to take those and to notice it going away
+		err := stream.discard()
+		if err != nil && ctx.Err() == nil {
+			stream.log.Error("server: failed to receive from client", "error", err)
+			return
+		}
+		stream.log.Info("server: client closed connection - finished")
+	}()
+
+	p := pusher.add(stream.request.RemoteAddr)
+	defer pusher.remove(p)
+	data := strings.Repeat("x", pushSize)
+	for {
+		var budget int
+		select {
+		case <-ctx.Done():
+			return
+		case budget = <-p.grants:
+		}
+		for i := 0; i < budget; i++ {
+			err := stream.send(responseMsg{Msg: "data", Data: data, Sent: clk.Now().UnixNano()})
+			if err != nil {
+				stream.log.Error("server: failed to push data to client", "error", err)
+				return
+			}
+			p.sent.Add(1)
+		}
+		p.busy.Store(false)
+	}
+}
+
+func runPush(ctx context.Context, stream *clientStream) error {
+	stop := context.AfterFunc(ctx, func() { stream.resp.Body.Close() })
+	defer stop()
+
+	recv := receiver(ctx, stream)
+	for {
+		var in responseMsg
+		err := recv(&in)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, io.EOF) {
+				stream.log.Info("client: context was done, exiting")
+				return nil
+			}
+			if errors.Is(err, errRecvOverflow) {
+				return err
+			}
+			return fmt.Errorf("failed to decode response message from server, error was: %w", err)
+		}
+		if in.Msg != "data" {
+			stream.log.Warn("client: received unknown push message from server", "msg", in.Msg)
+			continue
+		}
+		clientMetrics.observeLatency(clk.Since(time.Unix(0, in.Sent)))
+		if pushReadDelay > 0 {
+			clk.Sleep(ctx, pushReadDelay)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Quotas limit the concurrent streams and the messages per day of every
+// identity, the subject of its token within its tenant when authenticating
+// and otherwise its address, as the tenant header is the client's to choose.
+// Zero means unlimited.
+var (
+	quotaStreams             = 0
+	quotaMessages            = int64(0)
+	quotas        quotaStore = newMemoryQuotaStore()
+)
+
+// quotaStore keeps the usage of every identity against the quotas. A store
+// shared between servers can take the place of the default in memory one.
+type quotaStore interface {
+	// openStream counts a stream opened by identity, unless that exceeds
+	// the concurrent streams quota.
+	openStream(identity string) error
+	closeStream(identity string)
+	// countMessage counts a message received from identity at now, unless
+	// that exceeds the messages per day quota.
+	countMessage(identity string, now time.Time) error
+}
+
+// quotaError is the error of a quota exceeded, sent to the client as the
+// Quota of an error message so it can tell which quota and when it resets.
+type quotaError struct {
+	Quota    string
+	Limit    int64
+	Identity string
+	ResetAt  *time.Time `json:",omitempty"`
+}
+
+func (e *quotaError) Error() string {
+	return fmt.Sprintf("quota of %d %s exceeded", e.Limit, e.Quota)
+}
+
+// identity returns who request, authenticated with claims if authenticating,
+// is accounted to in quotas.
+func identity(request *http.Request, claims jwtClaims) string {
+	id := request.RemoteAddr
+	if jwtSecret == nil {
+		// a client could get fresh quotas with every tenant header
+		if addr := clientAddr(request); addr.IsValid() {
+			id = addr.String()
+		}
+		return id
+	}
+	id = claims.Subject
+	if tenant, _ := tenantFor(requestTenant(request, claims)); tenant != defaultTenant {
+		return tenant + "/" + id
+	}
+	return id
+}
+
+type memoryQuotaStore struct {
+	mu      sync.Mutex
+	streams map[string]int
+	// messages per identity on day, the days since the unix epoch in UTC
+	day      int64
+	messages map[string]int64
+}
+
+func newMemoryQuotaStore() *memoryQuotaStore {
+	return &memoryQuotaStore{streams: map[string]int{}, messages: map[string]int64{}}
+}
+
+func (s *memoryQuotaStore) openStream(identity string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if quotaStreams > 0 && s.streams[identity] >= quotaStreams {
+		return &quotaError{Quota: "concurrent streams", Limit: int64(quotaStreams), Identity: identity}
+	}
+	s.streams[identity]++
+	return nil
+}
+
+func (s *memoryQuotaStore) closeStream(identity string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.streams[identity]--
+	if s.streams[identity] <= 0 {
+		delete(s.streams, identity)
+	}
+}
+
+func (s *memoryQuotaStore) countMessage(identity string, now time.Time) error {
+	if quotaMessages <= 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	day := now.Unix() / (24 * 60 * 60)
+	if day != s.day {
+		s.day = day
+		clear(s.messages)
+	}
+	if s.messages[identity] >= quotaMessages {
+		resetAt := time.Unix((day+1)*24*60*60, 0).UTC()
+		return &quotaError{Quota: "messages per day", Limit: quotaMessages, Identity: identity, ResetAt: &resetAt}
+	}
+	s.messages[identity]++
+	return nil
+}
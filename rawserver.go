@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// serverStack selects the HTTP/1.1 server implementation: net/http, or raw,
+// a minimal one written directly against the connections which serves the
+// same handlers, so the cost of the full duplex path of net/http can be
+// compared, as in ab mode with -server-stack raw as one configuration. Only
+// requests are parsed with net/http.
+var serverStack = "net/http"
+
+// rawStackGaps are the features of net/http found missing from the raw stack,
+// logged when it starts.
+var rawStackGaps = []string{
+	"request contexts are not cancelled when the client goes away, only reads and writes fail",
+	"no read, write or idle timeouts and no limit on the header size",
+	"no Expect: 100-continue, HTTP/2 or TLS",
+	"responses are always chunked, even without a body",
+	"streams still open 5s into shutdown are closed instead of left running",
+}
+
+const (
+	rawShutdownTimeout = 5 * time.Second
+	// rawMaxDrain is the most of a request body left unread by its handler
+	// read to reuse the connection, as net/http does
+	rawMaxDrain = 256 << 10
+)
+
+func setServerStack(s string) error {
+	switch s {
+	case "net/http", "raw":
+		serverStack = s
+		return nil
+	}
+	return fmt.Errorf("unknown server stack %q, expected net/http or raw", s)
+}
+
+// serveRaw serves handler on ln with the raw stack until ctx is done.
+func serveRaw(ctx context.Context, ln net.Listener, handler http.Handler) error {
+	serverLog.Warn("server: serving with raw http stack, lacking features of net/http", "gaps", rawStackGaps)
+	stop := context.AfterFunc(ctx, func() { ln.Close() })
+	defer stop()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	conns := map[net.Conn]struct{}{}
+	var err error
+	for {
+		var conn net.Conn
+		conn, err = ln.Accept()
+		if err != nil {
+			break
+		}
+		mu.Lock()
+		conns[conn] = struct{}{}
+		mu.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serveRawConn(ctx, conn, handler)
+			mu.Lock()
+			delete(conns, conn)
+			mu.Unlock()
+		}()
+	}
+	if ctx.Err() == nil {
+		return fmt.Errorf("server: failed to accept connection, error was: %w", err)
+	}
+
+	serverLog.Info("server: context was done, shutting down server")
+	defer serverLog.Info("server: finished shutting down")
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-clk.After(rawShutdownTimeout):
+		mu.Lock()
+		for conn := range conns {
+			conn.Close()
+		}
+		mu.Unlock()
+		<-done
+	}
+	return nil
+}
+
+// serveRawConn serves the requests on conn one after the other, until the
+// client or a handler closes it or ctx is done.
+func serveRawConn(ctx context.Context, conn net.Conn, handler http.Handler) {
+	defer conn.Close()
+	// connections waiting for their next request are closed on shutdown
+	var idle atomic.Bool
+	idle.Store(true)
+	stop := context.AfterFunc(ctx, func() {
+		if idle.Load() {
+			conn.Close()
+		}
+	})
+	defer stop()
+
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	for ctx.Err() == nil {
+		request, err := http.ReadRequest(reader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && ctx.Err() == nil {
+				serverLog.Debug("server: failed to read request", "remote", conn.RemoteAddr(), "error", err)
+				io.WriteString(conn, "HTTP/1.1 400 Bad Request\r\nConnection: close\r\n\r\n")
+			}
+			return
+		}
+		idle.Store(false)
+		keepAlive := serveRawRequest(conn, writer, request, handler)
+		idle.Store(true)
+		if !keepAlive {
+			return
+		}
+	}
+}
+
+// serveRawRequest runs handler on request and returns whether conn can be
+// reused for the next request.
+func serveRawRequest(conn net.Conn, writer *bufio.Writer, request *http.Request, handler http.Handler) bool {
+	// as with net/http, the context of a request is not that of the server
+	ctx, cancelFunc := context.WithCancel(withConn(context.Background(), conn))
+	defer cancelFunc()
+	request = request.WithContext(ctx)
+	request.RemoteAddr = conn.RemoteAddr().String()
+
+	w := &rawResponseWriter{conn: conn, writer: writer, header: http.Header{}}
+	handler.ServeHTTP(w, request)
+	err := w.finish()
+	if err != nil {
+		serverLog.Debug("server: failed to finish response", "remote", request.RemoteAddr, "error", err)
+		return false
+	}
+	if request.Close || w.header.Get("Connection") == "close" {
+		return false
+	}
+	n, _ := io.CopyN(io.Discard, request.Body, rawMaxDrain)
+	if n == rawMaxDrain {
+		return false
+	}
+	// handlers may have left deadlines behind
+	return conn.SetDeadline(time.Time{}) == nil
+}
+
+// rawResponseWriter is the response writer of the raw stack. It has the
+// methods http.ResponseController looks for, with full duplex always on.
+type rawResponseWriter struct {
+	conn   net.Conn
+	writer *bufio.Writer
+	header http.Header
+	// nil until the header is written
+	chunks io.WriteCloser
+}
+
+func (w *rawResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *rawResponseWriter) WriteHeader(status int) {
+	if w.chunks != nil {
+		return
+	}
+	fmt.Fprintf(w.writer, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	w.header.Set("Transfer-Encoding", "chunked")
+	w.header.Write(w.writer)
+	w.writer.WriteString("\r\n")
+	w.chunks = httputil.NewChunkedWriter(w.writer)
+}
+
+func (w *rawResponseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.chunks.Write(p)
+}
+
+func (w *rawResponseWriter) FlushError() error {
+	w.WriteHeader(http.StatusOK)
+	return w.writer.Flush()
+}
+
+func (w *rawResponseWriter) Flush() {
+	w.FlushError()
+}
+
+func (w *rawResponseWriter) EnableFullDuplex() error {
+	return nil
+}
+
+func (w *rawResponseWriter) SetReadDeadline(deadline time.Time) error {
+	return w.conn.SetReadDeadline(deadline)
+}
+
+func (w *rawResponseWriter) SetWriteDeadline(deadline time.Time) error {
+	return w.conn.SetWriteDeadline(deadline)
+}
+
+// finish ends the chunked response body and flushes it.
+func (w *rawResponseWriter) finish() error {
+	w.WriteHeader(http.StatusOK)
+	w.chunks.Close()
+	// no trailers
+	w.writer.WriteString("\r\n")
+	return w.writer.Flush()
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// Record mode runs a short scripted exchange on a stream of the pong path and
+// writes what it prints as a terminal recording in the asciicast v2 format of
+// asciinema to recordOut, to share a demonstration of duplex streaming on
+// some infrastructure that anyone can replay with asciinema play. The script
+// pings recordPings times every pingInterval, waiting for every pong, then
+// sends as many pings at once while receiving their pongs, which shows the
+// pongs arriving while the client is still sending, and half-closes the
+// stream, waiting for the server to end the response. The recording ends
+// with the latency measured, and the measurements of the client are written
+// as with -summary-out next to it, to recordOut with the extension .json.
+// The exchange runs against an embedded server, or with recordExternal
+// against the server at -hostport, such as one across the infrastructure to
+// demonstrate.
+var (
+	recordOut      = "duplex.cast"
+	recordPings    = 5
+	recordExternal = false
+)
+
+const (
+	// recordWidth and recordHeight are the size of the terminal of the
+	// recording, wide enough for the lines of the script
+	recordWidth  = 100
+	recordHeight = 30
+)
+
+// castHeader is the first line of an asciicast v2 file.
+type castHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// castRecorder prints lines to stdout and records them as the output events
+// of an asciicast v2 file.
+type castRecorder struct {
+	mu      sync.Mutex
+	w       *bufio.Writer
+	started time.Time
+	err     error
+}
+
+func newCastRecorder(w io.Writer, title string) (*castRecorder, error) {
+	r := &castRecorder{w: bufio.NewWriter(w), started: clk.Now()}
+	header := castHeader{
+		Version:   2,
+		Width:     recordWidth,
+		Height:    recordHeight,
+		Timestamp: r.started.Unix(),
+		Title:     title,
+		Env:       map[string]string{"TERM": os.Getenv("TERM"), "SHELL": os.Getenv("SHELL")},
+	}
+	err := json.NewEncoder(r.w).Encode(header)
+	if err != nil {
+		return nil, fmt.Errorf("record: failed to write header of recording, error was: %w", err)
+	}
+	return r, nil
+}
+
+// printf prints a line and records it at the time since the recording
+// started.
+func (r *castRecorder) printf(format string, args ...any) {
+	line := fmt.Sprintf(format, args...)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fmt.Println(line)
+	if r.err != nil {
+		return
+	}
+	event := []any{clk.Since(r.started).Seconds(), "o", line + "\r\n"}
+	data, err := json.Marshal(event)
+	if err != nil {
+		r.err = err
+		return
+	}
+	_, r.err = fmt.Fprintf(r.w, "%s\n", data)
+}
+
+// close flushes the recording, returning the first error writing it.
+func (r *castRecorder) close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == nil {
+		r.err = r.w.Flush()
+	}
+	if r.err != nil {
+		return fmt.Errorf("record: failed to write recording, error was: %w", r.err)
+	}
+	return nil
+}
+
+// runRecord records the scripted exchange against the server at hostPort.
+func runRecord(ctx context.Context, hostPort string) error {
+	file, err := os.Create(recordOut)
+	if err != nil {
+		return fmt.Errorf("record: failed to create recording, error was: %w", err)
+	}
+	defer file.Close()
+	rec, err := newCastRecorder(file, "full duplex streaming against "+hostPort)
+	if err != nil {
+		return err
+	}
+
+	if !recordExternal {
+		server := &scenarioServer{hostPort: hostPort}
+		err := server.start(ctx)
+		if err != nil {
+			return err
+		}
+		defer server.stop()
+	}
+
+	rec.printf("$ %s %s", filepath.Base(os.Args[0]), strings.Join(os.Args[1:], " "))
+	err = recordExchange(ctx, rec, "http://"+hostPort+workloads["pong"].path)
+	if ctx.Err() != nil {
+		slog.Info("record: context was done, exiting")
+		err = nil
+	}
+	summary := clientMetrics.summary()
+	rec.printf("latency %s over %d pongs", summary.Latency.String(), summary.Received)
+	closeErr := rec.close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	err = file.Close()
+	if err != nil {
+		return fmt.Errorf("record: failed to write recording, error was: %w", err)
+	}
+
+	data, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	metricsOut := strings.TrimSuffix(recordOut, filepath.Ext(recordOut)) + ".json"
+	err = os.WriteFile(metricsOut, data, 0o644)
+	if err != nil {
+		return fmt.Errorf("record: failed to write measurements, error was: %w", err)
+	}
+	slog.Info("record: wrote recording and measurements", "recording", recordOut, "measurements", metricsOut)
+	return nil
+}
+
+// recordExchange runs the script on a stream to address, printing it to rec.
+func recordExchange(ctx context.Context, rec *castRecorder, address string) error {
+	started := clk.Now()
+	stream, err := openStream(ctx, address)
+	if err != nil {
+		return err
+	}
+	defer stream.resp.Body.Close()
+	stop := context.AfterFunc(ctx, func() { stream.resp.Body.Close() })
+	defer stop()
+	rec.printf("opened stream to %s over %s in %v", address, stream.resp.Proto, clk.Since(started).Round(time.Microsecond))
+
+	rec.printf("# ping and wait for every pong")
+	var pings int64
+	for i := 0; i < recordPings; i++ {
+		err := clk.Sleep(ctx, pingInterval)
+		if err != nil {
+			return err
+		}
+		pings++
+		sent := clk.Now()
+		err = stream.send(requestMsg{Msg: "ping", Seq: stream.seq(pings)})
+		if err != nil {
+			return fmt.Errorf("record: failed to send ping to server, error was: %w", err)
+		}
+		rec.printf("-> ping %d", pings)
+		err = recordPong(rec, stream, pings, sent)
+		if err != nil {
+			return err
+		}
+	}
+
+	rec.printf("# send %d pings at once, receiving their pongs meanwhile", recordPings)
+	// the send times of the pings, in the order their pongs arrive in
+	sentAt := make(chan time.Time, recordPings)
+	eg := errgroup.Group{}
+	eg.Go(func() error {
+		for i := 0; i < recordPings; i++ {
+			n := pings + int64(i) + 1
+			sentAt <- clk.Now()
+			err := stream.send(requestMsg{Msg: "ping", Seq: stream.seq(n)})
+			if err != nil {
+				return fmt.Errorf("record: failed to send ping to server, error was: %w", err)
+			}
+			rec.printf("-> ping %d", n)
+		}
+		return nil
+	})
+	eg.Go(func() error {
+		for i := 0; i < recordPings; i++ {
+			err := recordPong(rec, stream, pings+int64(i)+1, <-sentAt)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	err = eg.Wait()
+	if err != nil {
+		return err
+	}
+
+	rec.printf("# half-close the request body, waiting for the server to end the response")
+	err = stream.closeSend()
+	if err != nil {
+		return fmt.Errorf("record: failed to close request body, error was: %w", err)
+	}
+	var in responseMsg
+	err = stream.recv(&in)
+	if !errors.Is(err, io.EOF) {
+		return fmt.Errorf("record: server did not end the response after the request body, error was: %v", err)
+	}
+	rec.printf("server ended the response, %v after the stream was opened", clk.Since(started).Round(time.Millisecond))
+	clientMetrics.streamClosed(errStreamFinished)
+	return nil
+}
+
+// recordPong receives the pong answering ping n, sent at sent, from stream
+// and prints it to rec with its round trip.
+func recordPong(rec *castRecorder, stream *clientStream, n int64, sent time.Time) error {
+	var in responseMsg
+	err := stream.recv(&in)
+	if err != nil {
+		return fmt.Errorf("record: failed to receive pong from server, error was: %w", err)
+	}
+	if in.Msg == "error" {
+		return fmt.Errorf("record: server ended stream with error: %s", in.Error)
+	}
+	rtt := clk.Since(sent)
+	clientMetrics.observeLatency(rtt)
+	rec.printf("<- %s %d, round trip %v", in.Msg, n, rtt.Round(time.Microsecond))
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// With recvBuffer the client decodes the messages it receives in the
+// background into a buffer of that many messages, from which the workload
+// consumes them, mirroring the eviction policy of the server on the client.
+// recvOverflow sets what happens to a message received while the workload
+// does not keep up and the buffer is full:
+//
+//	block       stop reading until there is room, leaving the backlog to the
+//	            server as without a buffer
+//	drop        drop the message, counted as dropped
+//	disconnect  close the stream
+var (
+	recvBuffer   = 0
+	recvOverflow = "block"
+)
+
+var errRecvOverflow = errors.New("receive buffer full, disconnected")
+
+func setRecvOverflow(s string) error {
+	switch s {
+	case "block", "drop", "disconnect":
+		recvOverflow = s
+		return nil
+	}
+	return fmt.Errorf("unknown receive overflow policy %q, expected block, drop or disconnect", s)
+}
+
+// receiver returns the function the workload receives the messages of
+// stream with, through a receive buffer with recvBuffer. Once the stream
+// ends it returns the messages left in the buffer before the error.
+func receiver(ctx context.Context, stream *clientStream) func(v *responseMsg) error {
+	if recvBuffer <= 0 {
+		return func(v *responseMsg) error { return stream.recv(v) }
+	}
+	// the size of a message is that of its json, accounted as buffered by
+	// the stream while in the buffer
+	type bufferedMsg struct {
+		msg  responseMsg
+		size int64
+	}
+	buffer := make(chan bufferedMsg, recvBuffer)
+	done := make(chan struct{})
+	var err error
+	go func() {
+		defer close(done)
+		for {
+			offset := stream.dec.InputOffset()
+			var msg bufferedMsg
+			err = stream.recv(&msg.msg)
+			if err != nil {
+				return
+			}
+			msg.size = stream.dec.InputOffset() - offset
+			stream.buffers.recv.Add(msg.size)
+			select {
+			case buffer <- msg:
+				continue
+			default:
+			}
+			switch recvOverflow {
+			case "drop":
+				stream.buffers.recv.Add(-msg.size)
+				clientMetrics.messageDropped()
+			case "disconnect":
+				stream.buffers.recv.Add(-msg.size)
+				err = errRecvOverflow
+				stream.resp.Body.Close()
+				return
+			default:
+				select {
+				case buffer <- msg:
+				case <-ctx.Done():
+					stream.buffers.recv.Add(-msg.size)
+					err = ctx.Err()
+					return
+				}
+			}
+		}
+	}()
+	take := func(v *responseMsg, msg bufferedMsg) {
+		stream.buffers.recv.Add(-msg.size)
+		*v = msg.msg
+	}
+	return func(v *responseMsg) error {
+		select {
+		case msg := <-buffer:
+			take(v, msg)
+			return nil
+		case <-done:
+		}
+		select {
+		case msg := <-buffer:
+			take(v, msg)
+			return nil
+		default:
+			return err
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// registeredStream is an active stream on the server, as tracked by the
+// stream registry.
+type registeredStream struct {
+	id      uint64
+	path    string
+	remote  string
+	started time.Time
+	conn    net.Conn
+	cancel  context.CancelCauseFunc
+	// tenant is the tenant of the stream, and tenantCounts the measurements
+	// it is accounted to, those of overflowTenant beyond maxTenants
+	tenant       string
+	tenantCounts *tenantCounts
+	// since when the receive backlog of the client is over evictBacklog,
+	// only used by evictSlowClients
+	overBacklogSince time.Time
+	stats            streamStats
+	buffers          streamBuffers
+	// logLevel is the level of the logger of the stream, if set apart
+	logLevel streamLogLevel
+	// done is closed by end once the stream ended, with the cause it ended
+	// with
+	done  chan struct{}
+	cause error
+}
+
+// streamRegistry tracks the active streams of the server, so they can be
+// listed and closed from outside of their handlers.
+type streamRegistry struct {
+	mu      sync.Mutex
+	nextID  uint64
+	streams map[uint64]*registeredStream
+}
+
+var activeStreams = &streamRegistry{streams: map[uint64]*registeredStream{}}
+
+// register adds a stream of tenant and returns it with its id assigned; the
+// stream is removed again by unregister.
+func (r *streamRegistry) register(path string, remote string, tenant string, conn net.Conn, cancel context.CancelCauseFunc) *registeredStream {
+	_, counts := tenantFor(tenant)
+	counts.streamOpened()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nextID++
+	s := &registeredStream{id: r.nextID, path: path, remote: remote, tenant: tenant, tenantCounts: counts, started: clk.Now(), conn: conn, cancel: cancel, done: make(chan struct{})}
+	r.streams[s.id] = s
+	return s
+}
+
+func (r *streamRegistry) unregister(s *registeredStream) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.streams, s.id)
+}
+
+// end marks s ended with cause, for those watching it.
+func (s *registeredStream) end(cause error) {
+	s.tenantCounts.streamClosed(cause)
+	s.cause = cause
+	close(s.done)
+}
+
+// logger returns the server logger of s, logging at its level if set apart.
+func (s *registeredStream) logger() *slog.Logger {
+	return slog.New(streamLogHandler{Handler: serverLog.Handler(), level: &s.logLevel})
+}
+
+// get returns the active stream with id, or nil if there is none.
+func (r *streamRegistry) get(id uint64) *registeredStream {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.streams[id]
+}
+
+// oldest returns the longest running stream, or nil if there is none.
+func (r *streamRegistry) oldest() *registeredStream {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var oldest *registeredStream
+	for _, s := range r.streams {
+		if oldest == nil || s.started.Before(oldest.started) {
+			oldest = s
+		}
+	}
+	return oldest
+}
+
+// largest returns the stream buffering the most bytes, the oldest of those
+// if several do, or nil if there is none.
+func (r *streamRegistry) largest() *registeredStream {
+	var largest *registeredStream
+	var largestSize int64
+	for _, s := range r.all() {
+		size := s.buffers.snapshot().Total
+		if largest == nil || size > largestSize || size == largestSize && s.started.Before(largest.started) {
+			largest, largestSize = s, size
+		}
+	}
+	return largest
+}
+
+// all returns the active streams.
+func (r *streamRegistry) all() []*registeredStream {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	streams := make([]*registeredStream, 0, len(r.streams))
+	for _, s := range r.streams {
+		streams = append(streams, s)
+	}
+	return streams
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// With -repro-dir every stream keeps its last reproMessages messages in both
+// directions, and when reading a stream fails on a protocol error, such as a
+// malformed line, they are dumped together with the state of the stream into
+// a new timestamped directory below reproDir, so intermittent failures of
+// long runs come with the material to reproduce them.
+var (
+	reproDir      = ""
+	reproMessages = 100
+)
+
+var errMalformedMessage = errors.New("malformed message")
+
+// reproDumps numbers the dumps of the process, as several streams may fail
+// at once.
+var reproDumps atomic.Int64
+
+type reproMessage struct {
+	Time      time.Time
+	Direction string
+	Msg       json.RawMessage
+}
+
+// reproState is the state of a stream at the time of its failure, written
+// as state.json next to its messages.
+type reproState struct {
+	Manifest runManifest
+	Side     string
+	Path     string
+	Remote   string
+	Identity string `json:",omitempty"`
+	Opened   time.Time
+	Failed   time.Time
+	Error    string
+	Sent     int64
+	Received int64
+}
+
+// reproRecorder keeps the recent messages of one stream, nil unless
+// reproDir is set.
+type reproRecorder struct {
+	mu       sync.Mutex
+	state    reproState
+	messages []reproMessage
+	// index of the oldest message once messages is full
+	next int
+}
+
+func newReproRecorder(side string, path string, remote string) *reproRecorder {
+	if reproDir == "" || reproMessages <= 0 {
+		return nil
+	}
+	return &reproRecorder{state: reproState{Side: side, Path: path, Remote: remote, Opened: clk.Now()}}
+}
+
+// record keeps msg as sent or received in direction.
+func (r *reproRecorder) record(direction string, msg any) {
+	if r == nil {
+		return
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprintf("unencodable message: %v", err))
+	}
+	m := reproMessage{Time: clk.Now(), Direction: direction, Msg: data}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if direction == "sent" {
+		r.state.Sent++
+	} else {
+		r.state.Received++
+	}
+	if len(r.messages) < reproMessages {
+		r.messages = append(r.messages, m)
+		return
+	}
+	r.messages[r.next] = m
+	r.next = (r.next + 1) % len(r.messages)
+}
+
+// isProtocolError reports whether err of reading a stream means the peer
+// broke the protocol, rather than the stream ending.
+func isProtocolError(err error) bool {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	return errors.As(err, &syntaxErr) || errors.As(err, &typeErr) || errors.Is(err, errMalformedMessage)
+}
+
+// dump writes the recorded messages and state of the stream, failed with
+// err, together with the bytes of the stream read but not decoded yet from
+// unparsed, to a new directory below reproDir.
+func (r *reproRecorder) dump(identity string, err error, unparsed io.Reader) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	state := r.state
+	messages := append(r.messages[r.next:len(r.messages):len(r.messages)], r.messages[:r.next]...)
+	r.mu.Unlock()
+	state.Manifest = manifest
+	state.Identity = identity
+	state.Failed = clk.Now()
+	state.Error = err.Error()
+
+	dir := filepath.Join(reproDir, fmt.Sprintf("%s-%s-%d", state.Failed.UTC().Format("20060102T150405.000Z"), state.Side, reproDumps.Add(1)))
+	dumpErr := writeRepro(dir, state, messages, unparsed)
+	if dumpErr != nil {
+		sideLog(state.Side).Error(state.Side+": failed to dump repro of protocol failure", "dir", dir, "error", dumpErr)
+		return
+	}
+	sideLog(state.Side).Warn(state.Side+": dumped repro of protocol failure", "dir", dir, "error", err)
+}
+
+func writeRepro(dir string, state reproState, messages []reproMessage, unparsed io.Reader) error {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(filepath.Join(dir, "state.json"), data, 0o644)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(filepath.Join(dir, "messages.ndjson"))
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, m := range messages {
+		err = enc.Encode(m)
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	// what follows the failing message, up to what was already read
+	rest, err := io.ReadAll(io.LimitReader(unparsed, 64<<10))
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "unparsed"), rest, 0o644)
+}
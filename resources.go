@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"runtime"
+	"time"
+)
+
+// processResources is the resource usage of the whole process at one point
+// in time. In demo mode server and client share the process, so to attribute
+// usage to one side run it on its own with -mode server or -mode client.
+type processResources struct {
+	Heap       uint64
+	Goroutines int
+	// CPU is the user and system time consumed since the process started
+	CPU time.Duration
+	// FDs is the number of open file descriptors and Connections the number
+	// of those that are TCP connections, both 0 where fdUsageSupported is
+	// false
+	FDs         int
+	Connections int
+	// FDLimit is the soft limit of open file descriptors, 0 where unknown
+	FDLimit uint64
+}
+
+func sampleResources() processResources {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	fds, connections := processFDs()
+	limit, _, _ := nofileLimit()
+	return processResources{
+		Heap:        stats.HeapAlloc,
+		Goroutines:  runtime.NumGoroutine(),
+		CPU:         processCPUTime(),
+		FDs:         fds,
+		Connections: connections,
+		FDLimit:     limit,
+	}
+}
+
+// Every connection and listener takes a file descriptor, so runs with many
+// streams hit the limit of open files, failing to accept or dial with errors
+// far from the cause. Before running, the limit is logged and warned about
+// when below nofileWarnBelow, and raised to raiseNofile if set. While
+// running, the measurements warn once the open file descriptors come close
+// to the limit.
+var raiseNofile uint64 = 0
+
+const (
+	nofileWarnBelow = 4096
+	// nofileWarnUsage is the fraction of the limit of open files in use
+	// above which the measurements warn
+	nofileWarnUsage = 0.8
+)
+
+// checkNofileLimit raises the limit of open files to raiseNofile if set, and
+// logs it.
+func checkNofileLimit() error {
+	if raiseNofile > 0 {
+		err := raiseNofileLimit(raiseNofile)
+		if err != nil {
+			return err
+		}
+	}
+	soft, hard, err := nofileLimit()
+	if err != nil {
+		return fmt.Errorf("failed to get limit of open files, error was: %w", err)
+	}
+	if soft == 0 {
+		return nil
+	}
+	slog.Info("run: limit of open files", "soft", soft, "hard", hard)
+	if soft < nofileWarnBelow {
+		slog.Warn("run: limit of open files is low for many streams, raise it with -raise-nofile", "soft", soft, "hard", hard)
+	}
+	return nil
+}
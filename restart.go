@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+var (
+	restartInterval = 10 * time.Second
+	restartClients  = 4
+	// reconnectSLA is the longest a client may be without a stream after the
+	// server restarted
+	reconnectSLA = 5 * time.Second
+)
+
+// restartClient is the reconnect record of one client of the restart mode.
+type restartClient struct {
+	id         int
+	mu         sync.Mutex
+	reconnects int
+	violations int
+	total      time.Duration
+	max        time.Duration
+	// when the client lost its stream, zero while it has one
+	disconnected time.Time
+}
+
+func (c *restartClient) lost(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.disconnected = now
+}
+
+func (c *restartClient) reconnected(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.disconnected.IsZero() {
+		return
+	}
+	downtime := now.Sub(c.disconnected)
+	c.disconnected = time.Time{}
+	c.reconnects++
+	c.total += downtime
+	c.max = max(c.max, downtime)
+	if downtime > reconnectSLA {
+		c.violations++
+		slog.Warn("restart: client reconnected outside sla", "client", c.id, "downtime", downtime, "sla", reconnectSLA)
+		return
+	}
+	slog.Info("restart: client reconnected", "client", c.id, "downtime", downtime)
+}
+
+// runRestart runs the embedded server, restarting it every restartInterval,
+// while restartClients clients keep running the single stream workload wl
+// against it, reopening their stream whenever it ends. When ctx is done it
+// prints the downtime of every client to stdout and fails if any of them took
+// longer than reconnectSLA to get a stream back.
+func runRestart(ctx context.Context, hostPort string, wl workload) error {
+	if wl.run == nil {
+		return fmt.Errorf("restart mode requires a workload running a single stream per client")
+	}
+	address := "http://" + hostPort + wl.path
+
+	clients := make([]*restartClient, restartClients)
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.Go(func() error { return clientMetrics.report(ctx) })
+	eg.Go(func() error { return restartServer(ctx, hostPort) })
+	for i := range clients {
+		c := &restartClient{id: i}
+		clients[i] = c
+		eg.Go(func() error { return c.run(ctx, address, wl.run) })
+	}
+	err := eg.Wait()
+	if err != nil {
+		return err
+	}
+
+	now := clk.Now()
+	failed := 0
+	out := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(out, "client\treconnects\ttotal downtime\tmax downtime\tover sla\t")
+	for _, c := range clients {
+		c.mu.Lock()
+		// a client still without a stream at the end counts once it is
+		// already past the sla
+		if !c.disconnected.IsZero() && now.Sub(c.disconnected) > reconnectSLA {
+			c.violations++
+			c.max = max(c.max, now.Sub(c.disconnected))
+		}
+		fmt.Fprintf(out, "%d\t%d\t%v\t%v\t%d\t\n", c.id, c.reconnects, c.total, c.max, c.violations)
+		if c.violations > 0 {
+			failed++
+		}
+		c.mu.Unlock()
+	}
+	err = out.Flush()
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d clients did not reconnect within %v", failed, len(clients), reconnectSLA)
+	}
+	return nil
+}
+
+// restartServer runs the server, shutting it down and starting it again
+// every restartInterval, until ctx is done. With reusePort the new server
+// listens before the old one shuts down, so the restart is without downtime
+// for new streams and only the streams of the old server break.
+func restartServer(ctx context.Context, hostPort string) error {
+	eg, ctx := errgroup.WithContext(ctx)
+	stop := func() {}
+	for {
+		if !reusePort {
+			// the next server can only listen once the previous one stopped
+			stop()
+		}
+		ln, err := listen(ctx, hostPort)
+		if err != nil {
+			stop()
+			if ctx.Err() == nil {
+				eg.Go(func() error { return fmt.Errorf("server: failed to listen, error was: %w", err) })
+			}
+			return eg.Wait()
+		}
+
+		serverCtx, cancelFunc := context.WithCancel(ctx)
+		done := make(chan struct{})
+		eg.Go(func() error {
+			defer close(done)
+			return serve(serverCtx, ln)
+		})
+		stop()
+		stop = func() {
+			cancelFunc()
+			<-done
+		}
+
+		select {
+		case <-ctx.Done():
+			return eg.Wait()
+		case <-clk.After(restartInterval):
+		}
+		slog.Info("restart: restarting server")
+	}
+}
+
+// run keeps a stream open against address, running run on it, until ctx is
+// done.
+func (c *restartClient) run(ctx context.Context, address string, run func(ctx context.Context, stream *clientStream) error) error {
+	var pending []any
+	for {
+		stream, err := openStream(ctx, address)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		c.reconnected(clk.Now())
+		err = stream.retry(pending)
+		if err == nil {
+			err = run(ctx, stream)
+		}
+		pending = stream.takePending()
+		if ctx.Err() == nil && stream.wentAway(err) {
+			clientMetrics.streamMigrated()
+		}
+		stream.w.Close()
+		stream.resp.Body.Close()
+		clientMetrics.streamClosed(streamCause(ctx, err))
+		if ctx.Err() != nil {
+			return nil
+		}
+		c.lost(clk.Now())
+		slog.Info("restart: client lost stream", "client", c.id, "error", err)
+	}
+}
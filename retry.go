@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// retryPending makes clients that reopen broken streams, as in restart mode,
+// send the messages possibly not delivered on the broken stream again on the
+// new one. Without acknowledgements the client cannot know what the server
+// got, so every message sent since the last message received counts as
+// possibly undelivered, as the server answers in order in the request and
+// response workloads. It is best effort: messages may still be lost, or
+// arrive twice when only the answer was lost.
+var retryPending = false
+
+// maxPending bounds the messages kept for a retry, the oldest are dropped.
+const maxPending = 1000
+
+// pendingMsg is a message kept for a retry, with the size of its json,
+// accounted as buffered by the stream.
+type pendingMsg struct {
+	msg  any
+	size int64
+}
+
+// trackSent keeps msg as pending until a message is received. It must be
+// called with s.mu held.
+func (s *clientStream) trackSent(msg any) {
+	if m, ok := msg.(requestMsg); ok && m.Msg == "auth" {
+		// the new stream is opened with a fresh token anyway
+		return
+	}
+	if len(s.pending) == maxPending {
+		s.buffers.pending.Add(-s.pending[0].size)
+		s.pending = s.pending[1:]
+	}
+	data, _ := json.Marshal(msg)
+	s.pending = append(s.pending, pendingMsg{msg: msg, size: int64(len(data))})
+	s.buffers.pending.Add(int64(len(data)))
+}
+
+// trackReceived takes a received message as acknowledgement of the pending
+// ones.
+func (s *clientStream) trackReceived() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = nil
+	s.buffers.pending.Store(0)
+}
+
+// takePending returns the messages possibly not delivered by the broken
+// stream s.
+func (s *clientStream) takePending() []any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending := make([]any, len(s.pending))
+	for i, m := range s.pending {
+		pending[i] = m.msg
+	}
+	s.pending = nil
+	s.buffers.pending.Store(0)
+	return pending
+}
+
+// retry sends the pending messages of a broken stream on s, before the
+// workload takes over s. The workload finds their number in s.retried, so
+// it can tell the answers to them apart.
+func (s *clientStream) retry(pending []any) error {
+	for _, msg := range pending {
+		err := s.send(msg)
+		if err != nil {
+			return fmt.Errorf("failed to retry pending message, error was: %w", err)
+		}
+		s.retried++
+	}
+	if len(pending) > 0 {
+		clientMetrics.messagesRetried(int64(len(pending)))
+		s.log.Info("client: retried messages pending on broken stream", "count", len(pending))
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// With reverseProxy the client streams through a httputil.ReverseProxy of
+// its own, listening on loopback and forwarding to the server, to test the
+// behaviour of the reverse proxy of Go on duplex streams without setting up
+// one. reverseProxyFlushInterval is its FlushInterval: zero flushes only
+// when its buffer fills, negative after every write. The proxy ignores it for
+// responses without a length, which it flushes after every write, so any
+// interval is expected to leave the latency of the streams unchanged.
+// With reverseProxyHold the proxy holds the body of every response back until
+// the body of its request ended, passing on only its header, as proxies do
+// which only stream a response once they got the whole request.
+var (
+	reverseProxy              = false
+	reverseProxyFlushInterval = time.Duration(0)
+	reverseProxyHold          = false
+)
+
+// serveReverseProxy serves a reverse proxy forwarding to target on ln until
+// ctx is done.
+func serveReverseProxy(ctx context.Context, ln net.Listener, target string) error {
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		return fmt.Errorf("proxy: failed to parse target %q, error was: %w", target, err)
+	}
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(targetURL)
+			r.SetXForwarded()
+		},
+		FlushInterval: reverseProxyFlushInterval,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			if r.Context().Err() == nil {
+				clientLog.Warn("proxy: failed to forward stream", "path", r.URL.Path, "error", err)
+			}
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	server := http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// the proxy copies the response while the request body is still
+			// being read, which the server of net/http allows only when told
+			err := http.NewResponseController(w).EnableFullDuplex()
+			if err != nil {
+				clientLog.Warn("proxy: failed to enable full duplex on http writer", "error", err)
+			}
+			if reverseProxyHold {
+				// the proxy does not read a request without a body
+				held := &heldResponse{ResponseWriter: w, released: r.ContentLength == 0}
+				r.Body = &requestEnd{ReadCloser: r.Body, ended: held.release}
+				w = held
+			}
+			proxy.ServeHTTP(w, r)
+		}),
+	}
+	clientLog.Info("proxy: forwarding streams through reverse proxy", "address", ln.Addr().String(), "target", target, "flush_interval", reverseProxyFlushInterval)
+
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		err := server.Serve(ln)
+		if !errors.Is(err, http.ErrServerClosed) {
+			return fmt.Errorf("proxy: failed to serve, error was: %w", err)
+		}
+		return nil
+	})
+	eg.Go(func() error {
+		<-ctx.Done()
+		// the streams end with the client anyway
+		return server.Close()
+	})
+	return eg.Wait()
+}
+
+// heldResponse holds the body of a response back until released, passing on
+// its header.
+type heldResponse struct {
+	http.ResponseWriter
+	mu       sync.Mutex
+	held     bytes.Buffer
+	released bool
+}
+
+func (w *heldResponse) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.released {
+		return w.held.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush flushes the header, and the body once released.
+func (w *heldResponse) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.released && w.held.Len() > 0 {
+		return
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// release writes out the body held back so far and passes on the rest.
+func (w *heldResponse) release() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.released {
+		return
+	}
+	w.released = true
+	if w.held.Len() == 0 {
+		// the response may not have started yet
+		return
+	}
+	w.ResponseWriter.Write(w.held.Bytes())
+	w.held.Reset()
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// requestEnd calls ended once its body was read to the end.
+type requestEnd struct {
+	io.ReadCloser
+	ended func()
+}
+
+func (r *requestEnd) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if errors.Is(err, io.EOF) {
+		r.ended()
+	}
+	return n, err
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// scenarioPath is the scenario file run by the scenario mode, or several
+// separated by commas run in parallel against the same server. A scenario is
+// a sequence of steps, one per line, run against the embedded server on the
+// pong path, with # starting a comment:
+//
+//	connect                  open a stream
+//	send N [at R/s]          send N pings, at R per second or at once
+//	pause D                  wait for the duration D
+//	expect K [within D]      wait up to D (5s) for K more pongs
+//	close                    close the stream
+//	reconnect                close the stream and open a new one
+//	kill-server              shut the embedded server down
+//	start-server             start the embedded server again
+//	assert ...               check a measurement once all steps ran, see
+//	                         scenarioAssertion
+//
+// With scenarioExternal the scenario runs against the server at -hostport
+// instead, such as one across a real network, without the server steps, which
+// parallel scenarios cannot use either.
+var (
+	scenarioPath     = ""
+	scenarioExternal = false
+)
+
+const (
+	defaultExpectWithin = 5 * time.Second
+	// scenarioCloseTimeout bounds the wait for the server to end the
+	// response of a closed stream
+	scenarioCloseTimeout = 1 * time.Second
+)
+
+// scenarioStep is one line of a scenario.
+type scenarioStep struct {
+	line int
+	text string
+	op   string
+	// messages to send or responses to expect
+	count int
+	// messages per second to send at, zero for all at once
+	rate float64
+	// duration to pause, or to wait for expected responses
+	wait      time.Duration
+	assertion scenarioAssertion
+}
+
+func parseScenario(r io.Reader) ([]scenarioStep, error) {
+	var steps []scenarioStep
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		step, err := parseScenarioStep(text)
+		if err != nil {
+			return nil, fmt.Errorf("scenario line %d: %w", line, err)
+		}
+		step.line, step.text = line, text
+		steps = append(steps, step)
+	}
+	return steps, scanner.Err()
+}
+
+func parseScenarioStep(text string) (scenarioStep, error) {
+	fields := strings.Fields(text)
+	step := scenarioStep{op: fields[0]}
+	args := fields[1:]
+	var err error
+	switch step.op {
+	case "connect", "close", "reconnect", "kill-server", "start-server":
+		if len(args) != 0 {
+			return step, fmt.Errorf("%s takes no arguments", step.op)
+		}
+	case "send":
+		if len(args) != 1 && (len(args) != 3 || args[1] != "at") {
+			return step, fmt.Errorf("expected send N [at R/s]")
+		}
+		step.count, err = strconv.Atoi(args[0])
+		if err == nil && len(args) == 3 {
+			step.rate, err = strconv.ParseFloat(strings.TrimSuffix(args[2], "/s"), 64)
+		}
+	case "pause":
+		if len(args) != 1 {
+			return step, fmt.Errorf("expected pause D")
+		}
+		step.wait, err = time.ParseDuration(args[0])
+	case "expect":
+		if len(args) != 1 && (len(args) != 3 || args[1] != "within") {
+			return step, fmt.Errorf("expected expect K [within D]")
+		}
+		step.count, err = strconv.Atoi(args[0])
+		step.wait = defaultExpectWithin
+		if err == nil && len(args) == 3 {
+			step.wait, err = time.ParseDuration(args[2])
+		}
+	case "assert":
+		step.assertion, err = parseAssertion(args)
+	default:
+		return step, fmt.Errorf("unknown step %q", step.op)
+	}
+	if err != nil {
+		return step, fmt.Errorf("malformed %s, error was: %w", step.op, err)
+	}
+	return step, nil
+}
+
+// scenarioServer is the embedded server of the scenarios.
+type scenarioServer struct {
+	hostPort string
+	// nil while the server is not running
+	stop func()
+}
+
+func (s *scenarioServer) start(ctx context.Context) error {
+	if s.stop != nil {
+		return fmt.Errorf("server is already running")
+	}
+	ln, err := listen(ctx, s.hostPort)
+	if err != nil {
+		return fmt.Errorf("server: failed to listen, error was: %w", err)
+	}
+	serverCtx, cancelFunc := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		err := serve(serverCtx, ln)
+		if err != nil {
+			slog.Error("scenario: server failed", "error", err)
+		}
+	}()
+	s.stop = func() {
+		cancelFunc()
+		<-done
+	}
+	return nil
+}
+
+func (s *scenarioServer) kill() error {
+	if s.stop == nil {
+		return fmt.Errorf("server is not running")
+	}
+	s.stop()
+	s.stop = nil
+	return nil
+}
+
+// scenarioRun is the state of a running scenario.
+type scenarioRun struct {
+	// name tags the streams of the scenario, by the scenario query parameter
+	name    string
+	steps   []scenarioStep
+	address string
+	// nil with scenarioExternal
+	server *scenarioServer
+	// whether other scenarios share server
+	parallel bool
+
+	stream *clientStream
+	// closed by the reader of stream once it stops
+	readerDone chan struct{}
+	// send times of the pings not answered yet, oldest first
+	mu     sync.Mutex
+	sentAt []time.Time
+	// measurements for assertions
+	latency    histogram
+	sent       int64
+	gaps       int64
+	reconnects int64
+	// responses received, and those already taken by expect steps
+	received atomic.Int64
+	expected int64
+	// wakes expect steps when a response arrives
+	arrived chan struct{}
+}
+
+// runScenarios runs the scenarios in the comma separated files of paths in
+// parallel against the server on hostPort, embedded unless scenarioExternal
+// is set, each failing on the first of its steps that fails.
+func runScenarios(ctx context.Context, hostPort string, paths string) error {
+	var runs []*scenarioRun
+	names := map[string]int{}
+	for _, path := range strings.Split(paths, ",") {
+		steps, err := loadScenario(path)
+		if err != nil {
+			return err
+		}
+		name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		names[name]++
+		if names[name] > 1 {
+			name += "-" + strconv.Itoa(names[name])
+		}
+		runs = append(runs, &scenarioRun{
+			name:    name,
+			steps:   steps,
+			address: "http://" + hostPort + workloads["pong"].path + "?scenario=" + url.QueryEscape(name),
+			arrived: make(chan struct{}, 1),
+		})
+	}
+
+	ctx, cancelFunc := context.WithCancel(ctx)
+	defer cancelFunc()
+	go clientMetrics.report(ctx)
+	var server *scenarioServer
+	if !scenarioExternal {
+		server = &scenarioServer{hostPort: hostPort}
+		err := server.start(ctx)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if server.stop != nil {
+				server.stop()
+			}
+		}()
+	}
+
+	errs := make([]error, len(runs))
+	var wg sync.WaitGroup
+	for i, run := range runs {
+		i, run := i, run
+		run.server = server
+		run.parallel = len(runs) > 1
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = run.run(ctx)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+func loadScenario(path string) ([]scenarioStep, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open scenario, error was: %w", err)
+	}
+	defer f.Close()
+	return parseScenario(f)
+}
+
+// run runs the steps of the scenario and checks its assertions.
+func (r *scenarioRun) run(ctx context.Context) error {
+	defer r.closeStream()
+	for _, step := range r.steps {
+		slog.Info("scenario: running step", "scenario", r.name, "line", step.line, "step", step.text)
+		err := r.step(ctx, step)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("scenario %s line %d %q failed, error was: %w", r.name, step.line, step.text, err)
+		}
+	}
+	// pings still unanswered once the stream is closed count as gaps
+	r.closeStream()
+	var report bytes.Buffer
+	failed := r.checkAssertions(&report)
+	os.Stdout.Write(report.Bytes())
+	if failed > 0 {
+		return fmt.Errorf("scenario %s: %d assertions failed", r.name, failed)
+	}
+	r.mu.Lock()
+	slog.Info("scenario: passed", "scenario", r.name, "steps", len(r.steps), "sent", r.sent, "received", r.received.Load(), "gaps", r.gaps, "latency", r.latency.String())
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *scenarioRun) step(ctx context.Context, step scenarioStep) error {
+	switch step.op {
+	case "connect":
+		return r.connect(ctx)
+	case "close":
+		r.closeStream()
+		return nil
+	case "reconnect":
+		r.closeStream()
+		r.mu.Lock()
+		r.reconnects++
+		r.mu.Unlock()
+		return r.connect(ctx)
+	case "kill-server", "start-server":
+		if r.server == nil {
+			return fmt.Errorf("no embedded server with -scenario-external")
+		}
+		if r.parallel {
+			return fmt.Errorf("the embedded server is shared by parallel scenarios")
+		}
+		if step.op == "kill-server" {
+			return r.server.kill()
+		}
+		return r.server.start(ctx)
+	case "send":
+		return r.send(ctx, step.count, step.rate)
+	case "pause":
+		select {
+		case <-ctx.Done():
+		case <-clk.After(step.wait):
+		}
+		return nil
+	case "expect":
+		return r.expect(ctx, step.count, step.wait)
+	case "assert":
+		// checked once all steps ran
+		return nil
+	}
+	return fmt.Errorf("unknown step %q", step.op)
+}
+
+// connect opens a stream and starts reading its responses.
+func (r *scenarioRun) connect(ctx context.Context) error {
+	if r.stream != nil {
+		return fmt.Errorf("already connected")
+	}
+	stream, err := openStream(ctx, r.address)
+	if err != nil {
+		return err
+	}
+	r.stream = stream
+	r.readerDone = make(chan struct{})
+	go r.read(stream, r.readerDone)
+	return nil
+}
+
+// read counts the responses of stream until it ends, measuring the round
+// trip of each against the oldest ping not answered yet.
+func (r *scenarioRun) read(stream *clientStream, done chan struct{}) {
+	defer close(done)
+	for {
+		var in responseMsg
+		err := stream.recv(&in)
+		if err != nil {
+			slog.Debug("scenario: stream ended", "scenario", r.name, "error", err)
+			return
+		}
+		if in.Msg == "error" {
+			slog.Warn("scenario: server sent error", "scenario", r.name, "error", in.Error)
+			continue
+		}
+		r.mu.Lock()
+		if len(r.sentAt) > 0 {
+			rtt := clk.Since(r.sentAt[0])
+			clientMetrics.observeLatency(rtt)
+			r.latency.record(rtt)
+			r.sentAt = r.sentAt[1:]
+		}
+		r.mu.Unlock()
+		r.received.Add(1)
+		select {
+		case r.arrived <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// closeStream closes the stream, if any, and waits for its reader. Pings
+// not answered by then count as gaps.
+func (r *scenarioRun) closeStream() {
+	if r.stream == nil {
+		return
+	}
+	// closing the response body while it is read can leave the read
+	// blocked once the connection is reused, so the server is given the
+	// chance to end the response first
+	r.stream.w.Close()
+	select {
+	case <-r.readerDone:
+	case <-clk.After(scenarioCloseTimeout):
+		r.stream.resp.Body.Close()
+		<-r.readerDone
+	}
+	r.stream.resp.Body.Close()
+	clientMetrics.streamClosed(errStreamFinished)
+	r.stream = nil
+	r.mu.Lock()
+	r.gaps += int64(len(r.sentAt))
+	r.sentAt = nil
+	r.mu.Unlock()
+}
+
+func (r *scenarioRun) send(ctx context.Context, count int, rate float64) error {
+	if r.stream == nil {
+		return fmt.Errorf("not connected")
+	}
+	var ticker clockTicker
+	if rate > 0 {
+		ticker = clk.NewTicker(time.Duration(float64(time.Second) / rate))
+		defer ticker.Stop()
+	}
+	for i := 0; i < count; i++ {
+		if ticker != nil && i > 0 {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C():
+			}
+		}
+		r.mu.Lock()
+		r.sentAt = append(r.sentAt, clk.Now())
+		r.sent++
+		r.mu.Unlock()
+		err := r.stream.send(requestMsg{Msg: "ping"})
+		if err != nil {
+			return fmt.Errorf("failed to send ping %d of %d, error was: %w", i+1, count, err)
+		}
+	}
+	return nil
+}
+
+// expect waits up to within for count responses more than those expected
+// by previous steps.
+func (r *scenarioRun) expect(ctx context.Context, count int, within time.Duration) error {
+	r.expected += int64(count)
+	timeout := clk.NewTimer(within)
+	defer timeout.Stop()
+	for r.received.Load() < r.expected {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-timeout.C():
+			return fmt.Errorf("expected %d responses within %v, got %d", count, within, int64(count)-(r.expected-r.received.Load()))
+		case <-r.arrived:
+		}
+	}
+	return nil
+}
+
+// streamLogAttrs returns the attributes the server logs a stream of request
+// by, with the scenario it is tagged with if any.
+func streamLogAttrs(request *http.Request) []any {
+	attrs := []any{"path", request.URL.Path}
+	if name := request.URL.Query().Get("scenario"); name != "" {
+		attrs = append(attrs, "scenario", name)
+	}
+	return attrs
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// selfCheck runs a quick smoke test of the build in its environment instead
+// of the selected mode: for every server stack it serves on an ephemeral port
+// of the loopback interface, checks the conformance cases against it, except
+// the idle timeout which takes too long, and runs every workload against it
+// for selfCheckDuration. It prints the results as a matrix and fails if any
+// check failed.
+var selfCheck = false
+
+const selfCheckDuration = 1500 * time.Millisecond
+
+func runSelfCheck(ctx context.Context) error {
+	defer func(stack string) { serverStack = stack }(serverStack)
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(out, "stack\tcheck\tresult\tdetail")
+	checks, failed := 0, 0
+	for _, stack := range []string{"net/http", "raw"} {
+		serverStack = stack
+		err := selfCheckStack(ctx, func(check string, err error) {
+			checks++
+			result, detail := "pass", ""
+			if err != nil {
+				failed++
+				result, detail = "FAIL", err.Error()
+			}
+			fmt.Fprintf(out, "%s\t%s\t%s\t%s\n", stack, check, result, detail)
+		})
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("selfcheck: failed to serve with %s stack, error was: %w", stack, err)
+		}
+	}
+	err := out.Flush()
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("selfcheck: %d of %d checks failed", failed, checks)
+	}
+	return nil
+}
+
+// selfCheckStack runs the checks against a server with the current stack,
+// passing the result of each to report.
+func selfCheckStack(ctx context.Context, report func(check string, err error)) error {
+	ln, err := listen(ctx, "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	serverCtx, stopServer := context.WithCancel(ctx)
+	eg := errgroup.Group{}
+	eg.Go(func() error { return serve(serverCtx, ln) })
+	defer func() {
+		stopServer()
+		eg.Wait()
+	}()
+	address := "http://" + ln.Addr().(*net.TCPAddr).AddrPort().String()
+
+	for _, c := range conformanceCases {
+		if c.id == "C5" || ctx.Err() != nil {
+			continue
+		}
+		report(c.id+" "+c.name, c.run(ctx, address+workloads["pong"].path))
+	}
+
+	names := make([]string, 0, len(workloads))
+	for name := range workloads {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		if ctx.Err() != nil {
+			break
+		}
+		wl := workloads[name]
+		runCtx, cancelFunc := context.WithTimeout(ctx, selfCheckDuration)
+		if wl.drive != nil {
+			err = wl.drive(runCtx, address+wl.path)
+		} else {
+			err = runStream(runCtx, address+wl.path, wl.run)
+		}
+		cancelFunc()
+		report("workload "+name, err)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// countingConn counts the writes to a connection, each a syscall as the
+// connection does not buffer.
+type countingConn struct {
+	net.Conn
+	writes *atomic.Int64
+}
+
+func (c countingConn) Write(p []byte) (int, error) {
+	c.writes.Add(1)
+	return c.Conn.Write(p)
+}
+
+// BenchmarkSendWrites counts the writes to the connection of a client
+// stream per message echoed by the server of the property tests, with every
+// line written at once as send does, and with the message and its newline
+// written apart as before they were coalesced. Through io.Pipe every write
+// of the stream is a chunk and a write of its own, while the ring buffer
+// takes both halves of a line together anyway.
+func BenchmarkSendWrites(b *testing.B) {
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	ln, err := listen(ctx, "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("failed to listen, error was: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(propertyPath, streamHandler(ctx, serveProperty))
+	server := http.Server{Handler: mux, ConnContext: withConn}
+	go server.Serve(ln)
+	defer server.Close()
+	address := "http://" + ln.Addr().(*net.TCPAddr).AddrPort().String() + propertyPath
+
+	var writes atomic.Int64
+	var dialer net.Dialer
+	transport := &http.Transport{DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return countingConn{Conn: conn, writes: &writes}, nil
+	}}
+	defer transport.CloseIdleConnections()
+	previousTransport, previousPipe := clientTransport, sendPipe
+	previousClientLog, previousServerLog := clientLog, serverLog
+	defer func() {
+		clientTransport, sendPipe = previousTransport, previousPipe
+		clientLog, serverLog = previousClientLog, previousServerLog
+	}()
+	clientTransport = transport
+	// every stream of every round would log its start and end
+	clientLog = slog.New(slog.NewTextHandler(io.Discard, nil))
+	serverLog = clientLog
+
+	for _, pipe := range []bool{true, false} {
+		for _, coalesced := range []bool{false, true} {
+			name := map[bool]string{true: "pipe", false: "buffer"}[pipe] + "/" + map[bool]string{true: "coalesced", false: "split"}[coalesced]
+			b.Run(name, func(b *testing.B) {
+				sendPipe = pipe
+				stream, err := openStream(ctx, address)
+				if err != nil {
+					b.Fatalf("failed to open stream, error was: %v", err)
+				}
+				defer stream.resp.Body.Close()
+				received := make(chan struct{})
+				go func() {
+					defer close(received)
+					for {
+						var in responseMsg
+						if stream.recv(&in) != nil {
+							return
+						}
+					}
+				}()
+
+				msg := requestMsg{Msg: "echo", Value: strings.Repeat("x", 100)}
+				line, _ := json.Marshal(msg)
+				before := writes.Load()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if coalesced {
+						err = stream.send(msg)
+					} else {
+						_, err = stream.w.Write(line)
+						if err == nil {
+							_, err = stream.w.Write([]byte("\n"))
+						}
+					}
+					if err != nil {
+						b.Fatalf("failed to send message, error was: %v", err)
+					}
+				}
+				err = stream.closeSend()
+				if err != nil {
+					b.Fatalf("failed to half-close, error was: %v", err)
+				}
+				<-received
+				b.StopTimer()
+				b.ReportMetric(float64(writes.Load()-before)/float64(b.N), "writes/op")
+			})
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// sendBufferSize is the capacity of the ring buffer of a client stream.
+const sendBufferSize = 64 << 10
+
+// sendPipe makes client streams send through an io.Pipe rather than a
+// sendBuffer, to compare the two.
+var sendPipe = false
+
+// sendBuffer is the request body of a client stream, a bounded ring buffer
+// written by the workload and read by the transport. Unlike io.Pipe, where
+// every write waits for a read to take it over, writes return as soon as
+// their bytes are copied into the buffer and the transport reads everything
+// buffered at once, so senders and the transport rarely contend on the lock
+// at high message rates. Writes only block while the buffer is full.
+type sendBuffer struct {
+	mu   sync.Mutex
+	buf  []byte
+	head int // index of the first buffered byte
+	size int // number of buffered bytes
+	// closed is set when the writer closed, readerClosed when the reader
+	closed       bool
+	readerClosed bool
+	// readable and writable wake a blocked reader or writer
+	readable chan struct{}
+	writable chan struct{}
+	// buffered is set to size as it changes, for the accounting of the
+	// stream
+	buffered *atomic.Int64
+}
+
+func newSendBuffer(buffered *atomic.Int64) *sendBuffer {
+	return &sendBuffer{
+		buf:      make([]byte, sendBufferSize),
+		buffered: buffered,
+		readable: make(chan struct{}, 1),
+		writable: make(chan struct{}, 1),
+	}
+}
+
+func wake(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// Write copies p into the buffer, waiting for room while it is full. It
+// fails with io.ErrClosedPipe once either side closed.
+func (b *sendBuffer) Write(p []byte) (int, error) {
+	written := 0
+	for {
+		b.mu.Lock()
+		if b.closed || b.readerClosed {
+			b.mu.Unlock()
+			return written, io.ErrClosedPipe
+		}
+		for len(p) > 0 && b.size < len(b.buf) {
+			tail := (b.head + b.size) % len(b.buf)
+			end := len(b.buf)
+			if tail < b.head {
+				end = b.head
+			}
+			n := copy(b.buf[tail:end], p)
+			b.size += n
+			written += n
+			p = p[n:]
+		}
+		b.buffered.Store(int64(b.size))
+		b.mu.Unlock()
+		wake(b.readable)
+		if len(p) == 0 {
+			return written, nil
+		}
+		<-b.writable
+	}
+}
+
+// Close closes the writing side, the reader gets io.EOF once it read all
+// buffered bytes.
+func (b *sendBuffer) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+	wake(b.readable)
+	return nil
+}
+
+// reader returns the reading side of b, to be used as request body.
+func (b *sendBuffer) reader() io.ReadCloser {
+	return sendBufferReader{b}
+}
+
+type sendBufferReader struct {
+	b *sendBuffer
+}
+
+// Read copies buffered bytes to p, waiting for some while the buffer is
+// empty.
+func (r sendBufferReader) Read(p []byte) (int, error) {
+	b := r.b
+	for {
+		b.mu.Lock()
+		if b.readerClosed {
+			b.mu.Unlock()
+			return 0, io.ErrClosedPipe
+		}
+		if b.size > 0 {
+			n := 0
+			for len(p) > 0 && b.size > 0 {
+				end := min(b.head+b.size, len(b.buf))
+				m := copy(p, b.buf[b.head:end])
+				b.head = (b.head + m) % len(b.buf)
+				b.size -= m
+				n += m
+				p = p[m:]
+			}
+			b.buffered.Store(int64(b.size))
+			b.mu.Unlock()
+			wake(b.writable)
+			return n, nil
+		}
+		if b.closed {
+			b.mu.Unlock()
+			return 0, io.EOF
+		}
+		b.mu.Unlock()
+		<-b.readable
+	}
+}
+
+// Close closes the reading side, failing further writes, and a read
+// waiting for bytes, as the transport of HTTP/2 closes the body while reading
+// it.
+func (r sendBufferReader) Close() error {
+	b := r.b
+	b.mu.Lock()
+	b.readerClosed = true
+	b.mu.Unlock()
+	wake(b.writable)
+	wake(b.readable)
+	return nil
+}
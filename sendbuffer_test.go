@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// benchmarkSend writes b.N messages of size bytes to w from several
+// senders at once, while the transport is played by a reader taking up to
+// 32KiB per read from r, as the HTTP/1 transport does.
+func benchmarkSend(b *testing.B, r io.ReadCloser, w io.WriteCloser, size int) {
+	msg := append(bytes.Repeat([]byte("x"), size-1), '\n')
+	read := make(chan int64)
+	go func() {
+		var reads int64
+		buf := make([]byte, 32<<10)
+		for {
+			_, err := r.Read(buf)
+			reads++
+			if err != nil {
+				read <- reads
+				return
+			}
+		}
+	}()
+
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			_, err := w.Write(msg)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+	w.Close()
+	reads := <-read
+	b.StopTimer()
+	b.ReportMetric(float64(reads)/float64(b.N), "reads/op")
+}
+
+// BenchmarkSendBuffer measures the ring buffer client streams send through.
+func BenchmarkSendBuffer(b *testing.B) {
+	for _, size := range []int{64, 1024, 16 << 10} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			buffer := newSendBuffer(new(atomic.Int64))
+			benchmarkSend(b, buffer.reader(), buffer, size)
+		})
+	}
+}
+
+// BenchmarkSendPipe measures io.Pipe, as client streams send through with
+// sendPipe, for comparison with BenchmarkSendBuffer.
+func BenchmarkSendPipe(b *testing.B) {
+	for _, size := range []int{64, 1024, 16 << 10} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			r, w := io.Pipe()
+			benchmarkSend(b, r, w, size)
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// Sensitivity mode measures how goodput and latency degrade with loss and
+// delay on the network, for the server stack selected with -server-stack:
+// against a server of its own on an ephemeral port of the loopback, it
+// emulates every combination of sensitivityDelays and sensitivityLosses
+// with netem on that port, and for sensitivityDuration echoes numbered
+// messages of sensitivitySize through the echo path on a stream of its own,
+// with sensitivityWindow messages in flight. The echoes are checked to come
+// back in order and complete. The results are printed as a table, with the
+// goodput and latency relative to those of the first combination, which
+// without delay and loss is the baseline. It takes what netem mode takes,
+// Linux and root.
+var (
+	sensitivityDelays   = []time.Duration{0, 10 * time.Millisecond, 50 * time.Millisecond}
+	sensitivityLosses   = []float64{0, 0.5, 1, 2, 5}
+	sensitivityDuration = 5 * time.Second
+	sensitivitySize     = byteSize(1 << 10)
+)
+
+const sensitivityWindow = 32
+
+func setSensitivityDelays(s string) error {
+	var delays []time.Duration
+	for _, field := range strings.Split(s, ",") {
+		delay, err := time.ParseDuration(field)
+		if err != nil || delay < 0 {
+			return fmt.Errorf("expected non-negative delay, got %q", field)
+		}
+		delays = append(delays, delay)
+	}
+	sensitivityDelays = delays
+	return nil
+}
+
+func setSensitivityLosses(s string) error {
+	var losses []float64
+	for _, field := range strings.Split(s, ",") {
+		loss, err := strconv.ParseFloat(field, 64)
+		if err != nil || loss < 0 || loss > 100 {
+			return fmt.Errorf("expected loss in percent from 0 to 100, got %q", field)
+		}
+		losses = append(losses, loss)
+	}
+	sensitivityLosses = losses
+	return nil
+}
+
+// sensitivityPoint is the result of one combination of delay and loss.
+type sensitivityPoint struct {
+	config   netemConfig
+	messages int64
+	// bytes of payload echoed per second
+	goodput float64
+	latency histogram
+	// echoes received after one of a later message, and messages never
+	// echoed
+	outOfOrder int64
+	missing    int64
+}
+
+// runSensitivity measures every combination against a server of its own.
+func runSensitivity(ctx context.Context) error {
+	ln, err := listen(ctx, "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("sensitivity: failed to listen, error was: %w", err)
+	}
+	serverCtx, stopServer := context.WithCancel(ctx)
+	eg := errgroup.Group{}
+	eg.Go(func() error { return serve(serverCtx, ln) })
+	defer func() {
+		stopServer()
+		eg.Wait()
+	}()
+	addrPort := ln.Addr().(*net.TCPAddr).AddrPort()
+	address := "http://" + addrPort.String() + echoPath
+	config := netemConfig{
+		device: netemDevice,
+		first:  addrPort.Port(),
+		last:   addrPort.Port(),
+		jitter: netemJitter,
+	}
+
+	var points []sensitivityPoint
+	for _, delay := range sensitivityDelays {
+		for _, loss := range sensitivityLosses {
+			config.delay, config.loss = delay, loss
+			point, err := measureSensitivity(ctx, address, config)
+			if ctx.Err() != nil {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("sensitivity: %v failed, error was: %w", config, err)
+			}
+			slog.Info("sensitivity: measured", "conditions", config, "messages", point.messages, "latency", point.latency.String())
+			points = append(points, point)
+		}
+	}
+
+	fmt.Printf("server stack: %s, message size: %v\n", serverStack, sensitivitySize)
+	out := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(out, "delay\tloss\tmessages\tgoodput\tp50\tp99\tgoodput%\tp50 x\tout of order\tmissing\t")
+	base := points[0]
+	for _, p := range points {
+		fmt.Fprintf(out, "%v\t%g%%\t%d\t%.1fKiB/s\t%v\t%v\t%.0f%%\t%.1f\t%d\t%d\t\n",
+			p.config.delay, p.config.loss, p.messages, p.goodput/(1<<10),
+			p.latency.quantile(0.5), p.latency.quantile(0.99),
+			ratio(p.goodput, base.goodput)*100,
+			ratio(float64(p.latency.quantile(0.5)), float64(base.latency.quantile(0.5))),
+			p.outOfOrder, p.missing)
+	}
+	err = out.Flush()
+	if err != nil {
+		return err
+	}
+	for _, p := range points {
+		if p.outOfOrder > 0 || p.missing > 0 {
+			return fmt.Errorf("sensitivity: echoes out of order or missing under %v", p.config)
+		}
+	}
+	return nil
+}
+
+// ratio returns a over b, or 0 if b is.
+func ratio(a, b float64) float64 {
+	if b == 0 {
+		return 0
+	}
+	return a / b
+}
+
+// measureSensitivity emulates config while echoing numbered messages for
+// sensitivityDuration on a stream of its own, then half-closes it and waits
+// for the echoes still in flight.
+func measureSensitivity(ctx context.Context, address string, config netemConfig) (sensitivityPoint, error) {
+	point := sensitivityPoint{config: config}
+	remove, err := applyNetem(config)
+	if err != nil {
+		return point, err
+	}
+	defer func() {
+		err := remove()
+		if err != nil {
+			slog.Error("sensitivity: failed to remove network conditions", "error", err)
+		}
+	}()
+
+	stream, err := openStream(ctx, address)
+	if err != nil {
+		return point, err
+	}
+	defer stream.resp.Body.Close()
+	defer stream.w.Close()
+	stop := context.AfterFunc(ctx, func() {
+		stream.w.Close()
+		stream.resp.Body.Close()
+	})
+	defer stop()
+
+	measuring, cancelFunc := context.WithTimeout(ctx, sensitivityDuration)
+	defer cancelFunc()
+	payload := strings.Repeat("x", int(sensitivitySize))
+	type sentMsg struct {
+		seq int64
+		at  time.Time
+	}
+	// the messages in flight, expected to be echoed in order
+	inFlight := make(chan sentMsg, sensitivityWindow)
+	sent := make(chan error, 1)
+	go func() {
+		for seq := int64(1); ; seq++ {
+			select {
+			case inFlight <- sentMsg{seq: seq, at: clk.Now()}:
+			case <-measuring.Done():
+				close(inFlight)
+				sent <- stream.closeSend()
+				return
+			}
+			err := stream.send(requestMsg{Msg: "echo", Seq: stream.seq(seq), Value: payload})
+			if err != nil {
+				close(inFlight)
+				sent <- err
+				return
+			}
+		}
+	}()
+
+	started := clk.Now()
+	for {
+		var in responseMsg
+		err := stream.recv(&in)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return point, err
+		}
+		msg, ok := <-inFlight
+		if !ok || stream.seqNumber(in.Seq) != msg.seq || len(in.Data) != int(sensitivitySize) {
+			point.outOfOrder++
+			continue
+		}
+		point.latency.record(clk.Since(msg.at))
+		point.messages++
+	}
+	elapsed := clk.Since(started)
+	err = <-sent
+	if err != nil {
+		return point, err
+	}
+	for range inFlight {
+		point.missing++
+	}
+	point.goodput = float64(point.messages) * float64(sensitivitySize) / elapsed.Seconds()
+	return point, nil
+}
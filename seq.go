@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// The sequence numbers of the messages of clients are sharded, so they stay
+// unique across the streams of a client and across client instances, and
+// deduplication and gap analysis over the messages of many of them, merged
+// into one report or arriving at one server, tell them apart. A sequence
+// number holds the instance of the client in its top 15 bits, the stream of
+// the instance in the next 24 bits, and the number of the message on the
+// stream in the lower 24 bits. Messages retried on a reopened stream keep
+// the number they were first sent with, so the server recognizes those
+// delivered twice.
+//
+// instance is set with -instance, to give the client processes of a test
+// disjoint sequence spaces; by default it is taken from the run id, so that
+// it likely differs between processes.
+var instance int64 = -1
+
+const (
+	seqStreamBits  = 24
+	seqMessageBits = 24
+	maxInstance    = 1<<(63-seqStreamBits-seqMessageBits) - 1
+	// seqSpaceIdle is how long the server keeps tracking a sequence space
+	// after its last message
+	seqSpaceIdle = 5 * time.Minute
+)
+
+func setInstance(s string) error {
+	i, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || i < 0 || i > maxInstance {
+		return fmt.Errorf("expected instance from 0 to %d, got %q", maxInstance, s)
+	}
+	instance = i
+	return nil
+}
+
+// runInstance returns the instance of the client of the run runID, that of
+// the run id unless set.
+func runInstance(runID string) int64 {
+	if instance >= 0 {
+		return instance
+	}
+	id, _ := strconv.ParseUint(runID, 16, 64)
+	return int64(id & maxInstance)
+}
+
+// seqBase returns the first sequence number of the stream of instance,
+// numbered from 1 by the process, wrapping over 24 bits.
+func seqBase(instance, stream int64) int64 {
+	return instance<<(seqStreamBits+seqMessageBits) | (stream&(1<<seqStreamBits-1))<<seqMessageBits
+}
+
+// splitSeq returns the sequence space of seq, made of its instance and
+// stream, and the number of the message in it.
+func splitSeq(seq int64) (space int64, n int64) {
+	return seq >> seqMessageBits, seq & (1<<seqMessageBits - 1)
+}
+
+// seq returns the sequence number of the nth message of s.
+func (s *clientStream) seq(n int64) int64 {
+	return s.seqBase | n
+}
+
+// seqNumber returns which message of s seq numbers, 0 if it is of another
+// stream.
+func (s *clientStream) seqNumber(seq int64) int64 {
+	space, n := splitSeq(seq)
+	if space != s.seqBase>>seqMessageBits {
+		return 0
+	}
+	return n
+}
+
+// seqTracker follows the sequence spaces the server received messages of,
+// as the highest number received in each. Numbers at or below it are
+// duplicates, those past the next one leave a gap of the numbers skipped.
+// The first message of a space is taken as its start.
+type seqTracker struct {
+	spaces    map[int64]*seqSpace
+	lastSweep time.Time
+}
+
+type seqSpace struct {
+	highest  int64
+	lastSeen time.Time
+}
+
+// observe tracks seq received at now, returning whether it was a duplicate
+// and how many numbers it skipped.
+func (t *seqTracker) observe(seq int64, now time.Time) (duplicate bool, skipped int64) {
+	if t.spaces == nil {
+		t.spaces = map[int64]*seqSpace{}
+		t.lastSweep = now
+	}
+	if now.Sub(t.lastSweep) > seqSpaceIdle {
+		for key, space := range t.spaces {
+			if now.Sub(space.lastSeen) > seqSpaceIdle {
+				delete(t.spaces, key)
+			}
+		}
+		t.lastSweep = now
+	}
+	key, n := splitSeq(seq)
+	space, ok := t.spaces[key]
+	if !ok {
+		// the space may have started before the server did, or been
+		// forgotten while idle
+		t.spaces[key] = &seqSpace{highest: n, lastSeen: now}
+		return false, 0
+	}
+	space.lastSeen = now
+	if n <= space.highest {
+		return true, 0
+	}
+	skipped = n - space.highest - 1
+	space.highest = n
+	return false, skipped
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"pgregory.net/rapid"
+)
+
+// TestSeqSplitProperty checks that a sequence number splits into the
+// instance and stream it was based on and the number of the message.
+func TestSeqSplitProperty(t *testing.T) {
+	rapid.Check(t, func(t *rapid.T) {
+		instance := rapid.Int64Range(0, maxInstance).Draw(t, "instance")
+		stream := rapid.Int64Range(0, 1<<seqStreamBits-1).Draw(t, "stream")
+		n := rapid.Int64Range(0, 1<<seqMessageBits-1).Draw(t, "n")
+		seq := seqBase(instance, stream) | n
+		if seq < 0 {
+			t.Fatalf("sequence number %d is negative", seq)
+		}
+		space, gotN := splitSeq(seq)
+		if space != instance<<seqStreamBits|stream || gotN != n {
+			t.Fatalf("split %d into space %d and number %d, expected %d and %d", seq, space, gotN, instance<<seqStreamBits|stream, n)
+		}
+	})
+}
+
+// TestSeqTrackerProperty checks the duplicates and gaps the tracker reports
+// for messages of a few spaces, in any order and with repeats, against those
+// of the highest number received of every space.
+func TestSeqTrackerProperty(t *testing.T) {
+	rapid.Check(t, func(t *rapid.T) {
+		var tracker seqTracker
+		highest := map[int64]int64{}
+		now := time.Unix(0, 0)
+		spaces := rapid.SliceOfN(rapid.Int64Range(0, 1<<(63-seqMessageBits)-1), 1, 3).Draw(t, "spaces")
+		messages := rapid.IntRange(0, 100).Draw(t, "messages")
+		for i := 0; i < messages; i++ {
+			space := rapid.SampledFrom(spaces).Draw(t, "space")
+			n := rapid.Int64Range(0, 50).Draw(t, "n")
+			now = now.Add(time.Second)
+			duplicate, skipped := tracker.observe(space<<seqMessageBits|n, now)
+			wantDuplicate, wantSkipped := false, int64(0)
+			if h, ok := highest[space]; ok {
+				wantDuplicate = n <= h
+				if n > h {
+					wantSkipped = n - h - 1
+				}
+			}
+			if !wantDuplicate {
+				highest[space] = n
+			}
+			if duplicate != wantDuplicate || skipped != wantSkipped {
+				t.Fatalf("message %d of space %d reported as duplicate %v with %d skipped, expected %v with %d", n, space, duplicate, skipped, wantDuplicate, wantSkipped)
+			}
+		}
+	})
+}
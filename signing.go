@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// With -signing-key every message sent is signed with Ed25519, with
+// -verify-key the signature of every message received is verified, as for
+// authenticated telemetry. A signed message is sent as
+// {"Signed":<message>,"Signature":"<base64>"}, inside the seal if payload
+// encryption is enabled too.
+var (
+	signingKey ed25519.PrivateKey
+	verifyKey  ed25519.PublicKey
+)
+
+// errBadSignature is returned for a received message whose signature does
+// not verify. Such messages are counted and dropped, the stream goes on.
+var errBadSignature = errors.New("message signature does not verify")
+
+type signedMsg struct {
+	Signed    json.RawMessage
+	Signature []byte
+}
+
+// setSigningKey sets the key with which messages are signed from its 32 byte
+// seed, given as hex.
+func setSigningKey(s string) error {
+	seed, err := hex.DecodeString(s)
+	if err != nil {
+		return fmt.Errorf("signing key is not hex, error was: %w", err)
+	}
+	if len(seed) != ed25519.SeedSize {
+		return fmt.Errorf("signing key must be a %d byte seed", ed25519.SeedSize)
+	}
+	signingKey = ed25519.NewKeyFromSeed(seed)
+	return nil
+}
+
+// setVerifyKey sets the public key, given as hex, with which the signatures
+// of received messages are verified.
+func setVerifyKey(s string) error {
+	key, err := hex.DecodeString(s)
+	if err != nil {
+		return fmt.Errorf("verify key is not hex, error was: %w", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("verify key must be %d bytes", ed25519.PublicKeySize)
+	}
+	verifyKey = key
+	return nil
+}
+
+// sign returns msg wrapped in a signedMsg if signing is enabled, otherwise msg
+// itself.
+func sign(msg any) (any, error) {
+	if signingKey == nil {
+		return msg, nil
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode message to sign, error was: %w", err)
+	}
+	return signedMsg{Signed: data, Signature: ed25519.Sign(signingKey, data)}, nil
+}
+
+// verify returns the message signed in raw if its signature verifies.
+func verify(raw []byte) ([]byte, error) {
+	var signed signedMsg
+	err := json.Unmarshal(raw, &signed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode signed message, error was: %w", err)
+	}
+	if !ed25519.Verify(verifyKey, signed.Signed, signed.Signature) {
+		return nil, errBadSignature
+	}
+	return signed.Signed, nil
+}
@@ -0,0 +1,496 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// Simulation mode runs the logic that waits on time on a virtual clock, over
+// connections in memory to a server in the same process, so it runs
+// deterministically and as fast as the machine allows, without any real
+// waiting: a day of heartbeats passes in seconds. The clients of a scenario
+// are its actors. Virtual time stands still while any of them is busy, and
+// only moves on, to the next time one of them waits for, once all of them
+// wait on the clock. Each scenario is checked against what the logic has to
+// do in exactly that time:
+//
+//	heartbeat  simulateStreams idle streams send a heartbeat every
+//	           heartbeatInterval for simulateDuration, each answered at
+//	           the same virtual instant
+//	outage     the server refuses connections for simulateOutage, the
+//	           client retries every openRetryInterval and opens its stream
+//	           at the first retry after the outage
+var (
+	simulateDuration = 24 * time.Hour
+	simulateStreams  = 10
+	simulateOutage   = 5 * time.Minute
+)
+
+const (
+	// simulateStall is how long the actors may take in real time to all wait
+	// on the clock again, before the simulation counts as stuck
+	simulateStall = 10 * time.Second
+)
+
+// simulateEpoch is where virtual time starts, the same for every run.
+var simulateEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+var errSimulatedRefused = errors.New("connection refused by simulated outage")
+
+type simulationScenario struct {
+	name string
+	run  func(ctx context.Context, sim *simulation) error
+}
+
+var simulationScenarios = []simulationScenario{
+	{"heartbeat", simulateHeartbeats},
+	{"outage", simulateServerOutage},
+}
+
+// simulation is a server in memory and the virtual clock of a scenario.
+type simulation struct {
+	clock   *simClock
+	ln      *memListener
+	address string
+}
+
+// runSimulation runs every scenario and writes the matrix of their results
+// to stdout, failing if any of them failed.
+func runSimulation(ctx context.Context) error {
+	out := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(out, "scenario\tresult\tvirtual\treal\tdetail")
+	failed := 0
+	for _, scenario := range simulationScenarios {
+		started := time.Now()
+		sim, err := simulateScenario(ctx, scenario)
+		if ctx.Err() != nil {
+			return nil
+		}
+		result, detail := "pass", ""
+		if err != nil {
+			failed++
+			result, detail = "FAIL", err.Error()
+		}
+		fmt.Fprintf(out, "%s\t%s\t%v\t%v\t%s\n", scenario.name, result, sim.clock.Now().Sub(simulateEpoch), time.Since(started).Round(time.Millisecond), detail)
+	}
+	err := out.Flush()
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("simulate: %d of %d scenarios failed", failed, len(simulationScenarios))
+	}
+	return nil
+}
+
+// simulateScenario runs scenario against a server of its own, with the
+// client on its clock.
+func simulateScenario(ctx context.Context, scenario simulationScenario) (*simulation, error) {
+	sim := &simulation{
+		clock:   newSimClock(simulateEpoch),
+		ln:      newMemListener(),
+		address: "http://simulation",
+	}
+	// reports every few virtual seconds would flood the log
+	defer func(interval time.Duration) { reportInterval = interval }(reportInterval)
+	reportInterval = 0
+
+	serverCtx, stopServer := context.WithCancel(ctx)
+	eg := errgroup.Group{}
+	eg.Go(func() error { return serve(serverCtx, sim.ln) })
+	defer func() {
+		stopServer()
+		sim.ln.Close()
+		eg.Wait()
+	}()
+
+	defer func(transport http.RoundTripper) {
+		clientTransport = transport
+		clk = wallClock{}
+	}(clientTransport)
+	clientTransport = &http.Transport{DialContext: sim.ln.dial}
+	clk = sim.clock
+
+	return sim, scenario.run(ctx, sim)
+}
+
+func simulateHeartbeats(ctx context.Context, sim *simulation) error {
+	before := clientMetrics.summary().Latency
+	actorCtx, stopActors := context.WithCancel(ctx)
+	defer stopActors()
+	for i := 0; i < simulateStreams; i++ {
+		sim.clock.spawn(func() error {
+			return runStream(actorCtx, sim.address+workloads["idle"].path, runIdleStream)
+		})
+	}
+	err := sim.clock.run(simulateEpoch.Add(simulateDuration), stopActors)
+	if err != nil {
+		return err
+	}
+
+	after := clientMetrics.summary().Latency
+	answered := int64(after.count - before.count)
+	// the first heartbeat of a stream comes at a random time within the
+	// first interval
+	perStream := int64(simulateDuration / heartbeatInterval)
+	if answered < int64(simulateStreams)*perStream || answered > int64(simulateStreams)*(perStream+1) {
+		return fmt.Errorf("expected %d to %d heartbeats answered, got %d", int64(simulateStreams)*perStream, int64(simulateStreams)*(perStream+1), answered)
+	}
+	if after.max > 0 {
+		return fmt.Errorf("expected heartbeats answered without virtual time passing, took up to %v", after.max)
+	}
+	return nil
+}
+
+func simulateServerOutage(ctx context.Context, sim *simulation) error {
+	outageEnd := sim.clock.Now().Add(simulateOutage)
+	attempts := 0
+	sim.ln.refuse = func() bool {
+		attempts++
+		return sim.clock.Now().Before(outageEnd)
+	}
+	actorCtx, stopActors := context.WithCancel(ctx)
+	defer stopActors()
+	var opened time.Time
+	sim.clock.spawn(func() error {
+		return runStream(actorCtx, sim.address+workloads["pong"].path, func(ctx context.Context, stream *clientStream) error {
+			opened = sim.clock.Now()
+			return nil
+		})
+	})
+	err := sim.clock.run(outageEnd.Add(time.Hour), stopActors)
+	if err != nil {
+		return err
+	}
+
+	expected, expectedAttempts := simulateEpoch, 1
+	for expected.Before(outageEnd) {
+		expected = expected.Add(openRetryInterval)
+		expectedAttempts++
+	}
+	if !opened.Equal(expected) || attempts != expectedAttempts {
+		return fmt.Errorf("expected stream opened after %v in %d attempts, got after %v in %d attempts", expected.Sub(simulateEpoch), expectedAttempts, opened.Sub(simulateEpoch), attempts)
+	}
+	return nil
+}
+
+// simClock is a virtual clock for the actors of a simulation. Its time only
+// moves on in run, once every actor waits in Sleep. Its timers and tickers
+// fire as the time moves past them, but do not count as waiting, so actors
+// have to wait with Sleep for the time to move on.
+type simClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*simWaiter
+	// actors running, and how many of them wait in Sleep
+	actors, sleeping int
+	// err is the first error an actor returned
+	err error
+	// changed is signalled whenever an actor starts waiting or returns
+	changed chan struct{}
+}
+
+// simWaiter waits for a time of a simClock, an actor in Sleep if wake is
+// set, otherwise a timer, or a ticker if period is set.
+type simWaiter struct {
+	until  time.Time
+	wake   chan struct{}
+	c      chan time.Time
+	period time.Duration
+}
+
+func newSimClock(now time.Time) *simClock {
+	return &simClock{now: now, changed: make(chan struct{}, 1)}
+}
+
+func (c *simClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *simClock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+func (c *simClock) Sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	c.mu.Lock()
+	w := &simWaiter{until: c.now.Add(d), wake: make(chan struct{})}
+	c.waiters = append(c.waiters, w)
+	c.sleeping++
+	c.signal()
+	c.mu.Unlock()
+
+	select {
+	case <-w.wake:
+		return nil
+	case <-ctx.Done():
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.remove(w) {
+		c.sleeping--
+	}
+	return ctx.Err()
+}
+
+func (c *simClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+func (c *simClock) NewTimer(d time.Duration) clockTimer {
+	t := &simTimer{clock: c, w: &simWaiter{c: make(chan time.Time, 1)}}
+	t.Reset(d)
+	return t
+}
+
+func (c *simClock) NewTicker(d time.Duration) clockTicker {
+	if d <= 0 {
+		panic("non-positive interval for simClock.NewTicker")
+	}
+	t := &simTimer{clock: c, w: &simWaiter{c: make(chan time.Time, 1), period: d}}
+	t.Reset(d)
+	return simTicker{t}
+}
+
+// remove removes w from the waiters, telling whether it was one. It must be
+// called with c.mu held.
+func (c *simClock) remove(w *simWaiter) bool {
+	i := slices.Index(c.waiters, w)
+	if i < 0 {
+		return false
+	}
+	c.waiters = slices.Delete(c.waiters, i, i+1)
+	return true
+}
+
+// simTimer is a timer or ticker of a simClock.
+type simTimer struct {
+	clock *simClock
+	w     *simWaiter
+}
+
+func (t *simTimer) C() <-chan time.Time {
+	return t.w.c
+}
+
+func (t *simTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	return t.stop()
+}
+
+// stop stops t and drains its channel, as timers do since Go 1.23. It must
+// be called with t.clock.mu held.
+func (t *simTimer) stop() bool {
+	select {
+	case <-t.w.c:
+	default:
+	}
+	return t.clock.remove(t.w)
+}
+
+func (t *simTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	active := t.stop()
+	t.w.until = t.clock.now.Add(max(d, 0))
+	t.clock.waiters = append(t.clock.waiters, t.w)
+	return active
+}
+
+// simTicker is a ticker of a simClock, a timer which rearms itself.
+type simTicker struct {
+	*simTimer
+}
+
+func (t simTicker) Stop() {
+	t.simTimer.Stop()
+}
+
+// signal wakes run to check on the actors. It must be called with c.mu held.
+func (c *simClock) signal() {
+	select {
+	case c.changed <- struct{}{}:
+	default:
+	}
+}
+
+// spawn starts f as an actor.
+func (c *simClock) spawn(f func() error) {
+	c.mu.Lock()
+	c.actors++
+	c.mu.Unlock()
+	go func() {
+		err := f()
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.actors--
+		if err != nil && c.err == nil {
+			c.err = err
+		}
+		c.signal()
+	}()
+}
+
+// run moves the time on from one wake up to the next, as long as they are
+// not after until, then stops the actors and waits for them to return. It
+// returns the first error of an actor.
+func (c *simClock) run(until time.Time, stop context.CancelFunc) error {
+	for {
+		err := c.waitIdle()
+		if err != nil {
+			return err
+		}
+		c.mu.Lock()
+		if c.actors == 0 || !c.dueBy(until) {
+			c.mu.Unlock()
+			break
+		}
+		c.wakeNext()
+		c.mu.Unlock()
+	}
+
+	stop()
+	for {
+		c.mu.Lock()
+		actors, err := c.actors, c.err
+		c.mu.Unlock()
+		if actors == 0 {
+			return err
+		}
+		select {
+		case <-c.changed:
+		case <-time.After(simulateStall):
+			return fmt.Errorf("%d actors did not stop within %v", actors, simulateStall)
+		}
+	}
+}
+
+// dueBy tells whether anything waits for a time no later than until. It must
+// be called with c.mu held.
+func (c *simClock) dueBy(until time.Time) bool {
+	for _, w := range c.waiters {
+		if !w.until.After(until) {
+			return true
+		}
+	}
+	return false
+}
+
+// wakeNext moves the time on to the earliest wake up and wakes everything due
+// then at once, so their order does not depend on the order they started
+// waiting in. It must be called with c.mu held.
+func (c *simClock) wakeNext() {
+	next := c.waiters[0].until
+	for _, w := range c.waiters {
+		if w.until.Before(next) {
+			next = w.until
+		}
+	}
+	c.now = next
+	c.waiters = slices.DeleteFunc(c.waiters, func(w *simWaiter) bool {
+		if w.until.After(next) {
+			return false
+		}
+		if w.wake != nil {
+			c.sleeping--
+			close(w.wake)
+			return true
+		}
+		select {
+		case w.c <- next:
+		default:
+			// a ticker drops ticks nobody received, as time.Ticker does
+		}
+		if w.period > 0 {
+			w.until = next.Add(w.period)
+			return false
+		}
+		return true
+	})
+}
+
+// waitIdle waits until every actor waits in Sleep, or none is left.
+func (c *simClock) waitIdle() error {
+	for {
+		c.mu.Lock()
+		idle, err := c.sleeping == c.actors, c.err
+		c.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if idle {
+			return nil
+		}
+		select {
+		case <-c.changed:
+		case <-time.After(simulateStall):
+			return fmt.Errorf("actors busy for %v of real time, the simulation is stuck", simulateStall)
+		}
+	}
+}
+
+// memListener is a listener for connections in memory, dialed with dial.
+type memListener struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+	// refuse makes a dial fail when it returns true
+	refuse func() bool
+}
+
+func newMemListener() *memListener {
+	return &memListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+	return memAddr{}
+}
+
+func (l *memListener) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	if l.refuse != nil && l.refuse() {
+		return nil, errSimulatedRefused
+	}
+	server, client := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+type memAddr struct{}
+
+func (memAddr) Network() string { return "memory" }
+func (memAddr) String() string  { return "memory" }
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+
+	netproxy "golang.org/x/net/proxy"
+)
+
+// With socksProxy the client tunnels its connections to the server through
+// the SOCKS5 proxy at that host and port, such as the dynamic forward of
+// ssh -D, instead of a proxy of connectProxy or HTTPS_PROXY. The proxy
+// resolves the name of the server, as seen from its end of the tunnel. The
+// tunnels are counted and reported as those of an HTTP proxy.
+var socksProxy = ""
+
+func setSOCKSProxy(s string) error {
+	_, _, err := net.SplitHostPort(s)
+	if err != nil {
+		return fmt.Errorf("expected socks5 proxy as host:port, got %q", s)
+	}
+	socksProxy = s
+	return nil
+}
+
+// dialFunc adapts a dial function to the dialers of golang.org/x/net/proxy.
+type dialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+func (f dialFunc) Dial(network, address string) (net.Conn, error) {
+	return f(context.Background(), network, address)
+}
+
+func (f dialFunc) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return f(ctx, network, address)
+}
+
+// openSOCKSTunnel connects to address through the SOCKS5 proxy, connecting
+// to it with dial.
+func openSOCKSTunnel(ctx context.Context, dial func(ctx context.Context, network, address string) (net.Conn, error), network string, proxy *url.URL, address string) (net.Conn, error) {
+	d, err := netproxy.SOCKS5(network, proxy.Host, nil, dialFunc(dial))
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up socks5 proxy, error was: %w", err)
+	}
+	conn, err := d.(netproxy.ContextDialer).DialContext(ctx, network, address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect through socks5 proxy, error was: %w", err)
+	}
+	return conn, nil
+}
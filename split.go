@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// Some proxies hold the response of a request back until its request body
+// ended, so that on a duplex stream the client never receives anything. The
+// split transport gets a stream through such a path by carrying its two
+// halves on separate requests: the client receives the stream as the
+// response of a GET, which has no body to wait for, and sends it as a POST
+// to splitPath per message, which the server feeds to the stream as its
+// request body. Both carry the session of the stream, which the client draws
+// at random and which takes the place of its connection, so the server
+// serves the stream as any other.
+//
+// The client opens every stream over the split transport with splitStreams.
+// Otherwise, while probing, it takes the path as half duplex once not a
+// single probe arrived halfDuplexAfter after it asked for the first, and
+// switches to the split transport, moving the streams it runs over to it.
+// Trailers of the request body do not make it through the split transport.
+var (
+	splitStreams    = false
+	halfDuplexAfter = 5 * time.Second
+)
+
+const (
+	splitPath          = "/split"
+	splitSessionHeader = "X-Split-Session"
+	// splitCloseHeader on a post ends the request body of the stream, as
+	// the client half-closing it
+	splitCloseHeader = "X-Split-Close"
+)
+
+// splitStats are the counts of the split transport on the client, published
+// with expvar.
+type splitStats struct {
+	// HalfDuplex is whether the client took the path as half duplex
+	HalfDuplex bool
+	Opened     int64
+	// Resumed were moved over from a stream opened before the switch
+	Resumed int64
+}
+
+var splitCounts = struct {
+	mu    sync.Mutex
+	stats splitStats
+}{}
+
+func init() {
+	expvar.Publish("split", expvar.Func(func() any {
+		splitCounts.mu.Lock()
+		defer splitCounts.mu.Unlock()
+		return splitCounts.stats
+	}))
+}
+
+// splitSwitched is done once the client switched to the split transport.
+var splitSwitched, switchToSplit = context.WithCancel(context.Background())
+
+// useSplit returns whether the client opens streams over the split
+// transport.
+func useSplit() bool {
+	return splitStreams || splitSwitched.Err() != nil
+}
+
+// takeHalfDuplex switches the client to the split transport, once, as the
+// probes on the stream logging to log were not delivered.
+func takeHalfDuplex(log *slog.Logger) {
+	if splitSwitched.Err() != nil {
+		return
+	}
+	splitCounts.mu.Lock()
+	splitCounts.stats.HalfDuplex = true
+	splitCounts.mu.Unlock()
+	log.Warn("client: no probe delivered although flushed, the path holds responses back until the request ends, switching to the split transport", "after", halfDuplexAfter)
+	switchToSplit()
+}
+
+// splitOnSwitch breaks s, unless opened over the split transport, once the
+// client switches to it, to be resumed over it. It returns the function to
+// stop watching, as context.AfterFunc does.
+func (s *clientStream) splitOnSwitch() func() bool {
+	if s.split {
+		return func() bool { return true }
+	}
+	return context.AfterFunc(splitSwitched, func() {
+		s.w.Close()
+		s.resp.Body.Close()
+	})
+}
+
+// switched returns whether s broke as the client switched to the split
+// transport.
+func (s *clientStream) switched() bool {
+	return !s.split && splitSwitched.Err() != nil
+}
+
+// splitWriter is the request body of a stream over the split transport,
+// posting every write to the server.
+type splitWriter struct {
+	mu      sync.Mutex
+	ctx     context.Context
+	client  *http.Client
+	url     string
+	session string
+	closed  bool
+}
+
+// newSplitWriter returns the request body of a new session of the stream at
+// address.
+func newSplitWriter(ctx context.Context, client *http.Client, address string) (*splitWriter, error) {
+	target, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse address, error was: %w", err)
+	}
+	target.Path = splitPath
+	target.RawQuery = ""
+	session := make([]byte, 16)
+	rand.Read(session)
+	return &splitWriter{ctx: ctx, client: client, url: target.String(), session: hex.EncodeToString(session)}, nil
+}
+
+func (w *splitWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return 0, io.ErrClosedPipe
+	}
+	err := w.post(p, false)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close ends the request body of the stream.
+func (w *splitWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.post(nil, true)
+}
+
+func (w *splitWriter) post(p []byte, close bool) error {
+	req, err := http.NewRequestWithContext(w.ctx, http.MethodPost, w.url, bytes.NewReader(p))
+	if err != nil {
+		return fmt.Errorf("failed to create request, error was: %w", err)
+	}
+	req.Header.Set(splitSessionHeader, w.session)
+	if close {
+		req.Header.Set(splitCloseHeader, "1")
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("server answered post of split stream with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// splitSessions are the request bodies of the streams open over the split
+// transport on the server, by session.
+var splitSessions = struct {
+	mu       sync.Mutex
+	sessions map[string]*splitSession
+}{sessions: map[string]*splitSession{}}
+
+type splitSession struct {
+	// mu keeps the posts of the session from interleaving
+	mu sync.Mutex
+	w  *io.PipeWriter
+}
+
+// splitBody is the request body of a stream over the split transport on the
+// server, written by the posts of its session.
+type splitBody struct {
+	*io.PipeReader
+}
+
+// unblockSplit fails the read waiting on body, if it is that of a stream
+// over the split transport, as a read deadline of its connection would.
+func unblockSplit(body io.ReadCloser) {
+	if body, ok := body.(*splitBody); ok {
+		body.CloseWithError(os.ErrDeadlineExceeded)
+	}
+}
+
+// acceptSplit serves the streams over the split transport with next, which
+// serves every other request: it serves a GET of a session as a stream whose
+// request body is written by the posts of the session to splitPath.
+func acceptSplit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		id := request.Header.Get(splitSessionHeader)
+		if request.URL.Path == splitPath {
+			serveSplitPost(writer, request, id)
+			return
+		}
+		if id == "" || request.Method != http.MethodGet {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		r, w := io.Pipe()
+		splitSessions.mu.Lock()
+		if splitSessions.sessions[id] != nil {
+			splitSessions.mu.Unlock()
+			writer.WriteHeader(http.StatusConflict)
+			return
+		}
+		splitSessions.sessions[id] = &splitSession{w: w}
+		splitSessions.mu.Unlock()
+		defer func() {
+			splitSessions.mu.Lock()
+			delete(splitSessions.sessions, id)
+			splitSessions.mu.Unlock()
+			// posts still waiting on the stream fail
+			r.Close()
+		}()
+
+		stream := request.Clone(request.Context())
+		stream.Method = http.MethodPost
+		stream.Body = &splitBody{r}
+		next.ServeHTTP(writer, stream)
+	})
+}
+
+// serveSplitPost writes the body of a post of session id to the request body
+// of its stream, and ends that if asked.
+func serveSplitPost(writer http.ResponseWriter, request *http.Request, id string) {
+	if request.Method != http.MethodPost {
+		writer.Header().Set("Allow", http.MethodPost)
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	splitSessions.mu.Lock()
+	session := splitSessions.sessions[id]
+	splitSessions.mu.Unlock()
+	if session == nil {
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	_, err := io.Copy(session.w, request.Body)
+	if err == nil && request.Header.Get(splitCloseHeader) != "" {
+		err = session.w.Close()
+	}
+	if err != nil {
+		// the stream ended
+		writer.WriteHeader(http.StatusGone)
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
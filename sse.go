@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The sse workload has the server push data messages down a plain
+// text/event-stream response to a GET, as server-sent events, so that the
+// server to client half is measured on its own, without a request body
+// streamed alongside it. The events are those of the push workload, paced by
+// its scheduler with pushRate, pushBudget and pushSize, and carry the
+// responseMsg as their data, signed and sealed like any other, with its
+// sequence number as event id. The client reads them like an EventSource
+// would and, as one, reconnects with Last-Event-ID when the server ends the
+// response, the server resuming after the last event received.
+const ContentTypeEventStream = "text/event-stream"
+
+// sseHandler serves the events of the sse workload until the request or ctx
+// is done.
+func sseHandler(ctx context.Context) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		serverConnNegotiated(request)
+		if method := request.Method; method != http.MethodGet {
+			writer.Header().Set("Allow", http.MethodGet)
+			writer.WriteHeader(http.StatusMethodNotAllowed)
+			serverLog.Info("server: client attempted to connect with wrong method instead of GET", "wrong_method", method)
+			return
+		}
+		if accepts := request.Header.Get("Accept"); !acceptsEventStream(accepts) {
+			writer.WriteHeader(http.StatusNotAcceptable)
+			serverLog.Info("server: client requested data in wrong format instead of "+ContentTypeEventStream, "wrong_accept", accepts)
+			return
+		}
+		var seq int64
+		if lastID := request.Header.Get("Last-Event-ID"); lastID != "" {
+			var err error
+			seq, err = strconv.ParseInt(lastID, 10, 64)
+			if err != nil || seq < 0 {
+				http.Error(writer, fmt.Sprintf("expected numeric Last-Event-ID, got %q", lastID), http.StatusBadRequest)
+				return
+			}
+		}
+
+		claims, id, ok := admitStream(writer, request)
+		if !ok {
+			return
+		}
+		defer quotas.closeStream(id)
+
+		respCtl := http.NewResponseController(writer)
+		writer.Header().Set("Content-Type", ContentTypeEventStream)
+		writer.Header().Set("Cache-Control", "no-cache")
+		writer.WriteHeader(http.StatusOK)
+		err := respCtl.Flush()
+		if err != nil {
+			serverMetrics.observeError("flush", err)
+			serverLog.Error("server: failed to flush status header to client", "error", err)
+			return
+		}
+		serverMetrics.streamOpened(0)
+
+		streamCtx, cancelFunc := context.WithCancelCause(request.Context())
+		defer cancelFunc(nil)
+		stop := context.AfterFunc(ctx, func() {
+			cancelFunc(fmt.Errorf("%w: %w", errServerShutdown, context.Cause(ctx)))
+		})
+		defer stop()
+		conn, _ := request.Context().Value(connContextKey{}).(net.Conn)
+		registered := activeStreams.register(request.URL.Path, request.RemoteAddr, requestTenant(request, claims), conn, cancelFunc)
+		defer activeStreams.unregister(registered)
+		log := registered.logger().With(append([]any{"stream", registered.id, "last_event_id", seq}, streamLogAttrs(request)...)...)
+		log.Info("server: event stream started")
+		defer func() {
+			cause := context.Cause(streamCtx)
+			if errors.Is(cause, context.Canceled) && request.Context().Err() != nil {
+				// the connection of the client went away
+				cause = errPeerClosed
+				if err := socketErr(conn); err != nil {
+					cause = fmt.Errorf("%w: %w", errPeerClosed, err)
+				}
+			}
+			log.Info("server: stream ended", "cause", cause, "reason", causeLabel(cause))
+			serverMetrics.streamClosed(cause)
+			registered.end(cause)
+		}()
+
+		p := pusher.add(request.RemoteAddr)
+		defer pusher.remove(p)
+		data := strings.Repeat("x", pushSize)
+		for {
+			var budget int
+			select {
+			case <-streamCtx.Done():
+				return
+			case budget = <-p.grants:
+			}
+			for i := 0; i < budget; i++ {
+				seq++
+				started := clk.Now()
+				err := writeEvent(writer, seq, responseMsg{Msg: "data", Data: data, Seq: seq, Sent: started.UnixNano()})
+				if err == nil {
+					err = respCtl.Flush()
+				}
+				if err != nil {
+					if streamCtx.Err() == nil {
+						serverMetrics.observeError("flush", err)
+					}
+					cancelFunc(errorCause(err))
+					log.Error("server: failed to push event to client", "error", err)
+					return
+				}
+				flushed := clk.Now()
+				serverMetrics.observeFlush(flushed.Sub(started))
+				registered.observeSent(flushed, flushed.Sub(started))
+				p.sent.Add(1)
+			}
+			p.busy.Store(false)
+		}
+	})
+}
+
+// acceptsEventStream returns whether the Accept header accepts takes a
+// text/event-stream response.
+func acceptsEventStream(accepts string) bool {
+	for _, accept := range strings.Split(accepts, ",") {
+		mediaType, _, err := mime.ParseMediaType(accept)
+		if err == nil && (mediaType == ContentTypeEventStream || mediaType == "text/*" || mediaType == "*/*") {
+			return true
+		}
+	}
+	return false
+}
+
+// writeEvent writes msg as the data event with id seq.
+func writeEvent(w io.Writer, seq int64, msg any) error {
+	msg, err := sign(msg)
+	if err != nil {
+		return err
+	}
+	msg, err = seal(msg)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: data\ndata: %s\n\n", seq, data)
+	return err
+}
+
+// serverEvent is an event of an event stream, as received.
+type serverEvent struct {
+	id    string
+	event string
+	data  string
+}
+
+// driveSSE reads the event stream of the server, reconnecting from the last
+// event received whenever the server ends it.
+func driveSSE(ctx context.Context, address string) error {
+	lastID := ""
+	for {
+		resp, err := openEventStream(ctx, address, lastID)
+		if err != nil {
+			if ctx.Err() != nil {
+				clientLog.Info("client: context was done, exiting")
+				return nil
+			}
+			return err
+		}
+		err = readEvents(ctx, resp, &lastID)
+		resp.Body.Close()
+		cause := streamCause(ctx, err)
+		clientLog.Debug("client: event stream ended", "cause", cause, "reason", causeLabel(cause), "last_event_id", lastID)
+		clientMetrics.streamClosed(cause)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if !errors.Is(cause, errPeerClosed) {
+			return err
+		}
+		clientLog.Info("client: server ended event stream, reconnecting", "last_event_id", lastID)
+		err = clk.Sleep(ctx, openRetryInterval)
+		if err != nil {
+			return nil
+		}
+	}
+}
+
+// openEventStream requests the event stream of the server at address, from
+// after the event lastID if set, retrying until the server answers it.
+func openEventStream(ctx context.Context, address string, lastID string) (*http.Response, error) {
+	client := http.Client{Transport: clientTransport}
+	var newConn atomic.Bool
+	var handshake atomic.Int64
+	for {
+		req, err := http.NewRequestWithContext(traceNewConn(traceTLSHandshake(ctx, &handshake), &newConn), http.MethodGet, h2Address(address), nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request, error was: %w", err)
+		}
+		req.Header.Set("Accept", ContentTypeEventStream)
+		if clientTenant != "" {
+			req.Header.Set(tenantHeader, clientTenant)
+		}
+		if lastID != "" {
+			req.Header.Set("Last-Event-ID", lastID)
+		}
+		if jwtSecret != nil {
+			token, err := mintToken(jwtSubject, clk.Now())
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		started := clk.Now()
+		resp, err := client.Do(req)
+		if err == nil && resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			err = fmt.Errorf("server answered with status %d", resp.StatusCode)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			clientMetrics.observeError("connect", err)
+			clientLog.Info("client: failed to start request against server", "error", err)
+			err = clk.Sleep(ctx, openRetryInterval)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		clientMetrics.streamOpened(clk.Since(started))
+		if newConn.Load() {
+			clientConnNegotiated(resp)
+			clientConnHandshaked(resp, time.Duration(handshake.Load()))
+		}
+		if answered, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); answered != ContentTypeEventStream {
+			resp.Body.Close()
+			err = fmt.Errorf("server answered in content type %q instead of %q", resp.Header.Get("Content-Type"), ContentTypeEventStream)
+			clientMetrics.observeError("protocol", err)
+			return nil, err
+		}
+		return resp, nil
+	}
+}
+
+// readEvents reads the events of resp until it ends, setting lastID to the
+// id of every event received.
+func readEvents(ctx context.Context, resp *http.Response, lastID *string) error {
+	stop := context.AfterFunc(ctx, func() { resp.Body.Close() })
+	defer stop()
+
+	arrivals := clientMetrics.newArrivalRecorder()
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	var event serverEvent
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			// a blank line dispatches the event
+			if event.data != "" {
+				err := receiveEvent(ctx, event, arrivals)
+				if err != nil {
+					return err
+				}
+			}
+			if event.id != "" {
+				*lastID = event.id
+			}
+			event = serverEvent{}
+			continue
+		}
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "":
+			// a comment
+		case "id":
+			event.id = value
+		case "event":
+			event.event = value
+		case "data":
+			if event.data != "" {
+				event.data += "\n"
+			}
+			event.data += value
+		}
+	}
+	err := scanner.Err()
+	if err == nil {
+		return io.EOF
+	}
+	if ctx.Err() == nil {
+		clientMetrics.observeError("decode", err)
+	}
+	return err
+}
+
+// receiveEvent takes the message of event.
+func receiveEvent(ctx context.Context, event serverEvent, arrivals *arrivalRecorder) error {
+	var in responseMsg
+	err := decodeMessage(json.NewDecoder(strings.NewReader(event.data)), &in)
+	if errors.Is(err, errBadSignature) {
+		clientMetrics.signatureFailed()
+		return nil
+	}
+	if err != nil {
+		clientMetrics.observeError("decode", err)
+		return fmt.Errorf("failed to decode event from server, error was: %w", err)
+	}
+	arrivals.observe(clk.Now())
+	if event.event != "data" || in.Msg != "data" {
+		clientLog.Warn("client: received unknown event from server", "event", event.event, "msg", in.Msg)
+		return nil
+	}
+	clientMetrics.observeLatency(clk.Since(time.Unix(0, in.Sent)))
+	if pushReadDelay > 0 {
+		clk.Sleep(ctx, pushReadDelay)
+	}
+	return nil
+}
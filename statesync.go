@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// The statesync workload keeps a keyed state map per stream on the server.
+// The client sends "set" and "delete" messages, the server streams back a
+// "patch" with the keys changed since the previous patch, and every
+// stateSyncSnapshotEvery patch intervals a full "snapshot" which the client
+// verifies its replica against.
+const (
+	stateSyncPatchInterval = 500 * time.Millisecond
+	stateSyncSnapshotEvery = 10
+	stateSyncSendInterval  = 200 * time.Millisecond
+	stateSyncKeys          = 16
+)
+
+func serveStateSync(ctx context.Context, stream *serverStream) {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	defer cancelFunc()
+
+	var mu sync.Mutex
+	state := map[string]string{}
+	dirty := map[string]struct{}{}
+
+	go func() {
+		defer cancelFunc()
+		for {
+			var inMsg requestMsg
+			err := stream.recv(&inMsg)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+					stream.log.Error("server: failed to receive request message from client", "error", err)
+					return
+				}
+				stream.log.Info("server: client closed connection - finished")
+				return
+			}
+			stream.log.Debug("server: received message from client", "msg", inMsg.Msg, "key", inMsg.Key)
+
+			mu.Lock()
+			switch inMsg.Msg {
+			case "set":
+				state[inMsg.Key] = inMsg.Value
+				dirty[inMsg.Key] = struct{}{}
+			case "delete":
+				delete(state, inMsg.Key)
+				dirty[inMsg.Key] = struct{}{}
+			default:
+				stream.log.Warn("server: received unknown statesync message from client", "msg", inMsg.Msg)
+			}
+			mu.Unlock()
+		}
+	}()
+
+	ticker := clk.NewTicker(stateSyncPatchInterval)
+	defer ticker.Stop()
+	for tick := 1; ; tick++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+
+		mu.Lock()
+		patch := responseMsg{Msg: "patch", State: map[string]string{}}
+		for key := range dirty {
+			if value, ok := state[key]; ok {
+				patch.State[key] = value
+			} else {
+				patch.Deleted = append(patch.Deleted, key)
+			}
+		}
+		clear(dirty)
+		var snapshot *responseMsg
+		if tick%stateSyncSnapshotEvery == 0 {
+			snapshot = &responseMsg{Msg: "snapshot", State: maps.Clone(state)}
+		}
+		mu.Unlock()
+
+		if len(patch.State) > 0 || len(patch.Deleted) > 0 {
+			err := stream.send(patch)
+			if err != nil {
+				stream.log.Error("server: failed to send patch to client", "error", err)
+				return
+			}
+			stream.log.Debug("server: sent patch to client", "changed", len(patch.State), "deleted", len(patch.Deleted))
+		}
+		if snapshot != nil {
+			err := stream.send(snapshot)
+			if err != nil {
+				stream.log.Error("server: failed to send snapshot to client", "error", err)
+				return
+			}
+			stream.log.Debug("server: sent snapshot to client", "keys", len(snapshot.State))
+		}
+	}
+}
+
+func runStateSync(ctx context.Context, stream *clientStream) error {
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		ticker := clk.NewTicker(stateSyncSendInterval)
+		defer ticker.Stop()
+		for counter := 0; ; counter++ {
+			select {
+			case <-ctx.Done():
+				stream.log.Info("client: context was done, exiting")
+				return nil
+			case <-ticker.C():
+			}
+
+			outMsg := requestMsg{Msg: "set", Key: "key-" + strconv.Itoa(rand.Intn(stateSyncKeys)), Value: strconv.Itoa(counter)}
+			if rand.Intn(4) == 0 {
+				outMsg = requestMsg{Msg: "delete", Key: outMsg.Key}
+			}
+			err := stream.send(outMsg)
+			if err != nil {
+				if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrClosedPipe) {
+					return fmt.Errorf("client: failed to send statesync message to server, error was: %w", err)
+				}
+				return nil
+			}
+			stream.log.Debug("client: posted statesync message to server", "msg", outMsg.Msg, "key", outMsg.Key)
+		}
+	})
+	eg.Go(func() error {
+		// unblock recv below once the client is asked to stop
+		stop := context.AfterFunc(ctx, func() { stream.resp.Body.Close() })
+		defer stop()
+
+		replica := map[string]string{}
+		for {
+			var in responseMsg
+			err := stream.recv(&in)
+			if err != nil {
+				if ctx.Err() != nil || errors.Is(err, io.EOF) {
+					return nil
+				}
+				return fmt.Errorf("failed to decode response message from server, error was: %w", err)
+			}
+			switch in.Msg {
+			case "patch":
+				maps.Copy(replica, in.State)
+				for _, key := range in.Deleted {
+					delete(replica, key)
+				}
+				stream.log.Debug("client: applied patch from server", "changed", len(in.State), "deleted", len(in.Deleted))
+			case "snapshot":
+				if !maps.Equal(replica, in.State) {
+					stream.log.Warn("client: replica diverged from server snapshot, resynchronizing", "replica_keys", len(replica), "snapshot_keys", len(in.State))
+				} else {
+					stream.log.Info("client: replica matches server snapshot", "keys", len(in.State))
+				}
+				replica = in.State
+			default:
+				stream.log.Warn("client: received unknown statesync message from server", "msg", in.Msg)
+			}
+		}
+	})
+	return eg.Wait()
+}
@@ -0,0 +1,961 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"maps"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// metrics collects measurements of the messages received on one side of the
+// duplex streams, across all streams of that side, and periodically reports
+// them.
+type metrics struct {
+	side string
+
+	mu       sync.Mutex
+	interval measurements
+	// totals over the whole run, the interval is merged in on every report
+	total measurements
+	// measurements during warmup, kept out of interval and total
+	warmup measurements
+	// streams currently open
+	active int64
+	// stream handlers recovered from a panic
+	panics int64
+	// streams rejected or closed while over the memory limit
+	rejected int64
+	shed     int64
+	// streams of clients evicted for not keeping up with reading
+	evicted int64
+	// received messages dropped as their signature did not verify
+	signatureFailures int64
+	// messages of broken streams sent again, with -retry-pending
+	retries int64
+	// streams resumed on a new stream after the server went away with
+	// GOAWAY, in h2 mode
+	migrations int64
+	// received messages dropped as the receive buffer was full
+	dropped int64
+	// the sequence spaces of the messages received, and the messages
+	// received twice and skipped in them, on the server only
+	seqs       seqTracker
+	duplicates int64
+	seqGaps    int64
+	// streams closed over the run per label of their cause
+	closeCauses map[string]int64
+	// process CPU time at the previous snapshot
+	lastCPU time.Duration
+}
+
+// measurements is the set of measurements taken over some period.
+type measurements struct {
+	received     int64
+	latency      histogram
+	interArrival histogram
+	jitter       histogram
+	opened       int64
+	closed       int64
+	// time taken to establish a stream, on the client only
+	setup histogram
+	// round trip times and retransmits of the connections sampled with
+	// tcpInfoInterval, on the client only
+	tcpRTT      histogram
+	retransmits int64
+	// time the server spent writing and flushing a message
+	flush histogram
+	// how much later than the fastest one a flushed message was delivered,
+	// and the deliveries late by flushStallThreshold or more, on the client
+	// only
+	flushDelivery histogram
+	flushStalls   int64
+	// how much later than the fastest one a probe was delivered, on the
+	// client only
+	probeDelivery histogram
+	// the round trips of pings split into upstream, server and downstream
+	// times with echoTimestamps, on the client only
+	upstream   histogram
+	serverTime histogram
+	downstream histogram
+	// flow control windows of HTTP/2 connections found exhausted, and the
+	// time they stayed so, per direction and level, with h2Windows
+	windowStalls  map[string]int64
+	windowBlocked map[string]time.Duration
+	// connections per protocol negotiated
+	protocols map[string]int64
+	// TLS handshakes of new connections per kind, full or resumed, and the
+	// time those of the client took
+	handshakes       map[string]int64
+	fullHandshake    histogram
+	resumedHandshake histogram
+	// errors of sending, receiving and opening streams per category
+	errors map[string]int64
+}
+
+func (s *measurements) merge(other *measurements) {
+	s.opened += other.opened
+	s.closed += other.closed
+	s.setup.merge(&other.setup)
+	s.received += other.received
+	s.latency.merge(&other.latency)
+	s.interArrival.merge(&other.interArrival)
+	s.jitter.merge(&other.jitter)
+	s.tcpRTT.merge(&other.tcpRTT)
+	s.retransmits += other.retransmits
+	s.flush.merge(&other.flush)
+	s.flushDelivery.merge(&other.flushDelivery)
+	s.probeDelivery.merge(&other.probeDelivery)
+	s.upstream.merge(&other.upstream)
+	s.serverTime.merge(&other.serverTime)
+	s.downstream.merge(&other.downstream)
+	s.flushStalls += other.flushStalls
+	for window, n := range other.windowStalls {
+		if s.windowStalls == nil {
+			s.windowStalls = map[string]int64{}
+		}
+		s.windowStalls[window] += n
+	}
+	for window, d := range other.windowBlocked {
+		if s.windowBlocked == nil {
+			s.windowBlocked = map[string]time.Duration{}
+		}
+		s.windowBlocked[window] += d
+	}
+	for protocol, n := range other.protocols {
+		if s.protocols == nil {
+			s.protocols = map[string]int64{}
+		}
+		s.protocols[protocol] += n
+	}
+	for kind, n := range other.handshakes {
+		if s.handshakes == nil {
+			s.handshakes = map[string]int64{}
+		}
+		s.handshakes[kind] += n
+	}
+	s.fullHandshake.merge(&other.fullHandshake)
+	s.resumedHandshake.merge(&other.resumedHandshake)
+	for category, n := range other.errors {
+		if s.errors == nil {
+			s.errors = map[string]int64{}
+		}
+		s.errors[category] += n
+	}
+}
+
+func (s *measurements) reset() {
+	s.opened = 0
+	s.closed = 0
+	s.setup.reset()
+	s.received = 0
+	s.latency.reset()
+	s.interArrival.reset()
+	s.jitter.reset()
+	s.tcpRTT.reset()
+	s.retransmits = 0
+	s.flush.reset()
+	s.flushDelivery.reset()
+	s.probeDelivery.reset()
+	s.upstream.reset()
+	s.serverTime.reset()
+	s.downstream.reset()
+	s.flushStalls = 0
+	clear(s.windowStalls)
+	clear(s.windowBlocked)
+	clear(s.protocols)
+	clear(s.handshakes)
+	s.fullHandshake.reset()
+	s.resumedHandshake.reset()
+	clear(s.errors)
+}
+
+var (
+	clientMetrics = &metrics{side: "client"}
+	serverMetrics = &metrics{side: "server"}
+)
+
+var (
+	reportInterval = 5 * time.Second
+	metricsPushURL = ""
+	// the first warmup of the run and the first warmupMessages messages
+	// received are measured separately, as connection setup, buffer growth
+	// and GC ramp up skew short runs
+	warmup         = time.Duration(0)
+	warmupMessages = int64(0)
+)
+
+// current returns the measurements an observation at now belongs to. It must
+// be called with m.mu held.
+func (m *metrics) current(now time.Time) *measurements {
+	if warmup > 0 && now.Before(manifest.Started.Add(warmup)) || m.warmup.received < warmupMessages {
+		return &m.warmup
+	}
+	return &m.interval
+}
+
+// arrivalRecorder tracks the arrivals of a single stream, as inter-arrival
+// times only make sense between messages of the same stream.
+type arrivalRecorder struct {
+	metrics *metrics
+	last    time.Time
+	lastGap time.Duration
+}
+
+func (m *metrics) newArrivalRecorder() *arrivalRecorder {
+	return &arrivalRecorder{metrics: m}
+}
+
+// observe records the arrival of a message at now. Jitter is the variation
+// between consecutive inter-arrival times, as in RFC 3550.
+func (r *arrivalRecorder) observe(now time.Time) {
+	m := r.metrics
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	current := m.current(now)
+	current.received++
+	if !r.last.IsZero() {
+		gap := now.Sub(r.last)
+		current.interArrival.record(gap)
+		if r.lastGap != 0 {
+			current.jitter.record((gap - r.lastGap).Abs())
+		}
+		r.lastGap = gap
+	}
+	r.last = now
+}
+
+// observeLatency records the latency of a message, for workloads where it can
+// be measured, such as the round trip of a ping.
+func (m *metrics) observeLatency(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.current(clk.Now()).latency.record(d)
+}
+
+// observeTCPSample records the round trip time and retransmits of a sampled
+// connection.
+func (m *metrics) observeTCPSample(sample tcpSample) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	current := m.current(sample.Time)
+	current.tcpRTT.record(sample.RTT)
+	current.retransmits += int64(sample.NewRetransmits)
+}
+
+// observeFlush records the time taken to write and flush a message.
+func (m *metrics) observeFlush(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.current(clk.Now()).flush.record(d)
+}
+
+// observeFlushDelivery records how much later than the fastest one a flushed
+// message was delivered.
+func (m *metrics) observeFlushDelivery(excess time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	current := m.current(clk.Now())
+	current.flushDelivery.record(excess)
+	if excess >= flushStallThreshold {
+		current.flushStalls++
+	}
+}
+
+// observeProbeDelivery records how much later than the fastest one a probe
+// was delivered.
+func (m *metrics) observeProbeDelivery(drift time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.current(clk.Now()).probeDelivery.record(drift)
+}
+
+// observeRTTSplit records the upstream, server and downstream times of the
+// round trip of a ping.
+func (m *metrics) observeRTTSplit(upstream, server, downstream time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	current := m.current(clk.Now())
+	current.upstream.record(max(upstream, 0))
+	current.serverTime.record(max(server, 0))
+	current.downstream.record(max(downstream, 0))
+}
+
+// streamOpened records a stream being established after setup.
+func (m *metrics) streamOpened(setup time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	current := m.current(clk.Now())
+	current.opened++
+	if setup > 0 {
+		current.setup.record(setup)
+	}
+	m.active++
+}
+
+// observeError counts err of op, one of connect, encode, decode or flush,
+// under its category. Errors that only tell the stream ended, as the peer or
+// this side closed it, are not counted.
+func (m *metrics) observeError(op string, err error) {
+	if !countsAsError(err) {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	current := m.current(clk.Now())
+	if current.errors == nil {
+		current.errors = map[string]int64{}
+	}
+	current.errors[errorCategory(op, err)]++
+}
+
+// streamClosed records a stream ending with cause, as returned by
+// context.Cause for its context.
+func (m *metrics) streamClosed(cause error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.current(clk.Now()).closed++
+	m.active--
+	if m.closeCauses == nil {
+		m.closeCauses = map[string]int64{}
+	}
+	m.closeCauses[causeLabel(cause)]++
+}
+
+func (m *metrics) panicked() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.panics++
+}
+
+func (m *metrics) streamRejected() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rejected++
+}
+
+func (m *metrics) streamShed() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.shed++
+}
+
+func (m *metrics) streamEvicted() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.evicted++
+}
+
+func (m *metrics) signatureFailed() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.signatureFailures++
+}
+
+func (m *metrics) messageDropped() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dropped++
+}
+
+func (m *metrics) messagesRetried(n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.retries += n
+}
+
+// windowStalled counts a flow control window found exhausted at now.
+func (m *metrics) windowStalled(window string, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	current := m.current(now)
+	if current.windowStalls == nil {
+		current.windowStalls = map[string]int64{}
+	}
+	current.windowStalls[window]++
+}
+
+// windowBlocked counts the time d a flow control window stayed exhausted,
+// until it opened again at now.
+func (m *metrics) windowBlocked(window string, d time.Duration, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	current := m.current(now)
+	if current.windowBlocked == nil {
+		current.windowBlocked = map[string]time.Duration{}
+	}
+	current.windowBlocked[window] += d
+}
+
+// connNegotiated counts a connection served with protocol.
+func (m *metrics) connNegotiated(protocol string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	current := m.current(clk.Now())
+	if current.protocols == nil {
+		current.protocols = map[string]int64{}
+	}
+	current.protocols[protocol]++
+}
+
+// connHandshaked counts a TLS handshake of a new connection, resumed or
+// full, which took took if measured.
+func (m *metrics) connHandshaked(resumed bool, took time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	current := m.current(clk.Now())
+	if current.handshakes == nil {
+		current.handshakes = map[string]int64{}
+	}
+	current.handshakes[handshakeKind(resumed)]++
+	if took <= 0 {
+		return
+	}
+	if resumed {
+		current.resumedHandshake.record(took)
+	} else {
+		current.fullHandshake.record(took)
+	}
+}
+
+func (m *metrics) streamMigrated() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.migrations++
+}
+
+// observeSeq tracks the sequence number of a message received at now.
+func (m *metrics) observeSeq(seq int64, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	duplicate, skipped := m.seqs.observe(seq, now)
+	if duplicate {
+		m.duplicates++
+	}
+	m.seqGaps += skipped
+}
+
+// metricsSnapshot is the measurements of one report interval together with
+// the totals of the run so far, as pushed to -metrics-push-url.
+type metricsSnapshot struct {
+	Manifest runManifest
+	Side     string
+	Time     time.Time
+	Interval time.Duration
+
+	Active   int64
+	Panics   int64
+	Rejected int64
+	Shed     int64
+	// Evicted is the number of streams of clients evicted for not keeping up
+	Evicted int64
+	// SignatureFailures is the number of received messages dropped as their
+	// signature did not verify
+	SignatureFailures int64
+	// Retries is the number of messages of broken streams sent again
+	Retries int64
+	// GoAwayMigrations is the number of streams resumed on a new stream
+	// after the server went away with GOAWAY
+	GoAwayMigrations int64
+	// Dropped is the number of received messages dropped as the receive
+	// buffer was full
+	Dropped int64
+	// Duplicates and SeqGaps are the messages the server received twice
+	// and skipped by sequence number
+	Duplicates int64
+	SeqGaps    int64
+	// CloseCauses is the number of streams closed over the run per cause
+	CloseCauses map[string]int64
+	// Tenants is the measurements of the server per tenant, once there is
+	// a tenant other than the default one
+	Tenants   map[string]tenantSnapshot `json:",omitempty"`
+	Resources processResources
+	// CPUUsage is the fraction of a CPU the process used over the interval
+	CPUUsage     float64
+	Opened       int64
+	Closed       int64
+	Setup        percentileSummary
+	Received     int64
+	Rate         float64
+	Latency      percentileSummary
+	InterArrival percentileSummary
+	Jitter       percentileSummary
+	// TCPRTT and Retransmits are those of the sampled connections, with
+	// -tcp-info-interval
+	TCPRTT      percentileSummary
+	Retransmits int64
+	// Flush is the time the server took to write and flush a message,
+	// FlushDelivery how much later than the fastest one the client received
+	// a flushed message, and FlushStalls the deliveries late by 30ms or more
+	Flush         percentileSummary
+	FlushDelivery percentileSummary
+	FlushStalls   int64
+	// ProbeDelivery is how much later than the fastest one the client
+	// received a probe, with -probe-interval
+	ProbeDelivery percentileSummary
+	// Upstream, ServerTime and Downstream split the round trips of pings,
+	// with -echo-timestamps
+	Upstream   percentileSummary
+	ServerTime percentileSummary
+	Downstream percentileSummary
+	// WindowStalls is the number of HTTP/2 flow control windows found
+	// exhausted, and WindowBlocked the time they stayed so, per direction
+	// and level, such as send_stream
+	WindowStalls  map[string]int64
+	WindowBlocked map[string]time.Duration
+	// Protocols is the number of connections per protocol negotiated
+	Protocols map[string]int64
+	// Handshakes is the number of TLS handshakes of new connections per
+	// kind, full or resumed, and FullHandshake and Resumption the time
+	// the full and resumed handshakes of the client took
+	Handshakes    map[string]int64
+	FullHandshake percentileSummary
+	Resumption    percentileSummary
+	// Errors is the number of errors per category, and ErrorRates that per
+	// second
+	Errors     map[string]int64
+	ErrorRates map[string]float64
+
+	TotalOpened        int64
+	TotalClosed        int64
+	TotalSetup         percentileSummary
+	TotalReceived      int64
+	TotalLatency       percentileSummary
+	TotalInterArrival  percentileSummary
+	TotalJitter        percentileSummary
+	TotalTCPRTT        percentileSummary
+	TotalRetransmits   int64
+	TotalFlush         percentileSummary
+	TotalFlushDelivery percentileSummary
+	TotalFlushStalls   int64
+	TotalProbeDelivery percentileSummary
+	TotalUpstream      percentileSummary
+	TotalServerTime    percentileSummary
+	TotalDownstream    percentileSummary
+	TotalWindowStalls  map[string]int64
+	TotalWindowBlocked map[string]time.Duration
+	TotalProtocols     map[string]int64
+	TotalHandshakes    map[string]int64
+	TotalFullHandshake percentileSummary
+	TotalResumption    percentileSummary
+	TotalErrors        map[string]int64
+
+	WarmupReceived int64
+	WarmupLatency  percentileSummary
+	WarmupJitter   percentileSummary
+
+	// histograms holds the histograms of the interval, with otlpURL
+	histograms measurements
+}
+
+type percentileSummary struct {
+	P50, P90, P99, Max time.Duration
+}
+
+func summarize(h *histogram) percentileSummary {
+	return percentileSummary{
+		P50: h.quantile(0.5),
+		P90: h.quantile(0.9),
+		P99: h.quantile(0.99),
+		Max: h.max,
+	}
+}
+
+// snapshot takes the measurements of the interval since the previous
+// snapshot, merges them into the totals and starts a new interval.
+func (m *metrics) snapshot(now time.Time, interval time.Duration) metricsSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.total.merge(&m.interval)
+	resources := sampleResources()
+	cpuUsage := float64(resources.CPU-m.lastCPU) / float64(interval)
+	m.lastCPU = resources.CPU
+	snapshot := metricsSnapshot{
+		Manifest:           manifest,
+		Side:               m.side,
+		Time:               now,
+		Interval:           interval,
+		Active:             m.active,
+		Panics:             m.panics,
+		Rejected:           m.rejected,
+		Shed:               m.shed,
+		Evicted:            m.evicted,
+		SignatureFailures:  m.signatureFailures,
+		Retries:            m.retries,
+		GoAwayMigrations:   m.migrations,
+		Dropped:            m.dropped,
+		Duplicates:         m.duplicates,
+		SeqGaps:            m.seqGaps,
+		CloseCauses:        maps.Clone(m.closeCauses),
+		Resources:          resources,
+		CPUUsage:           cpuUsage,
+		Opened:             m.interval.opened,
+		Closed:             m.interval.closed,
+		Setup:              summarize(&m.interval.setup),
+		Received:           m.interval.received,
+		Rate:               float64(m.interval.received) / interval.Seconds(),
+		Latency:            summarize(&m.interval.latency),
+		InterArrival:       summarize(&m.interval.interArrival),
+		Jitter:             summarize(&m.interval.jitter),
+		TotalOpened:        m.total.opened,
+		TotalClosed:        m.total.closed,
+		TotalSetup:         summarize(&m.total.setup),
+		TotalReceived:      m.total.received,
+		TotalLatency:       summarize(&m.total.latency),
+		TotalInterArrival:  summarize(&m.total.interArrival),
+		TotalJitter:        summarize(&m.total.jitter),
+		TCPRTT:             summarize(&m.interval.tcpRTT),
+		Retransmits:        m.interval.retransmits,
+		TotalTCPRTT:        summarize(&m.total.tcpRTT),
+		TotalRetransmits:   m.total.retransmits,
+		Flush:              summarize(&m.interval.flush),
+		FlushDelivery:      summarize(&m.interval.flushDelivery),
+		FlushStalls:        m.interval.flushStalls,
+		TotalFlush:         summarize(&m.total.flush),
+		TotalFlushDelivery: summarize(&m.total.flushDelivery),
+		TotalFlushStalls:   m.total.flushStalls,
+		ProbeDelivery:      summarize(&m.interval.probeDelivery),
+		TotalProbeDelivery: summarize(&m.total.probeDelivery),
+		Upstream:           summarize(&m.interval.upstream),
+		ServerTime:         summarize(&m.interval.serverTime),
+		Downstream:         summarize(&m.interval.downstream),
+		TotalUpstream:      summarize(&m.total.upstream),
+		TotalServerTime:    summarize(&m.total.serverTime),
+		TotalDownstream:    summarize(&m.total.downstream),
+		WindowStalls:       maps.Clone(m.interval.windowStalls),
+		WindowBlocked:      maps.Clone(m.interval.windowBlocked),
+		TotalWindowStalls:  maps.Clone(m.total.windowStalls),
+		TotalWindowBlocked: maps.Clone(m.total.windowBlocked),
+		Protocols:          maps.Clone(m.interval.protocols),
+		TotalProtocols:     maps.Clone(m.total.protocols),
+		Handshakes:         maps.Clone(m.interval.handshakes),
+		FullHandshake:      summarize(&m.interval.fullHandshake),
+		Resumption:         summarize(&m.interval.resumedHandshake),
+		TotalHandshakes:    maps.Clone(m.total.handshakes),
+		TotalFullHandshake: summarize(&m.total.fullHandshake),
+		TotalResumption:    summarize(&m.total.resumedHandshake),
+		Errors:             maps.Clone(m.interval.errors),
+		ErrorRates:         rates(m.interval.errors, interval),
+		TotalErrors:        maps.Clone(m.total.errors),
+		WarmupReceived:     m.warmup.received,
+		WarmupLatency:      summarize(&m.warmup.latency),
+		WarmupJitter:       summarize(&m.warmup.jitter),
+	}
+	attrs := []any{
+		"run_id", manifest.RunID,
+		"active", m.active,
+		"panics", m.panics,
+		"rejected", m.rejected,
+		"shed", m.shed,
+		"evicted", m.evicted,
+		"signature_failures", m.signatureFailures,
+		"retries", m.retries,
+		"goaway_migrations", m.migrations,
+		"dropped", m.dropped,
+		"heap", byteSize(resources.Heap),
+		"goroutines", resources.Goroutines,
+		"cpu", fmt.Sprintf("%.1f%%", cpuUsage*100),
+		"opened", m.interval.opened,
+		"closed", m.interval.closed,
+		"close_causes", formatCounts(m.closeCauses),
+		"setup", m.interval.setup.String(),
+		"received", m.interval.received,
+		"rate", fmt.Sprintf("%.1f/s", snapshot.Rate),
+		"latency", m.interval.latency.String(),
+		"inter_arrival", m.interval.interArrival.String(),
+		"jitter", m.interval.jitter.String(),
+		"total_opened", m.total.opened,
+		"total_setup", m.total.setup.String(),
+		"total_received", m.total.received,
+		"total_latency", m.total.latency.String(),
+		"total_inter_arrival", m.total.interArrival.String(),
+		"total_jitter", m.total.jitter.String(),
+	}
+	if fdUsageSupported {
+		attrs = append(attrs,
+			"fds", resources.FDs,
+			"connections", resources.Connections,
+		)
+	}
+	if resources.FDLimit > 0 {
+		attrs = append(attrs, "fd_limit", resources.FDLimit)
+	}
+	if m.side == "server" {
+		attrs = append(attrs,
+			"duplicates", m.duplicates,
+			"seq_gaps", m.seqGaps,
+		)
+	}
+	if tcpInfoInterval > 0 && m.side == "client" {
+		attrs = append(attrs,
+			"tcp_rtt", m.interval.tcpRTT.String(),
+			"retransmits", m.interval.retransmits,
+			"total_tcp_rtt", m.total.tcpRTT.String(),
+			"total_retransmits", m.total.retransmits,
+		)
+	}
+	if m.total.flush.count > 0 {
+		attrs = append(attrs,
+			"flush", m.interval.flush.String(),
+			"total_flush", m.total.flush.String(),
+		)
+	}
+	if m.total.flushDelivery.count > 0 {
+		attrs = append(attrs,
+			"flush_delivery", m.interval.flushDelivery.String(),
+			"flush_stalls", m.interval.flushStalls,
+			"total_flush_delivery", m.total.flushDelivery.String(),
+			"total_flush_stalls", m.total.flushStalls,
+		)
+	}
+	if m.total.probeDelivery.count > 0 {
+		attrs = append(attrs,
+			"probe_delivery", m.interval.probeDelivery.String(),
+			"total_probe_delivery", m.total.probeDelivery.String(),
+		)
+	}
+	if m.total.upstream.count > 0 {
+		attrs = append(attrs,
+			"upstream", m.interval.upstream.String(),
+			"server_time", m.interval.serverTime.String(),
+			"downstream", m.interval.downstream.String(),
+			"total_upstream", m.total.upstream.String(),
+			"total_server_time", m.total.serverTime.String(),
+			"total_downstream", m.total.downstream.String(),
+		)
+	}
+	if len(m.total.protocols) > 0 {
+		attrs = append(attrs,
+			"protocols", formatCounts(m.interval.protocols),
+			"total_protocols", formatCounts(m.total.protocols),
+		)
+	}
+	if len(m.total.handshakes) > 0 {
+		attrs = append(attrs,
+			"tls_handshakes", formatCounts(m.interval.handshakes),
+			"total_tls_handshakes", formatCounts(m.total.handshakes),
+		)
+	}
+	if m.total.fullHandshake.count > 0 || m.total.resumedHandshake.count > 0 {
+		attrs = append(attrs,
+			"full_handshake", m.interval.fullHandshake.String(),
+			"resumed_handshake", m.interval.resumedHandshake.String(),
+			"total_full_handshake", m.total.fullHandshake.String(),
+			"total_resumed_handshake", m.total.resumedHandshake.String(),
+		)
+	}
+	if h2Windows {
+		attrs = append(attrs,
+			"h2_window_stalls", formatCounts(m.interval.windowStalls),
+			"h2_window_blocked", formatDurations(m.interval.windowBlocked),
+			"total_h2_window_stalls", formatCounts(m.total.windowStalls),
+			"total_h2_window_blocked", formatDurations(m.total.windowBlocked),
+		)
+	}
+	if len(m.total.errors) > 0 {
+		attrs = append(attrs,
+			"errors", formatCounts(m.interval.errors),
+			"error_rates", formatRates(snapshot.ErrorRates),
+			"total_errors", formatCounts(m.total.errors),
+		)
+	}
+	if m.active > 0 {
+		attrs = append(attrs,
+			"heap_per_stream", byteSize(resources.Heap/uint64(m.active)),
+			"goroutines_per_stream", fmt.Sprintf("%.1f", float64(resources.Goroutines)/float64(m.active)),
+		)
+	}
+	if m.warmup.received > 0 {
+		attrs = append(attrs,
+			"warmup_received", m.warmup.received,
+			"warmup_latency", m.warmup.latency.String(),
+			"warmup_jitter", m.warmup.jitter.String(),
+		)
+	}
+	sideLog(m.side).Info(m.side+": measurements", attrs...)
+	if m.side == "server" {
+		snapshot.Tenants = tenantSnapshots(interval)
+		logTenants(snapshot.Tenants)
+	}
+	if otlpURL != "" {
+		snapshot.histograms = m.interval
+		// the copy shares the maps of the interval
+		snapshot.histograms.errors = nil
+		snapshot.histograms.windowStalls = nil
+		snapshot.histograms.windowBlocked = nil
+		snapshot.histograms.protocols = nil
+		snapshot.histograms.handshakes = nil
+	}
+	if resources.FDLimit > 0 && float64(resources.FDs) > nofileWarnUsage*float64(resources.FDLimit) {
+		sideLog(m.side).Warn(m.side+": open file descriptors close to their limit, raise it with -raise-nofile", "fds", resources.FDs, "fd_limit", resources.FDLimit)
+	}
+	m.interval.reset()
+	return snapshot
+}
+
+// metricsVars is the counters and percentiles of a side published with
+// expvar at /debug/vars, over the run so far including the current interval.
+type metricsVars struct {
+	Active            int64
+	Panics            int64
+	Rejected          int64
+	Shed              int64
+	Evicted           int64
+	SignatureFailures int64
+	Retries           int64
+	GoAwayMigrations  int64
+	Dropped           int64
+	Duplicates        int64
+	SeqGaps           int64
+	Opened            int64
+	Closed            int64
+	CloseCauses       map[string]int64
+	Errors            map[string]int64
+	Setup             percentileSummary
+	Received          int64
+	Latency           percentileSummary
+	InterArrival      percentileSummary
+	Jitter            percentileSummary
+	WarmupReceived    int64
+}
+
+func init() {
+	expvar.Publish("manifest", expvar.Func(func() any { return manifest }))
+	expvar.Publish("client", expvar.Func(clientMetrics.vars))
+	expvar.Publish("server", expvar.Func(serverMetrics.vars))
+}
+
+func (m *metrics) vars() any {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	run := m.total
+	// the copy shares the maps of the totals
+	run.errors = maps.Clone(m.total.errors)
+	run.windowStalls = maps.Clone(m.total.windowStalls)
+	run.windowBlocked = maps.Clone(m.total.windowBlocked)
+	run.protocols = maps.Clone(m.total.protocols)
+	run.handshakes = maps.Clone(m.total.handshakes)
+	run.merge(&m.interval)
+	return metricsVars{
+		Active:            m.active,
+		Panics:            m.panics,
+		Rejected:          m.rejected,
+		Shed:              m.shed,
+		Evicted:           m.evicted,
+		SignatureFailures: m.signatureFailures,
+		Retries:           m.retries,
+		GoAwayMigrations:  m.migrations,
+		Dropped:           m.dropped,
+		Duplicates:        m.duplicates,
+		SeqGaps:           m.seqGaps,
+		Opened:            run.opened,
+		Closed:            run.closed,
+		CloseCauses:       maps.Clone(m.closeCauses),
+		Errors:            run.errors,
+		Setup:             summarize(&run.setup),
+		Received:          run.received,
+		Latency:           summarize(&run.latency),
+		InterArrival:      summarize(&run.interArrival),
+		Jitter:            summarize(&run.jitter),
+		WarmupReceived:    m.warmup.received,
+	}
+}
+
+// runSummary holds the complete distributions measured over a whole run, as
+// written to -summary-out when the run ends.
+type runSummary struct {
+	Manifest     runManifest
+	Side         string
+	Opened       int64
+	Setup        histogram
+	Received     int64
+	Latency      histogram
+	InterArrival histogram
+	Jitter       histogram
+
+	WarmupReceived int64
+	WarmupLatency  histogram
+	WarmupJitter   histogram
+}
+
+func (m *metrics) summary() runSummary {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.total.merge(&m.interval)
+	m.interval.reset()
+	return runSummary{
+		Manifest:       manifest,
+		Side:           m.side,
+		Opened:         m.total.opened,
+		Setup:          m.total.setup,
+		Received:       m.total.received,
+		Latency:        m.total.latency,
+		InterArrival:   m.total.interArrival,
+		Jitter:         m.total.jitter,
+		WarmupReceived: m.warmup.received,
+		WarmupLatency:  m.warmup.latency,
+		WarmupJitter:   m.warmup.jitter,
+	}
+}
+
+// report logs the measurements every reportInterval until ctx is done, both
+// those of the last interval and those of the whole run, and pushes them to
+// metricsPushURL and exports them to otlpURL if set.
+func (m *metrics) report(ctx context.Context) error {
+	if reportInterval <= 0 {
+		return nil
+	}
+	ticker := clk.NewTicker(reportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C():
+			snapshot := m.snapshot(now, reportInterval)
+			if metricsPushURL != "" {
+				err := pushMetrics(ctx, metricsPushURL, snapshot)
+				if err != nil {
+					sideLog(m.side).Warn(m.side+": failed to push measurements", "url", metricsPushURL, "error", err)
+				}
+			}
+			if otlpURL != "" {
+				err := exportOTLP(ctx, otlpURL, m.side, snapshot)
+				if err != nil {
+					sideLog(m.side).Warn(m.side+": failed to export measurements over otlp", "url", otlpURL, "error", err)
+				}
+			}
+			if federate && m == clientMetrics {
+				federateReport(&snapshot)
+			}
+		}
+	}
+}
+
+// pushMetrics posts snapshot as json to url.
+func pushMetrics(ctx context.Context, url string, snapshot metricsSnapshot) error {
+	body, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to encode measurements, error was: %w", err)
+	}
+	ctx, cancelFunc := context.WithTimeout(ctx, reportInterval)
+	defer cancelFunc()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request, error was: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
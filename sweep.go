@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Sweep mode measures how throughput and latency change with the size of
+// the messages, over sizes around the common MTU boundaries: for every size
+// it echoes messages of that size through the echo path of the server for
+// sweepDuration, with sweepWindow messages in flight. The results are
+// printed as a table, followed by the knee points of the throughput and the
+// latency curve, the sizes above which growing the messages stops paying off
+// in throughput, and at which latency starts growing with the size rather
+// than being dominated by the fixed cost of a message.
+var (
+	sweepSizes = []byteSize{
+		1 << 10, 1400, 1460, 1500, 2 << 10, 2920, 4 << 10,
+		8 << 10, 8960, 9000, 16 << 10, 32 << 10, 64 << 10,
+	}
+	sweepDuration = 2 * time.Second
+)
+
+const (
+	echoPath    = "/echo"
+	sweepWindow = 8
+)
+
+func setSweepSizes(s string) error {
+	var sizes []byteSize
+	for _, field := range strings.Split(s, ",") {
+		var size byteSize
+		err := size.Set(field)
+		if err != nil {
+			return err
+		}
+		if size <= 0 {
+			return fmt.Errorf("sweep size must be positive, got %v", size)
+		}
+		sizes = append(sizes, size)
+	}
+	slices.Sort(sizes)
+	sweepSizes = sizes
+	return nil
+}
+
+// serveEcho answers every message with its value and sequence number.
+func serveEcho(ctx context.Context, stream *serverStream) {
+	for {
+		var inMsg requestMsg
+		err := stream.recv(&inMsg)
+		if err != nil {
+			if ctx.Err() == nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+				stream.log.Error("server: failed to receive request message from client", "error", err)
+			}
+			return
+		}
+		err = stream.send(responseMsg{Msg: "echo", Seq: inMsg.Seq, Data: inMsg.Value})
+		if err != nil {
+			stream.log.Error("server: failed to send echo to client", "error", err)
+			return
+		}
+	}
+}
+
+// sweepPoint is the result of one size of a sweep.
+type sweepPoint struct {
+	size     byteSize
+	messages int64
+	// bytes of payload echoed per second
+	throughput float64
+	latency    histogram
+}
+
+// runSweep sweeps the sizes against the server at hostPort.
+func runSweep(ctx context.Context, hostPort string) error {
+	var points []sweepPoint
+	for _, size := range sweepSizes {
+		point, err := sweepSize(ctx, "http://"+hostPort+echoPath, size)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("sweep: size %v failed, error was: %w", size, err)
+		}
+		slog.Info("sweep: measured size", "size", size, "messages", point.messages, "latency", point.latency.String())
+		points = append(points, point)
+	}
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(out, "size\tbytes\tmessages\tthroughput\tp50\tp99\t")
+	for _, p := range points {
+		fmt.Fprintf(out, "%v\t%d\t%d\t%.1fMiB/s\t%v\t%v\t\n", p.size, p.size, p.messages, p.throughput/(1<<20), p.latency.quantile(0.5), p.latency.quantile(0.99))
+	}
+	err := out.Flush()
+	if err != nil {
+		return err
+	}
+	if len(points) >= 3 {
+		throughputKnee := kneePoint(points, func(p sweepPoint) float64 { return p.throughput }, false)
+		latencyKnee := kneePoint(points, func(p sweepPoint) float64 { return float64(p.latency.quantile(0.5)) }, true)
+		fmt.Printf("throughput knee: %v\n", points[throughputKnee].size)
+		fmt.Printf("latency knee: %v\n", points[latencyKnee].size)
+	}
+	return nil
+}
+
+// sweepSize echoes messages of size for sweepDuration on a stream of its
+// own, then half-closes it and waits for the echoes still in flight.
+func sweepSize(ctx context.Context, address string, size byteSize) (sweepPoint, error) {
+	point := sweepPoint{size: size}
+	stream, err := openStream(ctx, address)
+	if err != nil {
+		return point, err
+	}
+	defer stream.resp.Body.Close()
+	defer stream.w.Close()
+	stop := context.AfterFunc(ctx, func() {
+		stream.w.Close()
+		stream.resp.Body.Close()
+	})
+	defer stop()
+
+	measuring, cancelFunc := context.WithTimeout(ctx, sweepDuration)
+	defer cancelFunc()
+	payload := strings.Repeat("x", int(size))
+	// send times of the messages in flight, answered in order
+	inFlight := make(chan time.Time, sweepWindow)
+	sent := make(chan error, 1)
+	go func() {
+		for {
+			select {
+			case inFlight <- clk.Now():
+			case <-measuring.Done():
+				sent <- stream.closeSend()
+				return
+			}
+			err := stream.send(requestMsg{Msg: "echo", Value: payload})
+			if err != nil {
+				sent <- err
+				return
+			}
+		}
+	}()
+
+	started := clk.Now()
+	for {
+		var in responseMsg
+		err := stream.recv(&in)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return point, err
+		}
+		if len(in.Data) != int(size) {
+			return point, fmt.Errorf("expected echo of %d bytes, got %d", size, len(in.Data))
+		}
+		point.latency.record(clk.Since(<-inFlight))
+		point.messages++
+	}
+	elapsed := clk.Since(started)
+	err = <-sent
+	if err != nil {
+		return point, err
+	}
+	point.throughput = float64(point.messages) * float64(size) / elapsed.Seconds()
+	return point, nil
+}
+
+// kneePoint returns the index of the knee of the curve of value over the
+// logarithm of the size, as the point farthest from the straight line
+// through its first and last point, with both axes normalized. For a rising
+// curve that flattens, the knee is above that line, for one that is flat
+// first and then rises, below it.
+func kneePoint(points []sweepPoint, value func(sweepPoint) float64, convex bool) int {
+	first, last := points[0], points[len(points)-1]
+	x0, x1 := math.Log(float64(first.size)), math.Log(float64(last.size))
+	y0, y1 := value(first), value(last)
+	knee, farthest := 0, math.Inf(-1)
+	for i, p := range points {
+		if x1 == x0 || y1 == y0 {
+			break
+		}
+		x := (math.Log(float64(p.size)) - x0) / (x1 - x0)
+		y := (value(p) - y0) / (y1 - y0)
+		distance := y - x
+		if convex {
+			distance = x - y
+		}
+		if distance > farthest {
+			knee, farthest = i, distance
+		}
+	}
+	return knee
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// tcp mode runs the pong workload as the demo does, but with the ndjson
+// pings and pongs written straight to a plain connection, with no HTTP at
+// all, as the baseline that tells the overhead of full duplex streaming
+// over net/http from that of the encoding and the network. The server takes
+// every connection as a stream, and the client pings every -ping-interval on
+// a single one, measured and reported the same way as the streams of the
+// demo, so that, for instance, -mode ab -ab-b "-mode tcp" compares the two.
+// With a -hostport of the unix scheme the connection is a unix socket.
+var tcpBaseline = false
+
+// checkTCPBaseline validates tcp mode against the other flags, with the
+// workload named workloadName.
+func checkTCPBaseline(workloadName string) error {
+	if !tcpBaseline {
+		return nil
+	}
+	if h2 || h3 || grpcMode || splitStreams {
+		return fmt.Errorf("tcp mode does not combine with -h2, -h2c, -h3, -grpc or -split-transport, as it speaks no HTTP")
+	}
+	if probeInterval > 0 || federate || tcpInfoInterval > 0 {
+		return fmt.Errorf("tcp mode does not combine with -probe-interval, -federate or -tcp-info-interval, which need HTTP streams")
+	}
+	if workloadName != "pong" || workloadMix != nil {
+		return fmt.Errorf("tcp mode runs the pong workload only")
+	}
+	return nil
+}
+
+// serveTCP serves every connection accepted on ln as a stream of pings
+// until ctx is done, when it closes them.
+func serveTCP(ctx context.Context, ln net.Listener) error {
+	stop := context.AfterFunc(ctx, func() {
+		serverLog.Info("server: context was done, shutting down tcp server")
+		ln.Close()
+	})
+	defer stop()
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("server: failed to accept connection, error was: %w", err)
+		}
+		serverMetrics.connNegotiated("tcp")
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stop := context.AfterFunc(ctx, func() { conn.Close() })
+			defer stop()
+			defer conn.Close()
+			servePingConn(ctx, conn)
+		}()
+	}
+}
+
+// servePingConn answers every ping on conn with a pong, as servePong does.
+func servePingConn(ctx context.Context, conn net.Conn) {
+	serverMetrics.streamOpened(0)
+	var err error
+	defer func() {
+		cause := errorCause(err)
+		if errors.Is(err, io.EOF) {
+			cause = errPeerClosed
+		}
+		if ctx.Err() != nil {
+			cause = fmt.Errorf("%w: %w", errServerShutdown, context.Cause(ctx))
+		}
+		serverMetrics.streamClosed(cause)
+	}()
+	dec := json.NewDecoder(conn)
+	// the encoder writes every pong in a single write
+	enc := json.NewEncoder(conn)
+	arrivals := serverMetrics.newArrivalRecorder()
+	for {
+		var in requestMsg
+		err = dec.Decode(&in)
+		if err != nil {
+			return
+		}
+		received := clk.Now()
+		arrivals.observe(received)
+		if in.Seq != 0 {
+			serverMetrics.observeSeq(in.Seq, received)
+		}
+		out := answerPing(in, received)
+		started := clk.Now()
+		err = enc.Encode(&out)
+		if err != nil {
+			return
+		}
+		serverMetrics.observeFlush(clk.Since(started))
+	}
+}
+
+// answerPing returns the pong answering in, received at received, with the
+// timestamps of the exchange when in carries when it was sent.
+func answerPing(in requestMsg, received time.Time) responseMsg {
+	out := responseMsg{Msg: "pong", Seq: in.Seq}
+	if in.Sent != 0 {
+		out.Echoed = in.Sent
+		out.Received = received.UnixNano()
+		out.Sent = clk.Now().UnixNano()
+	}
+	return out
+}
+
+// driveTCP runs the pong workload over a connection to the server at
+// address, on a single one at a time.
+func driveTCP(ctx context.Context, address string) error {
+	target, err := url.Parse(address)
+	if err != nil {
+		return fmt.Errorf("failed to parse address, error was: %w", err)
+	}
+	conn, err := dialPingConn(ctx, target.Host)
+	if err != nil {
+		if ctx.Err() != nil {
+			clientLog.Info("client: context was done, exiting")
+			return nil
+		}
+		return err
+	}
+	defer conn.Close()
+	clientMetrics.connNegotiated("tcp")
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	dec := json.NewDecoder(conn)
+	enc := json.NewEncoder(conn)
+	err = runPings(ctx, func(ping *requestMsg) error {
+		return enc.Encode(ping)
+	}, func(pong *responseMsg) error {
+		return dec.Decode(pong)
+	})
+	cause := streamCause(ctx, err)
+	clientLog.Debug("client: tcp connection ended", "cause", cause, "reason", causeLabel(cause))
+	clientMetrics.streamClosed(cause)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// dialPingConn dials the server at hostPort, or at unixSocket if set,
+// retrying until it accepts.
+func dialPingConn(ctx context.Context, hostPort string) (net.Conn, error) {
+	for {
+		started := clk.Now()
+		var conn net.Conn
+		var err error
+		if unixSocket != "" {
+			conn, err = dialUnix(ctx, "unix", unixSocket)
+		} else {
+			var d net.Dialer
+			conn, err = d.DialContext(ctx, "tcp", hostPort)
+		}
+		if err == nil {
+			clientMetrics.streamOpened(clk.Since(started))
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		clientMetrics.observeError("connect", err)
+		clientLog.Info("client: failed to connect to tcp server", "error", err)
+		err = clk.Sleep(ctx, openRetryInterval)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// runPings pings every pingInterval with send and receives the pong
+// answering each with recv, as runPong does, until ctx is done or either
+// fails.
+func runPings(ctx context.Context, send func(*requestMsg) error, recv func(*responseMsg) error) error {
+	base := seqBase(manifest.Instance, clientStreamIDs.Add(1))
+	arrivals := clientMetrics.newArrivalRecorder()
+	ticker := clk.NewTicker(pingInterval)
+	defer ticker.Stop()
+	var pings int64
+	var offset clockOffset
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C():
+		}
+		sent := clk.Now()
+		pings++
+		ping := requestMsg{Msg: "ping", Seq: base | pings}
+		if echoTimestamps {
+			ping.Sent = sent.UnixNano()
+		}
+		err := send(&ping)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("client: failed to send ping to server, error was: %w", err)
+		}
+		var in responseMsg
+		err = recv(&in)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("failed to receive pong from server, error was: %w", err)
+		}
+		received := clk.Now()
+		arrivals.observe(received)
+		if in.Seq != ping.Seq {
+			_, n := splitSeq(in.Seq)
+			err := fmt.Errorf("pong answers ping %d instead of %d", n, pings)
+			clientMetrics.observeError("protocol", err)
+			return fmt.Errorf("client: server answered out of sequence, error was: %w", err)
+		}
+		clientMetrics.observeLatency(received.Sub(sent))
+		if in.Echoed == sent.UnixNano() && in.Echoed != 0 {
+			upstream, server, downstream := offset.split(sent, in, received)
+			clientMetrics.observeRTTSplit(upstream, server, downstream)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// With tcpInfoInterval the client samples the kernel's view of each of its
+// connections every interval: the smoothed round trip time and its
+// variation, the congestion window and the segments retransmitted, from
+// TCP_INFO on Linux. Every sample is passed to the hooks in tcpSampleHooks,
+// by default measuring the round trip times and counting the retransmits in
+// the reports of the client, so spikes of the latency of the application can
+// be correlated with what the network did at the time.
+var tcpInfoInterval = time.Duration(0)
+
+// tcpSample is the state of a connection at one point in time.
+type tcpSample struct {
+	Local  string
+	Remote string
+	Time   time.Time
+	RTT    time.Duration
+	RTTVar time.Duration
+	// Cwnd is the congestion window in segments
+	Cwnd uint32
+	// Retransmits is the number of segments retransmitted over the life of
+	// the connection, NewRetransmits those since the previous sample
+	Retransmits    uint32
+	NewRetransmits uint32
+}
+
+var tcpSampleHooks = []func(tcpSample){clientMetrics.observeTCPSample}
+
+// sampledConns are the connections of the client with the retransmits at
+// their previous sample.
+var sampledConns = struct {
+	mu    sync.Mutex
+	conns map[*net.TCPConn]uint32
+}{conns: map[*net.TCPConn]uint32{}}
+
+// sampledConn removes a connection from sampledConns once closed.
+type sampledConn struct {
+	net.Conn
+	tcpConn *net.TCPConn
+}
+
+func (c *sampledConn) Close() error {
+	sampledConns.mu.Lock()
+	delete(sampledConns.conns, c.tcpConn)
+	sampledConns.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// newSampledTransport returns a transport like transport, the default one if
+// nil, whose connections are sampled.
+func newSampledTransport(transport http.RoundTripper) *http.Transport {
+	t, ok := transport.(*http.Transport)
+	if !ok {
+		t = newBaseTransport()
+	}
+	dial := t.DialContext
+	t.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		tcpConn, ok := tcpConnOf(conn)
+		if !ok {
+			return conn, nil
+		}
+		sampledConns.mu.Lock()
+		sampledConns.conns[tcpConn] = 0
+		sampledConns.mu.Unlock()
+		return &sampledConn{Conn: conn, tcpConn: tcpConn}, nil
+	}
+	return t
+}
+
+func sampleTCPInfo(ctx context.Context) error {
+	if tcpInfoInterval <= 0 {
+		return nil
+	}
+	if !tcpInfoSupported {
+		clientLog.Warn("client: sampling TCP_INFO is not supported on this platform")
+		return nil
+	}
+	ticker := clk.NewTicker(tcpInfoInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C():
+		}
+
+		var samples []tcpSample
+		sampledConns.mu.Lock()
+		for conn, retransmits := range sampledConns.conns {
+			sample, err := sampleConn(conn)
+			if err != nil {
+				clientLog.Debug("client: failed to sample connection", "remote", conn.RemoteAddr(), "error", err)
+				continue
+			}
+			sample.NewRetransmits = sample.Retransmits - retransmits
+			sampledConns.conns[conn] = sample.Retransmits
+			samples = append(samples, sample)
+		}
+		sampledConns.mu.Unlock()
+
+		for _, sample := range samples {
+			clientLog.Debug("client: tcp sample", "local", sample.Local, "rtt", sample.RTT, "rttvar", sample.RTTVar, "cwnd", sample.Cwnd, "retransmits", sample.Retransmits)
+			if sample.NewRetransmits > 0 {
+				clientLog.Info("client: tcp segments retransmitted", "local", sample.Local, "remote", sample.Remote, "retransmits", sample.NewRetransmits, "rtt", sample.RTT, "rttvar", sample.RTTVar)
+			}
+			for _, hook := range tcpSampleHooks {
+				hook(sample)
+			}
+		}
+	}
+}
+
+func sampleConn(conn *net.TCPConn) (tcpSample, error) {
+	sample := tcpSample{Local: conn.LocalAddr().String(), Remote: conn.RemoteAddr().String(), Time: clk.Now()}
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return sample, err
+	}
+	err = readTCPInfo(rawConn, &sample)
+	return sample, err
+}
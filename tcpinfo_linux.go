@@ -0,0 +1,30 @@
+package main
+
+import (
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const tcpInfoSupported = true
+
+// readTCPInfo fills sample from the TCP_INFO of the socket conn.
+func readTCPInfo(conn syscall.RawConn, sample *tcpSample) error {
+	var info *unix.TCPInfo
+	var sockErr error
+	err := conn.Control(func(fd uintptr) {
+		info, sockErr = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	})
+	if err != nil {
+		return err
+	}
+	if sockErr != nil {
+		return sockErr
+	}
+	sample.RTT = time.Duration(info.Rtt) * time.Microsecond
+	sample.RTTVar = time.Duration(info.Rttvar) * time.Microsecond
+	sample.Cwnd = info.Snd_cwnd
+	sample.Retransmits = info.Total_retrans
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+const tcpInfoSupported = false
+
+func readTCPInfo(conn syscall.RawConn, sample *tcpSample) error {
+	return fmt.Errorf("TCP_INFO is not available on this platform")
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// The telemetry workload models an edge device uploading telemetry: the
+// client produces a reading of telemetrySize bytes every telemetryInterval
+// into its outbox whether it is connected or not, while an uploader sends
+// the readings of the outbox to the server in the order they were queued.
+// The server acknowledges every reading, and only acknowledged readings
+// leave the outbox, so that those queued while the server cannot be reached,
+// and those in flight when a stream breaks, are sent again from the oldest
+// once the client reconnects. The client measures the time from queuing a
+// reading to its acknowledgement as latency, and the server counts readings
+// delivered twice as duplicates.
+var (
+	telemetryInterval = 100 * time.Millisecond
+	telemetrySize     = 64
+)
+
+// telemetryStats are the counts of the telemetry workload on the client,
+// published with expvar. Queued and Bytes are what the outboxes hold.
+type telemetryStats struct {
+	Produced int64
+	Sent     int64
+	Acked    int64
+	// Restored were found in the offline queue when it was opened
+	Restored int64
+	// DroppedAge and DroppedSize were dropped unacknowledged to keep within
+	// the bounds of the outbox
+	DroppedAge  int64
+	DroppedSize int64
+	Queued      int64
+	Bytes       int64
+}
+
+var telemetryCounts = struct {
+	mu    sync.Mutex
+	stats telemetryStats
+}{}
+
+func init() {
+	expvar.Publish("telemetry", expvar.Func(func() any {
+		telemetryCounts.mu.Lock()
+		defer telemetryCounts.mu.Unlock()
+		return telemetryCounts.stats
+	}))
+}
+
+func serveTelemetry(ctx context.Context, stream *serverStream) {
+	for {
+		var inMsg requestMsg
+		err := stream.recv(&inMsg)
+		if err != nil {
+			if ctx.Err() == nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+				stream.log.Error("server: failed to receive reading from client", "error", err)
+			}
+			return
+		}
+		if inMsg.Msg != "reading" {
+			stream.log.Warn("server: received unknown telemetry message from client", "msg", inMsg.Msg)
+			continue
+		}
+		err = stream.send(responseMsg{Msg: "ack", Seq: inMsg.Seq})
+		if err != nil {
+			stream.log.Error("server: failed to acknowledge reading to client", "error", err)
+			return
+		}
+	}
+}
+
+func driveTelemetry(ctx context.Context, address string) error {
+	// the readings are numbered across the streams uploading them
+	box, err := openOutbox(offlineQueue, seqBase(manifest.Instance, 0))
+	if err != nil {
+		return err
+	}
+	defer box.close()
+
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.Go(func() error {
+		return produceReadings(ctx, box)
+	})
+	eg.Go(func() error {
+		for ctx.Err() == nil {
+			err := runStream(ctx, address, func(ctx context.Context, stream *clientStream) error {
+				return uploadReadings(ctx, stream, box)
+			})
+			if err != nil && ctx.Err() == nil {
+				clientLog.Warn("client: telemetry stream broke, queuing readings until reconnected", "error", err)
+				clk.Sleep(ctx, openRetryInterval)
+			}
+		}
+		return nil
+	})
+	return eg.Wait()
+}
+
+func produceReadings(ctx context.Context, box *outbox) error {
+	ticker := clk.NewTicker(telemetryInterval)
+	defer ticker.Stop()
+	data := make([]byte, (telemetrySize+1)/2)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C():
+		}
+		rand.Read(data)
+		err := box.push(hex.EncodeToString(data)[:telemetrySize])
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// uploadReadings sends the readings of box on stream, from the oldest, until
+// the stream breaks.
+func uploadReadings(ctx context.Context, stream *clientStream, box *outbox) error {
+	streamCtx, cancelFunc := context.WithCancelCause(ctx)
+	defer cancelFunc(nil)
+	stop := context.AfterFunc(streamCtx, func() { stream.resp.Body.Close() })
+	defer stop()
+	go func() {
+		cancelFunc(receiveAcks(stream, box))
+	}()
+
+	var last int64
+	if pending := box.pending(last); len(pending) > 1 {
+		stream.log.Info("client: uploading readings queued before connecting", "count", len(pending), "oldest", pending[0].Queued)
+	}
+	for {
+		for _, entry := range box.pending(last) {
+			err := stream.send(requestMsg{Msg: "reading", Seq: entry.Seq, Sent: entry.Queued.UnixNano(), Value: entry.Value})
+			if err != nil {
+				if streamCtx.Err() != nil {
+					break
+				}
+				return fmt.Errorf("client: failed to send reading to server, error was: %w", err)
+			}
+			last = entry.Seq
+			telemetryCounts.mu.Lock()
+			telemetryCounts.stats.Sent++
+			telemetryCounts.mu.Unlock()
+		}
+		select {
+		case <-streamCtx.Done():
+			if ctx.Err() != nil {
+				return nil
+			}
+			return context.Cause(streamCtx)
+		case <-box.queued:
+		}
+	}
+}
+
+// receiveAcks takes the readings the server acknowledges on stream out of
+// box, until the stream breaks.
+func receiveAcks(stream *clientStream, box *outbox) error {
+	for {
+		var in responseMsg
+		err := stream.recv(&in)
+		if err != nil {
+			return fmt.Errorf("failed to decode acknowledgement from server, error was: %w", err)
+		}
+		if in.Msg != "ack" {
+			stream.log.Warn("client: received unknown telemetry message from server", "msg", in.Msg)
+			continue
+		}
+		acked, err := box.ack(in.Seq)
+		if err != nil {
+			return err
+		}
+		now := clk.Now()
+		for _, entry := range acked {
+			clientMetrics.observeLatency(now.Sub(entry.Queued))
+		}
+	}
+}
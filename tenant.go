@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"maps"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Shared test servers tell the teams using them apart by tenant, so that
+// every team gets numbers of its own. A stream belongs to the tenant of the
+// tenant claim of its token when authenticating, and otherwise to that of
+// its tenantHeader, defaultTenant without either. The server partitions by
+// tenant:
+//
+//   - its measurements of the streams and messages, logged per tenant with
+//     every report once there is a tenant other than defaultTenant, pushed
+//     as Tenants of the snapshots, and published as tenants at /debug/vars,
+//     where once tenants are told apart a request only gets the entry of
+//     its tenant, by the same rules as at /debug/streams
+//   - the identities of the quotas when authenticating, so that the same
+//     subject in two tenants is accounted to separately
+//   - the streams watched and set apart at /debug/streams, which a request
+//     only finds among those of its tenant, by the tenant claim of its token
+//     when authenticating and by its tenantHeader otherwise, required once
+//     there is a tenant other than defaultTenant
+//
+// Beyond maxTenants tenants, the streams of new ones are accounted to
+// overflowTenant, so that clients cannot grow the measurements without
+// bound. The client opens its streams for clientTenant.
+var clientTenant = ""
+
+const (
+	tenantHeader   = "X-Tenant"
+	defaultTenant  = "default"
+	overflowTenant = "other"
+	maxTenants     = 64
+)
+
+// requestTenant returns the tenant of request, authenticated with claims if
+// authenticating.
+func requestTenant(request *http.Request, claims jwtClaims) string {
+	tenant := request.Header.Get(tenantHeader)
+	if jwtSecret != nil {
+		tenant = claims.Tenant
+	}
+	if tenant == "" {
+		return defaultTenant
+	}
+	return tenant
+}
+
+// tenantCounts are the measurements of the streams of a tenant on the
+// server.
+type tenantCounts struct {
+	mu            sync.Mutex
+	active        int64
+	opened        int64
+	closed        int64
+	quotaRejected int64
+	received      int64
+	sent          int64
+	flush         histogram
+	closeCauses   map[string]int64
+	// received at the previous report
+	reported int64
+}
+
+// tenantSnapshot is the measurements of a tenant since the server started,
+// with the Rate of messages received since the previous report.
+type tenantSnapshot struct {
+	Active        int64
+	Opened        int64
+	Closed        int64
+	QuotaRejected int64
+	Received      int64
+	Rate          float64 `json:",omitempty"`
+	Sent          int64
+	Flush         percentileSummary
+	CloseCauses   map[string]int64
+}
+
+var tenants = struct {
+	mu     sync.Mutex
+	counts map[string]*tenantCounts
+}{counts: map[string]*tenantCounts{}}
+
+func init() {
+	expvar.Publish("tenants", expvar.Func(func() any {
+		return tenantSnapshots(0)
+	}))
+}
+
+// tenantsInUse returns whether a stream was accounted to a tenant other than
+// defaultTenant.
+func tenantsInUse() bool {
+	tenants.mu.Lock()
+	defer tenants.mu.Unlock()
+	for tenant := range tenants.counts {
+		if tenant != defaultTenant {
+			return true
+		}
+	}
+	return false
+}
+
+// debugTenant returns the tenant request to the debug endpoints of the
+// streams is made for, empty for any while there is no tenant but
+// defaultTenant, answering it and returning false if it is not authorized.
+func debugTenant(writer http.ResponseWriter, request *http.Request) (string, bool) {
+	if jwtSecret != nil {
+		token, ok := bearerToken(request.Header.Get("Authorization"))
+		err := errors.New("missing bearer token")
+		var claims jwtClaims
+		if ok {
+			claims, err = parseToken(token, clk.Now())
+		}
+		if err != nil {
+			writer.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(writer, "unauthorized", http.StatusUnauthorized)
+			audit("auth_failure", request, "error", err.Error())
+			return "", false
+		}
+		return requestTenant(request, claims), true
+	}
+	tenant := request.Header.Get(tenantHeader)
+	if tenant == "" && tenantsInUse() {
+		http.Error(writer, fmt.Sprintf("expected the tenant of the stream as %s", tenantHeader), http.StatusForbidden)
+		return "", false
+	}
+	return tenant, true
+}
+
+// serveVars serves /debug/vars, all of the variables while tenants are not
+// told apart, and otherwise only the measurements of the tenant of the
+// request as debugTenant tells it, as the others are of all tenants.
+func serveVars(writer http.ResponseWriter, request *http.Request) {
+	tenant, ok := debugTenant(writer, request)
+	if !ok {
+		return
+	}
+	if tenant == "" {
+		expvar.Handler().ServeHTTP(writer, request)
+		return
+	}
+	own := map[string]tenantSnapshot{}
+	tenants.mu.Lock()
+	counts := tenants.counts[tenant]
+	tenants.mu.Unlock()
+	if counts != nil {
+		own[tenant] = counts.snapshot(0)
+	}
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(writer).Encode(map[string]any{"tenants": own})
+}
+
+// tenantFor returns the name tenant is accounted to, and its measurements.
+func tenantFor(tenant string) (string, *tenantCounts) {
+	tenants.mu.Lock()
+	defer tenants.mu.Unlock()
+	counts := tenants.counts[tenant]
+	if counts == nil && len(tenants.counts) >= maxTenants {
+		tenant = overflowTenant
+		counts = tenants.counts[tenant]
+	}
+	if counts == nil {
+		counts = &tenantCounts{closeCauses: map[string]int64{}}
+		tenants.counts[tenant] = counts
+	}
+	return tenant, counts
+}
+
+// tenantSnapshots returns the measurements of every tenant, with the rates
+// since the previous report over interval if it is positive, nil while
+// there is no tenant other than defaultTenant.
+func tenantSnapshots(interval time.Duration) map[string]tenantSnapshot {
+	tenants.mu.Lock()
+	defer tenants.mu.Unlock()
+	if len(tenants.counts) == 0 || len(tenants.counts) == 1 && tenants.counts[defaultTenant] != nil {
+		return nil
+	}
+	snapshots := make(map[string]tenantSnapshot, len(tenants.counts))
+	for tenant, c := range tenants.counts {
+		snapshots[tenant] = c.snapshot(interval)
+	}
+	return snapshots
+}
+
+func (c *tenantCounts) snapshot(interval time.Duration) tenantSnapshot {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	snapshot := tenantSnapshot{
+		Active:        c.active,
+		Opened:        c.opened,
+		Closed:        c.closed,
+		QuotaRejected: c.quotaRejected,
+		Received:      c.received,
+		Sent:          c.sent,
+		Flush:         summarize(&c.flush),
+		CloseCauses:   maps.Clone(c.closeCauses),
+	}
+	if interval > 0 {
+		snapshot.Rate = float64(c.received-c.reported) / interval.Seconds()
+		c.reported = c.received
+	}
+	return snapshot
+}
+
+// logTenants logs the measurements of snapshots per tenant.
+func logTenants(snapshots map[string]tenantSnapshot) {
+	names := make([]string, 0, len(snapshots))
+	for tenant := range snapshots {
+		names = append(names, tenant)
+	}
+	sort.Strings(names)
+	for _, tenant := range names {
+		s := snapshots[tenant]
+		serverLog.Info("server: tenant measurements",
+			"tenant", tenant,
+			"active", s.Active,
+			"opened", s.Opened,
+			"closed", s.Closed,
+			"quota_rejected", s.QuotaRejected,
+			"received", s.Received,
+			"rate", fmt.Sprintf("%.1f/s", s.Rate),
+			"sent", s.Sent,
+			"flush", fmt.Sprintf("p50=%v p99=%v max=%v", s.Flush.P50, s.Flush.P99, s.Flush.Max),
+			"close_causes", formatCounts(s.CloseCauses),
+		)
+	}
+}
+
+func (c *tenantCounts) streamOpened() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.opened++
+	c.active++
+}
+
+func (c *tenantCounts) streamClosed(cause error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed++
+	c.active--
+	c.closeCauses[causeLabel(cause)]++
+}
+
+func (c *tenantCounts) streamRejected() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.quotaRejected++
+}
+
+func (c *tenantCounts) observeReceived() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.received++
+}
+
+func (c *tenantCounts) observeSent(flush time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sent++
+	c.flush.record(flush)
+}
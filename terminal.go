@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// Terminal mode connects the local terminal to a command the server runs on
+// a pseudo terminal, such as a shell, through a single stream. Unlike the
+// workloads the stream carries raw bytes rather than ndjson: keystrokes go
+// out in the request body as typed, and the output of the command comes back
+// in the response, flushed on every read from the pseudo terminal, so any
+// latency or buffering on the path is felt right away. The local terminal is
+// put into raw mode, its size and TERM are passed along when the stream is
+// opened, later resizes are not. When stdin ends, as with a script piped in,
+// the client half-closes the stream and the server sends end of file to the
+// command, then streams its remaining output until it exits. As the bytes
+// are not messages, they cannot be signed, sealed or carry the control
+// messages renewing a token, so terminal sessions do not combine with
+// -jwt-secret, -payload-key, -signing-key or -verify-key.
+var (
+	// terminalCommand is the command the server runs for terminal sessions,
+	// which are refused without it
+	terminalCommand = ""
+)
+
+const (
+	terminalPath = "/terminal"
+	// terminalEOF is the end of file character of a pseudo terminal in
+	// canonical mode, ctrl-d
+	terminalEOF = 0x04
+)
+
+// checkTerminal validates terminal mode, if terminalMode, and serving
+// terminal sessions against the other flags.
+func checkTerminal(terminalMode bool) error {
+	if !terminalMode && terminalCommand == "" {
+		return nil
+	}
+	if jwtSecret != nil || payloadAEAD != nil || signingKey != nil || verifyKey != nil {
+		return fmt.Errorf("terminal sessions carry raw bytes rather than messages and do not combine with -jwt-secret, -payload-key, -signing-key or -verify-key")
+	}
+	return nil
+}
+
+// terminalWriter writes raw bytes to the response of a stream, flushing each
+// write.
+type terminalWriter struct {
+	stream *serverStream
+}
+
+func (w terminalWriter) Write(p []byte) (int, error) {
+	w.stream.mu.Lock()
+	defer w.stream.mu.Unlock()
+	n, err := w.stream.writer.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, w.stream.respCtl.Flush()
+}
+
+func serveTerminal(ctx context.Context, stream *serverStream) {
+	out := terminalWriter{stream}
+	if terminalCommand == "" {
+		fmt.Fprint(out, "terminal sessions are disabled, the server has no -terminal-command\r\n")
+		return
+	}
+	query := stream.request.URL.Query()
+	rows, _ := strconv.Atoi(query.Get("rows"))
+	cols, _ := strconv.Atoi(query.Get("cols"))
+	started := clk.Now()
+	err := runTerminalCommand(ctx, stream.request.Body, out, query.Get("term"), rows, cols)
+	if err != nil && ctx.Err() == nil {
+		stream.log.Error("server: terminal session failed", "error", err)
+		fmt.Fprintf(out, "\r\nterminal session failed: %v\r\n", err)
+		return
+	}
+	stream.log.Info("server: terminal session ended", "remote", stream.request.RemoteAddr, "took", clk.Since(started).Round(time.Millisecond))
+}
+
+// runTerminal runs terminal mode against the server at hostPort.
+func runTerminal(ctx context.Context, hostPort string) error {
+	query := url.Values{}
+	query.Set("term", os.Getenv("TERM"))
+	if cols, rows, err := term.GetSize(int(os.Stdout.Fd())); err == nil {
+		query.Set("rows", strconv.Itoa(rows))
+		query.Set("cols", strconv.Itoa(cols))
+	}
+	stream, err := openStream(ctx, "http://"+hostPort+terminalPath+"?"+query.Encode())
+	if err != nil {
+		if ctx.Err() != nil {
+			slog.Info("terminal: context was done, exiting")
+			return nil
+		}
+		return err
+	}
+	defer stream.resp.Body.Close()
+	defer stream.w.Close()
+	stop := context.AfterFunc(ctx, func() { stream.resp.Body.Close() })
+	defer stop()
+
+	// ctrl-c goes to the command rather than interrupting the client, as
+	// signals are not generated in raw mode
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return fmt.Errorf("terminal: failed to put terminal into raw mode, error was: %w", err)
+		}
+		defer term.Restore(fd, state)
+	}
+
+	go func() {
+		// stdin cannot be interrupted, this is left behind blocked in a
+		// read when the server ends the session first
+		_, err := io.Copy(stream.w, os.Stdin)
+		if err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			slog.Warn("terminal: failed to read stdin", "error", err)
+		}
+		stream.closeSend()
+	}()
+	_, err = io.Copy(os.Stdout, stream.resp.Body)
+	if err != nil && ctx.Err() == nil {
+		return fmt.Errorf("terminal: failed to receive from server, error was: %w", err)
+	}
+	return nil
+}
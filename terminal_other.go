@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+func runTerminalCommand(ctx context.Context, in io.Reader, out io.Writer, termName string, rows, cols int) error {
+	return errors.New("terminal sessions are only supported on unix")
+}
@@ -0,0 +1,50 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+
+	"github.com/creack/pty"
+)
+
+// runTerminalCommand runs terminalCommand on a pseudo terminal of rows and
+// cols, fed from in and writing its output to out, until it exits. End of
+// file on in is passed on as the end of file character.
+func runTerminalCommand(ctx context.Context, in io.Reader, out io.Writer, termName string, rows, cols int) error {
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", terminalCommand)
+	cmd.Env = os.Environ()
+	if termName != "" {
+		cmd.Env = append(cmd.Env, "TERM="+termName)
+	}
+	var size *pty.Winsize
+	if rows > 0 && cols > 0 {
+		size = &pty.Winsize{Rows: uint16(rows), Cols: uint16(cols)}
+	}
+	ptmx, err := pty.StartWithSize(cmd, size)
+	if err != nil {
+		return fmt.Errorf("failed to start %q, error was: %w", terminalCommand, err)
+	}
+	defer ptmx.Close()
+
+	go func() {
+		_, err := io.Copy(ptmx, in)
+		if err == nil {
+			ptmx.Write([]byte{terminalEOF})
+		}
+	}()
+	// reads fail once the command exited and the pseudo terminal closed
+	io.Copy(out, ptmx)
+	err = cmd.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		// the exit status is the business of the user
+		return nil
+	}
+	return err
+}
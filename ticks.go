@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// The ticks workload has the server push a message on every wall clock
+// boundary of tickInterval, carrying both the boundary it was scheduled for
+// and the time it was actually sent. The client compares them with the time
+// of arrival, separating the lateness of the server's timer from the jitter
+// added by delivery over the duplex stream. Every tick also carries when the
+// previous one was flushed, to measure the delivery of flushes.
+var tickInterval = 100 * time.Millisecond
+
+const tickReportInterval = 5 * time.Second
+
+func serveTicks(ctx context.Context, stream *serverStream) {
+	ctx, cancelFunc := context.WithCancel(ctx)
+	defer cancelFunc()
+
+	go func() {
+		defer cancelFunc()
+		// the client is not expected to send anything but control messages,
+		// read to take those and to notice it going away
+		err := stream.discard()
+		if err != nil && ctx.Err() == nil {
+			stream.log.Error("server: failed to receive from client", "error", err)
+			return
+		}
+		stream.log.Info("server: client closed connection - finished")
+	}()
+
+	for {
+		scheduled := clk.Now().Truncate(tickInterval).Add(tickInterval)
+		timer := clk.NewTimer(scheduled.Sub(clk.Now()))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C():
+		}
+
+		tick := responseMsg{
+			Msg:       "tick",
+			Scheduled: scheduled.UnixNano(),
+			Sent:      clk.Now().UnixNano(),
+		}
+		if flushed := stream.lastFlushed(); !flushed.IsZero() {
+			tick.Flushed = flushed.UnixNano()
+		}
+		err := stream.send(tick)
+		if err != nil {
+			stream.log.Error("server: failed to send tick to client", "error", err)
+			return
+		}
+	}
+}
+
+func runTicks(ctx context.Context, stream *clientStream) error {
+	stop := context.AfterFunc(ctx, func() { stream.resp.Body.Close() })
+	defer stop()
+
+	var timerLateness, deliveryLatency, flushDelivery durationSummary
+	lastReport := clk.Now()
+	// arrival of the previous tick, and the fastest delivery of a flush
+	var lastArrival time.Time
+	fastest := time.Duration(math.MaxInt64)
+	for {
+		var in responseMsg
+		err := stream.recv(&in)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, io.EOF) {
+				stream.log.Info("client: context was done, exiting")
+				return nil
+			}
+			return fmt.Errorf("failed to decode response message from server, error was: %w", err)
+		}
+		received := clk.Now()
+		if in.Msg != "tick" {
+			stream.log.Warn("client: received unknown ticks message from server", "msg", in.Msg)
+			continue
+		}
+
+		lateness := time.Duration(in.Sent - in.Scheduled)
+		latency := received.Sub(time.Unix(0, in.Sent))
+		timerLateness.add(lateness)
+		deliveryLatency.add(latency)
+		clientMetrics.observeLatency(latency)
+		stream.log.Debug("client: received tick from server", "timer_lateness", lateness, "delivery_latency", latency)
+		if in.Flushed != 0 && !lastArrival.IsZero() {
+			// includes the offset between the clocks, which the fastest
+			// delivery cancels out
+			delivery := lastArrival.Sub(time.Unix(0, in.Flushed))
+			fastest = min(fastest, delivery)
+			flushDelivery.add(delivery - fastest)
+			clientMetrics.observeFlushDelivery(delivery - fastest)
+		}
+		lastArrival = received
+
+		if received.Sub(lastReport) >= tickReportInterval {
+			stream.log.Info("client: tick timing",
+				"ticks", timerLateness.count,
+				"timer_lateness", timerLateness.String(),
+				"delivery_latency", deliveryLatency.String(),
+				"flush_delivery", flushDelivery.String(),
+			)
+			timerLateness = durationSummary{}
+			deliveryLatency = durationSummary{}
+			flushDelivery = durationSummary{}
+			lastReport = received
+		}
+	}
+}
+
+// durationSummary accumulates count, min, max, mean and standard deviation of
+// a series of durations.
+type durationSummary struct {
+	count    int
+	min, max time.Duration
+	sum      float64
+	sumSq    float64
+}
+
+func (s *durationSummary) add(d time.Duration) {
+	if s.count == 0 || d < s.min {
+		s.min = d
+	}
+	if s.count == 0 || d > s.max {
+		s.max = d
+	}
+	s.count++
+	s.sum += float64(d)
+	s.sumSq += float64(d) * float64(d)
+}
+
+func (s *durationSummary) mean() time.Duration {
+	if s.count == 0 {
+		return 0
+	}
+	return time.Duration(s.sum / float64(s.count))
+}
+
+func (s *durationSummary) stddev() time.Duration {
+	if s.count == 0 {
+		return 0
+	}
+	mean := s.sum / float64(s.count)
+	return time.Duration(math.Sqrt(math.Max(0, s.sumSq/float64(s.count)-mean*mean)))
+}
+
+func (s *durationSummary) String() string {
+	return fmt.Sprintf("min=%v mean=%v max=%v stddev=%v", s.min, s.mean(), s.max, s.stddev())
+}
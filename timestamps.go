@@ -0,0 +1,43 @@
+package main
+
+import "time"
+
+// With echoTimestamps every ping of the pong workload carries when the
+// client sent it, which the server echoes in its pong together with when it
+// received the ping and when it sent the pong. The client decomposes the
+// round trip of every ping into upstream, the time from the client to the
+// server, server, the time the server took to answer, and downstream, the
+// time from the server back to the client. As the clocks of client and
+// server may be apart, it estimates their offset from the exchange of the
+// stream with the least time on the network, assuming that one took as long
+// upstream as downstream, as NTP does, and corrects the upstream and
+// downstream times by it. An asymmetry between the directions of that
+// exchange shifts both by half of it, but the drift of either over a run is
+// measured correctly.
+var echoTimestamps = false
+
+// clockOffset estimates the offset of the clock of the server from that of
+// the client, over the exchanges of a stream.
+type clockOffset struct {
+	// network is the least time on the network of an exchange so far, and
+	// offset the offset estimated from it
+	network time.Duration
+	offset  time.Duration
+	ok      bool
+}
+
+// split returns the upstream, server and downstream times of the exchange of
+// a ping sent at sent and answered by in, received at received, updating the
+// estimate of the offset with it.
+func (c *clockOffset) split(sent time.Time, in responseMsg, received time.Time) (upstream, server, downstream time.Duration) {
+	// both include the offset, with opposite signs
+	up := time.Unix(0, in.Received).Sub(sent)
+	down := received.Sub(time.Unix(0, in.Sent))
+	server = time.Duration(in.Sent - in.Received)
+	if network := up + down; !c.ok || network < c.network {
+		c.network = network
+		c.offset = (up - down) / 2
+		c.ok = true
+	}
+	return up - c.offset, server, down + c.offset
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Over TLS, in h2 and h3 mode, both sides report whether the handshake of
+// every new connection resumed the session of an earlier one with a session
+// ticket, as a PSK in TLS 1.3, which skips the certificates and their
+// signatures and so changes how long a reconnect takes. They count the
+// handshakes as full or resumed in tls_handshakes and log every one, the
+// client with the time it took, kept apart for full and resumed handshakes.
+// The client keeps the tickets the server sent it to resume with unless
+// tlsResume is off, so every handshake is a full one. The servers of a run
+// share the key encrypting the tickets, so that the clients of restart mode
+// can resume sessions with the restarted server.
+var tlsResume = true
+
+// sessionTicketKey returns the key of the session tickets of the servers of
+// the run.
+var sessionTicketKey = sync.OnceValue(func() [32]byte {
+	var key [32]byte
+	rand.Read(key[:])
+	return key
+})
+
+// clientTLSConfig returns the TLS config of the client in h2 and h3 mode.
+func clientTLSConfig() *tls.Config {
+	// the certificate of the server is generated on the fly
+	config := &tls.Config{InsecureSkipVerify: true, KeyLogWriter: keyLogWriter()}
+	if tlsResume {
+		config.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+	return config
+}
+
+// traceTLSHandshake returns ctx tracing how long the TLS handshake of the
+// new connection of its request takes, which it sets took to.
+func traceTLSHandshake(ctx context.Context, took *atomic.Int64) context.Context {
+	var started time.Time
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		TLSHandshakeStart: func() { started = clk.Now() },
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if err == nil {
+				took.Store(int64(clk.Since(started)))
+			}
+		},
+	})
+}
+
+// clientConnHandshaked counts and logs the TLS handshake of a new connection,
+// by its first response resp, which took took if it was traced.
+func clientConnHandshaked(resp *http.Response, took time.Duration) {
+	if resp.TLS == nil {
+		return
+	}
+	clientMetrics.connHandshaked(resp.TLS.DidResume, took)
+	attrs := []any{"resumed", resp.TLS.DidResume, "version", tls.VersionName(resp.TLS.Version), "host", resp.Request.URL.Host}
+	if took > 0 {
+		attrs = append(attrs, "took", took)
+	}
+	clientLog.Info("client: tls handshake", attrs...)
+}
+
+// serverConnHandshaked counts and logs the TLS handshake of the connection of
+// request.
+func serverConnHandshaked(request *http.Request) {
+	if request.TLS == nil {
+		return
+	}
+	serverMetrics.connHandshaked(request.TLS.DidResume, 0)
+	serverLog.Info("server: tls handshake", "resumed", request.TLS.DidResume, "version", tls.VersionName(request.TLS.Version), "remote", request.RemoteAddr)
+}
+
+// handshakeKind names a TLS handshake as counted, by whether it resumed.
+func handshakeKind(resumed bool) string {
+	if resumed {
+		return "resumed"
+	}
+	return "full"
+}
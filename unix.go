@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// A -hostport of unix:///path/to/socket makes the server listen on the unix
+// domain socket at that path instead of TCP, and the client dial it, so that
+// profiles of encoding and decoding are not drowned in the noise of the TCP
+// stack. The URLs of the client then have unixHost for host, whatever they
+// are dialed over.
+const (
+	unixScheme = "unix://"
+	unixHost   = "localhost"
+)
+
+// unixSocket is the path of the socket of a -hostport of the unix scheme,
+// empty otherwise.
+var unixSocket = ""
+
+// setUnixSocket takes the socket path from hostPort if it is of the unix
+// scheme, and returns the host of the URLs of the client.
+func setUnixSocket(hostPort string) string {
+	socket, ok := strings.CutPrefix(hostPort, unixScheme)
+	if !ok {
+		return hostPort
+	}
+	unixSocket = socket
+	return unixHost
+}
+
+// checkUnixSocket validates a unix socket against the other flags, in mode.
+func checkUnixSocket(mode string) error {
+	if unixSocket == "" {
+		return nil
+	}
+	if h3 || grpcMode {
+		return fmt.Errorf("-hostport %s does not combine with -h3 or -grpc, which dial their own transports", unixScheme)
+	}
+	if tcpInfoInterval > 0 || nagle || reusePort || evictBacklog > 0 {
+		return fmt.Errorf("-hostport %s does not combine with -tcp-info-interval, -nagle, -reuse-port or -evict-backlog, which are about TCP", unixScheme)
+	}
+	if mode == "netem" || mode == "sensitivity" {
+		return fmt.Errorf("-hostport %s does not combine with %s mode, which emulates the network on ports", unixScheme, mode)
+	}
+	if selfCheck || reverseProxy {
+		return fmt.Errorf("-hostport %s does not combine with -selfcheck or -reverse-proxy, which listen on ports of their own", unixScheme)
+	}
+	return nil
+}
+
+// listenUnix listens on unixSocket, taking over a socket file left behind by
+// a server that did not shut down, but not one still accepted on.
+func listenUnix(ctx context.Context) (net.Listener, error) {
+	info, err := os.Lstat(unixSocket)
+	if err == nil && info.Mode()&os.ModeSocket != 0 {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "unix", unixSocket)
+		if err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("unix socket %s is in use by another server", unixSocket)
+		}
+		serverLog.Info("server: removing stale unix socket", "path", unixSocket)
+		os.Remove(unixSocket)
+	}
+	var lc net.ListenConfig
+	return lc.Listen(ctx, "unix", unixSocket)
+}
+
+// dialUnix dials unixSocket for whichever address.
+func dialUnix(ctx context.Context, _, _ string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "unix", unixSocket)
+}
+
+// newBaseTransport returns a clone of the default transport the transports
+// of the client start from, dialing unixSocket if set, or tunneling through
+// a proxy if configured.
+func newBaseTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if unixSocket != "" {
+		transport.DialContext = dialUnix
+	} else if proxyConfigured() {
+		// tunnels take the place of the proxying of the transport, which
+		// forwards the requests of http servers instead
+		transport.Proxy = nil
+		transport.DialContext = dialTunnel(transport.DialContext)
+	}
+	return transport
+}
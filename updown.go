@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The updown workload has the client stream an upload of updownSize bytes in
+// chunks of updownChunk bytes, then half-close the stream, while the server
+// processes every chunk as it arrives, hashing it, and once the upload ended
+// streams back the result, one digest per chunk. The client checks every
+// digest and measures the turnaround, from its half-close to the last digest,
+// as latency.
+//
+// The server answers the first chunk right away with a "receiving" message,
+// which the client waits for up to updownProbeTimeout before sending the
+// rest. When it reaches the client only after the whole upload was sent,
+// something on the path, a proxy or the stack, held back the upload until it
+// was complete rather than streaming it, and the client counts the upload as
+// buffered.
+var (
+	updownSize  = byteSize(16 << 20)
+	updownChunk = byteSize(64 << 10)
+)
+
+const updownProbeTimeout = 1 * time.Second
+
+// updownStats are the counts of the updown workload on the client, published
+// with expvar.
+type updownStats struct {
+	Uploads int64
+	Bytes   int64
+	// Buffered are the uploads the server only started receiving once they
+	// were sent completely
+	Buffered int64
+	// Corrupted are the uploads with a digest differing from the chunk sent
+	Corrupted int64
+}
+
+var updownCounts = struct {
+	mu    sync.Mutex
+	stats updownStats
+}{}
+
+func init() {
+	expvar.Publish("updown", expvar.Func(func() any {
+		updownCounts.mu.Lock()
+		defer updownCounts.mu.Unlock()
+		return updownCounts.stats
+	}))
+}
+
+func serveUpDown(ctx context.Context, stream *serverStream) {
+	var digests []string
+	for {
+		var inMsg requestMsg
+		err := stream.recv(&inMsg)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			if ctx.Err() == nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+				stream.log.Error("server: failed to receive chunk from client", "error", err)
+			}
+			return
+		}
+		if inMsg.Msg != "chunk" {
+			stream.log.Warn("server: received unknown updown message from client", "msg", inMsg.Msg)
+			continue
+		}
+		if len(digests) == 0 {
+			err := stream.send(responseMsg{Msg: "receiving"})
+			if err != nil {
+				stream.log.Error("server: failed to send to client", "error", err)
+				return
+			}
+		}
+		sum := sha256.Sum256([]byte(inMsg.Value))
+		digests = append(digests, hex.EncodeToString(sum[:]))
+	}
+	for i, digest := range digests {
+		err := stream.send(responseMsg{Msg: "digest", Seq: int64(i + 1), Data: digest})
+		if err != nil {
+			stream.log.Error("server: failed to send digest to client", "error", err)
+			return
+		}
+	}
+	stream.log.Debug("server: streamed back digests of upload", "chunks", len(digests))
+}
+
+func driveUpDown(ctx context.Context, address string) error {
+	if updownChunk <= 0 {
+		return fmt.Errorf("client: updown chunk size must be positive, got %v", updownChunk)
+	}
+	for ctx.Err() == nil {
+		err := runStream(ctx, address, runUpDownStream)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runUpDownStream(ctx context.Context, stream *clientStream) error {
+	stop := context.AfterFunc(ctx, func() { stream.resp.Body.Close() })
+	defer stop()
+
+	chunks := int((updownSize + updownChunk - 1) / updownChunk)
+	digests := make([]string, chunks)
+	// set once the whole upload was sent
+	var uploaded atomic.Bool
+	var closed time.Time
+	// closed once the server started receiving
+	receiving := make(chan struct{})
+	sent := make(chan error, 1)
+	go func() {
+		data := make([]byte, (updownChunk+1)/2)
+		left := updownSize
+		for i := range digests {
+			rand.Read(data)
+			value := hex.EncodeToString(data)[:min(updownChunk, left)]
+			left -= byteSize(len(value))
+			sum := sha256.Sum256([]byte(value))
+			digests[i] = hex.EncodeToString(sum[:])
+			err := stream.send(requestMsg{Msg: "chunk", Seq: stream.seq(int64(i + 1)), Value: value})
+			if err != nil {
+				sent <- fmt.Errorf("client: failed to send chunk to server, error was: %w", err)
+				return
+			}
+			if i == 0 {
+				select {
+				case <-receiving:
+				case <-clk.After(updownProbeTimeout):
+				}
+			}
+		}
+		uploaded.Store(true)
+		closed = clk.Now()
+		sent <- stream.closeSend()
+	}()
+
+	probed, buffered := false, false
+	var received []string
+	for {
+		var in responseMsg
+		err := stream.recv(&in)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if !errors.Is(err, io.EOF) {
+				return fmt.Errorf("failed to decode response message from server, error was: %w", err)
+			}
+			break
+		}
+		switch in.Msg {
+		case "receiving":
+			if !probed {
+				probed = true
+				buffered = uploaded.Load()
+				close(receiving)
+			}
+		case "digest":
+			received = append(received, in.Data)
+		default:
+			stream.log.Warn("client: received unknown updown message from server", "msg", in.Msg)
+		}
+	}
+	// the response only ends after the request body did
+	err := <-sent
+	if err != nil {
+		return err
+	}
+	turnaround := clk.Since(closed)
+	clientMetrics.observeLatency(turnaround)
+	// the digests are in the order of the chunks
+	corrupted := !slices.Equal(received, digests)
+
+	updownCounts.mu.Lock()
+	updownCounts.stats.Uploads++
+	updownCounts.stats.Bytes += int64(updownSize)
+	if buffered {
+		updownCounts.stats.Buffered++
+	}
+	if corrupted {
+		updownCounts.stats.Corrupted++
+	}
+	updownCounts.mu.Unlock()
+	if corrupted {
+		stream.log.Error("client: digests of upload do not match the chunks sent", "chunks", chunks, "received", len(received))
+		return nil
+	}
+	if buffered {
+		stream.log.Warn("client: server only started receiving the upload once it was sent completely, the path buffers it", "size", updownSize)
+	}
+	stream.log.Debug("client: upload streamed back", "chunks", chunks, "turnaround", turnaround)
+	return nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+)
+
+// The upload workload has the client upload uploadRecords records of
+// uploadSize bytes each, then half-close the stream with closeSend and read
+// the single summary the server answers with once the request body ended:
+// how many records and bytes it received, and a checksum of them in the
+// order received. The client checks the summary against what it sent,
+// measures the time from the half-close to the summary as latency, and
+// starts over with a new stream.
+//
+// With uploadTrailer the client also declares the checksum trailer and sends
+// the checksum of the records in it once the request body ended. The server
+// verifies it at the end of the body and refuses the upload with an error
+// message if it is missing or differs, which validates that trailers pass
+// along the duplex path.
+var (
+	uploadRecords = 1000
+	uploadSize    = 256
+	uploadTrailer = false
+)
+
+// checksumTrailer carries the crc32 of the records uploaded, as hex.
+const checksumTrailer = "X-Checksum"
+
+// uploadSummary is what the server received on an upload stream.
+type uploadSummary struct {
+	Records int64
+	Bytes   int64
+	// Checksum is the crc32 of the record values in the order received
+	Checksum uint32
+}
+
+// uploadStats are the counts of the upload workload on the client,
+// published with expvar.
+type uploadStats struct {
+	Uploads int64
+	Records int64
+	Bytes   int64
+	// Mismatched are the uploads whose summary differs from what was sent
+	Mismatched int64
+	// Refused are the uploads whose checksum trailer the server refused
+	Refused int64
+}
+
+var uploadCounts = struct {
+	mu    sync.Mutex
+	stats uploadStats
+}{}
+
+func init() {
+	expvar.Publish("upload", expvar.Func(func() any {
+		uploadCounts.mu.Lock()
+		defer uploadCounts.mu.Unlock()
+		return uploadCounts.stats
+	}))
+}
+
+func serveUpload(ctx context.Context, stream *serverStream) {
+	var summary uploadSummary
+	checksum := crc32.NewIEEE()
+	for {
+		var inMsg requestMsg
+		err := stream.recv(&inMsg)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			if ctx.Err() == nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+				stream.log.Error("server: failed to receive record from client", "error", err)
+			}
+			return
+		}
+		if inMsg.Msg != "record" {
+			stream.log.Warn("server: received unknown upload message from client", "msg", inMsg.Msg)
+			continue
+		}
+		summary.Records++
+		summary.Bytes += int64(len(inMsg.Value))
+		io.WriteString(checksum, inMsg.Value)
+	}
+	summary.Checksum = checksum.Sum32()
+	// the trailer is only known once the body ended
+	if _, declared := stream.request.Trailer[checksumTrailer]; declared {
+		sent := stream.request.Trailer.Get(checksumTrailer)
+		if sent != formatChecksum(summary.Checksum) {
+			stream.log.Warn("server: checksum trailer differs from upload received", "trailer", sent, "checksum", formatChecksum(summary.Checksum))
+			err := stream.send(responseMsg{Msg: "error", Error: fmt.Sprintf("checksum trailer %q differs from upload received, %s", sent, formatChecksum(summary.Checksum))})
+			if err != nil {
+				stream.log.Error("server: failed to refuse upload to client", "error", err)
+			}
+			return
+		}
+	}
+	err := stream.send(responseMsg{Msg: "summary", Summary: &summary})
+	if err != nil {
+		stream.log.Error("server: failed to send upload summary to client", "error", err)
+		return
+	}
+	stream.log.Debug("server: summarized upload", "records", summary.Records, "bytes", summary.Bytes)
+}
+
+func formatChecksum(checksum uint32) string {
+	return fmt.Sprintf("%08x", checksum)
+}
+
+func driveUpload(ctx context.Context, address string) error {
+	var trailers []string
+	if uploadTrailer {
+		trailers = append(trailers, checksumTrailer)
+	}
+	for ctx.Err() == nil {
+		err := runStream(ctx, address, runUploadStream, trailers...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runUploadStream(ctx context.Context, stream *clientStream) error {
+	stop := context.AfterFunc(ctx, func() { stream.resp.Body.Close() })
+	defer stop()
+
+	var sent uploadSummary
+	checksum := crc32.NewIEEE()
+	data := make([]byte, (uploadSize+1)/2)
+	for i := 0; i < uploadRecords; i++ {
+		rand.Read(data)
+		value := hex.EncodeToString(data)[:uploadSize]
+		err := stream.send(requestMsg{Msg: "record", Seq: stream.seq(int64(i + 1)), Value: value})
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("client: failed to send record to server, error was: %w", err)
+		}
+		sent.Records++
+		sent.Bytes += int64(len(value))
+		io.WriteString(checksum, value)
+	}
+	sent.Checksum = checksum.Sum32()
+	if uploadTrailer {
+		stream.setTrailer(checksumTrailer, formatChecksum(sent.Checksum))
+	}
+	err := stream.closeSend()
+	if err != nil {
+		return fmt.Errorf("client: failed to close request body, error was: %w", err)
+	}
+	closed := clk.Now()
+
+	var in responseMsg
+	err = stream.recv(&in)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return fmt.Errorf("failed to decode upload summary from server, error was: %w", err)
+	}
+	if in.Msg == "error" && uploadTrailer {
+		uploadCounts.mu.Lock()
+		uploadCounts.stats.Refused++
+		uploadCounts.mu.Unlock()
+		stream.log.Error("client: server refused upload", "error", in.Error)
+		return nil
+	}
+	if in.Msg != "summary" || in.Summary == nil {
+		return fmt.Errorf("client: expected upload summary from server, got %q", in.Msg)
+	}
+	clientMetrics.observeLatency(clk.Since(closed))
+	// the summary is the last message of the response
+	err = stream.recv(&in)
+	if err == nil {
+		return fmt.Errorf("client: expected response to end after upload summary, got %q", in.Msg)
+	}
+	if ctx.Err() == nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to read end of response from server, error was: %w", err)
+	}
+
+	uploadCounts.mu.Lock()
+	uploadCounts.stats.Uploads++
+	uploadCounts.stats.Records += in.Summary.Records
+	uploadCounts.stats.Bytes += in.Summary.Bytes
+	if *in.Summary != sent {
+		uploadCounts.stats.Mismatched++
+	}
+	uploadCounts.mu.Unlock()
+	if *in.Summary != sent {
+		stream.log.Error("client: upload summary of server differs from what was sent", "sent", sent, "summary", *in.Summary)
+		return nil
+	}
+	stream.log.Debug("client: upload summarized", "records", sent.Records, "bytes", sent.Bytes)
+	return nil
+}
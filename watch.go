@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The server streams the stats of an active stream as ndjson at
+// /debug/streams/{id}/watch, by the id the stream is logged with, so that a
+// single misbehaving stream can be watched live: a snapshot every
+// streamWatchInterval, or the interval of the query, such as ?interval=100ms,
+// and a last one once the stream ended, with the cause it ended with.
+// Intervals below minStreamWatchInterval are refused, as a watcher would
+// keep the server busy taking snapshots. The counts of messages cover the
+// stream since it started, the percentiles of its inter-arrival and flush
+// times only the time it has been watched, as their histograms are too
+// large to keep for every stream.
+//
+// The level an active stream logs at is set apart from that of the server at
+// /debug/streams/{id}/log, with PUT and the level of the query, such as
+// ?level=debug or ?level=off, reset to that of the server with DELETE and
+// shown with GET. A request only finds the streams of its tenant, as
+// debugTenant tells it.
+var streamWatchInterval = 1 * time.Second
+
+const (
+	streamsPath            = "/debug/streams/"
+	minStreamWatchInterval = 10 * time.Millisecond
+)
+
+// streamStats are the stats of a stream of the server since it started, and
+// the histograms of its times while watched, nil otherwise.
+type streamStats struct {
+	mu           sync.Mutex
+	received     int64
+	sent         int64
+	lastReceived time.Time
+	lastSent     time.Time
+	// offset is that of the decoder of the stream after the last message,
+	// largestMessage the size of the largest one received, to which the
+	// buffer of the decoder grew
+	offset         int64
+	largestMessage int64
+	watchers       int
+	interArrival   *histogram
+	flush          *histogram
+}
+
+// streamQuantiles summarize a histogram of a stream.
+type streamQuantiles struct {
+	P50, P90, P99, Max time.Duration
+}
+
+func quantilesOf(h *histogram) streamQuantiles {
+	if h == nil {
+		return streamQuantiles{}
+	}
+	return streamQuantiles{P50: h.quantile(0.5), P90: h.quantile(0.9), P99: h.quantile(0.99), Max: h.max}
+}
+
+// streamSnapshot is a snapshot of the stats of a stream, as watched. The
+// rates are per second since the previous snapshot, and SinceReceived and
+// SinceSent how long ago the last message was received and sent.
+type streamSnapshot struct {
+	Stream   uint64
+	Path     string
+	Remote   string
+	Tenant   string
+	Age      time.Duration
+	Received int64
+	Sent     int64
+	// LargestMessage is the size of the largest message received
+	LargestMessage int64
+	ReceivedRate   float64
+	SentRate       float64
+	SinceReceived  time.Duration `json:",omitempty"`
+	SinceSent      time.Duration `json:",omitempty"`
+	InterArrival   streamQuantiles
+	Flush          streamQuantiles
+	// Ended is set on the last snapshot, with the Cause of the end
+	Ended bool   `json:",omitempty"`
+	Cause string `json:",omitempty"`
+}
+
+// observeReceived records a message received at now on the stream s, nil if
+// it is not registered, whose decoder is at offset after it.
+func (s *registeredStream) observeReceived(now time.Time, offset int64) {
+	if s == nil {
+		return
+	}
+	s.stats.mu.Lock()
+	defer s.stats.mu.Unlock()
+	if !s.stats.lastReceived.IsZero() && s.stats.interArrival != nil {
+		s.stats.interArrival.record(now.Sub(s.stats.lastReceived))
+	}
+	s.stats.received++
+	s.stats.lastReceived = now
+	s.stats.largestMessage = max(s.stats.largestMessage, offset-s.stats.offset)
+	s.stats.offset = offset
+	s.buffers.decoder.Store(s.stats.largestMessage)
+	s.tenantCounts.observeReceived()
+}
+
+// observeSent records a message flushed at flushed, taking flush, on the
+// stream s, nil if it is not registered.
+func (s *registeredStream) observeSent(flushed time.Time, flush time.Duration) {
+	if s == nil {
+		return
+	}
+	s.stats.mu.Lock()
+	defer s.stats.mu.Unlock()
+	if s.stats.flush != nil {
+		s.stats.flush.record(flush)
+	}
+	s.stats.sent++
+	s.stats.lastSent = flushed
+	s.tenantCounts.observeSent(flush)
+}
+
+// watch starts recording the times of s for a watcher, until unwatch.
+func (s *registeredStream) watch() {
+	s.stats.mu.Lock()
+	defer s.stats.mu.Unlock()
+	if s.stats.watchers == 0 {
+		s.stats.interArrival = &histogram{}
+		s.stats.flush = &histogram{}
+	}
+	s.stats.watchers++
+}
+
+// unwatch stops recording the times of s once its last watcher is gone.
+func (s *registeredStream) unwatch() {
+	s.stats.mu.Lock()
+	defer s.stats.mu.Unlock()
+	s.stats.watchers--
+	if s.stats.watchers == 0 {
+		s.stats.interArrival = nil
+		s.stats.flush = nil
+	}
+}
+
+// snapshot returns the stats of s at now, with the rates since previous.
+func (s *registeredStream) snapshot(now time.Time, previous *streamSnapshot, previousAt time.Time) streamSnapshot {
+	s.stats.mu.Lock()
+	defer s.stats.mu.Unlock()
+	snapshot := streamSnapshot{
+		Stream:         s.id,
+		Path:           s.path,
+		Remote:         s.remote,
+		Tenant:         s.tenant,
+		Age:            now.Sub(s.started),
+		Received:       s.stats.received,
+		Sent:           s.stats.sent,
+		LargestMessage: s.stats.largestMessage,
+		InterArrival:   quantilesOf(s.stats.interArrival),
+		Flush:          quantilesOf(s.stats.flush),
+	}
+	if !s.stats.lastReceived.IsZero() {
+		snapshot.SinceReceived = now.Sub(s.stats.lastReceived)
+	}
+	if !s.stats.lastSent.IsZero() {
+		snapshot.SinceSent = now.Sub(s.stats.lastSent)
+	}
+	if elapsed := now.Sub(previousAt).Seconds(); elapsed > 0 {
+		snapshot.ReceivedRate = float64(snapshot.Received-previous.Received) / elapsed
+		snapshot.SentRate = float64(snapshot.Sent-previous.Sent) / elapsed
+	}
+	return snapshot
+}
+
+// serveStreams serves the endpoints of the stream of the path of request.
+func serveStreams(writer http.ResponseWriter, request *http.Request) {
+	idText, action, _ := strings.Cut(strings.TrimPrefix(request.URL.Path, streamsPath), "/")
+	if idText == "top" && action == "" {
+		tenant, ok := debugTenant(writer, request)
+		if ok {
+			serveTopStreams(writer, request, tenant)
+		}
+		return
+	}
+	id, err := strconv.ParseUint(idText, 10, 64)
+	if err != nil || action != "watch" && action != "log" {
+		http.NotFound(writer, request)
+		return
+	}
+	tenant, ok := debugTenant(writer, request)
+	if !ok {
+		return
+	}
+	s := activeStreams.get(id)
+	if s != nil && tenant != "" && tenant != s.tenant {
+		// streams of other tenants are not found for a request naming one
+		s = nil
+	}
+	if s == nil {
+		http.Error(writer, fmt.Sprintf("no active stream %d", id), http.StatusNotFound)
+		return
+	}
+	if action == "log" {
+		setStreamLogLevel(writer, request, s)
+		return
+	}
+	watchStream(writer, request, s)
+}
+
+// setStreamLogLevel sets, resets or shows the level s logs at, by the
+// method of request.
+func setStreamLogLevel(writer http.ResponseWriter, request *http.Request, s *registeredStream) {
+	switch request.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		text := request.URL.Query().Get("level")
+		var level *slog.Level
+		err := setSideLogLevel(&level, text)
+		if err != nil {
+			http.Error(writer, fmt.Sprintf("expected level of debug, info, warn, error or off, got %q", text), http.StatusBadRequest)
+			return
+		}
+		s.logLevel.level.Store(level)
+		serverLog.Info("server: set log level of stream", "stream", s.id, "level", text)
+	case http.MethodDelete:
+		s.logLevel.level.Store(nil)
+		serverLog.Info("server: reset log level of stream", "stream", s.id)
+	default:
+		writer.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(writer, "expected GET, PUT or DELETE", http.StatusMethodNotAllowed)
+		return
+	}
+	level := "the level of the server"
+	if l := s.logLevel.level.Load(); l != nil {
+		level = "level " + strings.ToLower(l.String())
+		if *l == logOff {
+			level = "level off"
+		}
+	}
+	fmt.Fprintf(writer, "stream %d logs at %s\n", s.id, level)
+}
+
+// watchStream streams the snapshots of s.
+func watchStream(writer http.ResponseWriter, request *http.Request, s *registeredStream) {
+	interval := streamWatchInterval
+	if text := request.URL.Query().Get("interval"); text != "" {
+		var err error
+		interval, err = time.ParseDuration(text)
+		if err != nil || interval < minStreamWatchInterval {
+			http.Error(writer, fmt.Sprintf("expected interval of at least %v, got %q", minStreamWatchInterval, text), http.StatusBadRequest)
+			return
+		}
+	}
+
+	s.watch()
+	defer s.unwatch()
+	writer.Header().Set("Content-Type", ContentTypeNdJson)
+	respCtl := http.NewResponseController(writer)
+	enc := json.NewEncoder(writer)
+	ticker := clk.NewTicker(interval)
+	defer ticker.Stop()
+	var previous streamSnapshot
+	previousAt := s.started
+	for {
+		now := clk.Now()
+		snapshot := s.snapshot(now, &previous, previousAt)
+		select {
+		case <-s.done:
+			snapshot.Ended = true
+			snapshot.Cause = s.cause.Error()
+		default:
+		}
+		err := enc.Encode(snapshot)
+		if err == nil {
+			err = respCtl.Flush()
+		}
+		if err != nil || snapshot.Ended {
+			return
+		}
+		previous, previousAt = snapshot, now
+
+		select {
+		case <-request.Context().Done():
+			return
+		case <-s.done:
+		case <-ticker.C():
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// The schema mode writes a JSON Schema of the wire format to stdout, so that
+// implementations in other languages can be generated from it and their
+// messages validated against it as the protocol evolves. The schemas of the
+// message and envelope types are derived from their Go types, a field being
+// required unless omitted when empty, while the kinds of messages, told apart
+// by Msg, are listed in wireKinds with the fields they carry. A line of a
+// stream is a request or a response, or either signed or sealed.
+
+// wireKind is a kind of message of the wire format.
+type wireKind struct {
+	msg string
+	// request is whether the client sends it, otherwise the server does
+	request bool
+	// control is whether it is a control message, which workloads enabling
+	// it take apart from their data
+	control     bool
+	fields      []string
+	description string
+}
+
+var wireKinds = []wireKind{
+	{msg: "ping", request: true, fields: []string{"Seq", "Sent"}, description: "asks for a pong, in the pong and churn workloads and sensitivity mode, with Sent when echoing timestamps"},
+	{msg: "heartbeat", request: true, description: "asks for a pong on an idle stream"},
+	{msg: "set", request: true, fields: []string{"Key", "Value"}, description: "sets Key to Value in the statesync workload"},
+	{msg: "delete", request: true, fields: []string{"Key"}, description: "deletes Key in the statesync workload"},
+	{msg: "job", request: true, fields: []string{"Seq"}, description: "asks for an answer in the halfclose workload"},
+	{msg: "record", request: true, fields: []string{"Seq", "Value"}, description: "uploads Value in the upload workload"},
+	{msg: "chunk", request: true, fields: []string{"Seq", "Value"}, description: "uploads the base64 chunk Value in the updown workload"},
+	{msg: "echo", request: true, fields: []string{"Seq", "Value"}, description: "asks for Value back, on the echo path"},
+	{msg: "probe", request: true, description: "asks for a probe on the probe path"},
+	{msg: "reading", request: true, fields: []string{"Seq", "Sent", "Value"}, description: "uploads the reading Value queued at Sent in the telemetry workload"},
+	{msg: "auth", request: true, control: true, fields: []string{"Value"}, description: "renews the credentials of the stream with the token Value"},
+	{msg: "pause", request: true, control: true, description: "stops the data the server sends until resume"},
+	{msg: "resume", request: true, control: true, description: "lets the server send data again after pause"},
+	{msg: "report", request: true, control: true, fields: []string{"Report"}, description: "carries a report of the measurements of the client, on the federation path"},
+
+	{msg: "pong", fields: []string{"Seq", "Echoed", "Received", "Sent"}, description: "answers a ping or heartbeat, with Seq in the duplex-v2 profile and the timestamps when echoing them"},
+	{msg: "snapshot", fields: []string{"State"}, description: "carries the whole state in the statesync workload"},
+	{msg: "patch", fields: []string{"State", "Deleted"}, description: "carries the changes of the state in the statesync workload"},
+	{msg: "tick", fields: []string{"Scheduled", "Sent", "Flushed"}, description: "marks a boundary of the tick interval in the ticks workload"},
+	{msg: "data", fields: []string{"Data", "Sent", "Seq"}, description: "carries generated data in the push, pause and priority workloads"},
+	{msg: "answer", fields: []string{"Seq"}, description: "answers a job in the halfclose workload"},
+	{msg: "ack", fields: []string{"Seq"}, description: "acknowledges a reading in the telemetry workload"},
+	{msg: "summary", fields: []string{"Summary"}, description: "summarizes an upload in the upload workload"},
+	{msg: "receiving", description: "acknowledges the first chunk in the updown workload"},
+	{msg: "digest", fields: []string{"Seq", "Data"}, description: "carries the hex sha256 digest of a chunk in the updown workload"},
+	{msg: "echo", fields: []string{"Seq", "Data"}, description: "carries the Value of an echo back as Data"},
+	{msg: "file", fields: []string{"Size"}, description: "announces the size of the file sent in file mode"},
+	{msg: "stored", fields: []string{"Data"}, description: "carries the hex sha256 digest of the file stored in file mode"},
+	{msg: "probe", fields: []string{"Sent"}, description: "answers a probe, flushed on its own"},
+	{msg: "error", fields: []string{"Error", "Quota"}, description: "ends the stream with Error, and the quota exceeded if one was"},
+	{msg: "reauth", control: true, description: "asks for fresh credentials before the current ones expire"},
+	{msg: "pause", control: true, description: "stops the data the client sends until resume"},
+	{msg: "resume", control: true, description: "lets the client send data again after pause"},
+}
+
+// writeWireSchema writes the schema of the wire format to w.
+func writeWireSchema(w io.Writer) error {
+	defs := map[string]any{}
+	request := schemaOf(reflect.TypeOf(requestMsg{}), defs)
+	response := schemaOf(reflect.TypeOf(responseMsg{}), defs)
+	signed := schemaOf(reflect.TypeOf(signedMsg{}), defs)
+	sealed := schemaOf(reflect.TypeOf(sealedMsg{}), defs)
+
+	var requests, responses []any
+	for _, kind := range wireKinds {
+		side, base, list := "response", response, &responses
+		if kind.request {
+			side, base, list = "request", request, &requests
+		}
+		description := kind.description
+		if kind.control {
+			description = "control message that " + description
+		}
+		if len(kind.fields) > 0 {
+			description += ", carrying " + strings.Join(kind.fields, ", ")
+		}
+		name := side + "." + kind.msg
+		defs[name] = map[string]any{
+			"description": description,
+			"allOf":       []any{base},
+			"properties":  map[string]any{"Msg": map[string]any{"const": kind.msg}},
+		}
+		*list = append(*list, ref(name))
+	}
+	defs["request"] = map[string]any{"description": "a message of the client", "oneOf": requests}
+	defs["response"] = map[string]any{"description": "a message of the server", "oneOf": responses}
+	for _, side := range []string{"request", "response"} {
+		defs[side+"Line"] = map[string]any{
+			"description": "a line of the " + side + " body, the message itself, signed, or sealed with the signed message inside when both",
+			"anyOf": []any{
+				ref(side),
+				map[string]any{
+					"allOf":      []any{signed},
+					"properties": map[string]any{"Signed": ref(side)},
+				},
+				sealed,
+			},
+		}
+	}
+
+	schema := map[string]any{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"title":   "test-stream-http-duplex wire format",
+		"description": fmt.Sprintf("A line of a stream, sent as %s with the profile parameter naming the generation of the protocol, one of %s, and %s without: the client sends requestLine lines, the server responseLine lines.",
+			ContentTypeNdJson, profileNames(), defaultProfile),
+		"anyOf": []any{ref("requestLine"), ref("responseLine")},
+		"$defs": defs,
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(schema)
+}
+
+func ref(name string) map[string]any {
+	return map[string]any{"$ref": "#/$defs/" + name}
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+// schemaOf returns the schema of the json encoding of t, adding those of the
+// structs it refers to to defs and referring to them by name.
+func schemaOf(t reflect.Type, defs map[string]any) map[string]any {
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t == rawMessageType:
+		return map[string]any{}
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		return map[string]any{"type": "string", "contentEncoding": "base64"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return schemaOf(t.Elem(), defs)
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": schemaOf(t.Elem(), defs)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaOf(t.Elem(), defs)}
+	case reflect.Struct:
+		name := t.Name()
+		if _, ok := defs[name]; !ok {
+			// taken before the fields, which may refer back to it
+			defs[name] = nil
+			defs[name] = structSchema(t, defs)
+		}
+		return ref(name)
+	default:
+		return map[string]any{}
+	}
+}
+
+func structSchema(t reflect.Type, defs map[string]any) map[string]any {
+	properties := map[string]any{}
+	required := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = schemaOf(field.Type, defs)
+		if !strings.Contains(options, "omitempty") {
+			required = append(required, name)
+		}
+	}
+	return map[string]any{"type": "object", "properties": properties, "required": required}
+}